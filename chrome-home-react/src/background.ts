@@ -238,7 +238,8 @@ async function registerWithBackend(token: string, identity: ExtensionIdentity, r
       },
       body: JSON.stringify({
         identity,
-        timestamp: Math.floor(Date.now() / 1000) // Convert to seconds
+        timestamp: Math.floor(Date.now() / 1000), // Convert to seconds
+        nonce: generateUUID() // Single-use, the backend rejects replays
       })
     })
     
@@ -246,6 +247,14 @@ async function registerWithBackend(token: string, identity: ExtensionIdentity, r
       const result = await response.json()
       console.log('✅ Extension registered with backend:', result.message)
       
+      // Use the token issued by the server for subsequent requests
+      if (result.token) {
+        await chrome.storage.local.set({ ext_auth_token: result.token })
+      }
+      if (result.refreshWindow) {
+        await chrome.storage.local.set({ token_refresh_window: result.refreshWindow })
+      }
+      
       await chrome.storage.local.set({
         backend_registered: true,
         registration_time: Date.now(),
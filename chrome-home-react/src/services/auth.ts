@@ -46,6 +46,43 @@ interface UsageStats {
   lastActivity: number
 }
 
+// Error body returned by the weather service: {error: {code, message, details}}
+interface ApiError {
+  status: number
+  code: string
+  message: string
+  details: Record<string, unknown>
+}
+
+// 401 error codes that registering again recovers from. INVALID_TOKEN covers
+// expired tokens and tokens the service can no longer verify, e.g. after a
+// signing key rotation. TOKEN_REFRESHED means a late or raced refresh (from
+// another tab) spent the token, and TOKEN_REVOKED an admin revocation.
+const REREGISTER_ERROR_CODES = new Set(['EXTENSION_NOT_REGISTERED', 'INVALID_TOKEN', 'TOKEN_REFRESHED', 'TOKEN_REVOKED'])
+
+// Refresh window to assume until the service has sent its own
+const DEFAULT_REFRESH_WINDOW_SECONDS = 4 * 60 * 60
+
+// Client tokens (payload.signature) are accepted for 24 hours
+const CLIENT_TOKEN_LIFETIME_SECONDS = 24 * 60 * 60
+
+/**
+ * Read the error envelope from a failed response without consuming it
+ */
+async function readApiError(response: Response): Promise<ApiError> {
+  try {
+    const body = await response.clone().json()
+    return {
+      status: response.status,
+      code: body?.error?.code ?? 'UNKNOWN',
+      message: body?.error?.message ?? response.statusText,
+      details: body?.error?.details ?? {}
+    }
+  } catch {
+    return { status: response.status, code: 'UNKNOWN', message: response.statusText, details: {} }
+  }
+}
+
 class ExtensionAuthService {
   private readonly storageKey = 'ext_auth_token'
   private readonly identityKey = 'ext_identity'
@@ -165,7 +202,7 @@ class ExtensionAuthService {
       
       // Check auth version to force regeneration when signature method changes
       const authVersion = await this.getFromStorage<number>('auth_version')
-      const CURRENT_AUTH_VERSION = 2 // Increment this to force regeneration
+      const CURRENT_AUTH_VERSION = 3 // Increment this to force regeneration
       
       if (authVersion !== CURRENT_AUTH_VERSION) {
         console.log('🔄 Auth version changed, regenerating tokens with new signature method...')
@@ -209,17 +246,31 @@ class ExtensionAuthService {
 
         // Try to register with backend if not already done
         if (!backendRegistered && !authState) {
-          await this.registerExtension(token, identity)
+          const result = await this.registerExtension(token, identity)
+          if (result?.token) token = result.token
+        }
+      }
+
+      // Exchange server-issued tokens for fresh ones once they are inside
+      // the refresh window the service reported
+      let expiresAt = this.getTokenExpiry(token)
+      const refreshWindow = await this.getFromStorage<number>('token_refresh_window') || DEFAULT_REFRESH_WINDOW_SECONDS
+      const now = Date.now()
+      if (token.split('.').length === 3 && now >= expiresAt - refreshWindow * 1000 && now < expiresAt) {
+        const refreshed = await this.refreshServerToken(token, identity as ExtensionIdentity)
+        if (refreshed) {
+          token = refreshed
+          expiresAt = this.getTokenExpiry(token)
         }
       }
 
-      // Validate token age (24 hours max)
-      const tokenAge = this.getTokenAge(token)
-      if (tokenAge > 24 * 60 * 60 * 1000) {
+      // Replace expired tokens
+      if (Date.now() >= expiresAt) {
         console.log('🔄 Token expired, refreshing...')
         token = await this.generateSecureToken(identity as ExtensionIdentity)
         await this.setInStorage(this.storageKey, token)
-        await this.registerExtension(token, identity as ExtensionIdentity)
+        const result = await this.registerExtension(token, identity as ExtensionIdentity)
+        if (result?.token) token = result.token
       }
 
       return { token, identity: identity as ExtensionIdentity }
@@ -242,19 +293,25 @@ class ExtensionAuthService {
   }
 
   /**
-   * Get token age from its payload
+   * Get token expiry time in milliseconds from its payload
    */
-  private getTokenAge(token: string): number {
+  private getTokenExpiry(token: string): number {
     try {
       const parts = token.split('.')
-      if (parts.length !== 2) return Infinity
+
+      // Server-issued tokens: header.claims.signature with base64url segments
+      if (parts.length === 3) {
+        const claims = JSON.parse(atob(parts[1].replace(/-/g, '+').replace(/_/g, '/')))
+        return (claims.exp || 0) * 1000
+      }
+      if (parts.length !== 2) return 0
       
       const payloadBytes = atob(parts[0])
       const payload = JSON.parse(payloadBytes)
       
-      return Date.now() - ((payload.ts || 0) * 1000) // Convert seconds back to milliseconds
+      return ((payload.ts || 0) + CLIENT_TOKEN_LIFETIME_SECONDS) * 1000 // Convert seconds to milliseconds
     } catch (error) {
-      return Infinity // Treat invalid tokens as expired
+      return 0 // Treat invalid tokens as expired
     }
   }
 
@@ -283,6 +340,7 @@ class ExtensionAuthService {
    */
   private async registerExtension(token: string, identity: ExtensionIdentity): Promise<any> {
     try {
+      const { v4: uuidv4 } = await import('uuid')
       const response = await fetch(`${this.baseUrl}/auth/register`, {
         method: 'POST',
         headers: {
@@ -293,7 +351,8 @@ class ExtensionAuthService {
         },
         body: JSON.stringify({
           identity,
-          timestamp: Math.floor(Date.now() / 1000) // Convert to seconds
+          timestamp: Math.floor(Date.now() / 1000), // Convert to seconds
+          nonce: uuidv4() // Single-use, the backend rejects replays
         })
       })
 
@@ -304,6 +363,14 @@ class ExtensionAuthService {
       const result = await response.json()
       console.log('Extension registered successfully:', result.message)
       
+      // Use the token issued by the server for subsequent requests
+      if (result.token) {
+        await this.setInStorage(this.storageKey, result.token)
+      }
+      if (result.refreshWindow) {
+        await this.setInStorage('token_refresh_window', result.refreshWindow)
+      }
+      
       // Mark as registered in storage
       await this.setInStorage('backend_registered', true)
       await this.setInStorage('registration_time', Date.now())
@@ -315,6 +382,52 @@ class ExtensionAuthService {
     }
   }
 
+  /**
+   * Exchange a nearly expired server-issued token for a fresh one. When the
+   * token can't be refreshed any more, e.g. another tab refreshed it first
+   * or it was revoked, register again instead.
+   */
+  private async refreshServerToken(token: string, identity: ExtensionIdentity): Promise<string | null> {
+    try {
+      const response = await fetch(`${this.baseUrl}/auth/refresh`, {
+        method: 'POST',
+        headers: {
+          'X-Extension-Token': token,
+          'X-Extension-ID': identity.extensionId,
+          'X-Extension-Version': identity.extensionVersion,
+          'X-Extension-Fingerprint': identity.fingerprint
+        }
+      })
+
+      if (response.status === 401) {
+        const { code } = await readApiError(response)
+        if (code === 'TOKEN_REFRESHED') {
+          // Another tab may have won the refresh and stored its token
+          const stored = await this.getFromStorage<string>(this.storageKey)
+          if (stored && stored !== token) return stored
+        }
+        if (REREGISTER_ERROR_CODES.has(code)) {
+          console.log(`🔄 Token refresh failed with ${code}, re-registering...`)
+          const result = await this.registerExtension(await this.generateSecureToken(identity), identity)
+          return result?.token ?? null
+        }
+      }
+      if (!response.ok) {
+        throw new Error(`Token refresh failed: ${response.status}`)
+      }
+
+      const result = await response.json()
+      await this.setInStorage(this.storageKey, result.token)
+      if (result.refreshWindow) {
+        await this.setInStorage('token_refresh_window', result.refreshWindow)
+      }
+      return result.token
+    } catch (error) {
+      console.warn('Token refresh failed:', error)
+      return null
+    }
+  }
+
   /**
    * Get authenticated headers for API requests
    */
@@ -359,8 +472,25 @@ class ExtensionAuthService {
         }
       })
 
-      // If we get a 401 with "Extension not registered", try re-registration ONCE
+      // If we get a 401 that registering again fixes, try re-registration ONCE
       if (response.status === 401) {
+        const { code } = await readApiError(response)
+
+        // Another tab refreshed the token while this request was in flight
+        const sentToken = (headers as Record<string, string>)['X-Extension-Token']
+        const storedToken = await this.getFromStorage<string>(this.storageKey)
+        if (code === 'TOKEN_REFRESHED' && storedToken && storedToken !== sentToken) {
+          console.log('🔄 Token was refreshed elsewhere, retrying with the new one...')
+          const retryHeaders = await this.getAuthHeaders()
+          return fetch(url, {
+            ...options,
+            headers: {
+              ...retryHeaders,
+              ...(options.headers || {})
+            }
+          })
+        }
+
         // Check if we already tried to re-register recently (within last 5 minutes)
         const lastRetry = await this.getFromStorage<number>('last_auth_retry')
         const now = Date.now()
@@ -370,9 +500,8 @@ class ExtensionAuthService {
           return response
         }
         
-        const text = await response.clone().text()
-        if (text.includes('Extension not registered') || text.includes('inactive')) {
-          console.log('🔄 Extension not registered, attempting re-registration...')
+        if (REREGISTER_ERROR_CODES.has(code)) {
+          console.log(`🔄 ${code}, attempting re-registration...`)
           
           // Mark retry attempt
           await this.setInStorage('last_auth_retry', now)
@@ -532,5 +661,5 @@ class ExtensionAuthService {
 const authService = new ExtensionAuthService()
 
 export default authService
-export { ExtensionAuthService }
-export type { ExtensionIdentity, AuthToken, AuthHeaders, ExtensionStats }
\ No newline at end of file
+export { ExtensionAuthService, readApiError }
+export type { ExtensionIdentity, AuthToken, AuthHeaders, ExtensionStats, ApiError }
\ No newline at end of file
@@ -8,7 +8,7 @@ import {
 import cacheService, { CacheConfig } from '../services/cache'
 import { buildApiUrl } from '../config/api'
 import { useSettings } from '../contexts/SettingsContext'
-import authService from '../services/auth'
+import authService, { readApiError } from '../services/auth'
 import '../weather-expandable.css'
 
 const GoogleWeatherWidget = ({ config, onConfigUpdate, isConfigMode }) => {
@@ -293,9 +293,11 @@ const GoogleWeatherWidget = ({ config, onConfigUpdate, isConfigMode }) => {
           clearTimeout(timeoutId)
           
           if (!response.ok) {
-            const errorText = await response.text()
-            console.error('Weather API error:', response.status, errorText)
-            throw new Error(`Weather API error: ${response.status} - ${errorText}`)
+            const apiError = await readApiError(response)
+            console.error('Weather API error:', apiError.status, apiError.code, apiError.message)
+            const error = new Error(`Weather API error: ${apiError.status} ${apiError.code} - ${apiError.message}`)
+            error.code = apiError.code
+            throw error
           }
           data = await response.json()
         } catch (error) {
@@ -396,7 +398,9 @@ const GoogleWeatherWidget = ({ config, onConfigUpdate, isConfigMode }) => {
           } else if (day.precipitationProbability?.probability?.percent !== undefined) {
             precipPercent = day.precipitationProbability.probability.percent
           }
-          if (day.precipitationProbability?.qpf?.quantity !== undefined) {
+          if (day.precipitation?.qpf?.quantity !== undefined) {
+            precipAmount = day.precipitation.qpf.quantity
+          } else if (day.precipitationProbability?.qpf?.quantity !== undefined) {
             precipAmount = day.precipitationProbability.qpf.quantity
           }
           
@@ -440,7 +444,8 @@ const GoogleWeatherWidget = ({ config, onConfigUpdate, isConfigMode }) => {
       setWeather({
         location: config.location || 'Unknown Location',
         lastUpdated: data.lastUpdated ? new Date(data.lastUpdated) : new Date(), // Handle cached timestamp
-        current: {
+        // The service returns current: null when only the forecasts arrived
+        current: current ? {
           temp: current.temperature?.degrees ? Math.round(current.temperature.degrees) : 0,
           feelsLike: current.feelsLikeTemperature?.degrees ? Math.round(current.feelsLikeTemperature.degrees) : null,
           condition: current.weatherCondition?.type || 'CLEAR',
@@ -462,6 +467,21 @@ const GoogleWeatherWidget = ({ config, onConfigUpdate, isConfigMode }) => {
           precipitationType: current.precipitation?.probability?.type || 'RAIN',
           thunderstormProbability: current.thunderstormProbability || 0,
           isDaytime: current.isDaytime
+        } : {
+          temp: null,
+          feelsLike: null,
+          condition: 'CLOUDY',
+          description: 'Current conditions unavailable',
+          humidity: null,
+          pressure: null,
+          visibility: null,
+          windSpeed: null,
+          windGust: null,
+          uvIndex: null,
+          cloudCover: null,
+          dewPoint: null,
+          precipitationProbability: 0,
+          thunderstormProbability: 0
         },
         hourly: hourly,
         daily: daily
@@ -787,7 +807,7 @@ const GoogleWeatherWidget = ({ config, onConfigUpdate, isConfigMode }) => {
         
         <div className="weather-main">
           <div className="weather-temp-group">
-            <div className="weather-temp">{weather.current.temp}°</div>
+            <div className="weather-temp">{weather.current.temp ?? '--'}°</div>
             {weather.current.feelsLike && weather.current.feelsLike !== weather.current.temp && (
               <div className="weather-feels-like">Feels {weather.current.feelsLike}°</div>
             )}
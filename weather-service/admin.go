@@ -0,0 +1,325 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AdminSession is a session as shown by the admin API. Tokens are never
+// included.
+type AdminSession struct {
+	ExtensionID      string     `json:"extensionId"`
+	ExtensionVersion string     `json:"extensionVersion"`
+	Fingerprint      string     `json:"fingerprint"`
+	UserAgent        string     `json:"userAgent"`
+	Timezone         string     `json:"timezone"`
+	RegisterTime     time.Time  `json:"registerTime"`
+	LastActivity     time.Time  `json:"lastActivity"`
+	RequestCount     int64      `json:"requestCount"`
+	IsActive         bool       `json:"isActive"`
+	SuspendedReason  string     `json:"suspendedReason,omitempty"`
+	TokensRevokedAt  *time.Time `json:"tokensRevokedAt,omitempty"`
+}
+
+func newAdminSession(session *ExtensionSession) AdminSession {
+	view := AdminSession{
+		ExtensionID:      session.Identity.ExtensionID,
+		ExtensionVersion: session.Identity.ExtensionVersion,
+		Fingerprint:      session.Identity.Fingerprint,
+		UserAgent:        session.Identity.UserAgent,
+		Timezone:         session.Identity.Timezone,
+		RegisterTime:     session.RegisterTime,
+		LastActivity:     session.LastActivity,
+		RequestCount:     session.RequestCount,
+		IsActive:         session.IsActive,
+		SuspendedReason:  session.SuspendedReason,
+	}
+	if !session.TokensRevokedAt.IsZero() {
+		revokedAt := session.TokensRevokedAt.UTC()
+		view.TokensRevokedAt = &revokedAt
+	}
+	return view
+}
+
+// Body of admin actions that take a reason
+type adminActionRequest struct {
+	Reason string `json:"reason"`
+}
+
+// Body of POST /admin/bans
+type banRequest struct {
+	Kind   string `json:"kind"`
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+}
+
+// Admin API middleware. Requests must carry the configured admin key
+// (ADMIN_API_KEY) in X-Admin-Key; without one the admin API is disabled.
+func adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		adminKey := config.AdminAPIKey
+		if adminKey == "" {
+			writeNotFound(w)
+			return
+		}
+
+		provided := r.Header.Get("X-Admin-Key")
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(adminKey)) != 1 {
+			logSecurityEvent(r.Context(), "ADMIN_AUTH_FAILED", map[string]interface{}{
+				"endpoint":   r.URL.Path,
+				"method":     r.Method,
+				"remoteAddr": r.RemoteAddr,
+				"keyPresent": provided != "",
+			})
+			writeError(w, http.StatusUnauthorized, ERR_INVALID_ADMIN_KEY, "Invalid admin key", nil)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// Record an admin action
+func logAdminAction(r *http.Request, action string, data map[string]interface{}) {
+	data["action"] = action
+	data["remoteAddr"] = r.RemoteAddr
+	logSecurityEvent(r.Context(), "ADMIN_ACTION", data)
+}
+
+// Route /admin/sessions and /admin/sessions/{id}[/{action}]
+func adminSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/sessions"), "/")
+	if path == "" {
+		if r.Method != "GET" {
+			writeMethodNotAllowed(w)
+			return
+		}
+		listSessionsHandler(w, r)
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	extensionID := parts[0]
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		session := getExtensionSession(r.Context(), extensionID)
+		if session == nil {
+			writeError(w, http.StatusNotFound, ERR_NOT_FOUND, "Session not found", nil)
+			return
+		}
+		writeJSON(w, newAdminSession(session))
+	case len(parts) == 2 && r.Method == "POST":
+		sessionActionHandler(w, r, extensionID, parts[1])
+	case len(parts) <= 2:
+		writeMethodNotAllowed(w)
+	default:
+		writeNotFound(w)
+	}
+}
+
+// List sessions, optionally filtered by version, status, last activity and
+// request count, most recently active first
+func listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var activeAfter, activeBefore time.Time
+	var minRequests, maxRequests int64 = 0, -1
+	var err error
+	if v := query.Get("activeAfter"); v != "" {
+		if activeAfter, err = time.Parse(time.RFC3339, v); err != nil {
+			writeParamError(w, invalidParam("activeAfter", "activeAfter must be an RFC 3339 timestamp", nil))
+			return
+		}
+	}
+	if v := query.Get("activeBefore"); v != "" {
+		if activeBefore, err = time.Parse(time.RFC3339, v); err != nil {
+			writeParamError(w, invalidParam("activeBefore", "activeBefore must be an RFC 3339 timestamp", nil))
+			return
+		}
+	}
+	if v := query.Get("minRequests"); v != "" {
+		if minRequests, err = strconv.ParseInt(v, 10, 64); err != nil {
+			writeParamError(w, invalidParam("minRequests", "minRequests must be an integer", nil))
+			return
+		}
+	}
+	if v := query.Get("maxRequests"); v != "" {
+		if maxRequests, err = strconv.ParseInt(v, 10, 64); err != nil {
+			writeParamError(w, invalidParam("maxRequests", "maxRequests must be an integer", nil))
+			return
+		}
+	}
+	status := query.Get("status")
+	if status != "" && status != "active" && status != "suspended" {
+		writeParamError(w, invalidParam("status", "status must be active or suspended", nil))
+		return
+	}
+	version := query.Get("version")
+
+	sessions, err := extensionRegistry.List()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "listing sessions failed", "error", err)
+		writeError(w, http.StatusServiceUnavailable, ERR_UNAVAILABLE, "Session store unavailable", nil)
+		return
+	}
+
+	matched := []AdminSession{}
+	for _, session := range sessions {
+		switch {
+		case version != "" && session.Identity.ExtensionVersion != version,
+			status == "active" && !session.IsActive,
+			status == "suspended" && session.IsActive,
+			!activeAfter.IsZero() && session.LastActivity.Before(activeAfter),
+			!activeBefore.IsZero() && !session.LastActivity.Before(activeBefore),
+			session.RequestCount < minRequests,
+			maxRequests >= 0 && session.RequestCount > maxRequests:
+			continue
+		}
+		matched = append(matched, newAdminSession(session))
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].LastActivity.After(matched[j].LastActivity)
+	})
+
+	writeJSON(w, map[string]interface{}{
+		"sessions": matched,
+		"count":    len(matched),
+	})
+}
+
+// Suspend, reactivate or revoke the tokens of a session
+func sessionActionHandler(w http.ResponseWriter, r *http.Request, extensionID, action string) {
+	var req adminActionRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, ERR_INVALID_BODY, "Invalid request body", nil)
+			return
+		}
+	}
+
+	var update func(*ExtensionSession)
+	switch action {
+	case "suspend":
+		update = func(s *ExtensionSession) {
+			s.IsActive = false
+			s.SuspendedReason = req.Reason
+		}
+	case "reactivate":
+		update = func(s *ExtensionSession) {
+			s.IsActive = true
+			s.SuspendedReason = ""
+		}
+	case "revoke":
+		// Every token issued up to now stops working; the extension has
+		// to register again. Token issue times are to the microsecond.
+		revokedAt := time.Now().Truncate(time.Microsecond)
+		update = func(s *ExtensionSession) {
+			s.TokensRevokedAt = revokedAt
+		}
+	default:
+		writeNotFound(w)
+		return
+	}
+
+	session, err := extensionRegistry.Update(extensionID, update)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "updating session failed", "extensionId", extensionID, "error", err)
+		writeError(w, http.StatusInternalServerError, ERR_INTERNAL, "Failed to update session", nil)
+		return
+	}
+	if session == nil {
+		writeError(w, http.StatusNotFound, ERR_NOT_FOUND, "Session not found", nil)
+		return
+	}
+
+	logAdminAction(r, action, map[string]interface{}{
+		"extensionId": extensionID,
+		"reason":      req.Reason,
+	})
+	writeJSON(w, newAdminSession(session))
+}
+
+// Route /admin/bans and /admin/bans/{kind}/{value}
+func adminBansHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/bans"), "/")
+
+	switch {
+	case path == "" && r.Method == "GET":
+		bans, err := extensionRegistry.ListBans()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "listing bans failed", "error", err)
+			writeError(w, http.StatusServiceUnavailable, ERR_UNAVAILABLE, "Session store unavailable", nil)
+			return
+		}
+		sort.Slice(bans, func(i, j int) bool { return bans[i].CreatedAt.After(bans[j].CreatedAt) })
+		writeJSON(w, map[string]interface{}{"bans": bans, "count": len(bans)})
+
+	case path == "" && r.Method == "POST":
+		createBanHandler(w, r)
+
+	case path != "" && r.Method == "DELETE":
+		parts := strings.SplitN(path, "/", 2)
+		if len(parts) != 2 || !validBanKind(parts[0]) {
+			writeNotFound(w)
+			return
+		}
+		existed, err := extensionRegistry.DeleteBan(parts[0], parts[1])
+		if err != nil {
+			slog.ErrorContext(r.Context(), "deleting ban failed", "error", err)
+			writeError(w, http.StatusInternalServerError, ERR_INTERNAL, "Failed to lift ban", nil)
+			return
+		}
+		if !existed {
+			writeError(w, http.StatusNotFound, ERR_NOT_FOUND, "Ban not found", nil)
+			return
+		}
+		logAdminAction(r, "unban", map[string]interface{}{
+			"banKind":  parts[0],
+			"banValue": parts[1],
+		})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+// Ban an extension ID or fingerprint. Matching sessions are rejected from
+// their next request on.
+func createBanHandler(w http.ResponseWriter, r *http.Request) {
+	var req banRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, ERR_INVALID_BODY, "Invalid request body", nil)
+		return
+	}
+	if !validBanKind(req.Kind) || req.Value == "" {
+		writeError(w, http.StatusBadRequest, ERR_INVALID_BODY, "kind must be extensionId or fingerprint, with a value", nil)
+		return
+	}
+
+	ban := &Ban{Kind: req.Kind, Value: req.Value, Reason: req.Reason, CreatedAt: time.Now().UTC()}
+	if err := extensionRegistry.PutBan(ban); err != nil {
+		slog.ErrorContext(r.Context(), "storing ban failed", "error", err)
+		writeError(w, http.StatusInternalServerError, ERR_INTERNAL, "Failed to store ban", nil)
+		return
+	}
+
+	logAdminAction(r, "ban", map[string]interface{}{
+		"banKind":  ban.Kind,
+		"banValue": ban.Value,
+		"reason":   ban.Reason,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ban)
+}
+
+func validBanKind(kind string) bool {
+	return kind == BAN_EXTENSION_ID || kind == BAN_FINGERPRINT
+}
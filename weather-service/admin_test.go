@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func adminRequest(method, path string, body interface{}) *httptest.ResponseRecorder {
+	var reqBody []byte
+	if body != nil {
+		reqBody, _ = json.Marshal(body)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewBuffer(reqBody))
+	req.Header.Set("X-Admin-Key", "test-admin-key")
+
+	recorder := httptest.NewRecorder()
+	handler := adminSessionsHandler
+	if strings.HasPrefix(path, "/admin/bans") {
+		handler = adminBansHandler
+	}
+	adminMiddleware(handler)(recorder, req)
+	return recorder
+}
+
+func putTestSession(extensionID, version string, requests int64, lastActivity time.Time) ExtensionIdentity {
+	identity := generateTestIdentity()
+	identity.ExtensionID = extensionID
+	identity.ExtensionVersion = version
+	identity.Fingerprint = "fp-" + extensionID
+	extensionRegistry.Put(&ExtensionSession{
+		Identity:     identity,
+		RegisterTime: lastActivity,
+		LastActivity: lastActivity,
+		RequestCount: requests,
+		IsActive:     true,
+	})
+	return identity
+}
+
+// Test that the admin API requires the admin key
+func TestAdminAuthentication(t *testing.T) {
+	req := httptest.NewRequest("GET", "/admin/sessions", nil)
+	recorder := httptest.NewRecorder()
+	adminMiddleware(adminSessionsHandler)(recorder, req)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Admin API should be disabled without ADMIN_API_KEY, got %d", recorder.Code)
+	}
+
+	setTestConfig(t, func(c *Config) { c.AdminAPIKey = "test-admin-key" })
+
+	req.Header.Set("X-Admin-Key", "wrong-key")
+	recorder = httptest.NewRecorder()
+	adminMiddleware(adminSessionsHandler)(recorder, req)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Wrong admin key should get 401, got %d", recorder.Code)
+	}
+
+	if recorder := adminRequest("GET", "/admin/sessions", nil); recorder.Code != http.StatusOK {
+		t.Errorf("Valid admin key should get 200, got %d", recorder.Code)
+	}
+}
+
+// Test session listing filters
+func TestAdminListSessions(t *testing.T) {
+	setTestConfig(t, func(c *Config) { c.AdminAPIKey = "test-admin-key" })
+	extensionRegistry = NewMemorySessionStore()
+
+	now := time.Now().UTC()
+	putTestSession("ext-old", "1.0.0", 5, now.Add(-48*time.Hour))
+	putTestSession("ext-busy", "2.0.0", 5000, now.Add(-time.Minute))
+	putTestSession("ext-new", "2.0.0", 10, now)
+
+	cases := map[string][]string{
+		"/admin/sessions":                  {"ext-new", "ext-busy", "ext-old"},
+		"/admin/sessions?version=2.0.0":    {"ext-new", "ext-busy"},
+		"/admin/sessions?minRequests=1000": {"ext-busy"},
+		"/admin/sessions?maxRequests=10":   {"ext-new", "ext-old"},
+		"/admin/sessions?activeBefore=" + now.Add(-time.Hour).Format(time.RFC3339): {"ext-old"},
+		"/admin/sessions?activeAfter=" + now.Add(-time.Hour).Format(time.RFC3339):  {"ext-new", "ext-busy"},
+	}
+	for path, expected := range cases {
+		recorder := adminRequest("GET", path, nil)
+		var response struct {
+			Sessions []AdminSession `json:"sessions"`
+		}
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+
+		var got []string
+		for _, session := range response.Sessions {
+			got = append(got, session.ExtensionID)
+		}
+		if len(got) != len(expected) {
+			t.Errorf("%s: expected %v, got %v", path, expected, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != expected[i] {
+				t.Errorf("%s: expected %v, got %v", path, expected, got)
+				break
+			}
+		}
+	}
+
+	if recorder := adminRequest("GET", "/admin/sessions?minRequests=lots", nil); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Invalid filter should get 400, got %d", recorder.Code)
+	}
+	if bytes.Contains(adminRequest("GET", "/admin/sessions", nil).Body.Bytes(), []byte(`"token"`)) {
+		t.Error("Session listing must not include tokens")
+	}
+}
+
+// Test suspending, reactivating and revoking a session
+func TestAdminSessionActions(t *testing.T) {
+	setTestConfig(t, func(c *Config) { c.AdminAPIKey = "test-admin-key" })
+	extensionRegistry = NewMemorySessionStore()
+	rateLimiter = NewRateLimiter(defaultRateLimitRules())
+
+	identity := putTestSession("ext-abuse", "1.0.0", 0, time.Now())
+	token, _, _ := issueExtensionToken(identity, time.Now().Add(-time.Minute))
+	okHandler := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	call := func() int {
+		headers := map[string]string{"X-Extension-Token": token, "X-Extension-ID": identity.ExtensionID}
+		recorder := httptest.NewRecorder()
+		authMiddleware(okHandler)(recorder, createTestRequest("GET", "/api/current", nil, headers))
+		return recorder.Code
+	}
+	register := func() *httptest.ResponseRecorder {
+		body := RegisterRequest{Identity: identity, Timestamp: time.Now().Unix(), Nonce: time.Now().String()}
+		recorder := httptest.NewRecorder()
+		registerExtensionHandler(recorder, createTestRequest("POST", "/api/auth/register", body, map[string]string{"X-Extension-ID": identity.ExtensionID}))
+		return recorder
+	}
+
+	recorder := adminRequest("POST", "/admin/sessions/ext-abuse/suspend", adminActionRequest{Reason: "scraping"})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Suspend failed: %d %s", recorder.Code, recorder.Body.String())
+	}
+	if code := call(); code != http.StatusForbidden {
+		t.Errorf("Suspended extension should get 403, got %d", code)
+	}
+	if recorder := register(); recorder.Code != http.StatusForbidden {
+		t.Errorf("Suspended extension should not be able to re-register, got %d", recorder.Code)
+	}
+
+	adminRequest("POST", "/admin/sessions/ext-abuse/reactivate", nil)
+	if code := call(); code != http.StatusOK {
+		t.Errorf("Reactivated extension should get 200, got %d", code)
+	}
+
+	adminRequest("POST", "/admin/sessions/ext-abuse/revoke", nil)
+	if code := call(); code != http.StatusUnauthorized {
+		t.Errorf("Revoked token should get 401, got %d", code)
+	}
+
+	// Registering again issues a working token but keeps the old one revoked
+	oldToken := token
+	recorder = register()
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Re-registration failed: %d %s", recorder.Code, recorder.Body.String())
+	}
+	var registration map[string]interface{}
+	json.Unmarshal(recorder.Body.Bytes(), &registration)
+	token = registration["token"].(string)
+	if code := call(); code != http.StatusOK {
+		t.Errorf("New token should get 200, got %d", code)
+	}
+	token = oldToken
+	if code := call(); code != http.StatusUnauthorized {
+		t.Errorf("Old token should stay revoked after re-registering, got %d", code)
+	}
+
+	if recorder := adminRequest("POST", "/admin/sessions/missing/suspend", nil); recorder.Code != http.StatusNotFound {
+		t.Errorf("Unknown session should get 404, got %d", recorder.Code)
+	}
+	if recorder := adminRequest("POST", "/admin/sessions/ext-abuse/explode", nil); recorder.Code != http.StatusNotFound {
+		t.Errorf("Unknown action should get 404, got %d", recorder.Code)
+	}
+}
+
+// Test banning and unbanning fingerprints
+func TestAdminBans(t *testing.T) {
+	setTestConfig(t, func(c *Config) { c.AdminAPIKey = "test-admin-key" })
+	extensionRegistry = NewMemorySessionStore()
+	rateLimiter = NewRateLimiter(defaultRateLimitRules())
+
+	identity := putTestSession("ext-banned", "1.0.0", 0, time.Now())
+	headers := map[string]string{"X-Extension-Token": generateTestToken(identity), "X-Extension-ID": identity.ExtensionID}
+	okHandler := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	call := func() int {
+		recorder := httptest.NewRecorder()
+		authMiddleware(okHandler)(recorder, createTestRequest("GET", "/api/current", nil, headers))
+		return recorder.Code
+	}
+
+	if recorder := adminRequest("POST", "/admin/bans", banRequest{Kind: "ip", Value: "1.2.3.4"}); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Unknown ban kind should get 400, got %d", recorder.Code)
+	}
+
+	recorder := adminRequest("POST", "/admin/bans", banRequest{Kind: BAN_FINGERPRINT, Value: identity.Fingerprint, Reason: "abuse"})
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Ban failed: %d %s", recorder.Code, recorder.Body.String())
+	}
+	if code := call(); code != http.StatusForbidden {
+		t.Errorf("Banned fingerprint should get 403, got %d", code)
+	}
+
+	// Another extension ID with the same fingerprint can't register
+	other := identity
+	other.ExtensionID = "ext-other"
+	body := RegisterRequest{Identity: other, Timestamp: time.Now().Unix(), Nonce: "ban-test"}
+	registration := httptest.NewRecorder()
+	registerExtensionHandler(registration, createTestRequest("POST", "/api/auth/register", body, map[string]string{"X-Extension-ID": other.ExtensionID}))
+	if registration.Code != http.StatusForbidden {
+		t.Errorf("Banned fingerprint should not register, got %d", registration.Code)
+	}
+
+	if !bytes.Contains(adminRequest("GET", "/admin/bans", nil).Body.Bytes(), []byte(identity.Fingerprint)) {
+		t.Error("Ban list should include the new ban")
+	}
+
+	if recorder := adminRequest("DELETE", "/admin/bans/fingerprint/"+identity.Fingerprint, nil); recorder.Code != http.StatusNoContent {
+		t.Fatalf("Unban failed: %d", recorder.Code)
+	}
+	if code := call(); code != http.StatusOK {
+		t.Errorf("Unbanned extension should get 200, got %d", code)
+	}
+	if recorder := adminRequest("DELETE", "/admin/bans/fingerprint/"+identity.Fingerprint, nil); recorder.Code != http.StatusNotFound {
+		t.Errorf("Lifting a missing ban should get 404, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Code of the Universal AQI, which Google returns for every location. Its
+// values are repeated at the top level of each air quality reading.
+const UNIVERSAL_AQI = "uaqi"
+
+// AirQuality is the air quality at a location at one point in time
+type AirQuality struct {
+	DateTime              string                 `json:"dateTime"`
+	AQI                   int                    `json:"aqi"`
+	Category              string                 `json:"category"`
+	DominantPollutant     string                 `json:"dominantPollutant,omitempty"`
+	Indexes               []AirQualityIndex      `json:"indexes"`
+	Pollutants            []Pollutant            `json:"pollutants,omitempty"`
+	HealthRecommendations *HealthRecommendations `json:"healthRecommendations,omitempty"`
+}
+
+// AirQualityIndex is one index value, either the Universal AQI or a local
+// index such as the US EPA's
+type AirQualityIndex struct {
+	Code              string `json:"code"`
+	DisplayName       string `json:"displayName"`
+	AQI               int    `json:"aqi"`
+	Category          string `json:"category"`
+	DominantPollutant string `json:"dominantPollutant,omitempty"`
+	Color             string `json:"color,omitempty"` // #rrggbb
+}
+
+// Pollutant is the measured concentration of one pollutant
+type Pollutant struct {
+	Code          string                  `json:"code"`
+	DisplayName   string                  `json:"displayName"`
+	FullName      string                  `json:"fullName,omitempty"`
+	Concentration *PollutantConcentration `json:"concentration,omitempty"`
+}
+
+// PollutantConcentration is a concentration such as PARTS_PER_BILLION or
+// MICROGRAMS_PER_CUBIC_METER
+type PollutantConcentration struct {
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit"`
+}
+
+// HealthRecommendations is advice for the general population and for
+// sensitive groups
+type HealthRecommendations struct {
+	GeneralPopulation      string `json:"generalPopulation,omitempty"`
+	Elderly                string `json:"elderly,omitempty"`
+	LungDiseasePopulation  string `json:"lungDiseasePopulation,omitempty"`
+	HeartDiseasePopulation string `json:"heartDiseasePopulation,omitempty"`
+	Athletes               string `json:"athletes,omitempty"`
+	PregnantWomen          string `json:"pregnantWomen,omitempty"`
+	Children               string `json:"children,omitempty"`
+}
+
+// AirQualityResponse is the response of /api/airquality
+type AirQualityResponse struct {
+	Current    *AirQuality      `json:"current"`
+	Hourly     []AirQuality     `json:"hourly"`
+	RegionCode string           `json:"regionCode,omitempty"`
+	Location   *RequestLocation `json:"location,omitempty"`
+	Missing    []string         `json:"missing,omitempty"`
+	Timestamp  string           `json:"timestamp"`
+}
+
+// Check that a reading has a time and at least one valid index
+func (a *AirQuality) Validate() error {
+	if a.DateTime == "" {
+		return fmt.Errorf("air quality: missing dateTime")
+	}
+	if len(a.Indexes) == 0 {
+		return fmt.Errorf("air quality: no indexes")
+	}
+	for _, index := range a.Indexes {
+		if index.Code == "" || index.AQI < 0 {
+			return fmt.Errorf("air quality: invalid index %q with aqi %d", index.Code, index.AQI)
+		}
+	}
+	return nil
+}
+
+// Google Air Quality API wire format
+
+type googleAirQualityRequest struct {
+	Location          googleLocation `json:"location"`
+	ExtraComputations []string       `json:"extraComputations"`
+	LanguageCode      string         `json:"languageCode"`
+	UniversalAQI      bool           `json:"universalAqi"`
+	Period            *googlePeriod  `json:"period,omitempty"`
+	PageSize          int            `json:"pageSize,omitempty"`
+}
+
+type googleLocation struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+type googlePeriod struct {
+	StartTime string `json:"startTime"`
+	EndTime   string `json:"endTime"`
+}
+
+type googleAirQualityReading struct {
+	DateTime   string `json:"dateTime"`
+	RegionCode string `json:"regionCode"`
+	Indexes    []struct {
+		Code              string       `json:"code"`
+		DisplayName       string       `json:"displayName"`
+		AQI               int          `json:"aqi"`
+		Category          string       `json:"category"`
+		DominantPollutant string       `json:"dominantPollutant"`
+		Color             *googleColor `json:"color"`
+	} `json:"indexes"`
+	Pollutants []struct {
+		Code          string `json:"code"`
+		DisplayName   string `json:"displayName"`
+		FullName      string `json:"fullName"`
+		Concentration *struct {
+			Value float64 `json:"value"`
+			Units string  `json:"units"`
+		} `json:"concentration"`
+	} `json:"pollutants"`
+	HealthRecommendations *HealthRecommendations `json:"healthRecommendations"`
+}
+
+type googleAirQualityForecastResponse struct {
+	HourlyForecasts []googleAirQualityReading `json:"hourlyForecasts"`
+	RegionCode      string                    `json:"regionCode"`
+}
+
+// Colour components from 0 to 1; missing components are 0
+type googleColor struct {
+	Red   float64 `json:"red"`
+	Green float64 `json:"green"`
+	Blue  float64 `json:"blue"`
+}
+
+func (c *googleColor) hex() string {
+	if c == nil {
+		return ""
+	}
+	component := func(v float64) int {
+		return int(math.Round(math.Max(0, math.Min(1, v)) * 255))
+	}
+	return fmt.Sprintf("#%02x%02x%02x", component(c.Red), component(c.Green), component(c.Blue))
+}
+
+// Convert to the domain model. The top-level index is the Universal AQI,
+// or the first index if Google left it out.
+func (r *googleAirQualityReading) toAirQuality() AirQuality {
+	reading := AirQuality{
+		DateTime:              r.DateTime,
+		Indexes:               make([]AirQualityIndex, 0, len(r.Indexes)),
+		HealthRecommendations: r.HealthRecommendations,
+	}
+	for _, index := range r.Indexes {
+		reading.Indexes = append(reading.Indexes, AirQualityIndex{
+			Code:              index.Code,
+			DisplayName:       index.DisplayName,
+			AQI:               index.AQI,
+			Category:          index.Category,
+			DominantPollutant: index.DominantPollutant,
+			Color:             index.Color.hex(),
+		})
+	}
+	for _, index := range reading.Indexes {
+		if index.Code == UNIVERSAL_AQI || reading.Category == "" {
+			reading.AQI = index.AQI
+			reading.Category = index.Category
+			reading.DominantPollutant = index.DominantPollutant
+		}
+		if index.Code == UNIVERSAL_AQI {
+			break
+		}
+	}
+	for _, p := range r.Pollutants {
+		pollutant := Pollutant{Code: p.Code, DisplayName: p.DisplayName, FullName: p.FullName}
+		if p.Concentration != nil {
+			pollutant.Concentration = &PollutantConcentration{Value: p.Concentration.Value, Unit: p.Concentration.Units}
+		}
+		reading.Pollutants = append(reading.Pollutants, pollutant)
+	}
+	return reading
+}
+
+// Parse Google current air quality into the domain model
+func parseAirQualityConditions(body []byte) (*AirQuality, string, error) {
+	var resp googleAirQualityReading
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, "", &PayloadError{fmt.Errorf("decode air quality conditions: %w", err)}
+	}
+	current := resp.toAirQuality()
+	if err := current.Validate(); err != nil {
+		return nil, "", &PayloadError{err}
+	}
+	return &current, resp.RegionCode, nil
+}
+
+// Parse a Google air quality forecast. Hours that fail validation are
+// dropped rather than failing the whole response.
+func parseAirQualityForecast(body []byte) ([]AirQuality, error) {
+	var resp googleAirQualityForecastResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, &PayloadError{fmt.Errorf("decode air quality forecast: %w", err)}
+	}
+
+	hourly := make([]AirQuality, 0, len(resp.HourlyForecasts))
+	for i, h := range resp.HourlyForecasts {
+		item := h.toAirQuality()
+		if err := item.Validate(); err != nil {
+			slog.Warn("skipping invalid air quality hour", "index", i, "error", err)
+			continue
+		}
+		hourly = append(hourly, item)
+	}
+	return hourly, nil
+}
+
+// googleAirQuality talks to the Google Air Quality API. There is no
+// secondary air quality provider, so it isn't part of the WeatherProvider
+// chain.
+type googleAirQuality struct {
+	apiKey string
+}
+
+// Returns nil when the Google API key isn't set
+func newAirQualityClient(cfg *Config) *googleAirQuality {
+	if cfg.GoogleAPIKey == "" {
+		return nil
+	}
+	return &googleAirQuality{apiKey: cfg.GoogleAPIKey}
+}
+
+// Request body of an air quality lookup. lat and lon are already validated
+// by parseCoordinates.
+func (g *googleAirQuality) request(ctx context.Context, lat, lon string, extraComputations ...string) googleAirQualityRequest {
+	latitude, _ := strconv.ParseFloat(lat, 64)
+	longitude, _ := strconv.ParseFloat(lon, 64)
+	return googleAirQualityRequest{
+		Location:          googleLocation{Latitude: latitude, Longitude: longitude},
+		ExtraComputations: extraComputations,
+		LanguageCode:      languageFromContext(ctx),
+		UniversalAQI:      true,
+	}
+}
+
+// Current air quality and the region code of the location
+func (g *googleAirQuality) CurrentConditions(ctx context.Context, lat, lon string) (*AirQuality, string, error) {
+	start := time.Now()
+	current, regionCode, err := g.currentConditions(ctx, lat, lon)
+	observeUpstream(ctx, "google", "airquality_current", start, err)
+	return current, regionCode, err
+}
+
+func (g *googleAirQuality) currentConditions(ctx context.Context, lat, lon string) (*AirQuality, string, error) {
+	payload := g.request(ctx, lat, lon, "LOCAL_AQI", "HEALTH_RECOMMENDATIONS", "POLLUTANT_CONCENTRATION")
+	apiURL := upstreamURL(GOOGLE_AIR_QUALITY_BASE+"/currentConditions:lookup", url.Values{"key": {g.apiKey}})
+	body, err := postUpstream(ctx, apiURL, payload)
+	if err != nil {
+		return nil, "", err
+	}
+	return parseAirQualityConditions(body)
+}
+
+// Hourly air quality forecast for the next hours, starting with the next
+// full hour
+func (g *googleAirQuality) HourlyForecast(ctx context.Context, lat, lon, hours string) ([]AirQuality, error) {
+	start := time.Now()
+	hourly, err := g.hourlyForecast(ctx, lat, lon, hours)
+	observeUpstream(ctx, "google", "airquality_hourly", start, err)
+	return hourly, err
+}
+
+func (g *googleAirQuality) hourlyForecast(ctx context.Context, lat, lon, hours string) ([]AirQuality, error) {
+	count, err := strconv.Atoi(hours)
+	if err != nil {
+		return nil, err
+	}
+	from := time.Now().UTC().Truncate(time.Hour).Add(time.Hour)
+	payload := g.request(ctx, lat, lon, "LOCAL_AQI", "HEALTH_RECOMMENDATIONS")
+	payload.Period = &googlePeriod{
+		StartTime: from.Format(time.RFC3339),
+		EndTime:   from.Add(time.Duration(count-1) * time.Hour).Format(time.RFC3339),
+	}
+	payload.PageSize = count
+
+	apiURL := upstreamURL(GOOGLE_AIR_QUALITY_BASE+"/forecast:lookup", url.Values{"key": {g.apiKey}})
+	body, err := postUpstream(ctx, apiURL, payload)
+	if err != nil {
+		return nil, err
+	}
+	return parseAirQualityForecast(body)
+}
+
+// Cached wrappers around the air quality lookups. Keys include the language
+// in ctx, since categories and recommendations are localized upstream.
+
+type airQualityResult struct {
+	current    *AirQuality
+	regionCode string
+}
+
+func cachedAirQuality(ctx context.Context, client *googleAirQuality, lat, lon string) (*AirQuality, string, cacheStatus, error) {
+	value, status, err := weatherCache.Fetch(ctx, locationCacheKey("airquality", lat, lon, languageFromContext(ctx)), CACHE_TTL_AIR_QUALITY, func(ctx context.Context) (interface{}, error) {
+		current, regionCode, err := client.CurrentConditions(ctx, lat, lon)
+		return airQualityResult{current, regionCode}, err
+	})
+	if err != nil {
+		return nil, "", status, err
+	}
+	result := value.(airQualityResult)
+	return result.current, result.regionCode, status, nil
+}
+
+func cachedAirQualityForecast(ctx context.Context, client *googleAirQuality, lat, lon, hours string) ([]AirQuality, cacheStatus, error) {
+	value, status, err := weatherCache.Fetch(ctx, locationCacheKey("airquality_hourly", lat, lon, hours, languageFromContext(ctx)), CACHE_TTL_AIR_QUALITY_FORECAST, func(ctx context.Context) (interface{}, error) {
+		return client.HourlyForecast(ctx, lat, lon, hours)
+	})
+	if err != nil {
+		return nil, status, err
+	}
+	return value.([]AirQuality), status, nil
+}
+
+// Air quality endpoint: current conditions and the hourly forecast
+func airQualityHandler(w http.ResponseWriter, r *http.Request) {
+	client := newAirQualityClient(config)
+	if client == nil {
+		writeError(w, http.StatusInternalServerError, ERR_NOT_CONFIGURED, "API key not configured", nil)
+		return
+	}
+
+	query := r.URL.Query()
+	lang, paramErr := parseLanguage(query)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+	lat, lon, location, paramErr := locateRequest(r, query, lang)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+	hours, paramErr := parseCountParam(query, "hours", DEFAULT_FORECAST_HOURS, MAX_AIR_QUALITY_HOURS)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+	ctx := withLanguage(r.Context(), lang)
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(config.WeatherDeadline))
+	defer cancel()
+
+	var (
+		wg                          sync.WaitGroup
+		current                     *AirQuality
+		regionCode                  string
+		hourly                      []AirQuality
+		currentStatus, hourlyStatus cacheStatus
+		currentErr, hourlyErr       error
+	)
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		current, regionCode, currentStatus, currentErr = cachedAirQuality(ctx, client, lat, lon)
+	}()
+	go func() {
+		defer wg.Done()
+		hourly, hourlyStatus, hourlyErr = cachedAirQualityForecast(ctx, client, lat, lon, hours)
+	}()
+	wg.Wait()
+
+	var missing []string
+	if currentErr != nil {
+		slog.ErrorContext(r.Context(), "fetching air quality failed", "error", currentErr)
+		missing = append(missing, "current")
+	}
+	if hourlyErr != nil {
+		slog.ErrorContext(r.Context(), "fetching air quality forecast failed", "error", hourlyErr)
+		missing = append(missing, "hourly")
+	}
+	if len(missing) == 2 {
+		writeUpstreamError(w, currentErr, "Failed to fetch air quality data")
+		return
+	}
+	if hourly == nil {
+		hourly = []AirQuality{}
+	}
+
+	w.Header().Set("X-Cache", string(combineCacheStatus(currentStatus, hourlyStatus)))
+	writeJSON(w, AirQualityResponse{
+		Current:    current,
+		Hourly:     hourly,
+		RegionCode: regionCode,
+		Location:   location,
+		Missing:    missing,
+		Timestamp:  time.Now().Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func mockGoogleAirQualityReading(dateTime string) map[string]interface{} {
+	return map[string]interface{}{
+		"dateTime":   dateTime,
+		"regionCode": "us",
+		"indexes": []interface{}{
+			map[string]interface{}{
+				"code": "usa_epa", "displayName": "AQI (US)", "aqi": 45,
+				"category": "Good air quality", "dominantPollutant": "pm25",
+				"color": map[string]interface{}{"green": 0.89411765},
+			},
+			map[string]interface{}{
+				"code": "uaqi", "displayName": "Universal AQI", "aqi": 72,
+				"category": "Good air quality", "dominantPollutant": "o3",
+				"color": map[string]interface{}{"red": 0.42352942, "green": 0.7529412, "blue": 0.2901961},
+			},
+		},
+		"pollutants": []interface{}{
+			map[string]interface{}{
+				"code": "pm25", "displayName": "PM2.5", "fullName": "Fine particulate matter (<2.5µm)",
+				"concentration": map[string]interface{}{"value": 10.8, "units": "MICROGRAMS_PER_CUBIC_METER"},
+			},
+		},
+		"healthRecommendations": map[string]interface{}{
+			"generalPopulation": "Enjoy your usual outdoor activities.",
+			"athletes":          "You can continue your usual activities.",
+		},
+	}
+}
+
+func TestParseAirQualityConditions(t *testing.T) {
+	body, _ := json.Marshal(mockGoogleAirQualityReading("2024-01-15T12:00:00Z"))
+	current, regionCode, err := parseAirQualityConditions(body)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if regionCode != "us" {
+		t.Errorf("Expected region us, got %q", regionCode)
+	}
+
+	// The Universal AQI is repeated at the top level
+	if current.AQI != 72 || current.Category != "Good air quality" || current.DominantPollutant != "o3" {
+		t.Errorf("Unexpected top-level index %+v", current)
+	}
+	if len(current.Indexes) != 2 || current.Indexes[0].Color != "#00e400" || current.Indexes[1].Color != "#6cc04a" {
+		t.Errorf("Unexpected indexes %+v", current.Indexes)
+	}
+	if len(current.Pollutants) != 1 || *current.Pollutants[0].Concentration != (PollutantConcentration{10.8, "MICROGRAMS_PER_CUBIC_METER"}) {
+		t.Errorf("Unexpected pollutants %+v", current.Pollutants)
+	}
+	if current.HealthRecommendations == nil || current.HealthRecommendations.Athletes == "" {
+		t.Errorf("Expected health recommendations, got %+v", current.HealthRecommendations)
+	}
+
+	// A reading without indexes is an invalid payload
+	_, _, err = parseAirQualityConditions([]byte(`{"dateTime": "2024-01-15T12:00:00Z", "indexes": []}`))
+	if _, ok := err.(*PayloadError); !ok {
+		t.Errorf("Expected PayloadError, got %v", err)
+	}
+}
+
+func TestParseAirQualityForecast(t *testing.T) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"hourlyForecasts": []interface{}{
+			mockGoogleAirQualityReading("2024-01-15T13:00:00Z"),
+			map[string]interface{}{"dateTime": "2024-01-15T14:00:00Z"},
+			mockGoogleAirQualityReading("2024-01-15T15:00:00Z"),
+		},
+	})
+	hourly, err := parseAirQualityForecast(body)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(hourly) != 2 || hourly[1].DateTime != "2024-01-15T15:00:00Z" {
+		t.Errorf("Expected the invalid hour to be dropped, got %+v", hourly)
+	}
+}
+
+// Test the handler against a fake Air Quality API
+func TestAirQualityHandler(t *testing.T) {
+	weatherCache = newResponseCache()
+
+	var mu sync.Mutex
+	requests := map[string]googleAirQualityRequest{}
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Query().Get("key") != "test-key" {
+			t.Errorf("Unexpected upstream request %s %s", r.Method, r.URL)
+		}
+		var req googleAirQualityRequest
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Errorf("Invalid upstream body %s", body)
+		}
+		mu.Lock()
+		requests[r.URL.Path] = req
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/currentConditions:lookup"):
+			json.NewEncoder(w).Encode(mockGoogleAirQualityReading("2024-01-15T12:00:00Z"))
+		case strings.HasSuffix(r.URL.Path, "/forecast:lookup"):
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"hourlyForecasts": []interface{}{mockGoogleAirQualityReading("2024-01-15T13:00:00Z")},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer mockServer.Close()
+
+	originalBase := GOOGLE_AIR_QUALITY_BASE
+	GOOGLE_AIR_QUALITY_BASE = mockServer.URL
+	defer func() { GOOGLE_AIR_QUALITY_BASE = originalBase }()
+	setTestConfig(t, func(c *Config) { c.GoogleAPIKey = "test-key" })
+
+	w := httptest.NewRecorder()
+	airQualityHandler(w, httptest.NewRequest("GET", "/api/airquality?lat=37.7749&lon=-122.4194&hours=12&lang=fr", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp AirQualityResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if resp.Current == nil || resp.Current.AQI != 72 || len(resp.Hourly) != 1 || resp.RegionCode != "us" || resp.Missing != nil {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+	if w.Header().Get("X-Cache") != string(cacheMiss) {
+		t.Errorf("Expected X-Cache MISS, got %q", w.Header().Get("X-Cache"))
+	}
+
+	current := requests["/currentConditions:lookup"]
+	if current.Location != (googleLocation{37.7749, -122.4194}) || current.LanguageCode != "fr" || !current.UniversalAQI {
+		t.Errorf("Unexpected current conditions request %+v", current)
+	}
+	forecast := requests["/forecast:lookup"]
+	if forecast.PageSize != 12 || forecast.Period == nil || forecast.Period.StartTime == "" {
+		t.Errorf("Unexpected forecast request %+v", forecast)
+	}
+
+	// The second request is served from cache
+	w = httptest.NewRecorder()
+	airQualityHandler(w, httptest.NewRequest("GET", "/api/airquality?lat=37.7749&lon=-122.4194&hours=12&lang=fr", nil))
+	if w.Header().Get("X-Cache") != string(cacheHit) {
+		t.Errorf("Expected X-Cache HIT, got %q", w.Header().Get("X-Cache"))
+	}
+
+	w = httptest.NewRecorder()
+	airQualityHandler(w, httptest.NewRequest("GET", "/api/airquality?lat=1&lon=2&hours=97", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for too many hours, got %d", w.Code)
+	}
+}
+
+// Test that a failing forecast is reported in missing and a total failure
+// is an upstream error
+func TestAirQualityHandlerPartialFailure(t *testing.T) {
+	weatherCache = newResponseCache()
+
+	var failCurrent atomic.Bool
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/currentConditions:lookup") && !failCurrent.Load() {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(mockGoogleAirQualityReading("2024-01-15T12:00:00Z"))
+			return
+		}
+		http.Error(w, "quota exceeded", http.StatusTooManyRequests)
+	}))
+	defer mockServer.Close()
+
+	originalBase := GOOGLE_AIR_QUALITY_BASE
+	GOOGLE_AIR_QUALITY_BASE = mockServer.URL
+	defer func() { GOOGLE_AIR_QUALITY_BASE = originalBase }()
+	setTestConfig(t, func(c *Config) { c.GoogleAPIKey = "test-key" })
+
+	w := httptest.NewRecorder()
+	airQualityHandler(w, httptest.NewRequest("GET", "/api/airquality?lat=1&lon=2", nil))
+	var resp AirQualityResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if w.Code != http.StatusOK || resp.Current == nil || len(resp.Missing) != 1 || resp.Missing[0] != "hourly" || resp.Hourly == nil {
+		t.Errorf("Expected partial response missing hourly, got %d %+v", w.Code, resp)
+	}
+
+	failCurrent.Store(true)
+	w = httptest.NewRecorder()
+	airQualityHandler(w, httptest.NewRequest("GET", "/api/airquality?lat=3&lon=4", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the upstream status when every section fails, got %d", w.Code)
+	}
+	if apiErr := decodeAPIError(t, w); apiErr.Code != ERR_UPSTREAM_ERROR {
+		t.Errorf("Expected %s, got %+v", ERR_UPSTREAM_ERROR, apiErr)
+	}
+}
+
+func TestAirQualityNotConfigured(t *testing.T) {
+	setTestConfig(t, func(c *Config) { c.GoogleAPIKey = ""; c.OpenWeatherAPIKey = "owm-key" })
+
+	w := httptest.NewRecorder()
+	airQualityHandler(w, httptest.NewRequest("GET", "/api/airquality?lat=1&lon=2", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 without a Google API key, got %d", w.Code)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Alert severity and urgency levels, from the Common Alerting Protocol.
+// Providers that don't report them use UNKNOWN.
+const (
+	ALERT_SEVERITY_EXTREME  = "EXTREME"
+	ALERT_SEVERITY_SEVERE   = "SEVERE"
+	ALERT_SEVERITY_MODERATE = "MODERATE"
+	ALERT_SEVERITY_MINOR    = "MINOR"
+	ALERT_URGENCY_IMMEDIATE = "IMMEDIATE"
+	ALERT_URGENCY_EXPECTED  = "EXPECTED"
+	ALERT_URGENCY_FUTURE    = "FUTURE"
+	ALERT_URGENCY_PAST      = "PAST"
+	ALERT_UNKNOWN           = "UNKNOWN"
+)
+
+// Known levels. Severities are ordered most severe first.
+var (
+	alertSeverities = []string{ALERT_SEVERITY_EXTREME, ALERT_SEVERITY_SEVERE, ALERT_SEVERITY_MODERATE, ALERT_SEVERITY_MINOR, ALERT_UNKNOWN}
+	alertUrgencies  = []string{ALERT_URGENCY_IMMEDIATE, ALERT_URGENCY_EXPECTED, ALERT_URGENCY_FUTURE, ALERT_URGENCY_PAST}
+)
+
+// WeatherAlert is an official public warning, such as a storm, heat or
+// flood warning
+type WeatherAlert struct {
+	ID           string          `json:"id,omitempty"`
+	Event        string          `json:"event"`
+	Headline     string          `json:"headline"`
+	Description  string          `json:"description,omitempty"`
+	Instructions []string        `json:"instructions,omitempty"`
+	Severity     string          `json:"severity"`
+	Urgency      string          `json:"urgency"`
+	AreaName     string          `json:"areaName,omitempty"`
+	Effective    string          `json:"effective"`
+	Expires      string          `json:"expires,omitempty"`
+	Authority    *AlertAuthority `json:"authority,omitempty"`
+}
+
+// AlertAuthority is the agency that issued an alert
+type AlertAuthority struct {
+	Name      string `json:"name"`
+	Publisher string `json:"publisher,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+// AlertsResponse is the response of /api/alerts
+type AlertsResponse struct {
+	Alerts    []WeatherAlert   `json:"alerts"`
+	Location  *RequestLocation `json:"location,omitempty"`
+	Timestamp string           `json:"timestamp"`
+}
+
+// Check that an alert has a headline and valid times
+func (a *WeatherAlert) Validate() error {
+	if a.Headline == "" {
+		return fmt.Errorf("alert %q: missing headline", a.ID)
+	}
+	if _, err := time.Parse(time.RFC3339, a.Effective); err != nil {
+		return fmt.Errorf("alert %q: invalid effective time %q", a.ID, a.Effective)
+	}
+	if a.Expires != "" {
+		if _, err := time.Parse(time.RFC3339, a.Expires); err != nil {
+			return fmt.Errorf("alert %q: invalid expiry time %q", a.ID, a.Expires)
+		}
+	}
+	return nil
+}
+
+// Return a severity or urgency if it is one of known, otherwise UNKNOWN
+func normalizeAlertLevel(level string, known []string) string {
+	if slices.Contains(known, level) {
+		return level
+	}
+	return ALERT_UNKNOWN
+}
+
+// Return the alerts that haven't expired at now, most severe first. Alerts
+// are cached for a few minutes, so expiry is checked when responding.
+func activeAlerts(alerts []WeatherAlert, now time.Time) []WeatherAlert {
+	active := make([]WeatherAlert, 0, len(alerts))
+	for _, a := range alerts {
+		if expires, err := time.Parse(time.RFC3339, a.Expires); err == nil && !now.Before(expires) {
+			continue
+		}
+		active = append(active, a)
+	}
+	slices.SortStableFunc(active, func(a, b WeatherAlert) int {
+		return slices.Index(alertSeverities, a.Severity) - slices.Index(alertSeverities, b.Severity)
+	})
+	return active
+}
+
+// Google Weather API public alerts wire format
+
+type googleAlertsResponse struct {
+	WeatherAlerts []struct {
+		AlertID        string        `json:"alertId"`
+		AlertTitle     LocalizedText `json:"alertTitle"`
+		EventType      string        `json:"eventType"`
+		AreaName       string        `json:"areaName"`
+		Description    string        `json:"description"`
+		Instruction    []string      `json:"instruction"`
+		Severity       string        `json:"severity"`
+		Urgency        string        `json:"urgency"`
+		StartTime      string        `json:"startTime"`
+		ExpirationTime string        `json:"expirationTime"`
+		DataSource     *struct {
+			Publisher    string `json:"publisher"`
+			Name         string `json:"name"`
+			AuthorityURI string `json:"authorityUri"`
+		} `json:"dataSource"`
+	} `json:"weatherAlerts"`
+}
+
+// Parse Google public alerts. Alerts that fail validation are dropped
+// rather than failing the whole response.
+func parseAlerts(body []byte) ([]WeatherAlert, error) {
+	var resp googleAlertsResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, &PayloadError{fmt.Errorf("decode public alerts: %w", err)}
+	}
+
+	alerts := make([]WeatherAlert, 0, len(resp.WeatherAlerts))
+	for i, a := range resp.WeatherAlerts {
+		alert := WeatherAlert{
+			ID:           a.AlertID,
+			Event:        a.EventType,
+			Headline:     a.AlertTitle.Text,
+			Description:  a.Description,
+			Instructions: a.Instruction,
+			Severity:     normalizeAlertLevel(a.Severity, alertSeverities),
+			Urgency:      normalizeAlertLevel(a.Urgency, alertUrgencies),
+			AreaName:     a.AreaName,
+			Effective:    a.StartTime,
+			Expires:      a.ExpirationTime,
+		}
+		if s := a.DataSource; s != nil {
+			alert.Authority = &AlertAuthority{Name: s.Name, Publisher: s.Publisher, URL: s.AuthorityURI}
+		}
+		if err := alert.Validate(); err != nil {
+			slog.Warn("skipping invalid alert", "index", i, "error", err)
+			continue
+		}
+		alerts = append(alerts, alert)
+	}
+	return alerts, nil
+}
+
+// Active alerts endpoint
+func alertsHandler(w http.ResponseWriter, r *http.Request) {
+	provider := newWeatherProvider(config)
+	if provider == nil {
+		writeError(w, http.StatusInternalServerError, ERR_NOT_CONFIGURED, "API key not configured", nil)
+		return
+	}
+
+	query := r.URL.Query()
+	lang, paramErr := parseLanguage(query)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+	lat, lon, location, paramErr := locateRequest(r, query, lang)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+	ctx := withLanguage(r.Context(), lang)
+
+	alerts, status, err := cachedAlerts(ctx, provider, lat, lon)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "fetching alerts failed", "error", err)
+		writeUpstreamError(w, err, "Failed to fetch weather alerts")
+		return
+	}
+
+	w.Header().Set("X-Cache", string(status))
+	writeJSON(w, AlertsResponse{
+		Alerts:    activeAlerts(alerts, time.Now()),
+		Location:  location,
+		Timestamp: time.Now().Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const mockGoogleAlertsResponse = `{
+  "weatherAlerts": [
+    {
+      "alertId": "minor-1",
+      "alertTitle": {"text": "Wind Advisory", "languageCode": "en"},
+      "eventType": "WIND",
+      "areaName": "San Francisco",
+      "description": "Southwest winds 20 to 30 mph.",
+      "severity": "MINOR",
+      "urgency": "EXPECTED",
+      "startTime": "2024-01-15T12:00:00Z",
+      "expirationTime": "2099-01-16T00:00:00Z",
+      "dataSource": {"publisher": "NOAA", "name": "National Weather Service", "authorityUri": "https://www.weather.gov/"}
+    },
+    {
+      "alertId": "extreme-1",
+      "alertTitle": {"text": "Excessive Heat Warning"},
+      "eventType": "HEAT",
+      "instruction": ["Drink plenty of fluids.", "Stay in an air-conditioned room."],
+      "severity": "EXTREME",
+      "urgency": "IMMEDIATE",
+      "startTime": "2024-01-15T10:00:00Z"
+    },
+    {
+      "alertId": "unspecified-1",
+      "alertTitle": {"text": "Flood Watch"},
+      "severity": "SEVERITY_UNSPECIFIED",
+      "urgency": "URGENCY_UNSPECIFIED",
+      "startTime": "2024-01-15T10:00:00Z",
+      "expirationTime": "2024-01-15T11:00:00Z"
+    },
+    {"alertId": "invalid-1", "alertTitle": {"text": "No start"}}
+  ]
+}`
+
+func TestParseAlerts(t *testing.T) {
+	alerts, err := parseAlerts([]byte(mockGoogleAlertsResponse))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(alerts) != 3 {
+		t.Fatalf("Expected the invalid alert to be dropped, got %+v", alerts)
+	}
+
+	wind := alerts[0]
+	if wind.Headline != "Wind Advisory" || wind.Event != "WIND" || wind.Severity != ALERT_SEVERITY_MINOR || wind.Urgency != ALERT_URGENCY_EXPECTED {
+		t.Errorf("Unexpected alert %+v", wind)
+	}
+	if wind.Authority == nil || *wind.Authority != (AlertAuthority{"National Weather Service", "NOAA", "https://www.weather.gov/"}) {
+		t.Errorf("Unexpected authority %+v", wind.Authority)
+	}
+	if len(alerts[1].Instructions) != 2 {
+		t.Errorf("Expected instructions, got %+v", alerts[1].Instructions)
+	}
+	if alerts[2].Severity != ALERT_UNKNOWN || alerts[2].Urgency != ALERT_UNKNOWN {
+		t.Errorf("Expected unspecified levels to be UNKNOWN, got %+v", alerts[2])
+	}
+}
+
+func TestActiveAlerts(t *testing.T) {
+	alerts := []WeatherAlert{
+		{ID: "unknown", Severity: ALERT_UNKNOWN},
+		{ID: "minor", Severity: ALERT_SEVERITY_MINOR, Expires: "2024-01-15T12:00:00Z"},
+		{ID: "expired", Severity: ALERT_SEVERITY_EXTREME, Expires: "2024-01-15T11:00:00Z"},
+		{ID: "severe", Severity: ALERT_SEVERITY_SEVERE},
+	}
+	now := time.Date(2024, 1, 15, 11, 0, 0, 0, time.UTC)
+
+	var ids []string
+	for _, a := range activeAlerts(alerts, now) {
+		ids = append(ids, a.ID)
+	}
+	if strings.Join(ids, ",") != "severe,minor,unknown" {
+		t.Errorf("Expected active alerts most severe first, got %v", ids)
+	}
+	if alerts[0].ID != "unknown" {
+		t.Error("Filtering reordered the original alerts")
+	}
+}
+
+// Test /api/alerts and include=alerts on /api/weather against a fake Google
+func TestAlertsHandler(t *testing.T) {
+	weatherCache = newResponseCache()
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/publicAlerts:lookup":
+			if r.URL.Query().Get("languageCode") != "es" && r.URL.Query().Get("languageCode") != "en" {
+				t.Errorf("Unexpected languageCode in %s", r.URL.RawQuery)
+			}
+			w.Write([]byte(mockGoogleAlertsResponse))
+		case "/currentConditions:lookup":
+			json.NewEncoder(w).Encode(mockGoogleWeatherResponse())
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer mockServer.Close()
+
+	originalBase := GOOGLE_WEATHER_BASE
+	GOOGLE_WEATHER_BASE = mockServer.URL
+	defer func() { GOOGLE_WEATHER_BASE = originalBase }()
+	setTestConfig(t, func(c *Config) { c.GoogleAPIKey = "test-key" })
+
+	w := httptest.NewRecorder()
+	alertsHandler(w, httptest.NewRequest("GET", "/api/alerts?lat=37.77&lon=-122.42&lang=es", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp AlertsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	// The flood watch has expired; the heat warning comes first
+	if len(resp.Alerts) != 2 || resp.Alerts[0].ID != "extreme-1" || resp.Alerts[1].ID != "minor-1" {
+		t.Errorf("Unexpected alerts %+v", resp.Alerts)
+	}
+
+	w = httptest.NewRecorder()
+	weatherHandler(w, httptest.NewRequest("GET", "/api/weather?lat=37.77&lon=-122.42&include=alerts", nil))
+	var weather WeatherResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &weather); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(weather.Alerts) != 2 || weather.Pollen != nil {
+		t.Errorf("Expected only alerts to be included, got alerts %+v and pollen %+v", weather.Alerts, weather.Pollen)
+	}
+	if !strings.Contains(w.Header().Get("X-Cache-Detail"), "alerts=MISS") {
+		t.Errorf("Expected alerts in X-Cache-Detail, got %q", w.Header().Get("X-Cache-Detail"))
+	}
+}
+
+// Test that alerts fail over to OpenWeatherMap
+func TestOpenWeatherAlerts(t *testing.T) {
+	weatherCache = newResponseCache()
+
+	googleServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer googleServer.Close()
+
+	owmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("exclude") != "current,minutely,hourly,daily" {
+			t.Errorf("Unexpected exclude %q", r.URL.Query().Get("exclude"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"alerts": [{"sender_name": "Met Office", "event": "Yellow wind warning",
+			"start": 1735725600, "end": 4102444800, "description": "Strong winds"}]}`))
+	}))
+	defer owmServer.Close()
+
+	originalBase, originalOneCall := GOOGLE_WEATHER_BASE, OPENWEATHER_ONECALL_URL
+	GOOGLE_WEATHER_BASE, OPENWEATHER_ONECALL_URL = googleServer.URL, owmServer.URL
+	defer func() { GOOGLE_WEATHER_BASE, OPENWEATHER_ONECALL_URL = originalBase, originalOneCall }()
+	setTestConfig(t, func(c *Config) {
+		c.GoogleAPIKey = "test-key"
+		c.OpenWeatherAPIKey = "test-owm-key"
+	})
+
+	w := httptest.NewRecorder()
+	alertsHandler(w, httptest.NewRequest("GET", "/api/alerts?lat=51.5&lon=-0.12", nil))
+	var resp AlertsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(resp.Alerts) != 1 {
+		t.Fatalf("Expected one alert, got %d: %s", len(resp.Alerts), w.Body.String())
+	}
+	alert := resp.Alerts[0]
+	if alert.Headline != "Yellow wind warning" || alert.Severity != ALERT_UNKNOWN || alert.Effective != "2025-01-01T10:00:00Z" || alert.Authority.Name != "Met Office" {
+		t.Errorf("Unexpected alert %+v", alert)
+	}
+}
@@ -1,14 +1,11 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/base64"
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
-	"strings"
-	"sync"
 	"time"
 )
 
@@ -22,54 +19,34 @@ type ExtensionIdentity struct {
 	Timezone         string `json:"timezone"`
 }
 
-type TokenPayload struct {
-	ExtensionID string `json:"ext"`
-	Fingerprint string `json:"fp"`
-	Timestamp   int64  `json:"ts"`
-	Nonce       string `json:"nonce"`
-}
-
 type RegisterRequest struct {
 	Identity  ExtensionIdentity `json:"identity"`
 	Timestamp int64             `json:"timestamp"`
+	Nonce     string            `json:"nonce"`
 }
 
 type ExtensionSession struct {
-	Identity     ExtensionIdentity
-	Token        string
-	RegisterTime time.Time
-	LastActivity time.Time
-	RequestCount int64
-	IsActive     bool
+	Identity     ExtensionIdentity `json:"identity"`
+	Token        string            `json:"token"`
+	RegisterTime time.Time         `json:"registerTime"`
+	LastActivity time.Time         `json:"lastActivity"`
+	RequestCount int64             `json:"requestCount"`
+	IsActive     bool              `json:"isActive"`
+	// Set by the admin API
+	SuspendedReason string    `json:"suspendedReason,omitempty"`
+	TokensRevokedAt time.Time `json:"tokensRevokedAt,omitzero"`
 }
 
-// Global extension registry with thread safety
-type ExtensionRegistry struct {
-	mu       sync.RWMutex
-	sessions map[string]*ExtensionSession
-}
-
-var extensionRegistry = &ExtensionRegistry{
-	sessions: make(map[string]*ExtensionSession),
-}
+// Global extension registry, replaced at startup by the configured store
+var extensionRegistry SessionStore = NewMemorySessionStore()
 
 // Security configuration
 const (
-	TOKEN_EXPIRY_HOURS  = 24
-	MAX_REQUEST_PER_MIN = 120
-	MAX_EXTENSIONS      = 10000
+	REGISTRATION_MAX_SKEW_SECONDS = 300
+	MAX_NONCE_LENGTH              = 128
+	MAX_TRACKED_NONCES            = 100000
 )
 
-// Rate limiting per extension
-type RateLimiter struct {
-	requests map[string][]time.Time
-	mu       sync.RWMutex
-}
-
-var rateLimiter = &RateLimiter{
-	requests: make(map[string][]time.Time),
-}
-
 // Authentication middleware
 func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -84,14 +61,12 @@ func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		extensionID := r.Header.Get("X-Extension-ID")
 		extensionVersion := r.Header.Get("X-Extension-Version")
 		fingerprint := r.Header.Get("X-Extension-Fingerprint")
-		requestID := r.Header.Get("X-Request-ID")
 
 		// Log security event
-		logSecurityEvent("AUTH_ATTEMPT", map[string]interface{}{
+		logSecurityEvent(r.Context(), "AUTH_ATTEMPT", map[string]interface{}{
 			"extensionId":      extensionID,
 			"extensionVersion": extensionVersion,
 			"fingerprint":      fingerprint,
-			"requestId":        requestID,
 			"endpoint":         r.URL.Path,
 			"method":           r.Method,
 			"userAgent":        r.Header.Get("User-Agent"),
@@ -100,44 +75,89 @@ func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 
 		// Validate required headers
 		if token == "" || extensionID == "" {
-			http.Error(w, "Missing authentication headers", http.StatusUnauthorized)
+			logSecurityEvent(r.Context(), "MISSING_AUTH_HEADERS", map[string]interface{}{
+				"extensionId": extensionID,
+				"endpoint":    r.URL.Path,
+			})
+			writeError(w, http.StatusUnauthorized, ERR_MISSING_CREDENTIALS, "Missing authentication headers", nil)
 			return
 		}
 
-		// Validate token format and signature
-		if !validateTokenFormat(token, extensionID, fingerprint) {
-			logSecurityEvent("INVALID_TOKEN", map[string]interface{}{
+		// Validate token signature and claims
+		claims, err := verifyExtensionToken(token, extensionID, fingerprint)
+		if err != nil {
+			logSecurityEvent(r.Context(), "INVALID_TOKEN", map[string]interface{}{
 				"extensionId": extensionID,
 				"token":       token[:min(len(token), 20)] + "...",
-				"reason":      "invalid_format_or_signature",
+				"reason":      err.Error(),
 			})
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			writeError(w, http.StatusUnauthorized, ERR_INVALID_TOKEN, "Invalid token", nil)
+			return
+		}
+
+		// Reject tokens that have already been exchanged for a new one
+		if nonceStore.Seen(tokenNonceKey(claims)) {
+			logSecurityEvent(r.Context(), "TOKEN_REPLAY", map[string]interface{}{
+				"extensionId": extensionID,
+				"tokenId":     claims.ID,
+				"endpoint":    r.URL.Path,
+			})
+			writeError(w, http.StatusUnauthorized, ERR_TOKEN_REFRESHED, "Token has been refreshed", nil)
 			return
 		}
 
 		// Check if extension is registered and active
-		session := getExtensionSession(extensionID)
-		if session == nil || !session.IsActive {
-			logSecurityEvent("UNREGISTERED_EXTENSION", map[string]interface{}{
+		session := getExtensionSession(r.Context(), extensionID)
+		if session == nil {
+			logSecurityEvent(r.Context(), "UNREGISTERED_EXTENSION", map[string]interface{}{
+				"extensionId": extensionID,
+				"registered":  false,
+				"active":      false,
+			})
+			writeError(w, http.StatusUnauthorized, ERR_NOT_REGISTERED, "Extension not registered or inactive", nil)
+			return
+		}
+		if ban := findBan(r.Context(), extensionID, session.Identity.Fingerprint); ban != nil {
+			logSecurityEvent(r.Context(), "BANNED_EXTENSION", map[string]interface{}{
+				"extensionId": extensionID,
+				"banKind":     ban.Kind,
+				"endpoint":    r.URL.Path,
+			})
+			writeError(w, http.StatusForbidden, ERR_EXTENSION_BANNED, "Extension banned", nil)
+			return
+		}
+		if !session.IsActive {
+			logSecurityEvent(r.Context(), "SUSPENDED_EXTENSION", map[string]interface{}{
 				"extensionId": extensionID,
-				"registered":  session != nil,
-				"active":      session != nil && session.IsActive,
+				"endpoint":    r.URL.Path,
 			})
-			http.Error(w, "Extension not registered or inactive", http.StatusUnauthorized)
+			writeError(w, http.StatusForbidden, ERR_EXTENSION_SUSPENDED, "Extension suspended", nil)
 			return
 		}
 
-		// Rate limiting
-		if !checkRateLimit(extensionID) {
-			logSecurityEvent("RATE_LIMIT_EXCEEDED", map[string]interface{}{
+		// Reject tokens issued before an admin revoked them
+		if !session.TokensRevokedAt.IsZero() && !claims.Issued().After(session.TokensRevokedAt) {
+			logSecurityEvent(r.Context(), "REVOKED_TOKEN", map[string]interface{}{
 				"extensionId": extensionID,
+				"tokenId":     claims.ID,
 			})
-			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+			writeError(w, http.StatusUnauthorized, ERR_TOKEN_REVOKED, "Token revoked", nil)
 			return
 		}
 
+		// Rate limiting. Routes whose cost depends on the request body charge
+		// it themselves once they have read it.
+		if _, ok := handlerChargedRoutes[r.URL.Path]; !ok {
+			limit := checkRateLimit(extensionID, r.URL.Path)
+			writeRateLimitHeaders(w, limit)
+			if !limit.Allowed {
+				writeRateLimited(w, r, extensionID, limit)
+				return
+			}
+		}
+
 		// Update session activity
-		updateSessionActivity(extensionID)
+		updateSessionActivity(r.Context(), extensionID)
 
 		// Add extension context to request
 		r.Header.Set("X-Validated-Extension-ID", extensionID)
@@ -150,39 +170,94 @@ func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 // Register extension endpoint
 func registerExtensionHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(w)
 		return
 	}
 
 	// Parse registration request
 	var req RegisterRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ERR_INVALID_BODY, "Invalid request body", nil)
 		return
 	}
 
 	// Extract and validate headers
-	token := r.Header.Get("X-Extension-Token")
 	extensionID := r.Header.Get("X-Extension-ID")
 	extensionVersion := r.Header.Get("X-Extension-Version")
 
 	// Validate consistency
 	if req.Identity.ExtensionID != extensionID {
-		logSecurityEvent("REGISTRATION_MISMATCH", map[string]interface{}{
+		logSecurityEvent(r.Context(), "REGISTRATION_MISMATCH", map[string]interface{}{
 			"headerExtensionId": extensionID,
 			"bodyExtensionId":   req.Identity.ExtensionID,
 		})
-		http.Error(w, "Extension ID mismatch", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ERR_INVALID_REGISTRATION, "Extension ID mismatch", nil)
+		return
+	}
+
+	// Reject stale or replayed registration requests
+	skew := time.Now().Unix() - req.Timestamp
+	if skew > REGISTRATION_MAX_SKEW_SECONDS || skew < -REGISTRATION_MAX_SKEW_SECONDS {
+		logSecurityEvent(r.Context(), "REGISTRATION_STALE", map[string]interface{}{
+			"extensionId": extensionID,
+			"timestamp":   req.Timestamp,
+		})
+		writeError(w, http.StatusBadRequest, ERR_INVALID_REGISTRATION, "Registration timestamp out of range", nil)
+		return
+	}
+	if req.Nonce == "" || len(req.Nonce) > MAX_NONCE_LENGTH {
+		writeError(w, http.StatusBadRequest, ERR_INVALID_REGISTRATION, "Invalid registration nonce", nil)
+		return
+	}
+	nonceExpiry := time.Unix(req.Timestamp+REGISTRATION_MAX_SKEW_SECONDS, 0)
+	if !nonceStore.Use("register:"+req.Nonce, nonceExpiry) {
+		logSecurityEvent(r.Context(), "REGISTRATION_REPLAY", map[string]interface{}{
+			"extensionId": extensionID,
+			"nonce":       req.Nonce,
+		})
+		writeError(w, http.StatusConflict, ERR_NONCE_REUSED, "Registration nonce already used", nil)
+		return
+	}
+
+	// Banned and suspended extensions can't register their way back in
+	if ban := findBan(r.Context(), extensionID, req.Identity.Fingerprint); ban != nil {
+		logSecurityEvent(r.Context(), "BANNED_REGISTRATION", map[string]interface{}{
+			"extensionId": extensionID,
+			"banKind":     ban.Kind,
+		})
+		writeError(w, http.StatusForbidden, ERR_EXTENSION_BANNED, "Extension banned", nil)
+		return
+	}
+	existing := getExtensionSession(r.Context(), extensionID)
+	if existing != nil && !existing.IsActive {
+		logSecurityEvent(r.Context(), "SUSPENDED_REGISTRATION", map[string]interface{}{
+			"extensionId": extensionID,
+		})
+		writeError(w, http.StatusForbidden, ERR_EXTENSION_SUSPENDED, "Extension suspended", nil)
 		return
 	}
 
 	// Check if we've reached max extensions
-	if len(extensionRegistry.sessions) >= MAX_EXTENSIONS {
-		logSecurityEvent("MAX_EXTENSIONS_REACHED", map[string]interface{}{
-			"currentCount": len(extensionRegistry.sessions),
-			"maxAllowed":   MAX_EXTENSIONS,
+	sessionCount, err := extensionRegistry.Count()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "counting sessions failed", "error", err)
+		writeError(w, http.StatusServiceUnavailable, ERR_UNAVAILABLE, "Session store unavailable", nil)
+		return
+	}
+	if sessionCount >= config.MaxExtensions {
+		logSecurityEvent(r.Context(), "MAX_EXTENSIONS_REACHED", map[string]interface{}{
+			"currentCount": sessionCount,
+			"maxAllowed":   config.MaxExtensions,
 		})
-		http.Error(w, "Maximum extensions reached", http.StatusServiceUnavailable)
+		writeError(w, http.StatusServiceUnavailable, ERR_CAPACITY_REACHED, "Maximum extensions reached", nil)
+		return
+	}
+
+	// Issue a server-signed token for the extension
+	token, claims, err := issueExtensionToken(req.Identity, time.Now())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "issuing token failed", "extensionId", extensionID, "error", err)
+		writeError(w, http.StatusInternalServerError, ERR_INTERNAL, "Failed to issue token", nil)
 		return
 	}
 
@@ -195,13 +270,19 @@ func registerExtensionHandler(w http.ResponseWriter, r *http.Request) {
 		RequestCount: 0,
 		IsActive:     true,
 	}
+	// Keep an admin revocation so older tokens stay revoked
+	if existing != nil {
+		session.TokensRevokedAt = existing.TokensRevokedAt
+	}
 
 	// Register the extension
-	extensionRegistry.mu.Lock()
-	extensionRegistry.sessions[extensionID] = session
-	extensionRegistry.mu.Unlock()
+	if err := extensionRegistry.Put(session); err != nil {
+		slog.ErrorContext(r.Context(), "storing session failed", "extensionId", extensionID, "error", err)
+		writeError(w, http.StatusInternalServerError, ERR_INTERNAL, "Failed to register extension", nil)
+		return
+	}
 
-	logSecurityEvent("EXTENSION_REGISTERED", map[string]interface{}{
+	logSecurityEvent(r.Context(), "EXTENSION_REGISTERED", map[string]interface{}{
 		"extensionId":      extensionID,
 		"extensionVersion": extensionVersion,
 		"fingerprint":      req.Identity.Fingerprint,
@@ -211,10 +292,13 @@ func registerExtensionHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Return success response
 	response := map[string]interface{}{
-		"success":     true,
-		"message":     "Extension registered successfully",
-		"extensionId": extensionID,
-		"timestamp":   time.Now().Unix(),
+		"success":       true,
+		"message":       "Extension registered successfully",
+		"extensionId":   extensionID,
+		"token":         token,
+		"expiresAt":     claims.ExpiresAt,
+		"refreshWindow": refreshWindowSeconds(),
+		"timestamp":     time.Now().Unix(),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -227,13 +311,13 @@ func validateTokenHandler(w http.ResponseWriter, r *http.Request) {
 	sessionValid := r.Header.Get("X-Session-Valid") == "true"
 
 	if !sessionValid || extensionID == "" {
-		http.Error(w, "Invalid session", http.StatusUnauthorized)
+		writeError(w, http.StatusUnauthorized, ERR_INVALID_TOKEN, "Invalid session", nil)
 		return
 	}
 
-	session := getExtensionSession(extensionID)
+	session := getExtensionSession(r.Context(), extensionID)
 	if session == nil {
-		http.Error(w, "Session not found", http.StatusUnauthorized)
+		writeError(w, http.StatusUnauthorized, ERR_NOT_REGISTERED, "Session not found", nil)
 		return
 	}
 
@@ -249,124 +333,144 @@ func validateTokenHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-// Validate token format and signature
-func validateTokenFormat(token, extensionID, fingerprint string) bool {
-	parts := strings.Split(token, ".")
-	if len(parts) != 2 {
-		return false
+// Token refresh endpoint. Exchanges a valid token in its last
+// config.TokenRefreshWindow for a fresh one; the old token's nonce is
+// recorded so it can't be refreshed or used again.
+func refreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeMethodNotAllowed(w)
+		return
 	}
 
-	// Decode token payload
-	payloadBytes, err := base64.StdEncoding.DecodeString(parts[0])
-	if err != nil {
-		return false
+	extensionID := r.Header.Get("X-Validated-Extension-ID")
+	claims, err := verifyExtensionToken(r.Header.Get("X-Extension-Token"), extensionID, r.Header.Get("X-Extension-Fingerprint"))
+	if extensionID == "" || err != nil {
+		writeError(w, http.StatusUnauthorized, ERR_INVALID_TOKEN, "Invalid session", nil)
+		return
 	}
 
-	var payload TokenPayload
-	if err := json.Unmarshal(payloadBytes, &payload); err != nil {
-		return false
+	now := time.Now()
+	refreshFrom := time.Unix(claims.ExpiresAt, 0).Add(-time.Duration(config.TokenRefreshWindow))
+	if now.Before(refreshFrom) {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(refreshFrom.Sub(now).Seconds())+1))
+		writeError(w, http.StatusConflict, ERR_REFRESH_NOT_DUE, "Token is not due for refresh", map[string]interface{}{
+			"refreshFrom": refreshFrom.Unix(),
+		})
+		return
 	}
 
-	// Validate extension ID matches
-	if payload.ExtensionID != extensionID {
-		return false
+	session := getExtensionSession(r.Context(), extensionID)
+	if session == nil || !session.IsActive {
+		writeError(w, http.StatusUnauthorized, ERR_NOT_REGISTERED, "Session not found", nil)
+		return
 	}
 
-	// Validate token age (24 hours max)
-	if time.Now().Unix()-payload.Timestamp > TOKEN_EXPIRY_HOURS*3600 {
-		return false
+	// Spend the old token's nonce; only one refresh can win a race
+	if !nonceStore.Use(tokenNonceKey(claims), time.Unix(claims.ExpiresAt, 0)) {
+		logSecurityEvent(r.Context(), "TOKEN_REPLAY", map[string]interface{}{
+			"extensionId": extensionID,
+			"tokenId":     claims.ID,
+			"endpoint":    r.URL.Path,
+		})
+		writeError(w, http.StatusUnauthorized, ERR_TOKEN_REFRESHED, "Token has been refreshed", nil)
+		return
 	}
 
-	// Validate signature if fingerprint provided
-	if fingerprint != "" && payload.Fingerprint != fingerprint {
-		return false
+	token, newClaims, err := issueExtensionToken(session.Identity, now)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "issuing token failed", "extensionId", extensionID, "error", err)
+		writeError(w, http.StatusInternalServerError, ERR_INTERNAL, "Failed to issue token", nil)
+		return
+	}
+	session.Token = token
+	if err := extensionRegistry.Put(session); err != nil {
+		slog.ErrorContext(r.Context(), "storing session failed", "extensionId", extensionID, "error", err)
 	}
 
-	// Validate signature
-	expectedSig := generateTokenSignature(parts[0], fingerprint)
-	return parts[1] == expectedSig[:32]
-}
+	logSecurityEvent(r.Context(), "TOKEN_REFRESHED", map[string]interface{}{
+		"extensionId": extensionID,
+		"oldTokenId":  claims.ID,
+		"newTokenId":  newClaims.ID,
+	})
 
-// Generate token signature
-func generateTokenSignature(tokenData, fingerprint string) string {
-	data := tokenData + fingerprint
-	hash := sha256.Sum256([]byte(data))
-	return fmt.Sprintf("%x", hash)
-}
+	response := map[string]interface{}{
+		"success":       true,
+		"extensionId":   extensionID,
+		"token":         token,
+		"expiresAt":     newClaims.ExpiresAt,
+		"refreshWindow": refreshWindowSeconds(),
+		"timestamp":     now.Unix(),
+	}
 
-// Get extension session
-func getExtensionSession(extensionID string) *ExtensionSession {
-	extensionRegistry.mu.RLock()
-	defer extensionRegistry.mu.RUnlock()
-	return extensionRegistry.sessions[extensionID]
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
 
-// Update session activity
-func updateSessionActivity(extensionID string) {
-	extensionRegistry.mu.Lock()
-	defer extensionRegistry.mu.Unlock()
-	
-	if session, exists := extensionRegistry.sessions[extensionID]; exists {
-		session.LastActivity = time.Now()
-		session.RequestCount++
-	}
+// Seconds before expiry that a token can be refreshed, sent with every
+// issued token so clients don't have to hard-code it
+func refreshWindowSeconds() int64 {
+	return int64(time.Duration(config.TokenRefreshWindow).Seconds())
 }
 
-// Rate limiting check
-func checkRateLimit(extensionID string) bool {
-	rateLimiter.mu.Lock()
-	defer rateLimiter.mu.Unlock()
-
-	now := time.Now()
-	oneMinuteAgo := now.Add(-time.Minute)
+// Nonce store key for an issued token
+func tokenNonceKey(claims *TokenClaims) string {
+	return "token:" + claims.ID
+}
 
-	// Initialize if not exists
-	if rateLimiter.requests[extensionID] == nil {
-		rateLimiter.requests[extensionID] = []time.Time{}
+// Get extension session
+func getExtensionSession(ctx context.Context, extensionID string) *ExtensionSession {
+	session, err := extensionRegistry.Get(extensionID)
+	if err != nil {
+		slog.ErrorContext(ctx, "loading session failed", "extensionId", extensionID, "error", err)
+		return nil
 	}
+	return session
+}
 
-	// Remove old requests
-	requests := rateLimiter.requests[extensionID]
-	validRequests := []time.Time{}
-	for _, req := range requests {
-		if req.After(oneMinuteAgo) {
-			validRequests = append(validRequests, req)
-		}
+// Find a ban on an extension ID or fingerprint
+func findBan(ctx context.Context, extensionID, fingerprint string) *Ban {
+	ban, err := extensionRegistry.FindBan(extensionID, fingerprint)
+	if err != nil {
+		slog.ErrorContext(ctx, "checking bans failed", "extensionId", extensionID, "error", err)
+		return nil
 	}
+	return ban
+}
 
-	// Check if under limit
-	if len(validRequests) >= MAX_REQUEST_PER_MIN {
-		return false
+// Update session activity
+func updateSessionActivity(ctx context.Context, extensionID string) {
+	if err := extensionRegistry.RecordActivity(extensionID, time.Now()); err != nil {
+		slog.ErrorContext(ctx, "recording activity failed", "extensionId", extensionID, "error", err)
 	}
+}
 
-	// Add current request
-	validRequests = append(validRequests, now)
-	rateLimiter.requests[extensionID] = validRequests
-
-	return true
+// Rate limiting check
+func checkRateLimit(extensionID, route string) RateLimitResult {
+	return rateLimiter.Allow(extensionID, route)
 }
 
-// Security event logging
-func logSecurityEvent(eventType string, data map[string]interface{}) {
-	data["eventType"] = eventType
-	data["serverTime"] = time.Now().UTC().Format(time.RFC3339)
-	
-	jsonData, _ := json.Marshal(data)
-	log.Printf("SECURITY_EVENT: %s", string(jsonData))
+// Security event logging. Failures are logged as warnings.
+func logSecurityEvent(ctx context.Context, eventType string, data map[string]interface{}) {
+	level := slog.LevelInfo
+	if authFailureEvents[eventType] {
+		authFailuresTotal.Inc(eventType)
+		level = slog.LevelWarn
+	}
+	slog.LogAttrs(ctx, level, "security event", securityEventAttrs(eventType, data)...)
 }
 
 // Extension statistics endpoint
 func extensionStatsHandler(w http.ResponseWriter, r *http.Request) {
 	extensionID := r.Header.Get("X-Validated-Extension-ID")
-	
+
 	if extensionID == "" {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		writeError(w, http.StatusUnauthorized, ERR_INVALID_TOKEN, "Unauthorized", nil)
 		return
 	}
 
-	session := getExtensionSession(extensionID)
+	session := getExtensionSession(r.Context(), extensionID)
 	if session == nil {
-		http.Error(w, "Session not found", http.StatusNotFound)
+		writeError(w, http.StatusNotFound, ERR_NOT_REGISTERED, "Session not found", nil)
 		return
 	}
 
@@ -386,25 +490,20 @@ func extensionStatsHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // Cleanup inactive sessions
-func cleanupInactiveSessions() {
-	ticker := time.NewTicker(1 * time.Hour)
-	go func() {
-		for range ticker.C {
-			extensionRegistry.mu.Lock()
-			now := time.Now()
-			for extensionID, session := range extensionRegistry.sessions {
-				// Remove sessions inactive for more than 7 days
-				if now.Sub(session.LastActivity) > 7*24*time.Hour {
-					delete(extensionRegistry.sessions, extensionID)
-					logSecurityEvent("SESSION_EXPIRED", map[string]interface{}{
-						"extensionId":  extensionID,
-						"lastActivity": session.LastActivity.Unix(),
-					})
-				}
-			}
-			extensionRegistry.mu.Unlock()
+func cleanupInactiveSessions(workers *Workers) {
+	workers.Every(1*time.Hour, func() {
+		// Remove sessions inactive for longer than the configured expiry
+		removed, err := extensionRegistry.DeleteInactive(time.Now().Add(-time.Duration(config.SessionIdleExpiry)))
+		if err != nil {
+			slog.Error("removing inactive sessions failed", "error", err)
+		}
+		for _, session := range removed {
+			logSecurityEvent(context.Background(), "SESSION_EXPIRED", map[string]interface{}{
+				"extensionId":  session.Identity.ExtensionID,
+				"lastActivity": session.LastActivity.Unix(),
+			})
 		}
-	}()
+	})
 }
 
 // Helper function
@@ -413,4 +512,4 @@ func min(a, b int) int {
 		return a
 	}
 	return b
-}
\ No newline at end of file
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Most locations in one /api/weather/batch request. At the default cost of
+// one token per upstream call a full batch takes 30 to 50 of the 120 shared
+// tokens, depending on what the locations include.
+const MAX_BATCH_LOCATIONS = 10
+
+// BatchRequest is the body of POST /api/weather/batch
+type BatchRequest struct {
+	Locations []BatchLocation `json:"locations"`
+}
+
+// BatchLocation is one location of a batch. Its options take the same
+// values as the /api/weather query parameters of the same name.
+type BatchLocation struct {
+	ID           string      `json:"id,omitempty"` // key of the result, "lat,lon" by default
+	Lat          json.Number `json:"lat"`
+	Lon          json.Number `json:"lon"`
+	Hours        json.Number `json:"hours,omitempty"`
+	Days         json.Number `json:"days,omitempty"`
+	Units        string      `json:"units,omitempty"`
+	TempUnit     string      `json:"tempUnit,omitempty"`
+	WindUnit     string      `json:"windUnit,omitempty"`
+	PressureUnit string      `json:"pressureUnit,omitempty"`
+	Include      []string    `json:"include,omitempty"`
+}
+
+// BatchResult is the outcome for one location: the /api/weather response
+// on success, otherwise the error that request would have failed with.
+// Status is the HTTP status /api/weather would have answered with.
+type BatchResult struct {
+	Status int `json:"status"`
+	*WeatherResponse
+	Error *APIError `json:"error,omitempty"`
+}
+
+// BatchResponse is the response of /api/weather/batch, with results keyed
+// by location
+type BatchResponse struct {
+	Results   map[string]BatchResult `json:"results"`
+	Timestamp string                 `json:"timestamp"`
+}
+
+func (l BatchLocation) key() string {
+	if l.ID != "" {
+		return l.ID
+	}
+	return l.Lat.String() + "," + l.Lon.String()
+}
+
+// Query parameters equivalent to the location's options, so they are
+// validated exactly as on /api/weather
+func (l BatchLocation) query() url.Values {
+	query := url.Values{}
+	for name, value := range map[string]string{
+		"lat":          l.Lat.String(),
+		"lon":          l.Lon.String(),
+		"hours":        l.Hours.String(),
+		"days":         l.Days.String(),
+		"units":        l.Units,
+		"tempUnit":     l.TempUnit,
+		"windUnit":     l.WindUnit,
+		"pressureUnit": l.PressureUnit,
+		"include":      strings.Join(l.Include, ","),
+	} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	return query
+}
+
+// Parse a location's options into a combined lookup
+func parseBatchLocation(location BatchLocation, synthetic bool) (combinedRequest, *ParamError) {
+	query := location.query()
+	req := combinedRequest{synthetic: synthetic}
+	var err *ParamError
+	if req.lat, req.lon, err = parseCoordinates(query); err != nil {
+		return req, err
+	}
+	if req.units, err = parseUnits(query); err != nil {
+		return req, err
+	}
+	if req.hours, err = parseCountParam(query, "hours", DEFAULT_FORECAST_HOURS, MAX_FORECAST_HOURS); err != nil {
+		return req, err
+	}
+	if req.days, err = parseCountParam(query, "days", DEFAULT_COMBINED_DAYS, MAX_FORECAST_DAYS); err != nil {
+		return req, err
+	}
+	req.include, err = parseInclude(query, "pollen", "alerts")
+	return req, err
+}
+
+// Fetch one parsed location of a batch, returning its result and cache
+// status
+func fetchBatchLocation(ctx context.Context, provider WeatherProvider, req combinedRequest) (BatchResult, cacheStatus) {
+	resp, status, _, err := fetchCombinedWeather(ctx, provider, req)
+	if err != nil {
+		code, apiErr := upstreamAPIError(err, "Failed to fetch weather data")
+		return BatchResult{Status: code, Error: &apiErr}, ""
+	}
+	return BatchResult{Status: http.StatusOK, WeatherResponse: resp}, status
+}
+
+// Combined weather for several locations in one request. Locations are
+// fetched concurrently through the shared cache and fail independently;
+// the request itself only fails when the body is invalid. lang and fallback
+// are query parameters and apply to every location.
+func weatherBatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w)
+		return
+	}
+	provider := newWeatherProvider(config)
+	if provider == nil {
+		writeError(w, http.StatusInternalServerError, ERR_NOT_CONFIGURED, "API key not configured", nil)
+		return
+	}
+
+	query := r.URL.Query()
+	lang, paramErr := parseLanguage(query)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+	synthetic, paramErr := parseFallback(query)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+
+	var req BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, ERR_INVALID_BODY, "Invalid request body", nil)
+		return
+	}
+	if len(req.Locations) == 0 || len(req.Locations) > MAX_BATCH_LOCATIONS {
+		writeError(w, http.StatusBadRequest, ERR_INVALID_BODY,
+			fmt.Sprintf("locations must have 1 to %d entries", MAX_BATCH_LOCATIONS),
+			map[string]interface{}{"maxLocations": MAX_BATCH_LOCATIONS})
+		return
+	}
+	keys := make([]string, len(req.Locations))
+	seen := make(map[string]bool)
+	for i, location := range req.Locations {
+		keys[i] = location.key()
+		if seen[keys[i]] {
+			writeError(w, http.StatusBadRequest, ERR_INVALID_BODY, "Duplicate location "+keys[i],
+				map[string]interface{}{"location": keys[i]})
+			return
+		}
+		seen[keys[i]] = true
+	}
+
+	// Invalid locations fail on their own without an upstream call
+	results := make([]BatchResult, len(req.Locations))
+	lookups := make([]combinedRequest, len(req.Locations))
+	calls := 0
+	for i, location := range req.Locations {
+		lookup, paramErr := parseBatchLocation(location, synthetic)
+		if paramErr != nil {
+			apiErr := newAPIError(paramErr.Code, paramErr.Message, paramErr.Details)
+			results[i] = BatchResult{Status: http.StatusBadRequest, Error: &apiErr}
+			continue
+		}
+		lookups[i] = lookup
+		calls += combinedUpstreamCalls(lookup)
+	}
+
+	// Charge every upstream call at once, before any is made, and at least
+	// one token when there are none
+	if !chargeRequest(w, r, max(calls, 1)) {
+		return
+	}
+
+	ctx := withLanguage(r.Context(), lang)
+	statuses := make([]cacheStatus, len(req.Locations))
+	var wg sync.WaitGroup
+	for i := range req.Locations {
+		if results[i].Error != nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], statuses[i] = fetchBatchLocation(ctx, provider, lookups[i])
+		}()
+	}
+	wg.Wait()
+
+	resp := BatchResponse{
+		Results:   make(map[string]BatchResult, len(keys)),
+		Timestamp: time.Now().Format(time.RFC3339),
+	}
+	var answered []cacheStatus
+	for i, key := range keys {
+		resp.Results[key] = results[i]
+		if statuses[i] != "" {
+			answered = append(answered, statuses[i])
+		}
+	}
+	w.Header().Set("X-Cache", string(combineCacheStatus(answered...)))
+	writeJSON(w, resp)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func postBatch(t *testing.T, target, body string, extensionID string) (*httptest.ResponseRecorder, BatchResponse) {
+	t.Helper()
+	r := httptest.NewRequest("POST", target, strings.NewReader(body))
+	if extensionID != "" {
+		r.Header.Set("X-Validated-Extension-ID", extensionID)
+	}
+	w := httptest.NewRecorder()
+	weatherBatchHandler(w, r)
+	var resp BatchResponse
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+	}
+	return w, resp
+}
+
+// Test that locations are fetched with their own options through the
+// shared cache, and fail on their own
+func TestWeatherBatchHandler(t *testing.T) {
+	weatherCache = newResponseCache()
+
+	var upstreamCalls atomic.Int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/currentConditions:lookup":
+			if r.URL.Query().Get("location.latitude") == "10" {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			json.NewEncoder(w).Encode(mockGoogleWeatherResponse())
+		case "/forecast/hours:lookup", "/forecast/days:lookup":
+			if r.URL.Query().Get("location.latitude") == "10" {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			if r.URL.Path == "/forecast/days:lookup" {
+				if got := r.URL.Query().Get("days"); got != "3" && got != "5" {
+					t.Errorf("Unexpected days %q", got)
+				}
+				w.Write([]byte(`{"forecastDays": [{"displayDate": {"year": 2025, "month": 1, "day": 1}}]}`))
+				return
+			}
+			w.Write([]byte(`{"forecastHours": [{"interval": {"startTime": "2025-01-01T10:00:00Z"}, "temperature": {"degrees": 10, "unit": "CELSIUS"}}]}`))
+		}
+	}))
+	defer mockServer.Close()
+
+	originalBase := GOOGLE_WEATHER_BASE
+	GOOGLE_WEATHER_BASE = mockServer.URL
+	defer func() { GOOGLE_WEATHER_BASE = originalBase }()
+	setTestConfig(t, func(c *Config) { c.GoogleAPIKey = "test-key" })
+
+	w, resp := postBatch(t, "/api/weather/batch", `{"locations": [
+	  {"id": "home", "lat": 51.5074, "lon": -0.1278, "units": "imperial", "days": 3},
+	  {"lat": 51.5075, "lon": -0.1279},
+	  {"id": "down", "lat": 10, "lon": 10},
+	  {"id": "bad", "lat": 91, "lon": 0}
+	]}`, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(resp.Results) != 4 {
+		t.Fatalf("Expected 4 results, got %v", resp.Results)
+	}
+
+	home := resp.Results["home"]
+	if home.Status != http.StatusOK || home.WeatherResponse == nil || home.Current.Temperature.Unit != UNIT_FAHRENHEIT {
+		t.Errorf("Expected home in fahrenheit, got %+v", home)
+	}
+	// The second location rounds to the same cache keys as the first
+	nearby := resp.Results["51.5075,-0.1279"]
+	if nearby.Status != http.StatusOK || nearby.Current.Temperature.Unit != UNIT_CELSIUS {
+		t.Errorf("Expected the nearby location in celsius, got %+v", nearby)
+	}
+	if down := resp.Results["down"]; down.Status != http.StatusServiceUnavailable || down.Error == nil || down.Error.Code != ERR_UPSTREAM_ERROR {
+		t.Errorf("Expected an upstream error for the failing location, got %+v", down)
+	}
+	if bad := resp.Results["bad"]; bad.Status != http.StatusBadRequest || bad.Error == nil || bad.Error.Details["parameter"] != "lat" {
+		t.Errorf("Expected a lat error, got %+v", bad)
+	}
+	// current, hourly, 3 and 5 days for London, and three failures
+	if upstreamCalls.Load() != 7 {
+		t.Errorf("Expected 7 upstream calls, got %d", upstreamCalls.Load())
+	}
+
+	for _, body := range []string{
+		`{"locations": []}`,
+		`{"locations": [{"lat": 1, "lon": 2}, {"lat": 1, "lon": 2}]}`,
+		`{"locations": [` + strings.Repeat(`{"lat": 1, "lon": 2},`, MAX_BATCH_LOCATIONS) + `{"lat": 3, "lon": 4}]}`,
+		`not json`,
+	} {
+		if w, _ := postBatch(t, "/api/weather/batch", body, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, w.Code)
+		}
+	}
+}
+
+// Test that a batch is charged per upstream call in one go
+func TestWeatherBatchRateLimit(t *testing.T) {
+	weatherCache = newResponseCache()
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(mockGoogleWeatherResponse())
+	}))
+	defer mockServer.Close()
+
+	originalBase, originalLimiter := GOOGLE_WEATHER_BASE, rateLimiter
+	GOOGLE_WEATHER_BASE = mockServer.URL
+	rateLimiter = NewRateLimiter(map[string]RateLimitRule{
+		RATE_LIMIT_DEFAULT_ROUTE: {Limit: 20, Cost: 1},
+		"/api/weather/batch":     {Cost: 1},
+	})
+	defer func() { GOOGLE_WEATHER_BASE, rateLimiter = originalBase, originalLimiter }()
+	setTestConfig(t, func(c *Config) { c.GoogleAPIKey = "test-key" })
+
+	// Three calls per location, one more each for pollen and alerts, and
+	// nothing for an invalid location
+	locations := `{"locations": [{"lat": 1, "lon": 2}, {"lat": 3, "lon": 4, "include": ["pollen", "alerts"]}, {"lat": 5, "lon": 6, "include": ["alerts"]}, {"lat": 91, "lon": 0}]}`
+	w, _ := postBatch(t, "/api/weather/batch", locations, "test-extension")
+	if w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Remaining") != "8" {
+		t.Errorf("Expected 200 with 8 tokens left, got %d with %s", w.Code, w.Header().Get("X-RateLimit-Remaining"))
+	}
+	w, _ = postBatch(t, "/api/weather/batch", locations, "test-extension")
+	if apiErr := decodeAPIError(t, w); w.Code != http.StatusTooManyRequests || apiErr.Code != ERR_RATE_LIMITED {
+		t.Errorf("Expected 429, got %d %+v", w.Code, apiErr)
+	}
+	// A rejected charge takes nothing
+	if result := rateLimiter.AllowN("test-extension", "/api/weather/batch", 8); !result.Allowed || result.Remaining != 0 {
+		t.Errorf("Expected 8 calls to still fit, got %+v", result)
+	}
+}
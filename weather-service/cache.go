@@ -0,0 +1,429 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upstream cache configuration. Coordinates are rounded to CACHE_COORD_DECIMALS
+// places (2 decimals is roughly 1 km) so installs in the same area share
+// entries. Each data type gets a TTL matching how often it actually changes.
+// Place lookups have their own, smaller cache, so autocomplete prefixes
+// can't crowd out weather data.
+const (
+	CACHE_COORD_DECIMALS           = 2
+	CACHE_TTL_CURRENT              = 10 * time.Minute
+	CACHE_TTL_HOURLY               = 30 * time.Minute
+	CACHE_TTL_HISTORY              = 1 * time.Hour
+	CACHE_TTL_DAILY                = 3 * time.Hour
+	CACHE_TTL_GEOCODE              = 24 * time.Hour
+	CACHE_TTL_AIR_QUALITY          = 30 * time.Minute
+	CACHE_TTL_AIR_QUALITY_FORECAST = 1 * time.Hour
+	CACHE_TTL_POLLEN               = 3 * time.Hour
+	CACHE_TTL_ALERTS               = 5 * time.Minute
+	CACHE_TTL_PLACES               = 7 * 24 * time.Hour
+	CACHE_TTL_TIME_ZONE            = 30 * 24 * time.Hour
+	CACHE_MAX_ENTRIES              = 50000
+	CACHE_MAX_PLACES               = 10000
+)
+
+// How long the last good weather data for a location is kept to answer
+// with when the upstream fails. Older data is worse than none.
+const CACHE_STALE_MAX_AGE = 12 * time.Hour
+
+// Cache lookup outcome, reported to clients in the X-Cache header
+type cacheStatus string
+
+const (
+	cacheHit       cacheStatus = "HIT"
+	cacheMiss      cacheStatus = "MISS"
+	cacheCoalesced cacheStatus = "COALESCED"
+	cacheStale     cacheStatus = "STALE"
+)
+
+type cacheEntry struct {
+	value   interface{}
+	expires time.Time
+	fetched time.Time // set on last good values only
+}
+
+// lruEntry is a cached value in the recency list
+type lruEntry struct {
+	key string
+	cacheEntry
+}
+
+// flightCall is an in-progress upstream request that other callers can wait on
+type flightCall struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// In-process TTL cache for upstream responses. Concurrent misses for the same
+// key share a single upstream request. When full, expired entries are
+// evicted first, then the least recently used.
+type ResponseCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element // of *lruEntry
+	recent     *list.List               // most recently used first
+	flights    map[string]*flightCall
+	lastGood   map[string]cacheEntry // last value of FetchOrStale keys, kept past their TTL
+}
+
+func newResponseCache() *ResponseCache {
+	return newBoundedResponseCache(CACHE_MAX_ENTRIES)
+}
+
+func newBoundedResponseCache(maxEntries int) *ResponseCache {
+	return &ResponseCache{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		recent:     list.New(),
+		flights:    make(map[string]*flightCall),
+		lastGood:   make(map[string]cacheEntry),
+	}
+}
+
+var (
+	weatherCache = newResponseCache()
+	placesCache  = newBoundedResponseCache(CACHE_MAX_PLACES)
+)
+
+// Return the cached value for key, or call fetch and cache its result for
+// ttl. Errors are never cached. If another caller is already fetching the
+// same key, wait for its result instead of making a second request.
+//
+// The upstream fetch runs detached from ctx so that one caller giving up
+// doesn't fail everyone waiting on the same key; it is bounded by the
+// upstream client timeout instead and still fills the cache when it
+// completes. Each caller stops waiting as soon as its own ctx is done.
+func (c *ResponseCache) Fetch(ctx context.Context, key string, ttl time.Duration, fetch func(context.Context) (interface{}, error)) (interface{}, cacheStatus, error) {
+	c.mu.Lock()
+	if element, ok := c.entries[key]; ok {
+		if entry := element.Value.(*lruEntry); time.Now().Before(entry.expires) {
+			c.recent.MoveToFront(element)
+			c.mu.Unlock()
+			return entry.value, cacheHit, nil
+		}
+	}
+	call, inFlight := c.flights[key]
+	if !inFlight {
+		call = &flightCall{done: make(chan struct{})}
+		c.flights[key] = call
+		go c.runFlight(context.WithoutCancel(ctx), key, ttl, call, fetch)
+	}
+	c.mu.Unlock()
+
+	status := cacheMiss
+	if inFlight {
+		status = cacheCoalesced
+	}
+
+	select {
+	case <-call.done:
+		return call.value, status, call.err
+	case <-ctx.Done():
+		return nil, status, ctx.Err()
+	}
+}
+
+// Like Fetch, but when the upstream fails and a value for key was fetched
+// within CACHE_STALE_MAX_AGE, return that value with status STALE and the
+// time it was fetched instead of the error
+func (c *ResponseCache) FetchOrStale(ctx context.Context, key string, ttl time.Duration, fetch func(context.Context) (interface{}, error)) (interface{}, cacheStatus, time.Time, error) {
+	value, status, err := c.Fetch(ctx, key, ttl, func(ctx context.Context) (interface{}, error) {
+		value, err := fetch(ctx)
+		if err == nil {
+			c.keepLastGood(key, value)
+		}
+		return value, err
+	})
+	if err == nil {
+		return value, status, time.Time{}, nil
+	}
+
+	c.mu.Lock()
+	entry, ok := c.lastGood[key]
+	c.mu.Unlock()
+	if !ok || !time.Now().Before(entry.expires) {
+		return nil, status, time.Time{}, err
+	}
+	endpoint, _, _ := strings.Cut(key, ":")
+	staleResponsesTotal.Inc(endpoint)
+	slog.WarnContext(ctx, "upstream failed, serving stale data", "key", key, "fetched", entry.fetched, "error", err)
+	return entry.value, cacheStale, entry.fetched, nil
+}
+
+func (c *ResponseCache) keepLastGood(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if _, ok := c.lastGood[key]; !ok && len(c.lastGood) >= CACHE_MAX_ENTRIES {
+		evictExpiredEntries(c.lastGood, now)
+		if len(c.lastGood) >= CACHE_MAX_ENTRIES {
+			return
+		}
+	}
+	c.lastGood[key] = cacheEntry{value: value, expires: now.Add(CACHE_STALE_MAX_AGE), fetched: now}
+}
+
+func (c *ResponseCache) runFlight(ctx context.Context, key string, ttl time.Duration, call *flightCall, fetch func(context.Context) (interface{}, error)) {
+	defer func() {
+		if r := recover(); r != nil {
+			call.value, call.err = nil, fmt.Errorf("upstream fetch for %s panicked: %v", key, r)
+		}
+
+		c.mu.Lock()
+		delete(c.flights, key)
+		if call.err == nil {
+			c.storeLocked(key, cacheEntry{value: call.value, expires: time.Now().Add(ttl)})
+		}
+		c.mu.Unlock()
+		close(call.done)
+	}()
+
+	call.value, call.err = fetch(ctx)
+}
+
+// Cache entry under key, making room when the cache is full
+func (c *ResponseCache) storeLocked(key string, entry cacheEntry) {
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*lruEntry).cacheEntry = entry
+		c.recent.MoveToFront(element)
+		return
+	}
+	if len(c.entries) >= c.maxEntries {
+		c.evictExpiredLocked(time.Now())
+	}
+	for len(c.entries) >= c.maxEntries {
+		c.removeLocked(c.recent.Back())
+	}
+	c.entries[key] = c.recent.PushFront(&lruEntry{key: key, cacheEntry: entry})
+}
+
+func (c *ResponseCache) removeLocked(element *list.Element) {
+	c.recent.Remove(element)
+	delete(c.entries, element.Value.(*lruEntry).key)
+}
+
+// Remove expired entries, and last good values too old to serve
+func (c *ResponseCache) EvictExpired() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	return c.evictExpiredLocked(now) + evictExpiredEntries(c.lastGood, now)
+}
+
+func (c *ResponseCache) evictExpiredLocked(now time.Time) int {
+	evicted := 0
+	for _, element := range c.entries {
+		if !now.Before(element.Value.(*lruEntry).expires) {
+			c.removeLocked(element)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+func evictExpiredEntries(entries map[string]cacheEntry, now time.Time) int {
+	evicted := 0
+	for key, entry := range entries {
+		if !now.Before(entry.expires) {
+			delete(entries, key)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// Number of cached entries, including expired ones not yet evicted
+func (c *ResponseCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// Periodically evict expired cache entries
+func cleanupExpiredCache(workers *Workers) {
+	workers.Every(5*time.Minute, func() {
+		if evicted := weatherCache.EvictExpired() + placesCache.EvictExpired(); evicted > 0 {
+			slog.Info("evicted expired cache entries", "count", evicted)
+		}
+	})
+}
+
+// Round a coordinate to CACHE_COORD_DECIMALS places. Unparseable values are
+// used verbatim so they still get a (useless but harmless) key.
+func quantizeCoordinate(value string) string {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return value
+	}
+	return strconv.FormatFloat(f, 'f', CACHE_COORD_DECIMALS, 64)
+}
+
+// Build a cache key from an endpoint, a location and extra parameters
+func locationCacheKey(endpoint, lat, lon string, params ...string) string {
+	key := fmt.Sprintf("%s:%s,%s", endpoint, quantizeCoordinate(lat), quantizeCoordinate(lon))
+	if len(params) > 0 {
+		key += ":" + strings.Join(params, ":")
+	}
+	return key
+}
+
+// Cached wrappers around WeatherProvider lookups. Weather data is fetched
+// once per location in the default language and localized from the
+// condition catalog after the cache; lookups whose text only the provider
+// can translate (geocoding, places, alerts) keep the language in ctx in
+// their keys. Weather data falls back to the last good value when the
+// upstream fails, labelled stale with its age.
+
+// ctx with the default language, for upstream lookups shared by every
+// language
+func defaultLanguage(ctx context.Context) context.Context {
+	return withLanguage(ctx, supportedLanguages[0])
+}
+
+type hourlyResult struct {
+	hourly   []HourlyForecast
+	timeZone *TimeZone
+}
+
+type dailyResult struct {
+	daily    []DailyForecast
+	timeZone *TimeZone
+}
+
+func cachedCurrentConditions(ctx context.Context, provider WeatherProvider, lat, lon string) (*CurrentConditions, cacheStatus, error) {
+	value, status, fetched, err := weatherCache.FetchOrStale(ctx, locationCacheKey("current", lat, lon), CACHE_TTL_CURRENT, func(ctx context.Context) (interface{}, error) {
+		return provider.CurrentConditions(defaultLanguage(ctx), lat, lon)
+	})
+	if err != nil {
+		return nil, status, err
+	}
+	current := value.(*CurrentConditions)
+	if status == cacheStale {
+		labelled := *current
+		labelled.Freshness = staleFreshness(fetched)
+		current = &labelled
+	}
+	return current, status, nil
+}
+
+func cachedHourlyForecast(ctx context.Context, provider WeatherProvider, lat, lon, hours string) ([]HourlyForecast, *TimeZone, cacheStatus, error) {
+	value, status, fetched, err := weatherCache.FetchOrStale(ctx, locationCacheKey("hourly", lat, lon, hours), CACHE_TTL_HOURLY, func(ctx context.Context) (interface{}, error) {
+		hourly, timeZone, err := provider.HourlyForecast(defaultLanguage(ctx), lat, lon, hours)
+		return hourlyResult{hourly, timeZone}, err
+	})
+	if err != nil {
+		return nil, nil, status, err
+	}
+	result := value.(hourlyResult)
+	if status == cacheStale {
+		return hourlyWithFreshness(result.hourly, staleFreshness(fetched)), result.timeZone, status, nil
+	}
+	return result.hourly, result.timeZone, status, nil
+}
+
+func cachedHourlyHistory(ctx context.Context, provider WeatherProvider, lat, lon, hours string) ([]HourlyForecast, *TimeZone, cacheStatus, error) {
+	value, status, fetched, err := weatherCache.FetchOrStale(ctx, locationCacheKey("history", lat, lon, hours), CACHE_TTL_HISTORY, func(ctx context.Context) (interface{}, error) {
+		hourly, timeZone, err := provider.HourlyHistory(defaultLanguage(ctx), lat, lon, hours)
+		return hourlyResult{hourly, timeZone}, err
+	})
+	if err != nil {
+		return nil, nil, status, err
+	}
+	result := value.(hourlyResult)
+	if status == cacheStale {
+		return hourlyWithFreshness(result.hourly, staleFreshness(fetched)), result.timeZone, status, nil
+	}
+	return result.hourly, result.timeZone, status, nil
+}
+
+func cachedDailyForecast(ctx context.Context, provider WeatherProvider, lat, lon, days string) ([]DailyForecast, *TimeZone, cacheStatus, error) {
+	value, status, fetched, err := weatherCache.FetchOrStale(ctx, locationCacheKey("daily", lat, lon, days), CACHE_TTL_DAILY, func(ctx context.Context) (interface{}, error) {
+		daily, timeZone, err := provider.DailyForecast(defaultLanguage(ctx), lat, lon, days)
+		return dailyResult{daily, timeZone}, err
+	})
+	if err != nil {
+		return nil, nil, status, err
+	}
+	result := value.(dailyResult)
+	if status == cacheStale {
+		return dailyWithFreshness(result.daily, staleFreshness(fetched)), result.timeZone, status, nil
+	}
+	return result.daily, result.timeZone, status, nil
+}
+
+func cachedGeocode(ctx context.Context, provider WeatherProvider, address string) (*GeocodeResponse, cacheStatus, error) {
+	key := "geocode:" + languageFromContext(ctx) + ":" + strings.ToLower(strings.TrimSpace(address))
+	value, status, err := weatherCache.Fetch(ctx, key, CACHE_TTL_GEOCODE, func(ctx context.Context) (interface{}, error) {
+		return provider.Geocode(ctx, address)
+	})
+	if err != nil {
+		return nil, status, err
+	}
+	return value.(*GeocodeResponse), status, nil
+}
+
+func cachedAlerts(ctx context.Context, provider WeatherProvider, lat, lon string) ([]WeatherAlert, cacheStatus, error) {
+	value, status, err := weatherCache.Fetch(ctx, locationCacheKey("alerts", lat, lon, languageFromContext(ctx)), CACHE_TTL_ALERTS, func(ctx context.Context) (interface{}, error) {
+		return provider.Alerts(ctx, lat, lon)
+	})
+	if err != nil {
+		return nil, status, err
+	}
+	return value.([]WeatherAlert), status, nil
+}
+
+// Place lookups fill in time zones after the cache, from a cache of their
+// own, so a failed time zone lookup isn't kept with the places
+
+func cachedReverseGeocode(ctx context.Context, provider WeatherProvider, lat, lon string) ([]Place, cacheStatus, error) {
+	value, status, err := placesCache.Fetch(ctx, locationCacheKey("reverse_geocode", lat, lon, languageFromContext(ctx)), CACHE_TTL_PLACES, func(ctx context.Context) (interface{}, error) {
+		return provider.ReverseGeocode(ctx, lat, lon)
+	})
+	if err != nil {
+		return nil, status, err
+	}
+	return withTimeZones(ctx, slices.Clone(value.([]Place))), status, nil
+}
+
+func cachedAutocomplete(ctx context.Context, provider WeatherProvider, text string) ([]Place, cacheStatus, error) {
+	key := "autocomplete:" + languageFromContext(ctx) + ":" + strings.ToLower(text)
+	value, status, err := placesCache.Fetch(ctx, key, CACHE_TTL_PLACES, func(ctx context.Context) (interface{}, error) {
+		return provider.Autocomplete(ctx, text)
+	})
+	if err != nil {
+		return nil, status, err
+	}
+	return withTimeZones(ctx, slices.Clone(value.([]Place))), status, nil
+}
+
+// Combine the statuses of several lookups into one X-Cache value: STALE if
+// any lookup fell back to stale data, HIT only if every lookup was served
+// from cache
+func combineCacheStatus(statuses ...cacheStatus) cacheStatus {
+	combined := cacheHit
+	for _, s := range statuses {
+		switch {
+		case s == cacheStale:
+			return cacheStale
+		case s == cacheMiss:
+			combined = cacheMiss
+		case s == cacheCoalesced && combined == cacheHit:
+			combined = cacheCoalesced
+		}
+	}
+	return combined
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Test basic hit/miss behaviour and expiry
+func TestResponseCacheHitMiss(t *testing.T) {
+	cache := newResponseCache()
+	calls := 0
+	fetch := func(context.Context) (interface{}, error) {
+		calls++
+		return "value", nil
+	}
+
+	if _, status, _ := cache.Fetch(context.Background(), "key", time.Minute, fetch); status != cacheMiss {
+		t.Errorf("First lookup should be a miss, got %s", status)
+	}
+	value, status, _ := cache.Fetch(context.Background(), "key", time.Minute, fetch)
+	if status != cacheHit || value != "value" {
+		t.Errorf("Second lookup should be a hit, got %s (%v)", status, value)
+	}
+	if calls != 1 {
+		t.Errorf("Expected 1 upstream call, got %d", calls)
+	}
+
+	// Expired entries are refetched and evicted
+	cache.Fetch(context.Background(), "short", time.Nanosecond, fetch)
+	time.Sleep(time.Millisecond)
+	if _, status, _ := cache.Fetch(context.Background(), "short", time.Nanosecond, fetch); status != cacheMiss {
+		t.Errorf("Expired entry should be a miss, got %s", status)
+	}
+	time.Sleep(time.Millisecond)
+	if evicted := cache.EvictExpired(); evicted != 1 {
+		t.Errorf("Expected 1 evicted entry, got %d", evicted)
+	}
+
+	// Errors are not cached
+	failing := func(context.Context) (interface{}, error) { return nil, errors.New("upstream down") }
+	cache.Fetch(context.Background(), "error", time.Minute, failing)
+	if _, status, err := cache.Fetch(context.Background(), "error", time.Minute, failing); status != cacheMiss || err == nil {
+		t.Errorf("Errors should not be cached, got %s (%v)", status, err)
+	}
+}
+
+// Test that a full cache evicts expired entries first, then the least
+// recently used
+func TestResponseCacheEviction(t *testing.T) {
+	cache := newBoundedResponseCache(3)
+	fetch := func(context.Context) (interface{}, error) { return "value", nil }
+
+	cache.Fetch(context.Background(), "a", time.Minute, fetch)
+	cache.Fetch(context.Background(), "b", time.Minute, fetch)
+	cache.Fetch(context.Background(), "expired", time.Nanosecond, fetch)
+	time.Sleep(time.Millisecond)
+	cache.Fetch(context.Background(), "c", time.Minute, fetch)
+	if cache.Len() != 3 {
+		t.Errorf("Expected 3 entries, got %d", cache.Len())
+	}
+
+	// a is used again, so b is the least recently used
+	cache.Fetch(context.Background(), "a", time.Minute, fetch)
+	cache.Fetch(context.Background(), "d", time.Minute, fetch)
+	for _, key := range []string{"a", "c", "d"} {
+		if _, status, _ := cache.Fetch(context.Background(), key, time.Minute, fetch); status != cacheHit {
+			t.Errorf("%s: expected a hit, got %s", key, status)
+		}
+	}
+	if _, status, _ := cache.Fetch(context.Background(), "b", time.Minute, fetch); status != cacheMiss {
+		t.Errorf("Expected b to have been evicted, got %s", status)
+	}
+}
+
+// Test that concurrent misses collapse into a single upstream call
+func TestResponseCacheCoalescing(t *testing.T) {
+	cache := newResponseCache()
+	var calls int32
+	release := make(chan struct{})
+
+	fetch := func(context.Context) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return 42, nil
+	}
+
+	var wg sync.WaitGroup
+	statuses := make([]cacheStatus, 10)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			value, status, err := cache.Fetch(context.Background(), "shared", time.Minute, fetch)
+			if err != nil || value != 42 {
+				t.Errorf("Unexpected result %v (%v)", value, err)
+			}
+			statuses[i] = status
+		}(i)
+	}
+
+	// Give every goroutine time to join the in-flight call
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("Expected 1 upstream call for concurrent misses, got %d", calls)
+	}
+	misses := 0
+	for _, s := range statuses {
+		if s == cacheMiss {
+			misses++
+		}
+	}
+	if misses != 1 {
+		t.Errorf("Expected exactly 1 MISS, got %d", misses)
+	}
+}
+
+// Test coordinate quantisation in cache keys
+func TestLocationCacheKey(t *testing.T) {
+	a := locationCacheKey("current", "37.77491", "-122.41942")
+	b := locationCacheKey("current", "37.7712", "-122.4171")
+	if a != b {
+		t.Errorf("Nearby coordinates should share a key: %s vs %s", a, b)
+	}
+	if a == locationCacheKey("daily", "37.77491", "-122.41942") {
+		t.Error("Different endpoints should not share a key")
+	}
+	if locationCacheKey("hourly", "1", "2", "24") == locationCacheKey("hourly", "1", "2", "48") {
+		t.Error("Different parameters should not share a key")
+	}
+}
+
+// Test the X-Cache header on the combined endpoint
+func TestWeatherHandlerCacheHeader(t *testing.T) {
+	weatherCache = newResponseCache()
+
+	var upstreamCalls int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upstreamCalls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/currentConditions:lookup":
+			json.NewEncoder(w).Encode(mockGoogleWeatherResponse())
+		case "/forecast/hours:lookup":
+			w.Write([]byte(`{"forecastHours": [{"interval": {"startTime": "2025-01-01T10:00:00Z"}, "temperature": {"degrees": 10, "unit": "CELSIUS"}}]}`))
+		case "/forecast/days:lookup":
+			w.Write([]byte(`{"forecastDays": [{"displayDate": {"year": 2025, "month": 1, "day": 1}}]}`))
+		}
+	}))
+	defer mockServer.Close()
+
+	originalBase := GOOGLE_WEATHER_BASE
+	GOOGLE_WEATHER_BASE = mockServer.URL
+	defer func() { GOOGLE_WEATHER_BASE = originalBase }()
+
+	setTestConfig(t, func(c *Config) { c.GoogleAPIKey = "test-key" })
+
+	req := httptest.NewRequest("GET", "/api/weather?lat=40.7128&lon=-74.0060", nil)
+	w := httptest.NewRecorder()
+	weatherHandler(w, req)
+	if got := w.Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("Expected X-Cache MISS, got %q", got)
+	}
+
+	// A request a few hundred metres away is served from cache
+	req = httptest.NewRequest("GET", "/api/weather?lat=40.7131&lon=-74.0058", nil)
+	w = httptest.NewRecorder()
+	weatherHandler(w, req)
+	if got := w.Header().Get("X-Cache"); got != "HIT" {
+		t.Errorf("Expected X-Cache HIT, got %q (%s)", got, w.Header().Get("X-Cache-Detail"))
+	}
+
+	if upstreamCalls != 3 {
+		t.Errorf("Expected 3 upstream calls in total, got %d", upstreamCalls)
+	}
+}
+
+// Test that failed lookups fall back to the last good value until it is
+// too old
+func TestResponseCacheFetchOrStale(t *testing.T) {
+	cache := newResponseCache()
+	fetched := func(context.Context) (interface{}, error) { return "value", nil }
+	failing := func(context.Context) (interface{}, error) { return nil, errors.New("upstream down") }
+
+	if _, _, _, err := cache.FetchOrStale(context.Background(), "current:1", time.Nanosecond, failing); err == nil {
+		t.Error("Expected the error with no value to fall back on")
+	}
+	cache.FetchOrStale(context.Background(), "current:1", time.Nanosecond, fetched)
+	time.Sleep(time.Millisecond)
+	value, status, at, err := cache.FetchOrStale(context.Background(), "current:1", time.Nanosecond, failing)
+	if err != nil || status != cacheStale || value != "value" || time.Since(at) > time.Second {
+		t.Errorf("Expected the stale value, got %v %s %v (%v)", value, status, at, err)
+	}
+
+	// Expired entries go, but the last good value stays until it is too old
+	if evicted := cache.EvictExpired(); evicted != 1 {
+		t.Errorf("Expected only the expired entry to be evicted, got %d", evicted)
+	}
+	cache.mu.Lock()
+	entry := cache.lastGood["current:1"]
+	entry.expires = time.Now()
+	cache.lastGood["current:1"] = entry
+	cache.mu.Unlock()
+	if _, _, _, err := cache.FetchOrStale(context.Background(), "current:1", time.Nanosecond, failing); err == nil {
+		t.Error("Expected data older than CACHE_STALE_MAX_AGE not to be served")
+	}
+	if evicted := cache.EvictExpired(); evicted != 1 {
+		t.Errorf("Expected the old value to be evicted, got %d", evicted)
+	}
+
+	if got := combineCacheStatus(cacheMiss, cacheStale, cacheHit); got != cacheStale {
+		t.Errorf("Expected STALE to win, got %s", got)
+	}
+	if got := combineCacheStatus(cacheCoalesced, cacheHit); got != cacheCoalesced {
+		t.Errorf("Expected COALESCED, got %s", got)
+	}
+}
+
+// Test that the combined endpoint serves labelled stale data when the
+// upstream fails, and synthetic data only on request
+func TestWeatherHandlerStale(t *testing.T) {
+	weatherCache = newResponseCache()
+
+	var failing atomic.Bool
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() && r.URL.Path != "/currentConditions:lookup" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/currentConditions:lookup":
+			json.NewEncoder(w).Encode(mockGoogleWeatherResponse())
+		case "/forecast/hours:lookup":
+			w.Write([]byte(`{"forecastHours": [{"interval": {"startTime": "2025-01-01T10:00:00Z"}, "temperature": {"degrees": 10, "unit": "CELSIUS"}}]}`))
+		case "/forecast/days:lookup":
+			w.Write([]byte(`{"forecastDays": [{"displayDate": {"year": 2025, "month": 1, "day": 1}}]}`))
+		}
+	}))
+	defer mockServer.Close()
+
+	originalBase := GOOGLE_WEATHER_BASE
+	GOOGLE_WEATHER_BASE = mockServer.URL
+	defer func() { GOOGLE_WEATHER_BASE = originalBase }()
+	setTestConfig(t, func(c *Config) { c.GoogleAPIKey = "test-key" })
+
+	get := func(target string) (WeatherResponse, *httptest.ResponseRecorder) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest("GET", target, nil))
+		var resp WeatherResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		return resp, w
+	}
+
+	get("/api/weather?lat=40.7128&lon=-74.0060")
+
+	// Expire the cache and date the forecasts an hour back
+	weatherCache.mu.Lock()
+	clear(weatherCache.entries)
+	weatherCache.recent.Init()
+	for key, entry := range weatherCache.lastGood {
+		entry.fetched = entry.fetched.Add(-time.Hour)
+		weatherCache.lastGood[key] = entry
+	}
+	weatherCache.mu.Unlock()
+	failing.Store(true)
+
+	resp, w := get("/api/weather?lat=40.7128&lon=-74.0060")
+	if got := w.Header().Get("X-Cache"); got != "STALE" {
+		t.Errorf("Expected X-Cache STALE, got %q (%s)", got, w.Header().Get("X-Cache-Detail"))
+	}
+	if len(resp.Missing) != 0 || resp.Current.Stale {
+		t.Errorf("Expected fresh current conditions and nothing missing, got %v %+v", resp.Missing, resp.Current.Freshness)
+	}
+	for _, f := range []Freshness{resp.Forecast.Hourly[0].Freshness, resp.Forecast.Daily[0].Freshness} {
+		if !f.Stale || f.Synthetic || f.AgeSeconds < 3600 || f.AgeSeconds > 3660 {
+			t.Errorf("Expected stale data an hour old, got %+v", f)
+		}
+	}
+
+	// With nothing to fall back on, failed sections are only made up when
+	// asked for
+	weatherCache = newResponseCache()
+	resp, _ = get("/api/weather?lat=40.7128&lon=-74.0060")
+	if len(resp.Forecast.Hourly) != 0 || len(resp.Forecast.Daily) != 0 || len(resp.Missing) != 2 {
+		t.Errorf("Expected the forecasts missing, got %d hours, %d days, missing %v",
+			len(resp.Forecast.Hourly), len(resp.Forecast.Daily), resp.Missing)
+	}
+	resp, _ = get("/api/weather?lat=40.7128&lon=-74.0060&fallback=synthetic")
+	if len(resp.Forecast.Hourly) == 0 || !resp.Forecast.Hourly[0].Synthetic || len(resp.Forecast.Daily) == 0 ||
+		!resp.Forecast.Daily[0].Synthetic || len(resp.Missing) != 2 {
+		t.Errorf("Expected labelled synthetic forecasts still listed as missing, got %+v", resp)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+)
+
+// Languages condition descriptions are translated into. The first is the
+// default.
+var supportedLanguages = []string{"en", "es", "fr", "de"}
+
+// Condition severity, from calm weather to conditions that are dangerous to
+// be out in
+const (
+	SEVERITY_NONE        = 0
+	SEVERITY_MINOR       = 1
+	SEVERITY_MODERATE    = 2
+	SEVERITY_SIGNIFICANT = 3
+	SEVERITY_SEVERE      = 4
+	SEVERITY_EXTREME     = 5
+)
+
+// ConditionInfo is the catalog entry for a weather condition type
+type ConditionInfo struct {
+	Severity     int
+	DayIcon      string
+	NightIcon    string
+	Descriptions map[string]string // by language
+}
+
+// Descriptions in the order of supportedLanguages
+func translations(texts ...string) map[string]string {
+	byLanguage := make(map[string]string, len(texts))
+	for i, text := range texts {
+		byLanguage[supportedLanguages[i]] = text
+	}
+	return byLanguage
+}
+
+// Every condition type the providers report. The Google Weather API types
+// come first; the rest are the OpenWeatherMap atmosphere conditions, which
+// Google has no type for.
+var conditionCatalog = map[string]ConditionInfo{
+	"TYPE_UNSPECIFIED": {SEVERITY_NONE, "unknown", "unknown",
+		translations("Unknown", "Desconocido", "Inconnu", "Unbekannt")},
+	"CLEAR": {SEVERITY_NONE, "clear-day", "clear-night",
+		translations("Clear", "Despejado", "Dégagé", "Klar")},
+	"MOSTLY_CLEAR": {SEVERITY_NONE, "mostly-clear-day", "mostly-clear-night",
+		translations("Mostly Clear", "Mayormente despejado", "Plutôt dégagé", "Überwiegend klar")},
+	"PARTLY_CLOUDY": {SEVERITY_NONE, "partly-cloudy-day", "partly-cloudy-night",
+		translations("Partly Cloudy", "Parcialmente nublado", "Partiellement nuageux", "Teilweise bewölkt")},
+	"MOSTLY_CLOUDY": {SEVERITY_NONE, "mostly-cloudy-day", "mostly-cloudy-night",
+		translations("Mostly Cloudy", "Mayormente nublado", "Plutôt nuageux", "Überwiegend bewölkt")},
+	"CLOUDY": {SEVERITY_NONE, "cloudy", "cloudy",
+		translations("Cloudy", "Nublado", "Nuageux", "Bewölkt")},
+	"WINDY": {SEVERITY_MODERATE, "wind", "wind",
+		translations("Windy", "Ventoso", "Venteux", "Windig")},
+	"WIND_AND_RAIN": {SEVERITY_SIGNIFICANT, "wind-rain", "wind-rain",
+		translations("Wind and Rain", "Viento y lluvia", "Vent et pluie", "Wind und Regen")},
+	"LIGHT_RAIN_SHOWERS": {SEVERITY_MINOR, "showers-day", "showers-night",
+		translations("Light Rain Showers", "Chubascos ligeros", "Faibles averses", "Leichte Regenschauer")},
+	"CHANCE_OF_SHOWERS": {SEVERITY_MINOR, "showers-day", "showers-night",
+		translations("Chance of Showers", "Posibilidad de chubascos", "Risque d'averses", "Schauer möglich")},
+	"SCATTERED_SHOWERS": {SEVERITY_MINOR, "showers-day", "showers-night",
+		translations("Scattered Showers", "Chubascos dispersos", "Averses éparses", "Vereinzelte Schauer")},
+	"RAIN_SHOWERS": {SEVERITY_MODERATE, "showers-day", "showers-night",
+		translations("Rain Showers", "Chubascos", "Averses", "Regenschauer")},
+	"HEAVY_RAIN_SHOWERS": {SEVERITY_SIGNIFICANT, "heavy-rain", "heavy-rain",
+		translations("Heavy Rain Showers", "Chubascos fuertes", "Fortes averses", "Starke Regenschauer")},
+	"LIGHT_TO_MODERATE_RAIN": {SEVERITY_MINOR, "rain", "rain",
+		translations("Light to Moderate Rain", "Lluvia ligera a moderada", "Pluie faible à modérée", "Leichter bis mäßiger Regen")},
+	"MODERATE_TO_HEAVY_RAIN": {SEVERITY_SIGNIFICANT, "heavy-rain", "heavy-rain",
+		translations("Moderate to Heavy Rain", "Lluvia moderada a fuerte", "Pluie modérée à forte", "Mäßiger bis starker Regen")},
+	"RAIN": {SEVERITY_MODERATE, "rain", "rain",
+		translations("Rain", "Lluvia", "Pluie", "Regen")},
+	"LIGHT_RAIN": {SEVERITY_MINOR, "drizzle", "drizzle",
+		translations("Light Rain", "Lluvia ligera", "Pluie faible", "Leichter Regen")},
+	"HEAVY_RAIN": {SEVERITY_SIGNIFICANT, "heavy-rain", "heavy-rain",
+		translations("Heavy Rain", "Lluvia fuerte", "Forte pluie", "Starker Regen")},
+	"RAIN_PERIODICALLY_HEAVY": {SEVERITY_SIGNIFICANT, "heavy-rain", "heavy-rain",
+		translations("Rain, Periodically Heavy", "Lluvia, a ratos fuerte", "Pluie, parfois forte", "Regen, zeitweise stark")},
+	"LIGHT_SNOW_SHOWERS": {SEVERITY_MINOR, "snow-showers-day", "snow-showers-night",
+		translations("Light Snow Showers", "Chubascos de nieve ligeros", "Faibles averses de neige", "Leichte Schneeschauer")},
+	"CHANCE_OF_SNOW_SHOWERS": {SEVERITY_MINOR, "snow-showers-day", "snow-showers-night",
+		translations("Chance of Snow Showers", "Posibilidad de chubascos de nieve", "Risque d'averses de neige", "Schneeschauer möglich")},
+	"SCATTERED_SNOW_SHOWERS": {SEVERITY_MINOR, "snow-showers-day", "snow-showers-night",
+		translations("Scattered Snow Showers", "Chubascos de nieve dispersos", "Averses de neige éparses", "Vereinzelte Schneeschauer")},
+	"SNOW_SHOWERS": {SEVERITY_MODERATE, "snow-showers-day", "snow-showers-night",
+		translations("Snow Showers", "Chubascos de nieve", "Averses de neige", "Schneeschauer")},
+	"HEAVY_SNOW_SHOWERS": {SEVERITY_SIGNIFICANT, "heavy-snow", "heavy-snow",
+		translations("Heavy Snow Showers", "Fuertes chubascos de nieve", "Fortes averses de neige", "Starke Schneeschauer")},
+	"LIGHT_TO_MODERATE_SNOW": {SEVERITY_MINOR, "snow", "snow",
+		translations("Light to Moderate Snow", "Nieve ligera a moderada", "Neige faible à modérée", "Leichter bis mäßiger Schneefall")},
+	"MODERATE_TO_HEAVY_SNOW": {SEVERITY_SIGNIFICANT, "heavy-snow", "heavy-snow",
+		translations("Moderate to Heavy Snow", "Nieve moderada a fuerte", "Neige modérée à forte", "Mäßiger bis starker Schneefall")},
+	"SNOW": {SEVERITY_MODERATE, "snow", "snow",
+		translations("Snow", "Nieve", "Neige", "Schnee")},
+	"LIGHT_SNOW": {SEVERITY_MINOR, "snow", "snow",
+		translations("Light Snow", "Nieve ligera", "Neige faible", "Leichter Schneefall")},
+	"HEAVY_SNOW": {SEVERITY_SIGNIFICANT, "heavy-snow", "heavy-snow",
+		translations("Heavy Snow", "Nevada intensa", "Fortes chutes de neige", "Starker Schneefall")},
+	"SNOWSTORM": {SEVERITY_SEVERE, "snowstorm", "snowstorm",
+		translations("Snowstorm", "Tormenta de nieve", "Tempête de neige", "Schneesturm")},
+	"SNOW_PERIODICALLY_HEAVY": {SEVERITY_SIGNIFICANT, "heavy-snow", "heavy-snow",
+		translations("Snow, Periodically Heavy", "Nieve, a ratos intensa", "Neige, parfois forte", "Schnee, zeitweise stark")},
+	"HEAVY_SNOW_STORM": {SEVERITY_SEVERE, "snowstorm", "snowstorm",
+		translations("Heavy Snowstorm", "Fuerte tormenta de nieve", "Forte tempête de neige", "Starker Schneesturm")},
+	"BLOWING_SNOW": {SEVERITY_SIGNIFICANT, "blowing-snow", "blowing-snow",
+		translations("Blowing Snow", "Ventisca", "Chasse-neige", "Schneetreiben")},
+	"RAIN_AND_SNOW": {SEVERITY_MODERATE, "sleet", "sleet",
+		translations("Rain and Snow", "Aguanieve", "Pluie et neige", "Schneeregen")},
+	"HAIL": {SEVERITY_SIGNIFICANT, "hail", "hail",
+		translations("Hail", "Granizo", "Grêle", "Hagel")},
+	"HAIL_SHOWERS": {SEVERITY_SIGNIFICANT, "hail", "hail",
+		translations("Hail Showers", "Chubascos de granizo", "Averses de grêle", "Hagelschauer")},
+	"THUNDERSTORM": {SEVERITY_SIGNIFICANT, "thunderstorm", "thunderstorm",
+		translations("Thunderstorm", "Tormenta", "Orage", "Gewitter")},
+	"THUNDERSHOWER": {SEVERITY_SIGNIFICANT, "thunderstorm-showers-day", "thunderstorm-showers-night",
+		translations("Thundershower", "Chubasco tormentoso", "Averse orageuse", "Gewitterschauer")},
+	"LIGHT_THUNDERSTORM_RAIN": {SEVERITY_MODERATE, "thunderstorm-showers-day", "thunderstorm-showers-night",
+		translations("Light Thunderstorm Rain", "Tormenta con lluvia ligera", "Orage avec pluie faible", "Gewitter mit leichtem Regen")},
+	"SCATTERED_THUNDERSTORMS": {SEVERITY_SIGNIFICANT, "thunderstorm-showers-day", "thunderstorm-showers-night",
+		translations("Scattered Thunderstorms", "Tormentas dispersas", "Orages épars", "Vereinzelte Gewitter")},
+	"HEAVY_THUNDERSTORM": {SEVERITY_SEVERE, "thunderstorm", "thunderstorm",
+		translations("Heavy Thunderstorm", "Tormenta fuerte", "Orage violent", "Schweres Gewitter")},
+
+	"MIST": {SEVERITY_MINOR, "fog", "fog",
+		translations("Mist", "Neblina", "Brume", "Feuchter Dunst")},
+	"FOG": {SEVERITY_MINOR, "fog", "fog",
+		translations("Fog", "Niebla", "Brouillard", "Nebel")},
+	"HAZE": {SEVERITY_MINOR, "haze-day", "haze-night",
+		translations("Haze", "Calima", "Brume sèche", "Trockener Dunst")},
+	"SMOKE": {SEVERITY_MODERATE, "smoke", "smoke",
+		translations("Smoke", "Humo", "Fumée", "Rauch")},
+	"DUST": {SEVERITY_MODERATE, "dust", "dust",
+		translations("Dust", "Polvo", "Poussière", "Staub")},
+	"VOLCANIC_ASH": {SEVERITY_SEVERE, "volcanic-ash", "volcanic-ash",
+		translations("Volcanic Ash", "Ceniza volcánica", "Cendres volcaniques", "Vulkanasche")},
+	"SQUALLS": {SEVERITY_SIGNIFICANT, "wind", "wind",
+		translations("Squalls", "Turbonadas", "Grains", "Böen")},
+	"TORNADO": {SEVERITY_EXTREME, "tornado", "tornado",
+		translations("Tornado", "Tornado", "Tornade", "Tornado")},
+}
+
+// Parse the lang parameter. Region subtags are accepted and dropped, so
+// fr-CA selects fr; the default is English.
+func parseLanguage(query url.Values) (string, *ParamError) {
+	raw := query.Get("lang")
+	if raw == "" {
+		return supportedLanguages[0], nil
+	}
+	base, _, _ := strings.Cut(strings.ToLower(strings.ReplaceAll(raw, "_", "-")), "-")
+	for _, lang := range supportedLanguages {
+		if base == lang {
+			return lang, nil
+		}
+	}
+	return "", invalidParam("lang", "lang must be one of "+strings.Join(supportedLanguages, ", "),
+		map[string]interface{}{"allowed": supportedLanguages})
+}
+
+type languageKey struct{}
+
+// Attach the response language to ctx. Providers forward it upstream, and
+// cache keys include it.
+func withLanguage(ctx context.Context, lang string) context.Context {
+	return context.WithValue(ctx, languageKey{}, lang)
+}
+
+// Language attached to ctx, or the default outside a request
+func languageFromContext(ctx context.Context) string {
+	if lang, ok := ctx.Value(languageKey{}).(string); ok {
+		return lang
+	}
+	return supportedLanguages[0]
+}
+
+// Return w described in lang from the catalog, with its severity and the
+// day or night icon. Types missing from the catalog keep the provider's
+// description. The original is never modified.
+func (w *WeatherCondition) localized(lang string, daytime bool) *WeatherCondition {
+	if w == nil {
+		return nil
+	}
+	localized := *w
+	info, ok := conditionCatalog[w.Type]
+	if !ok {
+		return &localized
+	}
+	localized.Description = LocalizedText{Text: info.Descriptions[lang], LanguageCode: lang}
+	localized.Severity = info.Severity
+	localized.Icon = info.DayIcon
+	if !daytime {
+		localized.Icon = info.NightIcon
+	}
+	return &localized
+}
+
+// Daytime unless the provider says otherwise
+func isDaytime(c Conditions) bool {
+	return c.IsDaytime == nil || *c.IsDaytime
+}
+
+// Return a copy of current conditions with the condition localized
+func (c *CurrentConditions) Localized(lang string) *CurrentConditions {
+	if c == nil {
+		return nil
+	}
+	localized := *c
+	localized.WeatherCondition = c.WeatherCondition.localized(lang, isDaytime(c.Conditions))
+	return &localized
+}
+
+// Return copies of forecast hours with their conditions localized
+func hourlyLocalized(hours []HourlyForecast, lang string) []HourlyForecast {
+	if hours == nil {
+		return nil
+	}
+	localized := make([]HourlyForecast, len(hours))
+	for i, h := range hours {
+		h.WeatherCondition = h.WeatherCondition.localized(lang, isDaytime(h.Conditions))
+		localized[i] = h
+	}
+	return localized
+}
+
+// Return copies of forecast days with their conditions localized
+func dailyLocalized(days []DailyForecast, lang string) []DailyForecast {
+	if days == nil {
+		return nil
+	}
+	localized := make([]DailyForecast, len(days))
+	for i, d := range days {
+		d.WeatherCondition = d.WeatherCondition.localized(lang, true)
+		if d.DaytimeForecast != nil {
+			daytime := *d.DaytimeForecast
+			daytime.WeatherCondition = daytime.WeatherCondition.localized(lang, true)
+			d.DaytimeForecast = &daytime
+		}
+		if d.NighttimeForecast != nil {
+			nighttime := *d.NighttimeForecast
+			nighttime.WeatherCondition = nighttime.WeatherCondition.localized(lang, false)
+			d.NighttimeForecast = &nighttime
+		}
+		localized[i] = d
+	}
+	return localized
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// Test that every catalog entry is complete and every provider type is in it
+func TestConditionCatalogComplete(t *testing.T) {
+	for conditionType, info := range conditionCatalog {
+		if info.DayIcon == "" || info.NightIcon == "" {
+			t.Errorf("%s: missing icon", conditionType)
+		}
+		if info.Severity < SEVERITY_NONE || info.Severity > SEVERITY_EXTREME {
+			t.Errorf("%s: severity %d out of range", conditionType, info.Severity)
+		}
+		for _, lang := range supportedLanguages {
+			if info.Descriptions[lang] == "" {
+				t.Errorf("%s: missing %s description", conditionType, lang)
+			}
+		}
+	}
+
+	// Every OpenWeatherMap condition ID maps to a catalog type
+	for id := 200; id < 900; id++ {
+		if _, ok := conditionCatalog[owmConditionType(id)]; !ok {
+			t.Errorf("OpenWeatherMap ID %d maps to %q, which is not in the catalog", id, owmConditionType(id))
+		}
+	}
+}
+
+func TestParseLanguage(t *testing.T) {
+	tests := map[string]string{"": "en", "fr": "fr", "fr-CA": "fr", "DE": "de", "es_MX": "es"}
+	for raw, want := range tests {
+		got, err := parseLanguage(url.Values{"lang": {raw}})
+		if err != nil || got != want {
+			t.Errorf("lang=%q: expected %s, got %q (%v)", raw, want, got, err)
+		}
+	}
+	if _, err := parseLanguage(url.Values{"lang": {"xx"}}); err == nil || err.Code != ERR_INVALID_PARAMETER {
+		t.Errorf("Expected unsupported language to be rejected, got %+v", err)
+	}
+}
+
+func TestWeatherConditionLocalized(t *testing.T) {
+	night := false
+	current := &CurrentConditions{Conditions: Conditions{
+		IsDaytime:        &night,
+		WeatherCondition: &WeatherCondition{Type: "THUNDERSHOWER", Description: LocalizedText{Text: "Thundershower", LanguageCode: "en"}},
+	}}
+
+	got := current.Localized("de").WeatherCondition
+	if got.Description != (LocalizedText{"Gewitterschauer", "de"}) || got.Severity != SEVERITY_SIGNIFICANT || got.Icon != "thunderstorm-showers-night" {
+		t.Errorf("Unexpected localized condition %+v", got)
+	}
+	if current.WeatherCondition.Description.Text != "Thundershower" || current.WeatherCondition.Icon != "" {
+		t.Error("Localizing modified the original condition")
+	}
+
+	// Unknown types keep the provider's description
+	unknown := (&WeatherCondition{Type: "NEW_TYPE", Description: LocalizedText{Text: "Something new"}}).localized("fr", true)
+	if unknown.Description.Text != "Something new" {
+		t.Errorf("Expected provider description for unknown type, got %+v", unknown)
+	}
+
+	days := dailyLocalized([]DailyForecast{{
+		WeatherCondition:  &WeatherCondition{Type: "CLEAR"},
+		NighttimeForecast: &DayPartForecast{WeatherCondition: &WeatherCondition{Type: "FOG"}},
+	}}, "es")
+	if days[0].WeatherCondition.Icon != "clear-day" || days[0].NighttimeForecast.WeatherCondition.Description.Text != "Niebla" {
+		t.Errorf("Unexpected localized day %+v %+v", days[0].WeatherCondition, days[0].NighttimeForecast.WeatherCondition)
+	}
+}
+
+// Test that weather data is fetched once in the default language and
+// localized per request
+func TestHandlerLanguage(t *testing.T) {
+	weatherCache = newResponseCache()
+
+	var languages []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		languages = append(languages, r.URL.Query().Get("languageCode"))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(mockGoogleWeatherResponse())
+	}))
+	defer mockServer.Close()
+
+	originalBase := GOOGLE_WEATHER_BASE
+	GOOGLE_WEATHER_BASE = mockServer.URL
+	defer func() { GOOGLE_WEATHER_BASE = originalBase }()
+	setTestConfig(t, func(c *Config) { c.GoogleAPIKey = "test-key" })
+
+	for _, tt := range []struct {
+		lang, text string
+	}{
+		{"fr", "Partiellement nuageux"},
+		{"", "Partly Cloudy"},
+		{"fr-FR", "Partiellement nuageux"},
+	} {
+		w := httptest.NewRecorder()
+		currentConditionsHandler(w, httptest.NewRequest("GET", "/api/current?lat=1&lon=2&lang="+tt.lang, nil))
+		var current CurrentConditions
+		if err := json.Unmarshal(w.Body.Bytes(), &current); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		if current.WeatherCondition == nil || current.WeatherCondition.Description.Text != tt.text {
+			t.Errorf("lang=%q: expected %q, got %+v", tt.lang, tt.text, current.WeatherCondition)
+		}
+	}
+
+	if len(languages) != 1 || languages[0] != "en" {
+		t.Errorf("Expected one upstream call in English for every language, got %v", languages)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Shown in place of secrets when the configuration is printed
+const REDACTED = "[redacted]"
+
+// Duration is a time.Duration written as a Go duration string ("24h",
+// "500ms") in config files and logs
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string such as \"24h\"")
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Config holds every tunable of the service. It is loaded once at startup
+// from CONFIG_FILE, if set, then overridden by environment variables named
+// after each field.
+type Config struct {
+	Port     string `json:"port"`     // PORT
+	LogLevel string `json:"logLevel"` // LOG_LEVEL
+
+	// HTTP server
+	ReadHeaderTimeout Duration `json:"readHeaderTimeout"` // READ_HEADER_TIMEOUT
+	ReadTimeout       Duration `json:"readTimeout"`       // READ_TIMEOUT
+	WriteTimeout      Duration `json:"writeTimeout"`      // WRITE_TIMEOUT
+	IdleTimeout       Duration `json:"idleTimeout"`       // IDLE_TIMEOUT
+	ShutdownTimeout   Duration `json:"shutdownTimeout"`   // SHUTDOWN_TIMEOUT
+	MaxHeaderBytes    int      `json:"maxHeaderBytes"`    // MAX_HEADER_BYTES
+	MaxBodyBytes      int      `json:"maxBodyBytes"`      // MAX_BODY_BYTES
+
+	// Browser origins allowed by CORS
+	AllowedOrigins []string `json:"allowedOrigins"` // CORS_ALLOWED_ORIGINS
+
+	// Upstream providers
+	GoogleAPIKey      string   `json:"googleApiKey"`      // GOOGLE_API_KEY
+	OpenWeatherAPIKey string   `json:"openWeatherApiKey"` // OPENWEATHER_API_KEY
+	UpstreamTimeout   Duration `json:"upstreamTimeout"`   // UPSTREAM_TIMEOUT
+	WeatherDeadline   Duration `json:"weatherDeadline"`   // WEATHER_DEADLINE
+
+	// Locating requests that don't send coordinates
+	GeoIPDatabasePath string   `json:"geoIpDatabasePath"` // GEOIP_DATABASE_PATH
+	TrustedProxies    []string `json:"trustedProxies"`    // TRUSTED_PROXIES
+
+	// Tokens and sessions
+	TokenSigningKeys   string   `json:"tokenSigningKeys"`   // TOKEN_SIGNING_KEYS
+	EphemeralTokenKeys bool     `json:"ephemeralTokenKeys"` // EPHEMERAL_TOKEN_KEYS, local development only
+	TokenExpiry        Duration `json:"tokenExpiry"`        // TOKEN_EXPIRY
+	TokenRefreshWindow Duration `json:"tokenRefreshWindow"` // TOKEN_REFRESH_WINDOW
+	SessionStorePath   string   `json:"sessionStorePath"`   // SESSION_STORE_PATH
+	SessionIdleExpiry  Duration `json:"sessionIdleExpiry"`  // SESSION_IDLE_EXPIRY
+	MaxExtensions      int      `json:"maxExtensions"`      // MAX_EXTENSIONS
+
+	// Rate limiting
+	RequestsPerMinute int    `json:"requestsPerMinute"` // REQUESTS_PER_MINUTE
+	RateLimits        string `json:"rateLimits"`        // RATE_LIMITS
+
+	AdminAPIKey string `json:"adminApiKey"` // ADMIN_API_KEY
+}
+
+// Configuration used when nothing is set
+func DefaultConfig() *Config {
+	return &Config{
+		Port:               "8080",
+		LogLevel:           "info",
+		ReadHeaderTimeout:  Duration(5 * time.Second),
+		ReadTimeout:        Duration(10 * time.Second),
+		WriteTimeout:       Duration(30 * time.Second),
+		IdleTimeout:        Duration(2 * time.Minute),
+		ShutdownTimeout:    Duration(8 * time.Second),
+		MaxHeaderBytes:     64 << 10,
+		MaxBodyBytes:       1 << 20,
+		AllowedOrigins:     []string{"http://localhost:*", "http://127.0.0.1:*"},
+		UpstreamTimeout:    Duration(10 * time.Second),
+		WeatherDeadline:    Duration(4 * time.Second),
+		TokenExpiry:        Duration(24 * time.Hour),
+		TokenRefreshWindow: Duration(4 * time.Hour),
+		SessionIdleExpiry:  Duration(7 * 24 * time.Hour),
+		MaxExtensions:      10000,
+		RequestsPerMinute:  120,
+	}
+}
+
+// Global configuration, replaced at startup by the loaded config
+var config = DefaultConfig()
+
+// Load the configuration from CONFIG_FILE and the environment, and
+// validate it
+func loadConfig() (*Config, error) {
+	cfg := DefaultConfig()
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Overlay a JSON config file. Fields missing from the file keep their
+// current values; unknown fields are rejected so typos don't go unnoticed.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Overlay environment variables, looked up with lookup
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	var errs []error
+	str := func(name string, field *string) {
+		if value, ok := lookup(name); ok {
+			*field = value
+		}
+	}
+	integer := func(name string, field *int) {
+		if value, ok := lookup(name); ok {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s must be an integer, got %q", name, value))
+				return
+			}
+			*field = parsed
+		}
+	}
+	boolean := func(name string, field *bool) {
+		if value, ok := lookup(name); ok {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s must be true or false, got %q", name, value))
+				return
+			}
+			*field = parsed
+		}
+	}
+	// Lists are separated by commas or spaces
+	list := func(name string, field *[]string) {
+		if value, ok := lookup(name); ok {
+			*field = strings.FieldsFunc(value, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+		}
+	}
+	duration := func(name string, field *Duration) {
+		if value, ok := lookup(name); ok {
+			parsed, err := time.ParseDuration(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s must be a duration such as \"24h\", got %q", name, value))
+				return
+			}
+			*field = Duration(parsed)
+		}
+	}
+
+	str("PORT", &c.Port)
+	str("LOG_LEVEL", &c.LogLevel)
+	duration("READ_HEADER_TIMEOUT", &c.ReadHeaderTimeout)
+	duration("READ_TIMEOUT", &c.ReadTimeout)
+	duration("WRITE_TIMEOUT", &c.WriteTimeout)
+	duration("IDLE_TIMEOUT", &c.IdleTimeout)
+	duration("SHUTDOWN_TIMEOUT", &c.ShutdownTimeout)
+	integer("MAX_HEADER_BYTES", &c.MaxHeaderBytes)
+	integer("MAX_BODY_BYTES", &c.MaxBodyBytes)
+	list("CORS_ALLOWED_ORIGINS", &c.AllowedOrigins)
+	str("GOOGLE_API_KEY", &c.GoogleAPIKey)
+	str("OPENWEATHER_API_KEY", &c.OpenWeatherAPIKey)
+	duration("UPSTREAM_TIMEOUT", &c.UpstreamTimeout)
+	duration("WEATHER_DEADLINE", &c.WeatherDeadline)
+	str("GEOIP_DATABASE_PATH", &c.GeoIPDatabasePath)
+	list("TRUSTED_PROXIES", &c.TrustedProxies)
+	str("TOKEN_SIGNING_KEYS", &c.TokenSigningKeys)
+	boolean("EPHEMERAL_TOKEN_KEYS", &c.EphemeralTokenKeys)
+	duration("TOKEN_EXPIRY", &c.TokenExpiry)
+	duration("TOKEN_REFRESH_WINDOW", &c.TokenRefreshWindow)
+	str("SESSION_STORE_PATH", &c.SessionStorePath)
+	duration("SESSION_IDLE_EXPIRY", &c.SessionIdleExpiry)
+	integer("MAX_EXTENSIONS", &c.MaxExtensions)
+	integer("REQUESTS_PER_MINUTE", &c.RequestsPerMinute)
+	str("RATE_LIMITS", &c.RateLimits)
+	str("ADMIN_API_KEY", &c.AdminAPIKey)
+	return errors.Join(errs...)
+}
+
+// Check the configuration, reporting every problem at once
+func (c *Config) Validate() error {
+	var errs []error
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+		errs = append(errs, fmt.Errorf("port must be between 1 and 65535, got %q", c.Port))
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		errs = append(errs, fmt.Errorf("logLevel must be debug, info, warn or error, got %q", c.LogLevel))
+	}
+	for _, d := range []struct {
+		name  string
+		value Duration
+	}{
+		{"readHeaderTimeout", c.ReadHeaderTimeout},
+		{"readTimeout", c.ReadTimeout},
+		{"writeTimeout", c.WriteTimeout},
+		{"idleTimeout", c.IdleTimeout},
+		{"shutdownTimeout", c.ShutdownTimeout},
+		{"upstreamTimeout", c.UpstreamTimeout},
+		{"weatherDeadline", c.WeatherDeadline},
+		{"tokenExpiry", c.TokenExpiry},
+		{"sessionIdleExpiry", c.SessionIdleExpiry},
+	} {
+		if d.value <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive", d.name))
+		}
+	}
+	// A shorter write timeout would cut off /api/weather before its deadline
+	if c.WriteTimeout <= c.WeatherDeadline {
+		errs = append(errs, errors.New("writeTimeout must be longer than weatherDeadline"))
+	}
+	if c.MaxHeaderBytes < 1024 || c.MaxBodyBytes < 1024 {
+		errs = append(errs, errors.New("maxHeaderBytes and maxBodyBytes must be at least 1024"))
+	}
+	// An empty allowlist would reject every browser request, usually because
+	// CORS_ALLOWED_ORIGINS was set to an empty variable
+	if len(c.AllowedOrigins) == 0 {
+		errs = append(errs, errors.New("allowedOrigins must list at least one origin"))
+	} else if _, err := NewOriginAllowlist(c.AllowedOrigins); err != nil {
+		errs = append(errs, fmt.Errorf("allowedOrigins: %w", err))
+	}
+	if _, err := parseTrustedProxies(c.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("trustedProxies: %w", err))
+	}
+	if c.TokenRefreshWindow <= 0 || c.TokenRefreshWindow >= c.TokenExpiry {
+		errs = append(errs, errors.New("tokenRefreshWindow must be positive and shorter than tokenExpiry"))
+	}
+	if c.MaxExtensions < 1 {
+		errs = append(errs, errors.New("maxExtensions must be at least 1"))
+	}
+	if c.RequestsPerMinute < 1 {
+		errs = append(errs, errors.New("requestsPerMinute must be at least 1"))
+	} else if _, err := c.rateLimitRules(); err != nil {
+		errs = append(errs, fmt.Errorf("rateLimits: %w", err))
+	}
+	if c.TokenSigningKeys != "" {
+		if _, err := parseSigningKeys(c.TokenSigningKeys); err != nil {
+			errs = append(errs, fmt.Errorf("tokenSigningKeys: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Copy of the configuration with secrets replaced, safe to log
+func (c *Config) Redacted() Config {
+	redacted := *c
+	for _, secret := range []*string{&redacted.GoogleAPIKey, &redacted.OpenWeatherAPIKey, &redacted.TokenSigningKeys, &redacted.AdminAPIKey} {
+		if *secret != "" {
+			*secret = REDACTED
+		}
+	}
+	return redacted
+}
+
+// Rate limit rules: the defaults with the shared bucket sized to
+// RequestsPerMinute, overridden by RateLimits
+func (c *Config) rateLimitRules() (map[string]RateLimitRule, error) {
+	rules := defaultRateLimitRules()
+	rules[RATE_LIMIT_DEFAULT_ROUTE] = RateLimitRule{Limit: c.RequestsPerMinute, Cost: 1}
+	if err := parseRateLimitRules(c.RateLimits, rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Log the configuration with secrets redacted
+func logConfig(c *Config) {
+	slog.Info("configuration loaded", "config", c.Redacted())
+	if c.GoogleAPIKey == "" && c.OpenWeatherAPIKey == "" {
+		slog.Warn("no weather provider API key configured, weather endpoints will fail")
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Replace the global config with the defaults changed by update for the
+// duration of a test
+func setTestConfig(t *testing.T, update func(*Config)) {
+	t.Helper()
+	original := config
+	cfg := DefaultConfig()
+	update(cfg)
+	config = cfg
+	t.Cleanup(func() { config = original })
+}
+
+// Environment lookup backed by a map
+func lookupFrom(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+}
+
+// Test that the environment overrides the config file, which overrides the
+// defaults
+func TestConfigLayering(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	file := `{"port": "9090", "maxExtensions": 50, "tokenExpiry": "12h", "googleApiKey": "file-key"}`
+	if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	cfg := DefaultConfig()
+	if err := cfg.loadFile(path); err != nil {
+		t.Fatalf("Failed to load config file: %v", err)
+	}
+	err := cfg.applyEnv(lookupFrom(map[string]string{
+		"MAX_EXTENSIONS":      "75",
+		"SESSION_IDLE_EXPIRY": "72h",
+	}))
+	if err != nil {
+		t.Fatalf("Failed to apply environment: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Expected valid config, got %v", err)
+	}
+
+	if cfg.Port != "9090" || cfg.GoogleAPIKey != "file-key" || cfg.TokenExpiry != Duration(12*time.Hour) {
+		t.Errorf("Expected file values, got %+v", cfg)
+	}
+	if cfg.MaxExtensions != 75 || cfg.SessionIdleExpiry != Duration(72*time.Hour) {
+		t.Errorf("Expected environment overrides, got %+v", cfg)
+	}
+	if cfg.RequestsPerMinute != 120 || cfg.TokenRefreshWindow != Duration(4*time.Hour) {
+		t.Errorf("Expected defaults for unset fields, got %+v", cfg)
+	}
+}
+
+func TestConfigFileRejectsUnknownFields(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{"maxExtension": 50}`), 0o600)
+
+	if err := DefaultConfig().loadFile(path); err == nil {
+		t.Error("Expected a misspelled field to be rejected")
+	}
+}
+
+func TestConfigEnvErrors(t *testing.T) {
+	err := DefaultConfig().applyEnv(lookupFrom(map[string]string{
+		"MAX_EXTENSIONS":       "lots",
+		"TOKEN_EXPIRY":         "1 day",
+		"EPHEMERAL_TOKEN_KEYS": "sure",
+	}))
+	for _, name := range []string{"MAX_EXTENSIONS", "TOKEN_EXPIRY", "EPHEMERAL_TOKEN_KEYS"} {
+		if err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("Expected invalid %s reported, got %v", name, err)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		update func(*Config)
+	}{
+		{"port", func(c *Config) { c.Port = "http" }},
+		{"log level", func(c *Config) { c.LogLevel = "verbose" }},
+		{"deadline", func(c *Config) { c.WeatherDeadline = 0 }},
+		{"write timeout", func(c *Config) { c.WriteTimeout = c.WeatherDeadline }},
+		{"body size", func(c *Config) { c.MaxBodyBytes = 10 }},
+		{"refresh window", func(c *Config) { c.TokenRefreshWindow = c.TokenExpiry }},
+		{"max extensions", func(c *Config) { c.MaxExtensions = 0 }},
+		{"requests per minute", func(c *Config) { c.RequestsPerMinute = 0 }},
+		{"rate limits", func(c *Config) { c.RateLimits = "/api/weather:2:3" }},
+		{"signing keys", func(c *Config) { c.TokenSigningKeys = "k1:HS256:c2hvcnQ=" }},
+		{"trusted proxies", func(c *Config) { c.TrustedProxies = []string{"10.0.0.0/33"} }},
+		{"empty origins", func(c *Config) { c.applyEnv(lookupFrom(map[string]string{"CORS_ALLOWED_ORIGINS": ""})) }},
+	}
+	for _, tt := range tests {
+		cfg := DefaultConfig()
+		tt.update(cfg)
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected invalid %s to be rejected", tt.name)
+		}
+	}
+
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Errorf("Expected default config to be valid, got %v", err)
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.GoogleAPIKey = "google-secret"
+	cfg.AdminAPIKey = "admin-secret"
+	cfg.SessionStorePath = "/data/sessions.json"
+
+	data, err := json.Marshal(cfg.Redacted())
+	if err != nil {
+		t.Fatalf("Failed to marshal config: %v", err)
+	}
+	out := string(data)
+	if strings.Contains(out, "secret") {
+		t.Errorf("Expected secrets to be redacted, got %s", out)
+	}
+	for _, want := range []string{`"googleApiKey":"[redacted]"`, `"openWeatherApiKey":""`, `"sessionStorePath":"/data/sessions.json"`, `"tokenExpiry":"24h0m0s"`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %s in %s", want, out)
+		}
+	}
+	if cfg.GoogleAPIKey != "google-secret" {
+		t.Error("Redacted must not modify the original config")
+	}
+}
+
+// Test that limits come from the injected config
+func TestConfigDrivesLimits(t *testing.T) {
+	setTestConfig(t, func(c *Config) {
+		c.RequestsPerMinute = 5
+		// A full batch doesn't fit the shared bucket
+		c.RateLimits = "/api/weather/batch:50:1"
+		c.TokenExpiry = Duration(time.Hour)
+		c.TokenRefreshWindow = Duration(30 * time.Minute)
+	})
+
+	limiter, err := newRateLimiter(config)
+	if err != nil {
+		t.Fatalf("Failed to create rate limiter: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		limiter.Allow("ext", "/api/current")
+	}
+	if limiter.Allow("ext", "/api/current").Allowed {
+		t.Error("Expected the shared bucket to hold RequestsPerMinute tokens")
+	}
+
+	now := time.Now()
+	_, claims, err := issueExtensionToken(generateTestIdentity(), now)
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+	if claims.ExpiresAt != now.Add(time.Hour).Unix() {
+		t.Errorf("Expected token to expire after the configured hour, got %d", claims.ExpiresAt-now.Unix())
+	}
+}
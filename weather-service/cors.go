@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CORS response headers
+const (
+	CORS_ALLOWED_METHODS   = "GET, POST, OPTIONS"
+	CORS_ALLOWED_HEADERS   = "Content-Type, Authorization, X-Extension-Token, X-Extension-ID, X-Extension-Version, X-Extension-Fingerprint, X-Request-ID, Last-Event-ID"
+	CORS_EXPOSED_HEADERS   = "X-Cache, X-Cache-Detail, X-RateLimit-Limit, X-RateLimit-Remaining, Retry-After, X-Request-ID"
+	CORS_PREFLIGHT_MAX_AGE = "86400"
+)
+
+// OriginAllowlist is the set of browser origins allowed to call the API.
+// Entries are exact origins such as chrome-extension://<id> or
+// https://example.com; http and https entries may use * as the port
+// (http://localhost:*) to allow any port.
+type OriginAllowlist struct {
+	exact     map[string]bool
+	anyPortOf map[string]bool // scheme://host of entries with port *
+}
+
+// Build an allowlist, rejecting malformed entries
+func NewOriginAllowlist(origins []string) (*OriginAllowlist, error) {
+	allowlist := &OriginAllowlist{exact: make(map[string]bool), anyPortOf: make(map[string]bool)}
+	for _, origin := range origins {
+		if err := allowlist.add(origin); err != nil {
+			return nil, err
+		}
+	}
+	return allowlist, nil
+}
+
+func (a *OriginAllowlist) add(origin string) error {
+	if base, ok := strings.CutSuffix(origin, ":*"); ok {
+		u, err := url.Parse(base)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Port() != "" || u.Path != "" {
+			return fmt.Errorf("origin %q: port wildcards need an http or https origin such as http://localhost:*", origin)
+		}
+		a.anyPortOf[base] = true
+		return nil
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" || strings.Contains(u.Host, "*") || u.Path != "" || u.RawQuery != "" || u.User != nil {
+		return fmt.Errorf("origin %q must be scheme://host[:port]", origin)
+	}
+	switch u.Scheme {
+	case "chrome-extension", "http", "https":
+	default:
+		return fmt.Errorf("origin %q: scheme must be chrome-extension, http or https", origin)
+	}
+	a.exact[origin] = true
+	return nil
+}
+
+// Whether origin may call the API
+func (a *OriginAllowlist) Allowed(origin string) bool {
+	if a.exact[origin] {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Port() == "" {
+		return false
+	}
+	return a.anyPortOf[u.Scheme+"://"+u.Hostname()]
+}
+
+// Wrap a handler with CORS checks against this allowlist. Requests without
+// an Origin header aren't from a browser page and pass through untouched;
+// requests from other origins get 403.
+func (a *OriginAllowlist) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a.serve(w, r, next)
+	}
+}
+
+func (a *OriginAllowlist) serve(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	// Responses differ by origin, so shared caches must key on it
+	w.Header().Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+	if preflight {
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+	}
+
+	if origin != "" {
+		if !a.Allowed(origin) {
+			logSecurityEvent(r.Context(), "CORS_REJECTED", map[string]interface{}{
+				"origin":   origin,
+				"endpoint": r.URL.Path,
+				"method":   r.Method,
+			})
+			writeError(w, http.StatusForbidden, ERR_ORIGIN_NOT_ALLOWED, "Origin not allowed", nil)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Expose-Headers", CORS_EXPOSED_HEADERS)
+	}
+
+	// Answer preflight requests without calling the handler
+	if r.Method == "OPTIONS" {
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", CORS_ALLOWED_METHODS)
+			w.Header().Set("Access-Control-Allow-Headers", CORS_ALLOWED_HEADERS)
+			w.Header().Set("Access-Control-Max-Age", CORS_PREFLIGHT_MAX_AGE)
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	next(w, r)
+}
+
+// Global CORS allowlist, replaced at startup from the configured origins
+var corsAllowlist = mustOriginAllowlist(DefaultConfig().AllowedOrigins)
+
+func mustOriginAllowlist(origins []string) *OriginAllowlist {
+	allowlist, err := NewOriginAllowlist(origins)
+	if err != nil {
+		panic(err)
+	}
+	return allowlist
+}
+
+// CORS middleware using the service's configured allowlist
+func enableCORS(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		corsAllowlist.serve(w, r, next)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOriginAllowlist(t *testing.T) {
+	allowlist, err := NewOriginAllowlist([]string{
+		"chrome-extension://abcdefghijklmnopabcdefghijklmnop",
+		"http://localhost:*",
+		"https://staging.example.com",
+	})
+	if err != nil {
+		t.Fatalf("Failed to build allowlist: %v", err)
+	}
+
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"chrome-extension://abcdefghijklmnopabcdefghijklmnop", true},
+		{"chrome-extension://pppppppppppppppppppppppppppppppp", false},
+		{"http://localhost:5173", true},
+		{"http://localhost:3000", true},
+		{"http://localhost", false},
+		{"https://localhost:5173", false},
+		{"http://localhost.evil.com:5173", false},
+		{"https://staging.example.com", true},
+		{"https://staging.example.com:8443", false},
+		{"https://evil.com", false},
+		{"null", false},
+	}
+	for _, tt := range tests {
+		if got := allowlist.Allowed(tt.origin); got != tt.allowed {
+			t.Errorf("Allowed(%q) = %v, want %v", tt.origin, got, tt.allowed)
+		}
+	}
+
+	for _, invalid := range []string{"*", "chrome-extension://*", "localhost:3000", "https://example.com/path", "ftp://example.com", "chrome-extension://id:*"} {
+		if _, err := NewOriginAllowlist([]string{invalid}); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	allowlist := mustOriginAllowlist([]string{"chrome-extension://allowed"})
+	called := false
+	handler := allowlist.Wrap(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+
+	// Allowed origin
+	req := httptest.NewRequest("GET", "/api/weather", nil)
+	req.Header.Set("Origin", "chrome-extension://allowed")
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if !called || w.Header().Get("Access-Control-Allow-Origin") != "chrome-extension://allowed" {
+		t.Errorf("Expected allowed origin to reach the handler, headers %v", w.Header())
+	}
+	if w.Header().Get("Vary") != "Origin" {
+		t.Errorf("Expected Vary: Origin, got %q", w.Header().Get("Vary"))
+	}
+	if !strings.Contains(w.Header().Get("Access-Control-Expose-Headers"), "X-Request-ID") {
+		t.Error("Expected exposed headers on allowed responses")
+	}
+
+	// Disallowed origin
+	called = false
+	req = httptest.NewRequest("GET", "/api/weather", nil)
+	req.Header.Set("Origin", "https://evil.com")
+	w = httptest.NewRecorder()
+	handler(w, req)
+	if called || w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 without calling the handler, got %d (called %v)", w.Code, called)
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Error("Disallowed origins must not get Access-Control-Allow-Origin")
+	}
+
+	// Disallowed preflight
+	req = httptest.NewRequest("OPTIONS", "/api/weather", nil)
+	req.Header.Set("Origin", "https://evil.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	w = httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected disallowed preflight to get 403, got %d", w.Code)
+	}
+
+	// Allowed preflight
+	called = false
+	req = httptest.NewRequest("OPTIONS", "/api/weather", nil)
+	req.Header.Set("Origin", "chrome-extension://allowed")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	req.Header.Set("Access-Control-Request-Headers", "x-extension-token")
+	w = httptest.NewRecorder()
+	handler(w, req)
+	if called || w.Code != http.StatusOK {
+		t.Errorf("Expected preflight answered by the middleware, got %d (called %v)", w.Code, called)
+	}
+	if w.Header().Get("Access-Control-Allow-Methods") != CORS_ALLOWED_METHODS || w.Header().Get("Access-Control-Max-Age") == "" {
+		t.Errorf("Expected preflight headers, got %v", w.Header())
+	}
+	if vary := w.Header().Values("Vary"); len(vary) != 3 {
+		t.Errorf("Expected Vary on Origin and request method and headers, got %v", vary)
+	}
+
+	// No Origin: not a browser cross-origin request
+	called = false
+	req = httptest.NewRequest("GET", "/api/weather", nil)
+	w = httptest.NewRecorder()
+	handler(w, req)
+	if !called || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Expected request without Origin to pass without CORS headers")
+	}
+}
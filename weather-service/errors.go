@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// Error codes returned in error responses. Clients branch on these, so a
+// code must keep its meaning once released; messages are for people and
+// may change.
+const (
+	// Request problems
+	ERR_MISSING_PARAMETER  = "MISSING_PARAMETER"
+	ERR_INVALID_PARAMETER  = "INVALID_PARAMETER"
+	ERR_INVALID_BODY       = "INVALID_BODY"
+	ERR_METHOD_NOT_ALLOWED = "METHOD_NOT_ALLOWED"
+	ERR_NOT_FOUND          = "NOT_FOUND"
+	ERR_ORIGIN_NOT_ALLOWED = "ORIGIN_NOT_ALLOWED"
+
+	// Authentication and registration
+	ERR_MISSING_CREDENTIALS  = "MISSING_CREDENTIALS"
+	ERR_INVALID_TOKEN        = "INVALID_TOKEN"
+	ERR_TOKEN_REFRESHED      = "TOKEN_REFRESHED"
+	ERR_TOKEN_REVOKED        = "TOKEN_REVOKED"
+	ERR_REFRESH_NOT_DUE      = "REFRESH_NOT_DUE"
+	ERR_NOT_REGISTERED       = "EXTENSION_NOT_REGISTERED"
+	ERR_EXTENSION_BANNED     = "EXTENSION_BANNED"
+	ERR_EXTENSION_SUSPENDED  = "EXTENSION_SUSPENDED"
+	ERR_INVALID_REGISTRATION = "INVALID_REGISTRATION"
+	ERR_NONCE_REUSED         = "NONCE_REUSED"
+	ERR_CAPACITY_REACHED     = "CAPACITY_REACHED"
+	ERR_INVALID_ADMIN_KEY    = "INVALID_ADMIN_KEY"
+	ERR_RATE_LIMITED         = "RATE_LIMITED"
+
+	// Server and upstream problems
+	ERR_NOT_CONFIGURED            = "NOT_CONFIGURED"
+	ERR_UNAVAILABLE               = "SERVICE_UNAVAILABLE"
+	ERR_INTERNAL                  = "INTERNAL_ERROR"
+	ERR_UPSTREAM_TIMEOUT          = "UPSTREAM_TIMEOUT"
+	ERR_UPSTREAM_ERROR            = "UPSTREAM_ERROR"
+	ERR_UPSTREAM_INVALID_RESPONSE = "UPSTREAM_INVALID_RESPONSE"
+)
+
+// Body of every error response
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+type APIError struct {
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details"`
+}
+
+// Build an error body. details may be nil; it is sent as an empty object so
+// clients can always index into it.
+func newAPIError(code, message string, details map[string]interface{}) APIError {
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+	return APIError{Code: code, Message: message, Details: details}
+}
+
+// Write an error response
+func writeError(w http.ResponseWriter, status int, code, message string, details map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: newAPIError(code, message, details)})
+}
+
+// Status and body for an upstream failure, passing through the upstream
+// status when there is one
+func upstreamAPIError(err error, message string) (int, APIError) {
+	var upstreamErr *UpstreamError
+	var payloadErr *PayloadError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, newAPIError(ERR_UPSTREAM_TIMEOUT, message, nil)
+	case errors.As(err, &upstreamErr):
+		return upstreamErr.StatusCode, newAPIError(ERR_UPSTREAM_ERROR, message, map[string]interface{}{
+			"upstreamStatus": upstreamErr.StatusCode,
+		})
+	case errors.As(err, &payloadErr):
+		return http.StatusBadGateway, newAPIError(ERR_UPSTREAM_INVALID_RESPONSE, message, nil)
+	default:
+		return http.StatusInternalServerError, newAPIError(ERR_INTERNAL, message, nil)
+	}
+}
+
+// Write an upstream failure
+func writeUpstreamError(w http.ResponseWriter, err error, message string) {
+	status, apiErr := upstreamAPIError(err, message)
+	writeError(w, status, apiErr.Code, apiErr.Message, apiErr.Details)
+}
+
+// Respond to a request for a path or method the API doesn't serve
+func writeNotFound(w http.ResponseWriter) {
+	writeError(w, http.StatusNotFound, ERR_NOT_FOUND, "Not found", nil)
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter) {
+	writeError(w, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Decode an error response body
+func decodeAPIError(t *testing.T, w *httptest.ResponseRecorder) APIError {
+	t.Helper()
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Expected a JSON error, got Content-Type %q", got)
+	}
+	var body ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Error body is not JSON: %q", w.Body.String())
+	}
+	return body.Error
+}
+
+func TestWriteError(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeError(w, http.StatusTooManyRequests, ERR_RATE_LIMITED, "Rate limit exceeded", map[string]interface{}{"retryAfter": 3})
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429, got %d", w.Code)
+	}
+	apiErr := decodeAPIError(t, w)
+	if apiErr.Code != ERR_RATE_LIMITED || apiErr.Message != "Rate limit exceeded" || apiErr.Details["retryAfter"] != float64(3) {
+		t.Errorf("Unexpected error body %+v", apiErr)
+	}
+
+	// Details are always an object
+	w = httptest.NewRecorder()
+	writeError(w, http.StatusNotFound, ERR_NOT_FOUND, "Not found", nil)
+	if want := `{"error":{"code":"NOT_FOUND","message":"Not found","details":{}}}`; w.Body.String() != want+"\n" {
+		t.Errorf("Expected %s, got %s", want, w.Body.String())
+	}
+}
+
+func TestWriteUpstreamError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{fmt.Errorf("fetch: %w", context.DeadlineExceeded), http.StatusGatewayTimeout, ERR_UPSTREAM_TIMEOUT},
+		{&UpstreamError{StatusCode: http.StatusTooManyRequests}, http.StatusTooManyRequests, ERR_UPSTREAM_ERROR},
+		{&PayloadError{errors.New("bad json")}, http.StatusBadGateway, ERR_UPSTREAM_INVALID_RESPONSE},
+		{errors.New("connection refused"), http.StatusInternalServerError, ERR_INTERNAL},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		writeUpstreamError(w, tt.err, "Failed to fetch weather data")
+		apiErr := decodeAPIError(t, w)
+		if w.Code != tt.status || apiErr.Code != tt.code || apiErr.Message != "Failed to fetch weather data" {
+			t.Errorf("%v: expected %d %s, got %d %+v", tt.err, tt.status, tt.code, w.Code, apiErr)
+		}
+	}
+}
+
+// Test that handler, middleware and parameter errors share the envelope
+func TestErrorEnvelopeFromHandlers(t *testing.T) {
+	setTestConfig(t, func(c *Config) { c.GoogleAPIKey = "test-key" })
+
+	w := httptest.NewRecorder()
+	dailyForecastHandler(w, httptest.NewRequest("GET", "/api/daily?lat=1&lon=2&days=30", nil))
+	apiErr := decodeAPIError(t, w)
+	if w.Code != http.StatusBadRequest || apiErr.Code != ERR_INVALID_PARAMETER || apiErr.Details["parameter"] != "days" || apiErr.Details["max"] != float64(MAX_FORECAST_DAYS) {
+		t.Errorf("Expected INVALID_PARAMETER for days, got %d %+v", w.Code, apiErr)
+	}
+
+	w = httptest.NewRecorder()
+	authMiddleware(func(w http.ResponseWriter, r *http.Request) {})(w, httptest.NewRequest("GET", "/api/weather", nil))
+	if apiErr := decodeAPIError(t, w); w.Code != http.StatusUnauthorized || apiErr.Code != ERR_MISSING_CREDENTIALS {
+		t.Errorf("Expected MISSING_CREDENTIALS, got %d %+v", w.Code, apiErr)
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Where a request's coordinates came from, when the client didn't send them
+const LOCATION_SOURCE_IP = "ip"
+
+// Marks the start of the metadata section at the end of an .mmdb file
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// RequestLocation is the approximate location of a request that was sent
+// without coordinates, as returned in the `location` field of responses
+type RequestLocation struct {
+	Source           string  `json:"source"`
+	Lat              float64 `json:"lat"`
+	Lon              float64 `json:"lon"`
+	AccuracyRadiusKm int     `json:"accuracyRadiusKm,omitempty"`
+	City             string  `json:"city,omitempty"`
+	Region           string  `json:"region,omitempty"`
+	Country          string  `json:"country,omitempty"`
+	CountryCode      string  `json:"countryCode,omitempty"`
+	TimeZone         string  `json:"timeZone,omitempty"` // IANA ID, e.g. Europe/Paris
+}
+
+// GeoIP city database, loaded at startup when GEOIP_DATABASE_PATH is set
+var geoIP *geoIPDatabase
+
+// Proxies whose X-Forwarded-For header is trusted, loaded at startup from
+// TRUSTED_PROXIES
+var trustedProxies []netip.Prefix
+
+// geoIPDatabase reads a MaxMind DB (.mmdb) file such as GeoLite2 City. The
+// whole file is held in memory.
+type geoIPDatabase struct {
+	tree       []byte
+	data       mmdbDecoder
+	nodeCount  uint32
+	recordSize int
+	ipVersion  int
+	ipv4Start  uint32 // node reached by the 96 zero bits before IPv4 addresses
+}
+
+// Load a GeoIP database file
+func openGeoIPDatabase(path string) (*geoIPDatabase, error) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read geoip database: %w", err)
+	}
+	db, err := newGeoIPDatabase(file)
+	if err != nil {
+		return nil, fmt.Errorf("geoip database %s: %w", path, err)
+	}
+	return db, nil
+}
+
+// Parse a GeoIP database from the contents of an .mmdb file
+func newGeoIPDatabase(file []byte) (*geoIPDatabase, error) {
+	start := bytes.LastIndex(file, mmdbMetadataMarker)
+	if start < 0 {
+		return nil, errors.New("metadata not found, not a MaxMind DB file")
+	}
+	metadata, _, err := mmdbDecoder{file[start+len(mmdbMetadataMarker):]}.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("decode metadata: %w", err)
+	}
+
+	nodeCount, _ := mmdbLookup(metadata, "node_count").(uint64)
+	recordSize, _ := mmdbLookup(metadata, "record_size").(uint64)
+	ipVersion, _ := mmdbLookup(metadata, "ip_version").(uint64)
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", recordSize)
+	}
+	if ipVersion != 4 && ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported IP version %d", ipVersion)
+	}
+	// The search tree is followed by 16 zero bytes, then the data section
+	treeSize := int(nodeCount) * int(recordSize) / 4
+	if nodeCount == 0 || nodeCount > math.MaxUint32 || treeSize+16 > start {
+		return nil, fmt.Errorf("invalid node count %d", nodeCount)
+	}
+
+	db := &geoIPDatabase{
+		tree:       file[:treeSize],
+		data:       mmdbDecoder{file[treeSize+16 : start]},
+		nodeCount:  uint32(nodeCount),
+		recordSize: int(recordSize),
+		ipVersion:  int(ipVersion),
+	}
+	if db.ipVersion == 6 {
+		for i := 0; i < 96 && db.ipv4Start < db.nodeCount; i++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// Read the left (bit 0) or right (bit 1) record of a search tree node
+func (db *geoIPDatabase) record(node uint32, bit byte) uint32 {
+	switch db.recordSize {
+	case 24:
+		b := db.tree[int(node)*6+int(bit)*3:]
+		return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+	case 28:
+		b := db.tree[int(node)*7:]
+		if bit == 0 {
+			return uint32(b[3]>>4)<<24 | uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+		}
+		return uint32(b[3]&0x0f)<<24 | uint32(b[4])<<16 | uint32(b[5])<<8 | uint32(b[6])
+	default:
+		return binary.BigEndian.Uint32(db.tree[int(node)*8+int(bit)*4:])
+	}
+}
+
+// Find the record for an address. It returns nil when the database has
+// no entry for it.
+func (db *geoIPDatabase) find(addr netip.Addr) (interface{}, error) {
+	addr = addr.Unmap()
+	var ip []byte
+	node := uint32(0)
+	if addr.Is4() {
+		b := addr.As4()
+		ip, node = b[:], db.ipv4Start
+	} else if db.ipVersion == 6 {
+		b := addr.As16()
+		ip = b[:]
+	} else {
+		return nil, nil
+	}
+
+	for i := 0; i < len(ip)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, ip[i/8]>>(7-i%8)&1)
+	}
+	switch {
+	case node == db.nodeCount:
+		return nil, nil
+	case node < db.nodeCount:
+		return nil, errors.New("search tree deeper than the address")
+	}
+	record, _, err := db.data.decode(int(node-db.nodeCount-16), 0)
+	return record, err
+}
+
+// Locate an address, naming places in lang where the database has the
+// translation and in English otherwise. It returns nil for addresses
+// without coordinates, such as private ranges.
+func (db *geoIPDatabase) Lookup(addr netip.Addr, lang string) (*RequestLocation, error) {
+	record, err := db.find(addr)
+	if err != nil || record == nil {
+		return nil, err
+	}
+	lat, latOK := mmdbLookup(record, "location", "latitude").(float64)
+	lon, lonOK := mmdbLookup(record, "location", "longitude").(float64)
+	if !latOK || !lonOK {
+		return nil, nil
+	}
+
+	location := &RequestLocation{
+		Source:  LOCATION_SOURCE_IP,
+		Lat:     lat,
+		Lon:     lon,
+		City:    localizedName(mmdbLookup(record, "city", "names"), lang),
+		Region:  localizedName(mmdbLookup(record, "subdivisions", 0, "names"), lang),
+		Country: localizedName(mmdbLookup(record, "country", "names"), lang),
+	}
+	location.CountryCode, _ = mmdbLookup(record, "country", "iso_code").(string)
+	location.TimeZone, _ = mmdbLookup(record, "location", "time_zone").(string)
+	if radius, ok := mmdbLookup(record, "location", "accuracy_radius").(uint64); ok {
+		location.AccuracyRadiusKm = int(radius)
+	}
+	return location, nil
+}
+
+// Pick the name for lang from a MaxMind names map, falling back to the
+// base language, then English
+func localizedName(names interface{}, lang string) string {
+	base, _, _ := strings.Cut(lang, "-")
+	for _, key := range []string{lang, base, "en"} {
+		if name, ok := mmdbLookup(names, key).(string); ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// Walk decoded MaxMind DB data by map keys and array indexes, returning nil
+// when a step is missing
+func mmdbLookup(value interface{}, path ...interface{}) interface{} {
+	for _, step := range path {
+		switch key := step.(type) {
+		case string:
+			m, ok := value.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			value = m[key]
+		case int:
+			a, ok := value.([]interface{})
+			if !ok || key >= len(a) {
+				return nil
+			}
+			value = a[key]
+		}
+	}
+	return value
+}
+
+// MaxMind DB data types
+const (
+	mmdbExtended = 0
+	mmdbPointer  = 1
+	mmdbString   = 2
+	mmdbDouble   = 3
+	mmdbBytes    = 4
+	mmdbUint16   = 5
+	mmdbUint32   = 6
+	mmdbMap      = 7
+	mmdbInt32    = 8
+	mmdbUint64   = 9
+	mmdbUint128  = 10
+	mmdbArray    = 11
+	mmdbBool     = 14
+	mmdbFloat    = 15
+)
+
+// Limits how deeply pointers, maps and arrays may nest so a corrupt file
+// can't recurse forever
+const MMDB_MAX_DEPTH = 32
+
+// mmdbDecoder decodes the MaxMind DB data format. Maps decode to
+// map[string]interface{}, arrays to []interface{}, unsigned integers to
+// uint64 and floats to float64. Pointers are offsets from the start of buf.
+type mmdbDecoder struct {
+	buf []byte
+}
+
+var errMMDBTruncated = errors.New("mmdb data truncated")
+
+func (d mmdbDecoder) bytes(offset, n int) ([]byte, error) {
+	if offset < 0 || n < 0 || offset+n > len(d.buf) {
+		return nil, errMMDBTruncated
+	}
+	return d.buf[offset : offset+n], nil
+}
+
+// Decode the value at offset, returning it and the offset that follows it
+func (d mmdbDecoder) decode(offset, depth int) (interface{}, int, error) {
+	if depth > MMDB_MAX_DEPTH {
+		return nil, 0, errors.New("mmdb data nested too deeply")
+	}
+	b, err := d.bytes(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	offset++
+	kind := int(ctrl >> 5)
+
+	if kind == mmdbPointer {
+		target, next, err := d.pointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.decode(target, depth+1)
+		return value, next, err
+	}
+	if kind == mmdbExtended {
+		b, err := d.bytes(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		kind = 7 + int(b[0])
+		offset++
+	}
+
+	size := int(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		b, err := d.bytes(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + int(b[0])
+		case 2:
+			size = 285 + (int(b[0])<<8 | int(b[1]))
+		default:
+			size = 65821 + (int(b[0])<<16 | int(b[1])<<8 | int(b[2]))
+		}
+	}
+
+	switch kind {
+	case mmdbMap:
+		m := make(map[string]interface{}, size)
+		for i := 0; i < size; i++ {
+			key, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("mmdb map key is not a string")
+			}
+			m[name], offset, err = d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]interface{}, size)
+		for i := range a {
+			a[i], offset, err = d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	}
+
+	b, err = d.bytes(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += size
+	switch kind {
+	case mmdbString:
+		return string(b), offset, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("mmdb double of %d bytes", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("mmdb float of %d bytes", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbInt32:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("mmdb integer of %d bytes", size)
+		}
+		var value uint64
+		for _, c := range b {
+			value = value<<8 | uint64(c)
+		}
+		if kind == mmdbInt32 {
+			return int64(int32(uint32(value))), offset, nil
+		}
+		return value, offset, nil
+	case mmdbBytes, mmdbUint128:
+		// 128-bit integers aren't used by city databases and are left as bytes
+		return slices.Clone(b), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported mmdb data type %d", kind)
+}
+
+// Read a pointer's target, returning it and the offset after the pointer
+func (d mmdbDecoder) pointer(ctrl byte, offset int) (int, int, error) {
+	n := int(ctrl>>3&3) + 1
+	b, err := d.bytes(offset, n)
+	if err != nil {
+		return 0, 0, err
+	}
+	high := int(ctrl & 7)
+	switch n {
+	case 1:
+		return high<<8 | int(b[0]), offset + n, nil
+	case 2:
+		return 2048 + (high<<16 | int(b[0])<<8 | int(b[1])), offset + n, nil
+	case 3:
+		return 526336 + (high<<24 | int(b[0])<<16 | int(b[1])<<8 | int(b[2])), offset + n, nil
+	default:
+		return int(binary.BigEndian.Uint32(b)), offset + n, nil
+	}
+}
+
+// Parse TRUSTED_PROXIES entries, each an address or CIDR range
+func parseTrustedProxies(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		if addr, err := netip.ParseAddr(entry); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR range", entry)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func isTrustedProxy(addr netip.Addr) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the address of the client that made a request. X-Forwarded-For is
+// only believed when the connection comes from a trusted proxy; it is read
+// right to left, skipping other trusted proxies, so a client can't spoof
+// its address by sending the header itself.
+func clientIP(r *http.Request) (netip.Addr, bool) {
+	var addr netip.Addr
+	if addrPort, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		addr = addrPort.Addr().Unmap()
+	} else if parsed, err := netip.ParseAddr(r.RemoteAddr); err == nil {
+		addr = parsed.Unmap()
+	} else {
+		return netip.Addr{}, false
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0 && isTrustedProxy(addr); i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+	}
+	return addr, true
+}
+
+// Resolve the coordinates of a request. They come from lat and lon when
+// either is given; otherwise from the client IP when a GeoIP database is
+// loaded, in which case the location is returned to be echoed in the
+// response.
+func locateRequest(r *http.Request, query url.Values, lang string) (lat, lon string, location *RequestLocation, err *ParamError) {
+	if query.Has("lat") || query.Has("lon") || geoIP == nil {
+		lat, lon, err = parseCoordinates(query)
+		return lat, lon, nil, err
+	}
+
+	if addr, ok := clientIP(r); ok {
+		var lookupErr error
+		location, lookupErr = geoIP.Lookup(addr, lang)
+		if lookupErr != nil {
+			slog.WarnContext(r.Context(), "geoip lookup failed", "error", lookupErr)
+		}
+	}
+	if location == nil {
+		err = missingParam("lat")
+		err.Message = "Missing lat parameter, and the location could not be determined from the client IP"
+		return "", "", nil, err
+	}
+	return strconv.FormatFloat(location.Lat, 'f', -1, 64), strconv.FormatFloat(location.Lon, 'f', -1, 64), location, nil
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// Encode a value in the MaxMind DB data format, without pointers
+func encodeMMDB(value interface{}) []byte {
+	control := func(kind, size int) []byte {
+		var b []byte
+		if kind > 7 {
+			b = []byte{0, byte(kind - 7)}
+		} else {
+			b = []byte{byte(kind << 5)}
+		}
+		switch {
+		case size < 29:
+			b[0] |= byte(size)
+			return b
+		case size < 285:
+			b[0] |= 29
+			return append(b, byte(size-29))
+		case size < 65821:
+			b[0] |= 30
+			return binary.BigEndian.AppendUint16(b, uint16(size-285))
+		}
+		b[0] |= 31
+		size -= 65821
+		return append(b, byte(size>>16), byte(size>>8), byte(size))
+	}
+
+	switch v := value.(type) {
+	case string:
+		return append(control(mmdbString, len(v)), v...)
+	case float64:
+		return binary.BigEndian.AppendUint64(control(mmdbDouble, 8), math.Float64bits(v))
+	case uint16:
+		return binary.BigEndian.AppendUint16(control(mmdbUint16, 2), v)
+	case uint32:
+		return binary.BigEndian.AppendUint32(control(mmdbUint32, 4), v)
+	case []interface{}:
+		b := control(mmdbArray, len(v))
+		for _, item := range v {
+			b = append(b, encodeMMDB(item)...)
+		}
+		return b
+	case map[string]interface{}:
+		b := control(mmdbMap, len(v))
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			b = append(b, encodeMMDB(key)...)
+			b = append(b, encodeMMDB(v[key])...)
+		}
+		return b
+	}
+	panic("unsupported mmdb test value")
+}
+
+// Build an IPv6 MaxMind DB with 24-bit records mapping each network to its
+// record
+func buildMMDB(t *testing.T, networks map[string]map[string]interface{}) []byte {
+	t.Helper()
+	const empty = -1
+	nodes := [][2]int{{empty, empty}}
+	var data []byte
+	var dataOffsets []int
+
+	for cidr, record := range networks {
+		prefix := netip.MustParsePrefix(cidr)
+		addr, bits := prefix.Addr().As16(), prefix.Bits()
+		// IPv4 networks live under ::/96, not the IPv4-mapped range
+		if prefix.Addr().Is4() {
+			v4 := prefix.Addr().As4()
+			addr = [16]byte{12: v4[0], 13: v4[1], 14: v4[2], 15: v4[3]}
+			bits += 96
+		}
+		dataOffsets = append(dataOffsets, len(data))
+		data = append(data, encodeMMDB(record)...)
+
+		node := 0
+		for i := 0; i < bits; i++ {
+			bit := int(addr[i/8]>>(7-i%8)) & 1
+			if i == bits-1 {
+				nodes[node][bit] = -2 - (len(dataOffsets) - 1)
+				break
+			}
+			if nodes[node][bit] == empty {
+				nodes = append(nodes, [2]int{empty, empty})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+
+	nodeCount := len(nodes)
+	var file []byte
+	for _, node := range nodes {
+		for _, record := range node {
+			value := record
+			switch {
+			case record == empty:
+				value = nodeCount
+			case record < empty:
+				value = nodeCount + 16 + dataOffsets[-2-record]
+			}
+			file = append(file, byte(value>>16), byte(value>>8), byte(value))
+		}
+	}
+	file = append(file, make([]byte, 16)...)
+	file = append(file, data...)
+	file = append(file, mmdbMetadataMarker...)
+	file = append(file, encodeMMDB(map[string]interface{}{
+		"binary_format_major_version": uint16(2),
+		"database_type":               "GeoLite2-City",
+		"ip_version":                  uint16(6),
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(24),
+	})...)
+	return file
+}
+
+func testGeoIPDatabase(t *testing.T) *geoIPDatabase {
+	t.Helper()
+	db, err := newGeoIPDatabase(buildMMDB(t, map[string]map[string]interface{}{
+		"81.2.69.0/24": {
+			"city":         map[string]interface{}{"names": map[string]interface{}{"en": "London", "fr": "Londres"}},
+			"subdivisions": []interface{}{map[string]interface{}{"iso_code": "ENG", "names": map[string]interface{}{"en": "England"}}},
+			"country":      map[string]interface{}{"iso_code": "GB", "names": map[string]interface{}{"en": "United Kingdom", "fr": "Royaume-Uni"}},
+			"location": map[string]interface{}{
+				"latitude": 51.5142, "longitude": -0.0931, "accuracy_radius": uint16(10), "time_zone": "Europe/London",
+			},
+		},
+		"2001:db8::/32": {
+			"country": map[string]interface{}{"iso_code": "FR"},
+		},
+	}))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	return db
+}
+
+func TestGeoIPLookup(t *testing.T) {
+	db := testGeoIPDatabase(t)
+
+	location, err := db.Lookup(netip.MustParseAddr("81.2.69.160"), "fr")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := RequestLocation{
+		Source: LOCATION_SOURCE_IP, Lat: 51.5142, Lon: -0.0931, AccuracyRadiusKm: 10,
+		City: "Londres", Region: "England", Country: "Royaume-Uni", CountryCode: "GB", TimeZone: "Europe/London",
+	}
+	if location == nil || *location != want {
+		t.Errorf("Expected %+v, got %+v", want, location)
+	}
+
+	// Unknown languages fall back to English, and IPv4-mapped addresses
+	// find the IPv4 network
+	location, _ = db.Lookup(netip.MustParseAddr("::ffff:81.2.69.1"), "pt-BR")
+	if location == nil || location.City != "London" {
+		t.Errorf("Expected London, got %+v", location)
+	}
+
+	// Unknown addresses and records without coordinates aren't located
+	for _, addr := range []string{"10.0.0.1", "2001:db8::1", "2001:db9::1"} {
+		if location, err := db.Lookup(netip.MustParseAddr(addr), "en"); location != nil || err != nil {
+			t.Errorf("%s: expected no location, got %+v, %v", addr, location, err)
+		}
+	}
+
+	if _, err := newGeoIPDatabase([]byte("not a database")); err == nil {
+		t.Error("Expected a file without metadata to be rejected")
+	}
+}
+
+func TestMMDBDecoderPointers(t *testing.T) {
+	long := strings.Repeat("x", 100)
+	buf := encodeMMDB("en")
+	buf = append(buf, encodeMMDB(long)...)
+	// An array of a pointer back to "en" and true
+	buf = append(buf, 0x02, mmdbArray-7, mmdbPointer<<5, 0x00, 0x01, mmdbBool-7)
+
+	value, next, err := mmdbDecoder{buf}.decode(3, 0)
+	if err != nil || value != long || next != 3+2+len(long) {
+		t.Errorf("Expected the long string, got %v, %d, %v", value, next, err)
+	}
+	value, _, err = mmdbDecoder{buf}.decode(next, 0)
+	if err != nil || !slices.Equal(value.([]interface{}), []interface{}{"en", true}) {
+		t.Errorf("Expected the pointer to be followed, got %v, %v", value, err)
+	}
+
+	if _, _, err := (mmdbDecoder{buf[:10]}).decode(3, 0); err == nil {
+		t.Error("Expected truncated data to be rejected")
+	}
+}
+
+// Test each encoding of the size of strings, maps and arrays
+func TestMMDBDecoderSizes(t *testing.T) {
+	for _, n := range []int{28, 29, 284, 285, 286, 65820, 65821, 70000} {
+		long := strings.Repeat("x", n)
+		value, _, err := mmdbDecoder{encodeMMDB(long)}.decode(0, 0)
+		if err != nil || value != long {
+			t.Errorf("Expected a %d-byte string, got %d bytes (%v)", n, len(fmt.Sprint(value)), err)
+		}
+	}
+
+	array := make([]interface{}, 300)
+	for i := range array {
+		array[i] = uint16(i)
+	}
+	value, _, err := mmdbDecoder{encodeMMDB(array)}.decode(0, 0)
+	if decoded, ok := value.([]interface{}); err != nil || !ok || len(decoded) != 300 || decoded[299] != uint64(299) {
+		t.Errorf("Expected a 300-item array, got %v", err)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	original := trustedProxies
+	trustedProxies, _ = parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	defer func() { trustedProxies = original }()
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		want         string
+	}{
+		{"direct", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"untrusted forwarder", "203.0.113.7:5000", []string{"81.2.69.160"}, "203.0.113.7"},
+		{"trusted proxy", "10.1.2.3:5000", []string{"81.2.69.160"}, "81.2.69.160"},
+		{"spoofed hop", "10.1.2.3:5000", []string{"1.1.1.1, 81.2.69.160, 192.0.2.1"}, "81.2.69.160"},
+		{"repeated headers", "10.1.2.3:5000", []string{"1.1.1.1", "81.2.69.160"}, "81.2.69.160"},
+		{"malformed hop", "10.1.2.3:5000", []string{"garbage"}, "10.1.2.3"},
+		{"ipv6", "[2001:db8::1]:5000", nil, "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/api/current", nil)
+		r.RemoteAddr = tt.remoteAddr
+		for _, value := range tt.forwardedFor {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		if got, ok := clientIP(r); !ok || got.String() != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.want, got)
+		}
+	}
+
+	if _, err := parseTrustedProxies([]string{"10.0.0.0/8", "proxy.internal"}); err == nil {
+		t.Error("Expected a hostname to be rejected")
+	}
+}
+
+// Test that requests without coordinates are located by client IP
+func TestLocateRequestByIP(t *testing.T) {
+	weatherCache = newResponseCache()
+
+	var upstreamLat atomic.Value
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamLat.Store(r.URL.Query().Get("location.latitude"))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(mockGoogleWeatherResponse())
+	}))
+	defer mockServer.Close()
+
+	originalBase, originalGeoIP := GOOGLE_WEATHER_BASE, geoIP
+	GOOGLE_WEATHER_BASE, geoIP = mockServer.URL, testGeoIPDatabase(t)
+	defer func() { GOOGLE_WEATHER_BASE, geoIP = originalBase, originalGeoIP }()
+	setTestConfig(t, func(c *Config) { c.GoogleAPIKey = "test-key" })
+
+	r := httptest.NewRequest("GET", "/api/current?lang=fr", nil)
+	r.RemoteAddr = "81.2.69.160:5000"
+	w := httptest.NewRecorder()
+	currentConditionsHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var current CurrentConditions
+	if err := json.Unmarshal(w.Body.Bytes(), &current); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if current.Location == nil || current.Location.Source != LOCATION_SOURCE_IP || current.Location.City != "Londres" {
+		t.Errorf("Expected an IP location, got %+v", current.Location)
+	}
+	if upstreamLat.Load() != "51.5142" {
+		t.Errorf("Expected the IP coordinates upstream, got %v", upstreamLat.Load())
+	}
+
+	// Coordinates in the query win, and aren't echoed back
+	r = httptest.NewRequest("GET", "/api/current?lat=37.7749&lon=-122.4194", nil)
+	r.RemoteAddr = "81.2.69.160:5000"
+	w = httptest.NewRecorder()
+	currentConditionsHandler(w, r)
+	if strings.Contains(w.Body.String(), `"location"`) || upstreamLat.Load() != "37.7749" {
+		t.Errorf("Expected the query coordinates without a location, got %s", w.Body.String())
+	}
+
+	// An address the database doesn't know is still a missing parameter
+	r = httptest.NewRequest("GET", "/api/current", nil)
+	r.RemoteAddr = "192.168.1.10:5000"
+	w = httptest.NewRecorder()
+	currentConditionsHandler(w, r)
+	if apiErr := decodeAPIError(t, w); w.Code != http.StatusBadRequest || apiErr.Code != ERR_MISSING_PARAMETER {
+		t.Errorf("Expected 400 MISSING_PARAMETER, got %d %+v", w.Code, apiErr)
+	}
+}
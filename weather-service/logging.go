@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Longest client-supplied request ID that is accepted as is
+const MAX_REQUEST_ID_LENGTH = 128
+
+type requestIDKey struct{}
+
+// Attach a request ID to ctx
+func withRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// Request ID attached to ctx, or "" outside a request
+func requestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// contextHandler adds the request ID from the context to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if requestID := requestIDFromContext(ctx); requestID != "" {
+		record.AddAttrs(slog.String("requestId", requestID))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// Build the JSON logger writing to w, logging from level (debug, info, warn
+// or error) up
+func newLogger(w io.Writer, level string) (*slog.Logger, error) {
+	var minLevel slog.Level
+	if err := minLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	handler := slog.NewJSONHandler(w, &slog.HandlerOptions{Level: minLevel})
+	return slog.New(contextHandler{handler}), nil
+}
+
+// Accept the client's X-Request-ID or generate one, attach it to the
+// request context, echo it in the response and log the completed request
+func requestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+		}
+		r.Header.Set("X-Request-ID", requestID)
+		w.Header().Set("X-Request-ID", requestID)
+		ctx := withRequestID(r.Context(), requestID)
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		slog.InfoContext(ctx, "request completed",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", recorder.status,
+			"durationMs", time.Since(start).Milliseconds(),
+			"remoteAddr", r.RemoteAddr,
+		)
+	})
+}
+
+// A client request ID is kept only if it is short and printable, so it
+// can't forge log fields or bloat every line
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > MAX_REQUEST_ID_LENGTH {
+		return false
+	}
+	for _, c := range requestID {
+		isAlnum := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+		if !isAlnum && !strings.ContainsRune("-_.:", c) {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Security event attributes in a stable order
+func securityEventAttrs(eventType string, data map[string]interface{}) []slog.Attr {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	attrs := make([]slog.Attr, 0, len(keys)+1)
+	attrs = append(attrs, slog.String("eventType", eventType))
+	for _, key := range keys {
+		attrs = append(attrs, slog.Any(key, data[key]))
+	}
+	return attrs
+}
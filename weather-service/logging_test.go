@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Route the default logger to a buffer for the duration of a test
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "info")
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	original := slog.Default()
+	slog.SetDefault(logger)
+	t.Cleanup(func() { slog.SetDefault(original) })
+	return &buf
+}
+
+// Decode JSON log lines
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Log line is not JSON: %q", line)
+		}
+		lines = append(lines, entry)
+	}
+	return lines
+}
+
+// Test that request IDs are accepted or generated, echoed and logged
+func TestRequestLogger(t *testing.T) {
+	buf := captureLogs(t)
+
+	var handlerRequestID string
+	handler := requestLogger(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerRequestID = requestIDFromContext(r.Context())
+		slog.ErrorContext(r.Context(), "upstream failed")
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+
+	req := httptest.NewRequest("GET", "/api/weather", nil)
+	req.Header.Set("X-Request-ID", "client-id-123")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if handlerRequestID != "client-id-123" {
+		t.Errorf("Expected client request ID in context, got %q", handlerRequestID)
+	}
+	if got := w.Header().Get("X-Request-ID"); got != "client-id-123" {
+		t.Errorf("Expected request ID echoed, got %q", got)
+	}
+
+	lines := logLines(t, buf)
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 log lines, got %d", len(lines))
+	}
+	for _, line := range lines {
+		if line["requestId"] != "client-id-123" {
+			t.Errorf("Expected requestId on every line, got %v", line)
+		}
+	}
+	if lines[1]["msg"] != "request completed" || lines[1]["status"] != float64(http.StatusBadGateway) {
+		t.Errorf("Unexpected access log line %v", lines[1])
+	}
+
+	// Missing or unsafe IDs are replaced
+	for _, clientID := range []string{"", "has space", strings.Repeat("a", MAX_REQUEST_ID_LENGTH+1)} {
+		req := httptest.NewRequest("GET", "/health", nil)
+		req.Header.Set("X-Request-ID", clientID)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		got := w.Header().Get("X-Request-ID")
+		if got == clientID || len(got) != 32 {
+			t.Errorf("Expected generated request ID for %q, got %q", clientID, got)
+		}
+		if handlerRequestID != got {
+			t.Errorf("Expected context ID %q to match response header %q", handlerRequestID, got)
+		}
+	}
+}
+
+// Test that security events are structured and failures logged as warnings
+func TestLogSecurityEvent(t *testing.T) {
+	buf := captureLogs(t)
+
+	ctx := withRequestID(context.Background(), "req-1")
+	logSecurityEvent(ctx, "INVALID_TOKEN", map[string]interface{}{"extensionId": "ext-1"})
+	logSecurityEvent(ctx, "EXTENSION_REGISTERED", map[string]interface{}{"extensionId": "ext-1"})
+
+	lines := logLines(t, buf)
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 log lines, got %d", len(lines))
+	}
+	if lines[0]["level"] != "WARN" || lines[0]["eventType"] != "INVALID_TOKEN" {
+		t.Errorf("Expected INVALID_TOKEN warning, got %v", lines[0])
+	}
+	if lines[1]["level"] != "INFO" || lines[1]["eventType"] != "EXTENSION_REGISTERED" {
+		t.Errorf("Expected EXTENSION_REGISTERED info, got %v", lines[1])
+	}
+	for _, line := range lines {
+		if line["extensionId"] != "ext-1" || line["requestId"] != "req-1" {
+			t.Errorf("Expected event data and request ID, got %v", line)
+		}
+	}
+}
+
+func TestNewLoggerLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "warn")
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	logger.Info("dropped")
+	logger.Warn("kept")
+	if strings.Contains(buf.String(), "dropped") || !strings.Contains(buf.String(), "kept") {
+		t.Errorf("Expected only warnings to be logged, got %q", buf.String())
+	}
+
+	if _, err := newLogger(&buf, "loud"); err == nil {
+		t.Error("Expected invalid log level to be rejected")
+	}
+}
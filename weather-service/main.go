@@ -1,602 +1,718 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
 var (
 	// These are variables so they can be overridden in tests
-	GOOGLE_WEATHER_BASE = "https://weather.googleapis.com/v1"
-	GOOGLE_GEOCODING_URL = "https://maps.googleapis.com/maps/api/geocode/json"
+	GOOGLE_WEATHER_BASE               = "https://weather.googleapis.com/v1"
+	GOOGLE_GEOCODING_URL              = "https://maps.googleapis.com/maps/api/geocode/json"
+	OPENWEATHER_ONECALL_URL           = "https://api.openweathermap.org/data/3.0/onecall"
+	OPENWEATHER_GEOCODING_URL         = "https://api.openweathermap.org/geo/1.0/direct"
+	GOOGLE_AIR_QUALITY_BASE           = "https://airquality.googleapis.com/v1"
+	GOOGLE_POLLEN_BASE                = "https://pollen.googleapis.com/v1"
+	GOOGLE_PLACES_BASE                = "https://places.googleapis.com/v1"
+	GOOGLE_TIMEZONE_URL               = "https://maps.googleapis.com/maps/api/timezone/json"
+	OPENWEATHER_REVERSE_GEOCODING_URL = "https://api.openweathermap.org/geo/1.0/reverse"
 )
 
-const (
-	OPENWEATHER_FORECAST_URL = "https://api.openweathermap.org/data/2.5/forecast"
-	OPENWEATHER_ONECALL_URL = "https://api.openweathermap.org/data/2.5/onecall"
-	// OpenWeatherMap API key (free tier)
-	OPENWEATHER_API_KEY = "439d4b804bc8187953eb36d2a8c26a02"
-)
-
-// Helper function to get condition description
-func getConditionDescription(conditionType string) string {
-	descriptions := map[string]string{
-		"CLEAR": "Clear",
-		"PARTLY_CLOUDY": "Partly Cloudy",
-		"MOSTLY_CLOUDY": "Mostly Cloudy",
-		"CLOUDY": "Cloudy",
-		"LIGHT_RAIN": "Light Rain",
-	}
-	if desc, ok := descriptions[conditionType]; ok {
-		return desc
-	}
-	return "Unknown"
-}
-
-// Helper function to extract timestamp from interval
-func getTimeFromInterval(interval interface{}) string {
-	if intervalMap, ok := interval.(map[string]interface{}); ok {
-		if startTime, ok := intervalMap["startTime"].(string); ok {
-			return startTime
-		}
-	}
-	return time.Now().Format(time.RFC3339)
-}
-
-// Create synthetic hourly data as fallback
-func createSyntheticHourlyData(currentData map[string]interface{}) []interface{} {
-	var hourlyList []interface{}
+// Create synthetic hourly data as fallback, labelled synthetic
+func createSyntheticHourlyData(current *CurrentConditions) []HourlyForecast {
+	var hourlyList []HourlyForecast
 	currentTime := time.Now()
-	
+
 	for i := 0; i < 24; i++ {
 		hourTime := currentTime.Add(time.Duration(i) * time.Hour)
-		hourlyItem := map[string]interface{}{
-			"timestamp": hourTime.Format(time.RFC3339),
-			"temperature": currentData["temperature"],
-			"feelsLikeTemperature": currentData["feelsLikeTemperature"],
-			"relativeHumidity": currentData["relativeHumidity"],
-			"weatherCondition": currentData["weatherCondition"],
-			"wind": currentData["wind"],
+		hourlyItem := HourlyForecast{
+			Timestamp: hourTime.Format(time.RFC3339),
+			Conditions: Conditions{
+				Temperature:          current.Temperature,
+				FeelsLikeTemperature: current.FeelsLikeTemperature,
+				RelativeHumidity:     current.RelativeHumidity,
+				WeatherCondition:     current.WeatherCondition,
+				Wind:                 current.Wind,
+				Precipitation:        current.Precipitation,
+			},
+			Freshness: Freshness{Synthetic: true},
 		}
-		
-		if precip, ok := currentData["precipitation"].(map[string]interface{}); ok {
-			hourlyItem["precipitation"] = precip
+		if current.Precipitation != nil {
+			hourlyItem.PrecipitationProbability = current.Precipitation.Probability
 		}
-		
+
 		hourlyList = append(hourlyList, hourlyItem)
 	}
-	
+
 	return hourlyList
 }
 
-// Create synthetic daily data as fallback
-func createSyntheticDailyData(currentData map[string]interface{}) []interface{} {
-	var dailyList []interface{}
+// Create synthetic daily data as fallback, labelled synthetic
+func createSyntheticDailyData(current *CurrentConditions) []DailyForecast {
+	var dailyList []DailyForecast
 	currentTime := time.Now()
-	
+
 	var baseTemp float64 = 15.0
-	if temp, ok := currentData["temperature"].(map[string]interface{}); ok {
-		if deg, ok := temp["degrees"].(float64); ok {
-			baseTemp = deg
-		}
+	unit := UNIT_CELSIUS
+	if current.Temperature != nil {
+		baseTemp = current.Temperature.Degrees
+		unit = current.Temperature.Unit
 	}
-	
+
 	for i := 0; i < 5; i++ {
 		futureDate := currentTime.AddDate(0, 0, i)
-		dailyItem := map[string]interface{}{
-			"date": futureDate.Format("2006-01-02"),
-			"maxTemperature": map[string]interface{}{
-				"degrees": baseTemp + 3,
-				"unit": "CELSIUS",
-			},
-			"minTemperature": map[string]interface{}{
-				"degrees": baseTemp - 3,
-				"unit": "CELSIUS",
-			},
-			"weatherCondition": currentData["weatherCondition"],
+		dailyItem := DailyForecast{
+			Date:             futureDate.Format("2006-01-02"),
+			MaxTemperature:   &Temperature{Degrees: baseTemp + 3, Unit: unit},
+			MinTemperature:   &Temperature{Degrees: baseTemp - 3, Unit: unit},
+			WeatherCondition: current.WeatherCondition,
+			Freshness:        Freshness{Synthetic: true},
 		}
-		
-		if precip, ok := currentData["precipitation"].(map[string]interface{}); ok {
-			dailyItem["precipitationProbability"] = precip["probability"]
+
+		if current.Precipitation != nil {
+			dailyItem.PrecipitationProbability = current.Precipitation.Probability
 		}
-		
+
 		dailyList = append(dailyList, dailyItem)
 	}
-	
+
 	return dailyList
 }
 
-// CORS middleware
-func enableCORS(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Allow all origins for Chrome extension
-		origin := r.Header.Get("Origin")
-		if origin != "" {
-			w.Header().Set("Access-Control-Allow-Origin", origin)
-		} else {
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-		}
-		
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Extension-Token, X-Extension-ID, X-Extension-Version, X-Extension-Fingerprint, X-Request-ID")
-		w.Header().Set("Access-Control-Max-Age", "86400")
-		
-		// Handle preflight requests
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
+// UpstreamError is returned when an upstream API answers with a non-200 status
+type UpstreamError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("upstream returned status %d: %s", e.StatusCode, e.Body)
+}
+
+// Shared client for upstream calls, unlike http.DefaultClient it has a
+// timeout. main sets it to the configured upstream timeout.
+var upstreamClient = &http.Client{Timeout: time.Duration(DefaultConfig().UpstreamTimeout)}
+
+// Fetch an upstream URL and return the body of a successful response
+func fetchUpstream(ctx context.Context, apiURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return doUpstream(req)
+}
+
+// POST payload as JSON to an upstream URL and return the body of a
+// successful response
+func postUpstream(ctx context.Context, apiURL string, payload interface{}) ([]byte, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doUpstream(req)
+}
+
+func doUpstream(req *http.Request) ([]byte, error) {
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		// Keep API keys in the query string out of logged errors
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = redactQuery(urlErr.URL)
 		}
-		
-		next(w, r)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read upstream response: %w", err)
 	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &UpstreamError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	return body, nil
+}
+
+// Strip the query string from an upstream URL
+func redactQuery(rawURL string) string {
+	if i := strings.IndexByte(rawURL, '?'); i >= 0 {
+		return rawURL[:i]
+	}
+	return rawURL
+}
+
+// Write a JSON response body
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
 }
 
 // Health check endpoint
 func healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
-		"status": "healthy",
-		"service": "weather-api-proxy",
+		"status":    "healthy",
+		"service":   "weather-api-proxy",
 		"timestamp": time.Now().Format(time.RFC3339),
 	})
 }
 
 // Current conditions endpoint
 func currentConditionsHandler(w http.ResponseWriter, r *http.Request) {
-	apiKey := os.Getenv("GOOGLE_API_KEY")
-	if apiKey == "" {
-		http.Error(w, "API key not configured", http.StatusInternalServerError)
+	provider := newWeatherProvider(config)
+	if provider == nil {
+		writeError(w, http.StatusInternalServerError, ERR_NOT_CONFIGURED, "API key not configured", nil)
 		return
 	}
-	
+
 	// Get query parameters
-	lat := r.URL.Query().Get("lat")
-	lon := r.URL.Query().Get("lon")
-	
-	if lat == "" || lon == "" {
-		http.Error(w, "Missing latitude or longitude", http.StatusBadRequest)
-		return
-	}
-	
-	// Build Google Weather API URL
-	url := fmt.Sprintf("%s/currentConditions:lookup?key=%s&location.latitude=%s&location.longitude=%s",
-		GOOGLE_WEATHER_BASE, apiKey, lat, lon)
-	
-	// Make request to Google Weather API
-	resp, err := http.Get(url)
-	if err != nil {
-		log.Printf("Error fetching current conditions: %v", err)
-		http.Error(w, "Failed to fetch weather data", http.StatusInternalServerError)
+	query := r.URL.Query()
+	lang, paramErr := parseLanguage(query)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
 		return
 	}
-	defer resp.Body.Close()
-	
-	// Read response body
-	body, err := io.ReadAll(resp.Body)
+	lat, lon, location, paramErr := locateRequest(r, query, lang)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+	units, paramErr := parseUnits(query)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+	ctx := withLanguage(r.Context(), lang)
+
+	current, status, err := cachedCurrentConditions(ctx, provider, lat, lon)
 	if err != nil {
-		log.Printf("Error reading response: %v", err)
-		http.Error(w, "Failed to read weather data", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "fetching current conditions failed", "error", err)
+		writeUpstreamError(w, err, "Failed to fetch weather data")
 		return
 	}
-	
-	// Return response
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(resp.StatusCode)
-	w.Write(body)
+
+	conditions := current.InUnits(units).Localized(lang)
+	conditions.Location = location
+	w.Header().Set("X-Cache", string(status))
+	writeJSON(w, conditions)
 }
 
 // Hourly forecast endpoint
 func hourlyForecastHandler(w http.ResponseWriter, r *http.Request) {
-	apiKey := os.Getenv("GOOGLE_API_KEY")
-	if apiKey == "" {
-		http.Error(w, "API key not configured", http.StatusInternalServerError)
+	provider := newWeatherProvider(config)
+	if provider == nil {
+		writeError(w, http.StatusInternalServerError, ERR_NOT_CONFIGURED, "API key not configured", nil)
 		return
 	}
-	
+
 	// Get query parameters
-	lat := r.URL.Query().Get("lat")
-	lon := r.URL.Query().Get("lon")
-	hours := r.URL.Query().Get("hours")
-	
-	if lat == "" || lon == "" {
-		http.Error(w, "Missing latitude or longitude", http.StatusBadRequest)
-		return
-	}
-	
-	if hours == "" {
-		hours = "24" // Default to 24 hours
-	}
-	
-	// Build Google Weather API URL for hourly forecast
-	url := fmt.Sprintf("%s/forecast/hours:lookup?key=%s&location.latitude=%s&location.longitude=%s&hours=%s",
-		GOOGLE_WEATHER_BASE, apiKey, lat, lon, hours)
-	
-	// Make request to Google Weather API
-	resp, err := http.Get(url)
-	if err != nil {
-		log.Printf("Error fetching hourly forecast: %v", err)
-		http.Error(w, "Failed to fetch hourly forecast data", http.StatusInternalServerError)
+	query := r.URL.Query()
+	lang, paramErr := parseLanguage(query)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
 		return
 	}
-	defer resp.Body.Close()
-	
-	// Read response body
-	body, err := io.ReadAll(resp.Body)
+	lat, lon, location, paramErr := locateRequest(r, query, lang)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+	hours, paramErr := parseCountParam(query, "hours", DEFAULT_FORECAST_HOURS, MAX_FORECAST_HOURS)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+	units, paramErr := parseUnits(query)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+	ctx := withLanguage(r.Context(), lang)
+
+	hourly, timeZone, status, err := cachedHourlyForecast(ctx, provider, lat, lon, hours)
 	if err != nil {
-		log.Printf("Error reading response: %v", err)
-		http.Error(w, "Failed to read hourly forecast data", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "fetching hourly forecast failed", "error", err)
+		writeUpstreamError(w, err, "Failed to fetch hourly forecast data")
 		return
 	}
-	
-	// Return response
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(resp.StatusCode)
-	w.Write(body)
+
+	w.Header().Set("X-Cache", string(status))
+	writeJSON(w, HourlyResponse{
+		Hourly:    hourlyLocalized(hourlyInUnits(hourly, units), lang),
+		TimeZone:  timeZone,
+		Location:  location,
+		Timestamp: time.Now().Format(time.RFC3339),
+	})
 }
 
 // Hourly history endpoint - Google Weather API provides past 24 hours
 func hourlyHistoryHandler(w http.ResponseWriter, r *http.Request) {
-	apiKey := os.Getenv("GOOGLE_API_KEY")
-	if apiKey == "" {
-		http.Error(w, "API key not configured", http.StatusInternalServerError)
+	provider := newWeatherProvider(config)
+	if provider == nil {
+		writeError(w, http.StatusInternalServerError, ERR_NOT_CONFIGURED, "API key not configured", nil)
 		return
 	}
-	
+
 	// Get query parameters
-	lat := r.URL.Query().Get("lat")
-	lon := r.URL.Query().Get("lon")
-	hours := r.URL.Query().Get("hours")
-	
-	if lat == "" || lon == "" {
-		http.Error(w, "Missing latitude or longitude", http.StatusBadRequest)
-		return
-	}
-	
-	if hours == "" {
-		hours = "24" // Default to 24 hours of history
-	}
-	
-	// Build Google Weather API URL for hourly history
-	url := fmt.Sprintf("%s/history/hours:lookup?key=%s&location.latitude=%s&location.longitude=%s&hours=%s",
-		GOOGLE_WEATHER_BASE, apiKey, lat, lon, hours)
-	
-	// Make request to Google Weather API
-	resp, err := http.Get(url)
-	if err != nil {
-		log.Printf("Error fetching hourly history: %v", err)
-		http.Error(w, "Failed to fetch hourly history data", http.StatusInternalServerError)
+	query := r.URL.Query()
+	lang, paramErr := parseLanguage(query)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
 		return
 	}
-	defer resp.Body.Close()
-	
-	// Read response body
-	body, err := io.ReadAll(resp.Body)
+	lat, lon, location, paramErr := locateRequest(r, query, lang)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+	hours, paramErr := parseCountParam(query, "hours", DEFAULT_HISTORY_HOURS, MAX_HISTORY_HOURS)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+	units, paramErr := parseUnits(query)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+	ctx := withLanguage(r.Context(), lang)
+
+	hourly, timeZone, status, err := cachedHourlyHistory(ctx, provider, lat, lon, hours)
 	if err != nil {
-		log.Printf("Error reading response: %v", err)
-		http.Error(w, "Failed to read hourly history data", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "fetching hourly history failed", "error", err)
+		writeUpstreamError(w, err, "Failed to fetch hourly history data")
 		return
 	}
-	
-	// Return response
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(resp.StatusCode)
-	w.Write(body)
+
+	w.Header().Set("X-Cache", string(status))
+	writeJSON(w, HourlyResponse{
+		Hourly:    hourlyLocalized(hourlyInUnits(hourly, units), lang),
+		TimeZone:  timeZone,
+		Location:  location,
+		Timestamp: time.Now().Format(time.RFC3339),
+	})
 }
 
 // Daily forecast endpoint
 func dailyForecastHandler(w http.ResponseWriter, r *http.Request) {
-	apiKey := os.Getenv("GOOGLE_API_KEY")
-	if apiKey == "" {
-		http.Error(w, "API key not configured", http.StatusInternalServerError)
+	provider := newWeatherProvider(config)
+	if provider == nil {
+		writeError(w, http.StatusInternalServerError, ERR_NOT_CONFIGURED, "API key not configured", nil)
 		return
 	}
-	
+
 	// Get query parameters
-	lat := r.URL.Query().Get("lat")
-	lon := r.URL.Query().Get("lon")
-	days := r.URL.Query().Get("days")
-	
-	if lat == "" || lon == "" {
-		http.Error(w, "Missing latitude or longitude", http.StatusBadRequest)
-		return
-	}
-	
-	if days == "" {
-		days = "14" // Default to 14 days
-	}
-	
-	// Build Google Weather API URL for daily forecast
-	url := fmt.Sprintf("%s/forecast/days:lookup?key=%s&location.latitude=%s&location.longitude=%s&days=%s",
-		GOOGLE_WEATHER_BASE, apiKey, lat, lon, days)
-	
-	// Make request to Google Weather API
-	resp, err := http.Get(url)
-	if err != nil {
-		log.Printf("Error fetching daily forecast: %v", err)
-		http.Error(w, "Failed to fetch daily forecast data", http.StatusInternalServerError)
+	query := r.URL.Query()
+	lang, paramErr := parseLanguage(query)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
 		return
 	}
-	defer resp.Body.Close()
-	
-	// Read response body
-	body, err := io.ReadAll(resp.Body)
+	lat, lon, location, paramErr := locateRequest(r, query, lang)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+	days, paramErr := parseCountParam(query, "days", DEFAULT_FORECAST_DAYS, MAX_FORECAST_DAYS)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+	units, paramErr := parseUnits(query)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+	ctx := withLanguage(r.Context(), lang)
+
+	daily, timeZone, status, err := cachedDailyForecast(ctx, provider, lat, lon, days)
 	if err != nil {
-		log.Printf("Error reading response: %v", err)
-		http.Error(w, "Failed to read daily forecast data", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "fetching daily forecast failed", "error", err)
+		writeUpstreamError(w, err, "Failed to fetch daily forecast data")
 		return
 	}
-	
-	// Return response
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(resp.StatusCode)
-	w.Write(body)
+
+	w.Header().Set("X-Cache", string(status))
+	writeJSON(w, DailyResponse{
+		Daily:     dailyLocalized(dailyInUnits(daily, units), lang),
+		TimeZone:  timeZone,
+		Location:  location,
+		Timestamp: time.Now().Format(time.RFC3339),
+	})
 }
 
 // Geocoding endpoint
 func geocodeHandler(w http.ResponseWriter, r *http.Request) {
-	apiKey := os.Getenv("GOOGLE_API_KEY")
-	if apiKey == "" {
-		http.Error(w, "API key not configured", http.StatusInternalServerError)
+	provider := newWeatherProvider(config)
+	if provider == nil {
+		writeError(w, http.StatusInternalServerError, ERR_NOT_CONFIGURED, "API key not configured", nil)
 		return
 	}
-	
+
 	// Get query parameters
-	address := r.URL.Query().Get("address")
-	
-	if address == "" {
-		http.Error(w, "Missing address parameter", http.StatusBadRequest)
-		return
-	}
-	
-	// Build Google Geocoding API URL - address is already URL-decoded by r.URL.Query()
-	// We need to re-encode it for the Google API
-	apiUrl := fmt.Sprintf("%s?address=%s&key=%s", GOOGLE_GEOCODING_URL, url.QueryEscape(address), apiKey)
-	
-	// Make request to Google Geocoding API
-	resp, err := http.Get(apiUrl)
-	if err != nil {
-		log.Printf("Error geocoding address: %v", err)
-		http.Error(w, "Failed to geocode address", http.StatusInternalServerError)
+	query := r.URL.Query()
+	address, paramErr := parseAddress(query)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
 		return
 	}
-	defer resp.Body.Close()
-	
-	// Read response body
-	body, err := io.ReadAll(resp.Body)
+	lang, paramErr := parseLanguage(query)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+	ctx := withLanguage(r.Context(), lang)
+
+	result, status, err := cachedGeocode(ctx, provider, address)
 	if err != nil {
-		log.Printf("Error reading response: %v", err)
-		http.Error(w, "Failed to read geocoding data", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "geocoding address failed", "error", err)
+		writeUpstreamError(w, err, "Failed to geocode address")
 		return
 	}
-	
-	// Return response
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(resp.StatusCode)
-	w.Write(body)
+
+	w.Header().Set("X-Cache", string(status))
+	writeJSON(w, result)
 }
 
-// Combined weather endpoint (all from Google Weather API)
+// Combined weather endpoint
 func weatherHandler(w http.ResponseWriter, r *http.Request) {
-	apiKey := os.Getenv("GOOGLE_API_KEY")
-	if apiKey == "" {
-		http.Error(w, "API key not configured", http.StatusInternalServerError)
+	provider := newWeatherProvider(config)
+	if provider == nil {
+		writeError(w, http.StatusInternalServerError, ERR_NOT_CONFIGURED, "API key not configured", nil)
 		return
 	}
-	
+
 	// Get query parameters
-	lat := r.URL.Query().Get("lat")
-	lon := r.URL.Query().Get("lon")
-	
-	if lat == "" || lon == "" {
-		http.Error(w, "Missing latitude or longitude", http.StatusBadRequest)
-		return
-	}
-	
-	// Fetch current conditions from Google
-	currentURL := fmt.Sprintf("%s/currentConditions:lookup?key=%s&location.latitude=%s&location.longitude=%s",
-		GOOGLE_WEATHER_BASE, apiKey, lat, lon)
-	
-	currentResp, err := http.Get(currentURL)
-	if err != nil {
-		log.Printf("Error fetching current conditions: %v", err)
-		http.Error(w, "Failed to fetch current weather", http.StatusInternalServerError)
+	query := r.URL.Query()
+	lang, paramErr := parseLanguage(query)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+	lat, lon, location, paramErr := locateRequest(r, query, lang)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
 		return
 	}
-	defer currentResp.Body.Close()
-	
-	var currentData map[string]interface{}
-	if err := json.NewDecoder(currentResp.Body).Decode(&currentData); err != nil {
-		log.Printf("Error decoding current weather: %v", err)
-		http.Error(w, "Failed to parse current weather", http.StatusInternalServerError)
+	units, paramErr := parseUnits(query)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
 		return
 	}
-	
+
 	// Check if client requested specific hours (default to 24)
-	hours := r.URL.Query().Get("hours")
-	if hours == "" {
-		hours = "24"
-	}
-	
-	// Fetch hourly forecast (next hours only - no history)
-	forecastURL := fmt.Sprintf("%s/forecast/hours:lookup?key=%s&location.latitude=%s&location.longitude=%s&hours=%s",
-		GOOGLE_WEATHER_BASE, apiKey, lat, lon, hours)
-	
-	forecastResp, err := http.Get(forecastURL)
-	if err != nil {
-		log.Printf("Error fetching hourly forecast: %v", err)
-	}
-	var forecastData map[string]interface{}
-	if forecastResp != nil && forecastResp.StatusCode == http.StatusOK {
-		defer forecastResp.Body.Close()
-		json.NewDecoder(forecastResp.Body).Decode(&forecastData)
-	}
-	
-	// Fetch daily forecast
-	dailyURL := fmt.Sprintf("%s/forecast/days:lookup?key=%s&location.latitude=%s&location.longitude=%s&days=5",
-		GOOGLE_WEATHER_BASE, apiKey, lat, lon)
-	
-	dailyResp, err := http.Get(dailyURL)
+	hours, paramErr := parseCountParam(query, "hours", DEFAULT_FORECAST_HOURS, MAX_FORECAST_HOURS)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+	days, paramErr := parseCountParam(query, "days", DEFAULT_COMBINED_DAYS, MAX_FORECAST_DAYS)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+	include, paramErr := parseInclude(query, "pollen", "alerts")
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+	synthetic, paramErr := parseFallback(query)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+
+	req := combinedRequest{
+		lat:       lat,
+		lon:       lon,
+		hours:     hours,
+		days:      days,
+		units:     units,
+		include:   include,
+		synthetic: synthetic,
+	}
+	if !chargeRequest(w, r, combinedUpstreamCalls(req)) {
+		return
+	}
+
+	resp, status, cacheDetail, err := fetchCombinedWeather(withLanguage(r.Context(), lang), provider, req)
 	if err != nil {
-		log.Printf("Error fetching daily forecast: %v", err)
-	}
-	var dailyData map[string]interface{}
-	if dailyResp != nil && dailyResp.StatusCode == http.StatusOK {
-		defer dailyResp.Body.Close()
-		json.NewDecoder(dailyResp.Body).Decode(&dailyData)
-	}
-	
-	// Process hourly forecast data (future hours only)
-	var hourlyList []interface{}
-	var dailyList []interface{}
-	if forecastData != nil {
-		// Try both "hours" and "forecastHours" keys
-		var forecastHours []interface{}
-		if hours, ok := forecastData["hours"].([]interface{}); ok {
-			forecastHours = hours
-		} else if fHours, ok := forecastData["forecastHours"].([]interface{}); ok {
-			forecastHours = fHours
-		}
-		
-		if forecastHours != nil {
-			for _, hour := range forecastHours {
-				if hourData, ok := hour.(map[string]interface{}); ok {
-					// Convert to our expected format
-					hourlyItem := map[string]interface{}{
-						"timestamp":                getTimeFromInterval(hourData["interval"]),
-						"temperature":              hourData["temperature"],
-						"feelsLikeTemperature":     hourData["feelsLikeTemperature"],
-						"relativeHumidity":         hourData["relativeHumidity"],
-						"weatherCondition":         hourData["weatherCondition"],
-						"wind":                     hourData["wind"],
-						"precipitationProbability": hourData["precipitationProbability"],
-						"uvIndex":                  hourData["uvIndex"],
-						"visibility":               hourData["visibility"],
-						"cloudCover":               hourData["cloudCover"],
-						"isDaytime":                hourData["isDaytime"],
-						"airPressure":              hourData["airPressure"],
-						"dewPoint":                 hourData["dewPoint"],
-					}
-					hourlyList = append(hourlyList, hourlyItem)
-				}
-			}
-		}
+		writeUpstreamError(w, err, "Failed to fetch weather data")
+		return
 	}
-	
-	// If we couldn't get hourly data, create synthetic fallback
-	if len(hourlyList) == 0 {
-		log.Printf("No hourly data available, using synthetic data")
-		hourlyList = createSyntheticHourlyData(currentData)
-	}
-	
-	// Process daily forecast data
-	if dailyData != nil {
-		// Try both "days" and "forecastDays" keys
-		var forecastDays []interface{}
-		if days, ok := dailyData["days"].([]interface{}); ok {
-			forecastDays = days
-		} else if fDays, ok := dailyData["forecastDays"].([]interface{}); ok {
-			forecastDays = fDays
-		}
-		
-		if forecastDays != nil {
-			for _, day := range forecastDays {
-				if dayData, ok := day.(map[string]interface{}); ok {
-					// Extract date from displayDate or interval
-					var date string
-					if displayDate, ok := dayData["displayDate"].(map[string]interface{}); ok {
-						year := int(displayDate["year"].(float64))
-						month := int(displayDate["month"].(float64))
-						day := int(displayDate["day"].(float64))
-						date = fmt.Sprintf("%04d-%02d-%02d", year, month, day)
-					} else if interval, ok := dayData["interval"].(map[string]interface{}); ok {
-						if startTime, ok := interval["startTime"].(string); ok {
-							date = startTime[:10] // Extract YYYY-MM-DD
-						}
-					}
-					
-					// Use daytime forecast as primary weather condition
-					var weatherCond interface{}
-					var uvIndex interface{}
-					var precipitation interface{}
-					var wind interface{}
-					var humidity interface{}
-					
-					if daytime, ok := dayData["daytimeForecast"].(map[string]interface{}); ok {
-						weatherCond = daytime["weatherCondition"]
-						uvIndex = daytime["uvIndex"]
-						precipitation = daytime["precipitation"]
-						wind = daytime["wind"]
-						humidity = daytime["relativeHumidity"]
-					}
-					
-					dailyItem := map[string]interface{}{
-						"date":                     date,
-						"maxTemperature":           dayData["maxTemperature"],
-						"minTemperature":           dayData["minTemperature"],
-						"feelsLikeMaxTemperature":  dayData["feelsLikeMaxTemperature"],
-						"feelsLikeMinTemperature":  dayData["feelsLikeMinTemperature"],
-						"weatherCondition":         weatherCond,
-						"precipitationProbability": precipitation,
-						"wind":                     wind,
-						"relativeHumidity":         humidity,
-						"uvIndex":                  uvIndex,
-						"sunEvents":                dayData["sunEvents"],
-						"moonEvents":               dayData["moonEvents"],
-						"daytimeForecast":          dayData["daytimeForecast"],
-						"nighttimeForecast":        dayData["nighttimeForecast"],
-					}
-					dailyList = append(dailyList, dailyItem)
-				}
+	resp.Location = location
+	w.Header().Set("X-Cache", string(status))
+	w.Header().Set("X-Cache-Detail", cacheDetail)
+	writeJSON(w, resp)
+}
+
+// Options of a combined weather lookup, already validated
+type combinedRequest struct {
+	lat, lon    string
+	hours, days string
+	units       Units
+	include     map[string]bool // optional sections: pollen, alerts
+	synthetic   bool            // fallback=synthetic
+}
+
+// Most upstream calls one combined lookup makes, with pollen and alerts
+// included
+const MAX_COMBINED_UPSTREAM_CALLS = 5
+
+// Upstream calls a combined lookup makes: current conditions, the hourly
+// and daily forecasts, and one per included section
+func combinedUpstreamCalls(req combinedRequest) int {
+	return 3 + len(req.include)
+}
+
+// Fetch current conditions, hourly and daily forecasts and the included
+// sections concurrently under one deadline, so a single slow upstream can't
+// stall the whole response. Sections that fail are listed in missing; an
+// error is returned only when no weather section could be fetched. Along
+// with the response come its combined cache status and the status of each
+// section for X-Cache-Detail.
+func fetchCombinedWeather(ctx context.Context, provider WeatherProvider, req combinedRequest) (*WeatherResponse, cacheStatus, string, error) {
+	lat, lon, include := req.lat, req.lon, req.include
+	lang := languageFromContext(ctx)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(config.WeatherDeadline))
+	defer cancel()
+
+	var (
+		wg                                       sync.WaitGroup
+		current                                  *CurrentConditions
+		hourlyList                               []HourlyForecast
+		dailyList                                []DailyForecast
+		pollen                                   []PollenDay
+		alerts                                   []WeatherAlert
+		currentStatus, hourlyStatus, dailyStatus cacheStatus
+		pollenStatus, alertsStatus               cacheStatus
+		currentErr, hourlyErr, dailyErr          error
+		pollenErr, alertsErr                     error
+	)
+
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		current, currentStatus, currentErr = cachedCurrentConditions(ctx, provider, lat, lon)
+	}()
+	go func() {
+		defer wg.Done()
+		// Next hours only - no history
+		hourlyList, _, hourlyStatus, hourlyErr = cachedHourlyForecast(ctx, provider, lat, lon, req.hours)
+	}()
+	go func() {
+		defer wg.Done()
+		dailyList, _, dailyStatus, dailyErr = cachedDailyForecast(ctx, provider, lat, lon, req.days)
+	}()
+	if include["pollen"] {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pollenClient := newPollenClient(config)
+			if pollenClient == nil {
+				pollenErr = errNotSupported
+				return
 			}
-		}
+			pollen, _, pollenStatus, pollenErr = cachedPollenForecast(ctx, pollenClient, lat, lon, "5")
+		}()
+	}
+	if include["alerts"] {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			alerts, alertsStatus, alertsErr = cachedAlerts(ctx, provider, lat, lon)
+		}()
+	}
+	wg.Wait()
+
+	// Record which sections could not be fetched
+	var missing []string
+	if currentErr != nil {
+		slog.ErrorContext(ctx, "fetching current conditions failed", "error", currentErr)
+		missing = append(missing, "current")
+	}
+	if hourlyErr != nil {
+		slog.ErrorContext(ctx, "fetching hourly forecast failed", "error", hourlyErr)
+		missing = append(missing, "hourly")
 	}
-	
-	// If we couldn't get daily data, create synthetic fallback
-	if len(dailyList) == 0 {
-		log.Printf("No daily data available, using synthetic data")
-		dailyList = createSyntheticDailyData(currentData)
+	if dailyErr != nil {
+		slog.ErrorContext(ctx, "fetching daily forecast failed", "error", dailyErr)
+		missing = append(missing, "daily")
 	}
-	
+
+	if pollenErr != nil {
+		slog.ErrorContext(ctx, "fetching pollen forecast failed", "error", pollenErr)
+		missing = append(missing, "pollen")
+	}
+	if alertsErr != nil {
+		slog.ErrorContext(ctx, "fetching alerts failed", "error", alertsErr)
+		missing = append(missing, "alerts")
+	}
+
+	// No weather section succeeded, report the current conditions failure
+	if currentErr != nil && hourlyErr != nil && dailyErr != nil {
+		return nil, "", "", currentErr
+	}
+
+	// Failed sections with no stale data are made up from the current
+	// conditions only when the client asked for it; they stay listed in
+	// missing
+	if req.synthetic && hourlyErr != nil && current != nil {
+		slog.WarnContext(ctx, "no hourly data available, using synthetic data")
+		syntheticFallbackTotal.Inc("hourly")
+		hourlyList = createSyntheticHourlyData(current)
+	}
+
+	if req.synthetic && dailyErr != nil && current != nil {
+		slog.WarnContext(ctx, "no daily data available, using synthetic data")
+		syntheticFallbackTotal.Inc("daily")
+		dailyList = createSyntheticDailyData(current)
+	}
+
 	// Combine all responses
-	response := map[string]interface{}{
-		"current": currentData,
-		"forecast": map[string]interface{}{
-			"daily": dailyList,
-			"hourly": hourlyList,
+	statuses := []cacheStatus{currentStatus, hourlyStatus, dailyStatus}
+	cacheDetail := fmt.Sprintf("current=%s, hourly=%s, daily=%s", currentStatus, hourlyStatus, dailyStatus)
+	if include["pollen"] {
+		statuses = append(statuses, pollenStatus)
+		cacheDetail += fmt.Sprintf(", pollen=%s", pollenStatus)
+	}
+	if include["alerts"] {
+		statuses = append(statuses, alertsStatus)
+		cacheDetail += fmt.Sprintf(", alerts=%s", alertsStatus)
+	}
+	resp := &WeatherResponse{
+		Current: current.InUnits(req.units).Localized(lang),
+		Forecast: Forecast{
+			Daily:  dailyLocalized(dailyInUnits(dailyList, req.units), lang),
+			Hourly: hourlyLocalized(hourlyInUnits(hourlyList, req.units), lang),
 		},
-		"timestamp": time.Now().Format(time.RFC3339),
+		Pollen:    pollen,
+		Alerts:    activeAlerts(alerts, time.Now()),
+		Missing:   missing,
+		Timestamp: time.Now().Format(time.RFC3339),
 	}
-	
-	// Return combined response
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	return resp, combineCacheStatus(statuses...), cacheDetail, nil
 }
 
 func main() {
-	// Get port from environment or use default
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	// Load and validate the configuration before anything else
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		os.Exit(1)
+	}
+	config = cfg
+	upstreamClient = &http.Client{Timeout: time.Duration(cfg.UpstreamTimeout)}
+
+	// Log JSON lines to stdout; the standard logger goes through slog too
+	logger, err := newLogger(os.Stdout, cfg.LogLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+	logConfig(cfg)
+
+	// Open the session store before accepting requests
+	store, err := newSessionStore(cfg)
+	if err != nil {
+		slog.Error("failed to open session store", "error", err)
+		os.Exit(1)
+	}
+	extensionRegistry = store
+
+	// Load the token signing keys
+	keyring, err := newTokenKeyring(cfg)
+	if err != nil {
+		slog.Error("failed to load token signing keys", "error", err)
+		os.Exit(1)
+	}
+	tokenKeys = keyring
+
+	// Load per-route rate limits
+	limiter, err := newRateLimiter(cfg)
+	if err != nil {
+		slog.Error("invalid rate limit configuration", "error", err)
+		os.Exit(1)
 	}
-	
+	rateLimiter = limiter
+
+	// Restrict browser access to the allowed origins
+	allowlist, err := NewOriginAllowlist(cfg.AllowedOrigins)
+	if err != nil {
+		slog.Error("invalid CORS configuration", "error", err)
+		os.Exit(1)
+	}
+	corsAllowlist = allowlist
+
+	// Locate requests without coordinates by client IP when a database is set
+	proxies, err := parseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		slog.Error("invalid trusted proxies", "error", err)
+		os.Exit(1)
+	}
+	trustedProxies = proxies
+	if cfg.GeoIPDatabasePath != "" {
+		db, err := openGeoIPDatabase(cfg.GeoIPDatabasePath)
+		if err != nil {
+			slog.Error("failed to load geoip database", "error", err)
+			os.Exit(1)
+		}
+		geoIP = db
+	}
+
+	// Background workers run until shutdown
+	workers := NewWorkers()
+
 	// Start cleanup routine for inactive sessions
-	cleanupInactiveSessions()
-	
+	cleanupInactiveSessions(workers)
+
+	// Start eviction of expired upstream cache entries
+	cleanupExpiredCache(workers)
+
+	// Start eviction of idle rate limit buckets
+	cleanupIdleRateLimits(workers)
+
 	// Setup routes with authentication
 	http.HandleFunc("/", enableCORS(healthHandler))
 	http.HandleFunc("/health", enableCORS(healthHandler))
-	
+
 	// Authentication endpoints
 	http.HandleFunc("/api/auth/register", enableCORS(registerExtensionHandler))
 	http.HandleFunc("/api/auth/validate", enableCORS(authMiddleware(validateTokenHandler)))
 	http.HandleFunc("/api/auth/stats", enableCORS(authMiddleware(extensionStatsHandler)))
-	
+	http.HandleFunc("/api/auth/refresh", enableCORS(authMiddleware(refreshTokenHandler)))
+	http.HandleFunc("/.well-known/jwks.json", enableCORS(jwksHandler))
+
+	// Admin endpoints, not exposed to browsers
+	http.HandleFunc("/admin/sessions", adminMiddleware(adminSessionsHandler))
+	http.HandleFunc("/admin/sessions/", adminMiddleware(adminSessionsHandler))
+	http.HandleFunc("/admin/bans", adminMiddleware(adminBansHandler))
+	http.HandleFunc("/admin/bans/", adminMiddleware(adminBansHandler))
+
+	// Prometheus metrics
+	http.HandleFunc("/metrics", metricsHandler)
+
 	// Protected weather endpoints
 	http.HandleFunc("/api/current", enableCORS(authMiddleware(currentConditionsHandler)))
 	http.HandleFunc("/api/history", enableCORS(authMiddleware(hourlyHistoryHandler)))
@@ -604,11 +720,42 @@ func main() {
 	http.HandleFunc("/api/daily", enableCORS(authMiddleware(dailyForecastHandler)))
 	http.HandleFunc("/api/geocode", enableCORS(authMiddleware(geocodeHandler)))
 	http.HandleFunc("/api/weather", enableCORS(authMiddleware(weatherHandler)))
-	
+	http.HandleFunc("/api/weather/batch", enableCORS(authMiddleware(weatherBatchHandler)))
+	http.HandleFunc("/api/weather/stream", enableCORS(authMiddleware(weatherStreamHandler)))
+	http.HandleFunc("/api/airquality", enableCORS(authMiddleware(airQualityHandler)))
+	http.HandleFunc("/api/pollen", enableCORS(authMiddleware(pollenHandler)))
+	http.HandleFunc("/api/alerts", enableCORS(authMiddleware(alertsHandler)))
+	http.HandleFunc("/api/reverse-geocode", enableCORS(authMiddleware(reverseGeocodeHandler)))
+	http.HandleFunc("/api/places/autocomplete", enableCORS(authMiddleware(autocompleteHandler)))
+
 	// Start server
-	log.Printf("Weather service with authentication starting on port %s", port)
-	log.Printf("Security features enabled: token validation, rate limiting, session management")
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	server := newHTTPServer(cfg, requestLogger(instrumentHandler(http.DefaultServeMux)))
+	// Shutdown doesn't wait for streams to go idle; end them so clients reconnect elsewhere
+	server.RegisterOnShutdown(weatherStreams.Close)
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		slog.Error("failed to listen", "addr", server.Addr, "error", err)
+		os.Exit(1)
 	}
-}
\ No newline at end of file
+	slog.Info("weather service starting", "port", cfg.Port,
+		"security", "token validation, rate limiting, session management")
+
+	// Serve until Cloud Run's SIGTERM (or Ctrl-C), then drain
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	serveErr := serve(ctx, server, listener, time.Duration(cfg.ShutdownTimeout))
+	if serveErr != nil {
+		slog.Error("server stopped with error", "error", serveErr)
+	}
+
+	// Stop background workers, then flush persistent state
+	workers.Stop()
+	if err := extensionRegistry.Close(); err != nil {
+		slog.Error("closing session store failed", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("weather service stopped")
+	if serveErr != nil {
+		os.Exit(1)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sync"
 	"testing"
 	"time"
 )
@@ -24,7 +25,7 @@ func mockGoogleWeatherResponse() map[string]interface{} {
 		},
 		"relativeHumidity": 65,
 		"weatherCondition": map[string]interface{}{
-			"type":        "PARTLY_CLOUDY",
+			"type": "PARTLY_CLOUDY",
 			"description": map[string]interface{}{
 				"text":         "Partly Cloudy",
 				"languageCode": "en",
@@ -51,14 +52,16 @@ func mockGoogleWeatherResponse() map[string]interface{} {
 			"distance": 10.0,
 			"unit":     "KILOMETERS",
 		},
-		"uvIndex": 5,
+		"uvIndex":    5,
 		"cloudCover": 40,
-		"isDaytime": true,
+		"isDaytime":  true,
 	}
 }
 
 // Test the weather handler response structure
 func TestWeatherHandler(t *testing.T) {
+	weatherCache = newResponseCache()
+
 	// Create a mock server that returns Google Weather API response
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Check for the correct path pattern
@@ -78,11 +81,10 @@ func TestWeatherHandler(t *testing.T) {
 	defer func() { GOOGLE_WEATHER_BASE = originalBase }()
 
 	// Set a test API key
-	os.Setenv("GOOGLE_API_KEY", "test-key")
-	defer os.Unsetenv("GOOGLE_API_KEY")
+	setTestConfig(t, func(c *Config) { c.GoogleAPIKey = "test-key" })
 
-	// Create request
-	req := httptest.NewRequest("GET", "/api/weather?lat=37.7749&lon=-122.4194", nil)
+	// Create request; the forecasts fail, so ask for synthetic ones
+	req := httptest.NewRequest("GET", "/api/weather?lat=37.7749&lon=-122.4194&fallback=synthetic", nil)
 	w := httptest.NewRecorder()
 
 	// Call handler
@@ -133,7 +135,7 @@ func TestWeatherHandler(t *testing.T) {
 		}
 
 		// Verify required fields
-		requiredFields := []string{"timestamp", "temperature", "weatherCondition"}
+		requiredFields := []string{"timestamp", "temperature", "weatherCondition", "synthetic"}
 		for _, field := range requiredFields {
 			if _, ok := firstHour[field]; !ok {
 				t.Errorf("Hourly entry missing field: %s", field)
@@ -170,7 +172,7 @@ func TestWeatherHandler(t *testing.T) {
 		}
 
 		// Verify required fields
-		requiredFields := []string{"date", "maxTemperature", "minTemperature", "weatherCondition"}
+		requiredFields := []string{"date", "maxTemperature", "minTemperature", "weatherCondition", "synthetic"}
 		for _, field := range requiredFields {
 			if _, ok := firstDay[field]; !ok {
 				t.Errorf("Daily entry missing field: %s", field)
@@ -181,6 +183,10 @@ func TestWeatherHandler(t *testing.T) {
 
 // Test CORS headers
 func TestCORSHeaders(t *testing.T) {
+	originalAllowlist := corsAllowlist
+	corsAllowlist = mustOriginAllowlist([]string{"chrome-extension://test"})
+	defer func() { corsAllowlist = originalAllowlist }()
+
 	handler := enableCORS(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
@@ -210,13 +216,15 @@ func TestCORSHeaders(t *testing.T) {
 
 // Test current conditions handler
 func TestCurrentConditionsHandler(t *testing.T) {
+	weatherCache = newResponseCache()
+
 	// Create mock server
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Verify API key is passed
 		if !r.URL.Query().Has("key") {
 			t.Error("API key not passed to Google API")
 		}
-		
+
 		// Return mock response
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(mockGoogleWeatherResponse())
@@ -228,8 +236,7 @@ func TestCurrentConditionsHandler(t *testing.T) {
 	GOOGLE_WEATHER_BASE = mockServer.URL
 	defer func() { GOOGLE_WEATHER_BASE = originalBase }()
 
-	os.Setenv("GOOGLE_API_KEY", "test-key")
-	defer os.Unsetenv("GOOGLE_API_KEY")
+	setTestConfig(t, func(c *Config) { c.GoogleAPIKey = "test-key" })
 
 	// Test valid request
 	req := httptest.NewRequest("GET", "/api/current?lat=37.7749&lon=-122.4194", nil)
@@ -269,6 +276,8 @@ func TestCurrentConditionsHandler(t *testing.T) {
 
 // Test geocoding handler
 func TestGeocodeHandler(t *testing.T) {
+	weatherCache = newResponseCache()
+
 	// Mock geocoding response
 	mockGeoResponse := map[string]interface{}{
 		"results": []map[string]interface{}{
@@ -292,7 +301,7 @@ func TestGeocodeHandler(t *testing.T) {
 		if !r.URL.Query().Has("address") {
 			t.Error("Address not passed to Geocoding API")
 		}
-		
+
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(mockGeoResponse)
 	}))
@@ -303,8 +312,7 @@ func TestGeocodeHandler(t *testing.T) {
 	GOOGLE_GEOCODING_URL = mockServer.URL
 	defer func() { GOOGLE_GEOCODING_URL = originalURL }()
 
-	os.Setenv("GOOGLE_API_KEY", "test-key")
-	defer os.Unsetenv("GOOGLE_API_KEY")
+	setTestConfig(t, func(c *Config) { c.GoogleAPIKey = "test-key" })
 
 	// Test valid request
 	req := httptest.NewRequest("GET", "/api/geocode?address=San+Francisco", nil)
@@ -380,13 +388,13 @@ func TestRealGoogleWeatherAPI(t *testing.T) {
 func TestSyntheticForecastGeneration(t *testing.T) {
 	// Create mock current conditions
 	currentData := mockGoogleWeatherResponse()
-	
+
 	// Generate hourly forecast
 	var hourlyList []interface{}
 	currentTime := time.Now()
 	for i := 0; i < 24; i++ {
 		hourTime := currentTime.Add(time.Duration(i) * time.Hour)
-		
+
 		hourlyItem := map[string]interface{}{
 			"timestamp":            hourTime.Format(time.RFC3339),
 			"temperature":          currentData["temperature"],
@@ -395,13 +403,13 @@ func TestSyntheticForecastGeneration(t *testing.T) {
 			"weatherCondition":     currentData["weatherCondition"],
 			"wind":                 currentData["wind"],
 		}
-		
+
 		if precip, ok := currentData["precipitation"].(map[string]interface{}); ok {
 			if prob, ok := precip["probability"].(map[string]interface{}); ok {
 				hourlyItem["precipitationProbability"] = prob
 			}
 		}
-		
+
 		hourlyList = append(hourlyList, hourlyItem)
 	}
 
@@ -412,7 +420,7 @@ func TestSyntheticForecastGeneration(t *testing.T) {
 
 	// Check structure of first entry
 	firstHour := hourlyList[0].(map[string]interface{})
-	
+
 	// Verify timestamp format
 	if timestamp, ok := firstHour["timestamp"].(string); ok {
 		if _, err := time.Parse(time.RFC3339, timestamp); err != nil {
@@ -434,10 +442,10 @@ func TestSyntheticForecastGeneration(t *testing.T) {
 	// Generate daily forecast
 	var dailyList []interface{}
 	var baseTemp float64 = 20.5
-	
+
 	for i := 0; i < 5; i++ {
 		futureDate := currentTime.AddDate(0, 0, i)
-		
+
 		dailyItem := map[string]interface{}{
 			"date": futureDate.Format("2006-01-02"),
 			"maxTemperature": map[string]interface{}{
@@ -450,7 +458,7 @@ func TestSyntheticForecastGeneration(t *testing.T) {
 			},
 			"weatherCondition": currentData["weatherCondition"],
 		}
-		
+
 		dailyList = append(dailyList, dailyItem)
 	}
 
@@ -461,7 +469,7 @@ func TestSyntheticForecastGeneration(t *testing.T) {
 
 	// Check structure of first day
 	firstDay := dailyList[0].(map[string]interface{})
-	
+
 	// Verify date format
 	if date, ok := firstDay["date"].(string); ok {
 		if _, err := time.Parse("2006-01-02", date); err != nil {
@@ -477,4 +485,170 @@ func TestSyntheticForecastGeneration(t *testing.T) {
 			t.Errorf("Max temperature not correct, expected 22.5, got %v", degrees)
 		}
 	}
-}
\ No newline at end of file
+}
+
+// Test that a slow upstream section doesn't stall the combined response
+func TestWeatherHandlerDeadline(t *testing.T) {
+	weatherCache = newResponseCache()
+
+	release := make(chan struct{})
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/currentConditions:lookup":
+			json.NewEncoder(w).Encode(mockGoogleWeatherResponse())
+		case "/forecast/hours:lookup":
+			// Simulate a hung upstream endpoint
+			<-release
+		case "/forecast/days:lookup":
+			w.Write([]byte(`{"forecastDays": [{"displayDate": {"year": 2025, "month": 1, "day": 1}}]}`))
+		}
+	}))
+	defer mockServer.Close()
+	defer close(release)
+
+	originalBase := GOOGLE_WEATHER_BASE
+	GOOGLE_WEATHER_BASE = mockServer.URL
+	defer func() { GOOGLE_WEATHER_BASE = originalBase }()
+
+	setTestConfig(t, func(c *Config) {
+		c.GoogleAPIKey = "test-key"
+		c.WeatherDeadline = Duration(200 * time.Millisecond)
+	})
+
+	req := httptest.NewRequest("GET", "/api/weather?lat=48.8566&lon=2.3522", nil)
+	w := httptest.NewRecorder()
+
+	start := time.Now()
+	weatherHandler(w, req)
+	elapsed := time.Since(start)
+
+	if elapsed > 2*time.Second {
+		t.Fatalf("Handler should return at the deadline, took %v", elapsed)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected partial response with status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var response WeatherResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if response.Current == nil {
+		t.Error("Current conditions should still be returned")
+	}
+	if len(response.Forecast.Daily) != 1 || response.Forecast.Daily[0].Date != "2025-01-01" {
+		t.Errorf("Daily forecast should still be returned, got %+v", response.Forecast.Daily)
+	}
+	if len(response.Missing) != 1 || response.Missing[0] != "hourly" {
+		t.Errorf("Expected missing [hourly], got %v", response.Missing)
+	}
+}
+
+// Test that days sets the length of the combined daily forecast
+func TestWeatherHandlerDays(t *testing.T) {
+	weatherCache = newResponseCache()
+
+	var requested []string
+	var mu sync.Mutex
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/currentConditions:lookup":
+			json.NewEncoder(w).Encode(mockGoogleWeatherResponse())
+		case "/forecast/hours:lookup":
+			w.Write([]byte(`{"forecastHours": []}`))
+		case "/forecast/days:lookup":
+			mu.Lock()
+			requested = append(requested, r.URL.Query().Get("days"))
+			mu.Unlock()
+			w.Write([]byte(`{"forecastDays": [{"displayDate": {"year": 2025, "month": 1, "day": 1}}]}`))
+		}
+	}))
+	defer mockServer.Close()
+
+	originalBase := GOOGLE_WEATHER_BASE
+	GOOGLE_WEATHER_BASE = mockServer.URL
+	defer func() { GOOGLE_WEATHER_BASE = originalBase }()
+
+	setTestConfig(t, func(c *Config) { c.GoogleAPIKey = "test-key" })
+
+	tests := []struct {
+		query    string
+		expected int
+		days     string
+	}{
+		{"", http.StatusOK, "5"},
+		{"&days=3", http.StatusOK, "3"},
+		{"&days=11", http.StatusBadRequest, ""},
+		{"&days=0", http.StatusBadRequest, ""},
+	}
+
+	for _, test := range tests {
+		mu.Lock()
+		requested = nil
+		mu.Unlock()
+
+		req := httptest.NewRequest("GET", "/api/weather?lat=40.4168&lon=-3.7038"+test.query, nil)
+		w := httptest.NewRecorder()
+		weatherHandler(w, req)
+
+		if w.Code != test.expected {
+			t.Errorf("%q: expected status %d, got %d: %s", test.query, test.expected, w.Code, w.Body.String())
+			continue
+		}
+		mu.Lock()
+		if test.days != "" && (len(requested) != 1 || requested[0] != test.days) {
+			t.Errorf("%q: expected %s days upstream, got %v", test.query, test.days, requested)
+		}
+		mu.Unlock()
+	}
+}
+
+// Test that the combined endpoint is charged per upstream call, like a
+// batch location
+func TestWeatherHandlerRateLimit(t *testing.T) {
+	weatherCache = newResponseCache()
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(mockGoogleWeatherResponse())
+	}))
+	defer mockServer.Close()
+
+	originalWeather, originalPollen, originalLimiter := GOOGLE_WEATHER_BASE, GOOGLE_POLLEN_BASE, rateLimiter
+	GOOGLE_WEATHER_BASE, GOOGLE_POLLEN_BASE = mockServer.URL, mockServer.URL
+	rateLimiter = NewRateLimiter(map[string]RateLimitRule{
+		RATE_LIMIT_DEFAULT_ROUTE: {Limit: 10, Cost: 1},
+		"/api/weather":           {Cost: 1},
+	})
+	defer func() {
+		GOOGLE_WEATHER_BASE, GOOGLE_POLLEN_BASE, rateLimiter = originalWeather, originalPollen, originalLimiter
+	}()
+	setTestConfig(t, func(c *Config) { c.GoogleAPIKey = "test-key" })
+
+	// Invalid requests cost nothing, three calls otherwise and one more
+	// each for pollen and alerts
+	tests := []struct {
+		query     string
+		expected  int
+		remaining string
+	}{
+		{"lat=91&lon=0", http.StatusBadRequest, ""},
+		{"lat=1&lon=2&include=pollen,alerts&fallback=synthetic", http.StatusOK, "5"},
+		{"lat=1&lon=2&fallback=synthetic", http.StatusOK, "2"},
+		{"lat=1&lon=2&include=alerts&fallback=synthetic", http.StatusTooManyRequests, "2"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/api/weather?"+test.query, nil)
+		req.Header.Set("X-Validated-Extension-ID", "test-extension")
+		w := httptest.NewRecorder()
+		weatherHandler(w, req)
+
+		if w.Code != test.expected || w.Header().Get("X-RateLimit-Remaining") != test.remaining {
+			t.Errorf("%s: expected %d with %q tokens left, got %d with %q", test.query, test.expected, test.remaining,
+				w.Code, w.Header().Get("X-RateLimit-Remaining"))
+		}
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Latency histogram buckets in seconds, the Prometheus client defaults
+var DEFAULT_LATENCY_BUCKETS = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Security event types counted as authentication failures
+var authFailureEvents = map[string]bool{
+	"MISSING_AUTH_HEADERS":   true,
+	"INVALID_TOKEN":          true,
+	"TOKEN_REPLAY":           true,
+	"REVOKED_TOKEN":          true,
+	"UNREGISTERED_EXTENSION": true,
+	"SUSPENDED_EXTENSION":    true,
+	"BANNED_EXTENSION":       true,
+	"REGISTRATION_MISMATCH":  true,
+	"REGISTRATION_STALE":     true,
+	"REGISTRATION_REPLAY":    true,
+	"SUSPENDED_REGISTRATION": true,
+	"BANNED_REGISTRATION":    true,
+	"MAX_EXTENSIONS_REACHED": true,
+	"ADMIN_AUTH_FAILED":      true,
+}
+
+// A metric family that can write itself in the Prometheus text format
+type metricCollector interface {
+	writeTo(w io.Writer)
+}
+
+// Registered collectors, written by /metrics in registration order
+var (
+	collectorsMu sync.Mutex
+	collectors   []metricCollector
+)
+
+func registerCollector(c metricCollector) {
+	collectorsMu.Lock()
+	defer collectorsMu.Unlock()
+	collectors = append(collectors, c)
+}
+
+// Service metrics
+var (
+	httpRequestsTotal = newCounterVec("weather_http_requests_total",
+		"HTTP requests by route, method and status code.", "route", "method", "status")
+	httpRequestDuration = newHistogramVec("weather_http_request_duration_seconds",
+		"HTTP request latency by route and status code.", DEFAULT_LATENCY_BUCKETS, "route", "status")
+	upstreamRequestDuration = newHistogramVec("weather_upstream_request_duration_seconds",
+		"Upstream provider call latency by provider and endpoint.", DEFAULT_LATENCY_BUCKETS, "provider", "endpoint")
+	upstreamErrorsTotal = newCounterVec("weather_upstream_errors_total",
+		"Failed upstream provider calls by provider, endpoint and reason.", "provider", "endpoint", "reason")
+	authFailuresTotal = newCounterVec("weather_auth_failures_total",
+		"Rejected authentication attempts by security event type.", "reason")
+	rateLimitRejectionsTotal = newCounterVec("weather_rate_limit_rejections_total",
+		"Requests rejected by the rate limiter by route.", "route")
+	syntheticFallbackTotal = newCounterVec("weather_synthetic_fallback_total",
+		"Responses that used synthetic data in place of a failed section.", "section")
+	staleResponsesTotal = newCounterVec("weather_stale_responses_total",
+		"Lookups answered with the last good data after an upstream failure, by endpoint.", "endpoint")
+	_ = newGaugeFunc("weather_active_sessions",
+		"Registered extension sessions that are not suspended.", countActiveSessions)
+	_ = newGaugeFunc("weather_stream_subscribers",
+		"Open /api/weather/stream connections.", func() float64 { return float64(weatherStreams.Subscribers()) })
+)
+
+func countActiveSessions() float64 {
+	sessions, err := extensionRegistry.List()
+	if err != nil {
+		slog.Error("listing sessions for metrics failed", "error", err)
+		return math.NaN()
+	}
+	active := 0
+	for _, session := range sessions {
+		if session.IsActive {
+			active++
+		}
+	}
+	return float64(active)
+}
+
+// Serve every registered metric in the Prometheus text exposition format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	collectorsMu.Lock()
+	registered := append([]metricCollector(nil), collectors...)
+	collectorsMu.Unlock()
+
+	buf := bufio.NewWriter(w)
+	for _, c := range registered {
+		c.writeTo(buf)
+	}
+	buf.Flush()
+}
+
+// counterVec is a counter partitioned by label values
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]*labeledValue
+}
+
+type labeledValue struct {
+	labelValues []string
+	value       float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: make(map[string]*labeledValue)}
+	registerCollector(c)
+	return c
+}
+
+// Increment the counter for the given label values
+func (c *counterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *counterVec) Add(delta float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.values[key]
+	if !ok {
+		v = &labeledValue{labelValues: labelValues}
+		c.values[key] = v
+	}
+	v.value += delta
+}
+
+// Current value for the given label values
+func (c *counterVec) Value(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, ok := c.values[strings.Join(labelValues, "\xff")]; ok {
+		return v.value
+	}
+	return 0
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		v := c.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, v.labelValues), formatFloat(v.value))
+	}
+}
+
+// histogramVec is a histogram partitioned by label values
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labelValues []string
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogramValue)}
+	registerCollector(h)
+	return h
+}
+
+// Record an observation for the given label values
+func (h *histogramVec) Observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogramValue{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = v
+	}
+	for i, upper := range h.buckets {
+		if value <= upper {
+			v.counts[i]++
+		}
+	}
+	v.sum += value
+	v.count++
+}
+
+// Number of observations for the given label values
+func (h *histogramVec) Count(labelValues ...string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if v, ok := h.values[strings.Join(labelValues, "\xff")]; ok {
+		return v.count
+	}
+	return 0
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	bucketLabels := append(append([]string(nil), h.labels...), "le")
+	for _, key := range sortedKeys(h.values) {
+		v := h.values[key]
+		for i, upper := range h.buckets {
+			labelValues := append(append([]string(nil), v.labelValues...), formatFloat(upper))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(bucketLabels, labelValues), v.counts[i])
+		}
+		labelValues := append(append([]string(nil), v.labelValues...), "+Inf")
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(bucketLabels, labelValues), v.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, v.labelValues), formatFloat(v.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, v.labelValues), v.count)
+	}
+}
+
+// gaugeFunc is a gauge whose value is computed at scrape time
+type gaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+func newGaugeFunc(name, help string, fn func() float64) *gaugeFunc {
+	g := &gaugeFunc{name: name, help: help, fn: fn}
+	registerCollector(g)
+	return g
+}
+
+func (g *gaugeFunc) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatFloat(g.fn()))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, labelValueEscaper.Replace(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush passes through to the underlying writer so streaming still works
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// Record request count and latency for every request served by mux. Routes
+// are labelled with the matched mux pattern rather than the raw path, so
+// label cardinality stays bounded.
+func instrumentHandler(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		mux.ServeHTTP(recorder, r)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		status := strconv.Itoa(recorder.status)
+		httpRequestsTotal.Inc(route, r.Method, status)
+		httpRequestDuration.Observe(time.Since(start).Seconds(), route, status)
+	})
+}
+
+// instrumentedProvider records latency and errors of every call to the
+// provider it wraps
+type instrumentedProvider struct {
+	provider WeatherProvider
+}
+
+func (p *instrumentedProvider) Name() string {
+	return p.provider.Name()
+}
+
+// Record one call to the wrapped provider
+func (p *instrumentedProvider) observe(ctx context.Context, endpoint string, start time.Time, err error) {
+	observeUpstream(ctx, p.provider.Name(), endpoint, start, err)
+}
+
+// Record one upstream call, logging failures against the request in ctx
+func observeUpstream(ctx context.Context, provider, endpoint string, start time.Time, err error) {
+	if errors.Is(err, errNotSupported) {
+		return
+	}
+	elapsed := time.Since(start)
+	upstreamRequestDuration.Observe(elapsed.Seconds(), provider, endpoint)
+	if err != nil {
+		reason := upstreamErrorReason(err)
+		upstreamErrorsTotal.Inc(provider, endpoint, reason)
+		slog.WarnContext(ctx, "upstream call failed",
+			"provider", provider,
+			"endpoint", endpoint,
+			"reason", reason,
+			"durationMs", elapsed.Milliseconds(),
+			"error", err,
+		)
+	}
+}
+
+func (p *instrumentedProvider) CurrentConditions(ctx context.Context, lat, lon string) (*CurrentConditions, error) {
+	start := time.Now()
+	current, err := p.provider.CurrentConditions(ctx, lat, lon)
+	p.observe(ctx, "current", start, err)
+	return current, err
+}
+
+func (p *instrumentedProvider) HourlyForecast(ctx context.Context, lat, lon, hours string) ([]HourlyForecast, *TimeZone, error) {
+	start := time.Now()
+	hourly, timeZone, err := p.provider.HourlyForecast(ctx, lat, lon, hours)
+	p.observe(ctx, "hourly", start, err)
+	return hourly, timeZone, err
+}
+
+func (p *instrumentedProvider) HourlyHistory(ctx context.Context, lat, lon, hours string) ([]HourlyForecast, *TimeZone, error) {
+	start := time.Now()
+	hourly, timeZone, err := p.provider.HourlyHistory(ctx, lat, lon, hours)
+	p.observe(ctx, "history", start, err)
+	return hourly, timeZone, err
+}
+
+func (p *instrumentedProvider) DailyForecast(ctx context.Context, lat, lon, days string) ([]DailyForecast, *TimeZone, error) {
+	start := time.Now()
+	daily, timeZone, err := p.provider.DailyForecast(ctx, lat, lon, days)
+	p.observe(ctx, "daily", start, err)
+	return daily, timeZone, err
+}
+
+func (p *instrumentedProvider) Geocode(ctx context.Context, address string) (*GeocodeResponse, error) {
+	start := time.Now()
+	result, err := p.provider.Geocode(ctx, address)
+	p.observe(ctx, "geocode", start, err)
+	return result, err
+}
+
+func (p *instrumentedProvider) Alerts(ctx context.Context, lat, lon string) ([]WeatherAlert, error) {
+	start := time.Now()
+	alerts, err := p.provider.Alerts(ctx, lat, lon)
+	p.observe(ctx, "alerts", start, err)
+	return alerts, err
+}
+
+func (p *instrumentedProvider) ReverseGeocode(ctx context.Context, lat, lon string) ([]Place, error) {
+	start := time.Now()
+	places, err := p.provider.ReverseGeocode(ctx, lat, lon)
+	p.observe(ctx, "reverse_geocode", start, err)
+	return places, err
+}
+
+func (p *instrumentedProvider) Autocomplete(ctx context.Context, text string) ([]Place, error) {
+	start := time.Now()
+	places, err := p.provider.Autocomplete(ctx, text)
+	p.observe(ctx, "autocomplete", start, err)
+	return places, err
+}
+
+// Classify an upstream error into a low-cardinality reason label
+func upstreamErrorReason(err error) string {
+	var upstreamErr *UpstreamError
+	var payloadErr *PayloadError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &upstreamErr):
+		return fmt.Sprintf("http_%dxx", upstreamErr.StatusCode/100)
+	case errors.As(err, &payloadErr):
+		return "invalid_payload"
+	default:
+		return "network"
+	}
+}
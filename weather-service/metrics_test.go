@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test the text exposition of counters and histograms
+func TestMetricExposition(t *testing.T) {
+	var out strings.Builder
+
+	counter := &counterVec{name: "test_total", help: "Test counter.", labels: []string{"route"}, values: make(map[string]*labeledValue)}
+	counter.Inc("/b")
+	counter.Add(2, "/a")
+	counter.Inc(`quote"and\slash`)
+	counter.writeTo(&out)
+
+	histogram := &histogramVec{name: "test_seconds", help: "Test histogram.", labels: []string{"route"},
+		buckets: []float64{0.1, 1}, values: make(map[string]*histogramValue)}
+	histogram.Observe(0.05, "/a")
+	histogram.Observe(0.5, "/a")
+	histogram.Observe(5, "/a")
+	histogram.writeTo(&out)
+
+	expected := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{route="/a"} 2
+test_total{route="/b"} 1
+test_total{route="quote\"and\\slash"} 1
+# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{route="/a",le="0.1"} 1
+test_seconds_bucket{route="/a",le="1"} 2
+test_seconds_bucket{route="/a",le="+Inf"} 3
+test_seconds_sum{route="/a"} 5.55
+test_seconds_count{route="/a"} 3
+`
+	if out.String() != expected {
+		t.Errorf("Unexpected exposition:\n%s\nwant:\n%s", out.String(), expected)
+	}
+}
+
+// Test that requests are labelled with the matched route pattern
+func TestInstrumentHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/sessions/", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Session not found", http.StatusNotFound)
+	})
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	handler := instrumentHandler(mux)
+
+	before404 := httpRequestsTotal.Value("/admin/sessions/", "GET", "404")
+	before200 := httpRequestsTotal.Value("/ok", "GET", "200")
+	beforeLatency := httpRequestDuration.Count("/ok", "200")
+
+	for _, id := range []string{"a", "b", "c"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/admin/sessions/"+id, nil))
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/ok", nil))
+
+	if got := httpRequestsTotal.Value("/admin/sessions/", "GET", "404") - before404; got != 3 {
+		t.Errorf("Expected 3 requests under the route pattern, got %v", got)
+	}
+	if got := httpRequestsTotal.Value("/ok", "GET", "200") - before200; got != 1 {
+		t.Errorf("Expected implicit 200 to be recorded, got %v", got)
+	}
+	if got := httpRequestDuration.Count("/ok", "200") - beforeLatency; got != 1 {
+		t.Errorf("Expected 1 latency observation, got %d", got)
+	}
+}
+
+// Test upstream metrics recorded by instrumentedProvider
+func TestInstrumentedProvider(t *testing.T) {
+	weatherCache = newResponseCache()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	originalBase := GOOGLE_WEATHER_BASE
+	GOOGLE_WEATHER_BASE = server.URL
+	defer func() { GOOGLE_WEATHER_BASE = originalBase }()
+
+	provider := &instrumentedProvider{provider: &googleProvider{apiKey: "test-key"}}
+	beforeCalls := upstreamRequestDuration.Count("google", "current")
+	beforeErrors := upstreamErrorsTotal.Value("google", "current", "http_5xx")
+
+	if _, err := provider.CurrentConditions(context.Background(), "51.5", "-0.12"); err == nil {
+		t.Fatal("Expected an upstream error")
+	}
+
+	if got := upstreamRequestDuration.Count("google", "current") - beforeCalls; got != 1 {
+		t.Errorf("Expected 1 upstream call recorded, got %d", got)
+	}
+	if got := upstreamErrorsTotal.Value("google", "current", "http_5xx") - beforeErrors; got != 1 {
+		t.Errorf("Expected 1 http_5xx error recorded, got %v", got)
+	}
+
+	// Lookups a provider doesn't support aren't upstream calls
+	owm := &instrumentedProvider{provider: &openWeatherProvider{apiKey: "test-key"}}
+	beforeHistory := upstreamRequestDuration.Count("openweathermap", "history")
+	owm.HourlyHistory(context.Background(), "51.5", "-0.12", "24")
+	if got := upstreamRequestDuration.Count("openweathermap", "history") - beforeHistory; got != 0 {
+		t.Errorf("Expected unsupported lookup not to be recorded, got %d", got)
+	}
+}
+
+func TestUpstreamErrorReason(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{context.DeadlineExceeded, "timeout"},
+		{fmt.Errorf("fetch: %w", context.Canceled), "canceled"},
+		{&UpstreamError{StatusCode: 404}, "http_4xx"},
+		{&UpstreamError{StatusCode: 503}, "http_5xx"},
+		{&PayloadError{Err: errors.New("bad json")}, "invalid_payload"},
+		{errors.New("connection refused"), "network"},
+	}
+	for _, tt := range tests {
+		if got := upstreamErrorReason(tt.err); got != tt.want {
+			t.Errorf("upstreamErrorReason(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+// Test auth failure, rate limit and session metrics end to end
+func TestMetricsHandler(t *testing.T) {
+	extensionRegistry = NewMemorySessionStore()
+	rateLimiter = NewRateLimiter(map[string]RateLimitRule{RATE_LIMIT_DEFAULT_ROUTE: {Limit: 1, Cost: 1}})
+	defer func() { rateLimiter = NewRateLimiter(defaultRateLimitRules()) }()
+
+	active := testSession("metrics-active", time.Now())
+	suspended := testSession("metrics-suspended", time.Now())
+	suspended.IsActive = false
+	extensionRegistry.Put(active)
+	extensionRegistry.Put(suspended)
+
+	beforeMissing := authFailuresTotal.Value("MISSING_AUTH_HEADERS")
+	beforeRejected := rateLimitRejectionsTotal.Value("/api/current")
+
+	handler := authMiddleware(func(w http.ResponseWriter, r *http.Request) {})
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/current", nil))
+
+	token := generateTestToken(active.Identity)
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/api/current", nil)
+		req.Header.Set("X-Extension-Token", token)
+		req.Header.Set("X-Extension-ID", active.Identity.ExtensionID)
+		req.Header.Set("X-Extension-Fingerprint", active.Identity.Fingerprint)
+		handler(httptest.NewRecorder(), req)
+	}
+
+	if got := authFailuresTotal.Value("MISSING_AUTH_HEADERS") - beforeMissing; got != 1 {
+		t.Errorf("Expected 1 MISSING_AUTH_HEADERS failure, got %v", got)
+	}
+	if got := rateLimitRejectionsTotal.Value("/api/current") - beforeRejected; got != 1 {
+		t.Errorf("Expected 1 rate limit rejection, got %v", got)
+	}
+
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type %q", w.Header().Get("Content-Type"))
+	}
+	body := w.Body.String()
+	for _, line := range []string{
+		"weather_active_sessions 1\n",
+		"# TYPE weather_http_request_duration_seconds histogram\n",
+		"# TYPE weather_synthetic_fallback_total counter\n",
+		`weather_auth_failures_total{reason="MISSING_AUTH_HEADERS"} `,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("Expected metrics output to contain %q", line)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"container/heap"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type nonceEntry struct {
+	nonce   string
+	expires time.Time
+}
+
+// Min-heap of nonces ordered by expiry
+type nonceHeap []nonceEntry
+
+func (h nonceHeap) Len() int            { return len(h) }
+func (h nonceHeap) Less(i, j int) bool  { return h[i].expires.Before(h[j].expires) }
+func (h nonceHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *nonceHeap) Push(x interface{}) { *h = append(*h, x.(nonceEntry)) }
+func (h *nonceHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// NonceStore remembers nonces until they expire so each one can only be
+// used once. It holds at most max nonces; when full, the nonce closest to
+// expiry is dropped to make room, which keeps memory bounded under a flood
+// of requests at the cost of a short replay window for that nonce. Nonces
+// are kept in process only, so a restart or another instance won't know
+// about them.
+type NonceStore struct {
+	mu      sync.Mutex
+	seen    map[string]time.Time
+	expires nonceHeap
+	max     int
+}
+
+func NewNonceStore(max int) *NonceStore {
+	return &NonceStore{
+		seen: make(map[string]time.Time),
+		max:  max,
+	}
+}
+
+var nonceStore = NewNonceStore(MAX_TRACKED_NONCES)
+
+// Record nonce as used until expires. Returns false if it was already used
+// and hasn't expired yet.
+func (n *NonceStore) Use(nonce string, expires time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+	if until, ok := n.seen[nonce]; ok && now.Before(until) {
+		return false
+	}
+
+	n.evictLocked(now)
+	n.seen[nonce] = expires
+	heap.Push(&n.expires, nonceEntry{nonce: nonce, expires: expires})
+	return true
+}
+
+// Report whether nonce has been used and hasn't expired
+func (n *NonceStore) Seen(nonce string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	until, ok := n.seen[nonce]
+	return ok && time.Now().Before(until)
+}
+
+// Number of tracked nonces
+func (n *NonceStore) Len() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.seen)
+}
+
+// Drop expired nonces, then the ones closest to expiry until there is room
+// for one more
+func (n *NonceStore) evictLocked(now time.Time) {
+	dropped := 0
+	for n.expires.Len() > 0 {
+		next := n.expires[0]
+		expired := !now.Before(next.expires)
+		if !expired && len(n.seen) < n.max {
+			break
+		}
+
+		heap.Pop(&n.expires)
+		// Skip stale entries for nonces that were reused after expiring
+		if until, ok := n.seen[next.nonce]; ok && until.Equal(next.expires) {
+			delete(n.seen, next.nonce)
+			if !expired {
+				dropped++
+			}
+		}
+	}
+	if dropped > 0 {
+		slog.Warn("nonce store full, dropped unexpired nonces", "count", dropped)
+	}
+}
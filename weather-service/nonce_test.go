@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Test that nonces can only be used once until they expire
+func TestNonceStoreReplay(t *testing.T) {
+	store := NewNonceStore(10)
+
+	if !store.Use("a", time.Now().Add(time.Minute)) {
+		t.Fatal("First use should succeed")
+	}
+	if store.Use("a", time.Now().Add(time.Minute)) {
+		t.Fatal("Second use should be rejected")
+	}
+	if !store.Seen("a") {
+		t.Error("Used nonce should be reported as seen")
+	}
+
+	// Expired nonces can be used again
+	store.Use("b", time.Now().Add(time.Millisecond))
+	time.Sleep(2 * time.Millisecond)
+	if store.Seen("b") {
+		t.Error("Expired nonce should not be reported as seen")
+	}
+	if !store.Use("b", time.Now().Add(time.Minute)) {
+		t.Error("Expired nonce should be usable again")
+	}
+}
+
+// Test that the store stays bounded, dropping the nonces closest to expiry
+func TestNonceStoreBounded(t *testing.T) {
+	store := NewNonceStore(100)
+
+	store.Use("long-lived", time.Now().Add(time.Hour))
+	for i := 0; i < 500; i++ {
+		store.Use(fmt.Sprintf("nonce-%d", i), time.Now().Add(time.Minute))
+	}
+
+	if store.Len() > 100 {
+		t.Fatalf("Expected at most 100 tracked nonces, got %d", store.Len())
+	}
+	if !store.Seen("long-lived") {
+		t.Error("The nonce furthest from expiry should be kept")
+	}
+	if !store.Seen("nonce-499") {
+		t.Error("The most recent nonce should be kept")
+	}
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// errNotSupported is returned by providers for lookups they can't serve
+var errNotSupported = errors.New("not supported by provider")
+
+// openWeatherProvider talks to the OpenWeatherMap One Call and Geocoding
+// APIs. Responses are requested in metric units and converted to the units
+// Google reports (km/h, kilometres, millibars) so both providers produce
+// identical shapes.
+type openWeatherProvider struct {
+	apiKey string
+}
+
+func (o *openWeatherProvider) Name() string {
+	return "openweathermap"
+}
+
+// OpenWeatherMap One Call wire format
+type owmCondition struct {
+	ID          int    `json:"id"`
+	Main        string `json:"main"`
+	Description string `json:"description"`
+	Icon        string `json:"icon"`
+}
+
+type owmHour struct {
+	Dt         int64          `json:"dt"`
+	Temp       float64        `json:"temp"`
+	FeelsLike  float64        `json:"feels_like"`
+	Pressure   float64        `json:"pressure"`
+	Humidity   int            `json:"humidity"`
+	DewPoint   float64        `json:"dew_point"`
+	UVI        float64        `json:"uvi"`
+	Clouds     int            `json:"clouds"`
+	Visibility *float64       `json:"visibility"`
+	WindSpeed  float64        `json:"wind_speed"`
+	WindDeg    int            `json:"wind_deg"`
+	WindGust   *float64       `json:"wind_gust"`
+	Weather    []owmCondition `json:"weather"`
+	Pop        *float64       `json:"pop"`
+	Rain       *owmVolume     `json:"rain"`
+	Snow       *owmVolume     `json:"snow"`
+}
+
+type owmVolume struct {
+	OneHour float64 `json:"1h"`
+}
+
+type owmDayTemp struct {
+	Day   float64 `json:"day"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Night float64 `json:"night"`
+}
+
+type owmDay struct {
+	Dt        int64          `json:"dt"`
+	Sunrise   int64          `json:"sunrise"`
+	Sunset    int64          `json:"sunset"`
+	MoonPhase float64        `json:"moon_phase"`
+	Temp      owmDayTemp     `json:"temp"`
+	FeelsLike owmDayTemp     `json:"feels_like"`
+	Humidity  int            `json:"humidity"`
+	WindSpeed float64        `json:"wind_speed"`
+	WindDeg   int            `json:"wind_deg"`
+	WindGust  *float64       `json:"wind_gust"`
+	Weather   []owmCondition `json:"weather"`
+	Clouds    int            `json:"clouds"`
+	Pop       float64        `json:"pop"`
+	Rain      float64        `json:"rain"`
+	Snow      float64        `json:"snow"`
+	UVI       float64        `json:"uvi"`
+}
+
+type owmAlert struct {
+	SenderName  string `json:"sender_name"`
+	Event       string `json:"event"`
+	Start       int64  `json:"start"`
+	End         int64  `json:"end"`
+	Description string `json:"description"`
+}
+
+type owmOneCallResponse struct {
+	Timezone string     `json:"timezone"`
+	Current  *owmHour   `json:"current"`
+	Hourly   []owmHour  `json:"hourly"`
+	Daily    []owmDay   `json:"daily"`
+	Alerts   []owmAlert `json:"alerts"`
+}
+
+type owmGeocodeResult struct {
+	Name       string            `json:"name"`
+	LocalNames map[string]string `json:"local_names"`
+	Lat        float64           `json:"lat"`
+	Lon        float64           `json:"lon"`
+	Country    string            `json:"country"`
+	State      string            `json:"state"`
+}
+
+// Convert to a Place, using the local name in lang when there is one.
+// OpenWeatherMap only has the country code and no time zone.
+func (m owmGeocodeResult) toPlace(lang string) Place {
+	name := m.Name
+	if local := m.LocalNames[lang]; local != "" {
+		name = local
+	}
+	return Place{Name: name, AdminArea: m.State, Country: m.Country, CountryCode: m.Country, Lat: m.Lat, Lon: m.Lon}
+}
+
+// Fetch a One Call response with the given sections excluded
+func (o *openWeatherProvider) oneCall(ctx context.Context, lat, lon, exclude string) (*owmOneCallResponse, error) {
+	apiURL := upstreamURL(OPENWEATHER_ONECALL_URL, url.Values{
+		"lat":     {lat},
+		"lon":     {lon},
+		"units":   {"metric"},
+		"exclude": {exclude},
+		"lang":    {languageFromContext(ctx)},
+		"appid":   {o.apiKey},
+	})
+
+	body, err := fetchUpstream(ctx, apiURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp owmOneCallResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, &PayloadError{fmt.Errorf("decode one call response: %w", err)}
+	}
+	return &resp, nil
+}
+
+func (o *openWeatherProvider) CurrentConditions(ctx context.Context, lat, lon string) (*CurrentConditions, error) {
+	resp, err := o.oneCall(ctx, lat, lon, "minutely,hourly,daily,alerts")
+	if err != nil {
+		return nil, err
+	}
+	if resp.Current == nil {
+		return nil, &PayloadError{errors.New("one call response missing current conditions")}
+	}
+
+	current := &CurrentConditions{
+		CurrentTime: time.Unix(resp.Current.Dt, 0).UTC().Format(time.RFC3339),
+		Conditions:  resp.Current.toConditions(languageFromContext(ctx)),
+	}
+	if resp.Timezone != "" {
+		current.TimeZone = &TimeZone{ID: resp.Timezone}
+	}
+	if err := current.Validate(); err != nil {
+		return nil, &PayloadError{err}
+	}
+	return current, nil
+}
+
+func (o *openWeatherProvider) HourlyForecast(ctx context.Context, lat, lon, hours string) ([]HourlyForecast, *TimeZone, error) {
+	resp, err := o.oneCall(ctx, lat, lon, "current,minutely,daily,alerts")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	limit := len(resp.Hourly)
+	if n, err := strconv.Atoi(hours); err == nil && n < limit {
+		limit = n
+	}
+
+	lang := languageFromContext(ctx)
+	hourly := make([]HourlyForecast, 0, limit)
+	for _, h := range resp.Hourly[:limit] {
+		item := HourlyForecast{
+			Timestamp:  time.Unix(h.Dt, 0).UTC().Format(time.RFC3339),
+			Conditions: h.toConditions(lang),
+		}
+		if item.Precipitation != nil {
+			item.PrecipitationProbability = item.Precipitation.Probability
+		}
+		if err := item.Validate(); err != nil {
+			continue
+		}
+		hourly = append(hourly, item)
+	}
+	return hourly, resp.timeZone(), nil
+}
+
+// The One Call API only serves history through a separate paid endpoint
+func (o *openWeatherProvider) HourlyHistory(ctx context.Context, lat, lon, hours string) ([]HourlyForecast, *TimeZone, error) {
+	return nil, nil, errNotSupported
+}
+
+func (o *openWeatherProvider) DailyForecast(ctx context.Context, lat, lon, days string) ([]DailyForecast, *TimeZone, error) {
+	resp, err := o.oneCall(ctx, lat, lon, "current,minutely,hourly,alerts")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	limit := len(resp.Daily)
+	if n, err := strconv.Atoi(days); err == nil && n < limit {
+		limit = n
+	}
+
+	loc := time.UTC
+	if resp.Timezone != "" {
+		if l, err := time.LoadLocation(resp.Timezone); err == nil {
+			loc = l
+		}
+	}
+
+	lang := languageFromContext(ctx)
+	daily := make([]DailyForecast, 0, limit)
+	for _, d := range resp.Daily[:limit] {
+		item := d.toDailyForecast(loc, lang)
+		if err := item.Validate(); err != nil {
+			continue
+		}
+		daily = append(daily, item)
+	}
+	return daily, resp.timeZone(), nil
+}
+
+// OpenWeatherMap doesn't report severity or urgency, and the event name is
+// the issuing agency's own text
+func (o *openWeatherProvider) Alerts(ctx context.Context, lat, lon string) ([]WeatherAlert, error) {
+	resp, err := o.oneCall(ctx, lat, lon, "current,minutely,hourly,daily")
+	if err != nil {
+		return nil, err
+	}
+
+	alerts := make([]WeatherAlert, 0, len(resp.Alerts))
+	for _, a := range resp.Alerts {
+		item := WeatherAlert{
+			Event:       a.Event,
+			Headline:    a.Event,
+			Description: a.Description,
+			Severity:    ALERT_UNKNOWN,
+			Urgency:     ALERT_UNKNOWN,
+			Effective:   time.Unix(a.Start, 0).UTC().Format(time.RFC3339),
+		}
+		if a.End != 0 {
+			item.Expires = time.Unix(a.End, 0).UTC().Format(time.RFC3339)
+		}
+		if a.SenderName != "" {
+			item.Authority = &AlertAuthority{Name: a.SenderName}
+		}
+		if err := item.Validate(); err != nil {
+			continue
+		}
+		alerts = append(alerts, item)
+	}
+	return alerts, nil
+}
+
+func (o *openWeatherProvider) Geocode(ctx context.Context, address string) (*GeocodeResponse, error) {
+	apiURL := upstreamURL(OPENWEATHER_GEOCODING_URL, url.Values{"q": {address}, "limit": {"5"}, "appid": {o.apiKey}})
+
+	body, err := fetchUpstream(ctx, apiURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []owmGeocodeResult
+	if err := json.Unmarshal(body, &matches); err != nil {
+		return nil, &PayloadError{fmt.Errorf("decode geocoding response: %w", err)}
+	}
+
+	result := &GeocodeResponse{Results: []GeocodeResult{}, Status: "ZERO_RESULTS"}
+	for _, m := range matches {
+		parts := []string{m.Name}
+		components := []AddressComponent{{LongName: m.Name, ShortName: m.Name, Types: []string{"locality", "political"}}}
+		if m.State != "" {
+			parts = append(parts, m.State)
+			components = append(components, AddressComponent{LongName: m.State, ShortName: m.State, Types: []string{"administrative_area_level_1", "political"}})
+		}
+		if m.Country != "" {
+			parts = append(parts, m.Country)
+			components = append(components, AddressComponent{LongName: m.Country, ShortName: m.Country, Types: []string{"country", "political"}})
+		}
+
+		result.Results = append(result.Results, GeocodeResult{
+			FormattedAddress:  strings.Join(parts, ", "),
+			AddressComponents: components,
+			Geometry:          GeocodeGeometry{Location: LatLng{Lat: m.Lat, Lng: m.Lon}},
+			Types:             []string{"locality", "political"},
+		})
+		result.Status = "OK"
+	}
+	return result, nil
+}
+
+func (o *openWeatherProvider) ReverseGeocode(ctx context.Context, lat, lon string) ([]Place, error) {
+	apiURL := upstreamURL(OPENWEATHER_REVERSE_GEOCODING_URL, url.Values{"lat": {lat}, "lon": {lon}, "limit": {strconv.Itoa(MAX_PLACE_RESULTS)}, "appid": {o.apiKey}})
+	return o.places(ctx, apiURL)
+}
+
+// The Geocoding API matches the start of place names, which is enough for
+// autocomplete
+func (o *openWeatherProvider) Autocomplete(ctx context.Context, text string) ([]Place, error) {
+	apiURL := upstreamURL(OPENWEATHER_GEOCODING_URL, url.Values{"q": {text}, "limit": {strconv.Itoa(MAX_PLACE_RESULTS)}, "appid": {o.apiKey}})
+	return o.places(ctx, apiURL)
+}
+
+func (o *openWeatherProvider) places(ctx context.Context, apiURL string) ([]Place, error) {
+	body, err := fetchUpstream(ctx, apiURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []owmGeocodeResult
+	if err := json.Unmarshal(body, &matches); err != nil {
+		return nil, &PayloadError{fmt.Errorf("decode geocoding response: %w", err)}
+	}
+
+	lang := languageFromContext(ctx)
+	places := make([]Place, 0, len(matches))
+	for _, m := range matches {
+		places = append(places, m.toPlace(lang))
+	}
+	return dedupePlaces(places), nil
+}
+
+func (r *owmOneCallResponse) timeZone() *TimeZone {
+	if r.Timezone == "" {
+		return nil
+	}
+	return &TimeZone{ID: r.Timezone}
+}
+
+func (h owmHour) toConditions(lang string) Conditions {
+	humidity := h.Humidity
+	clouds := h.Clouds
+	uvIndex := int(math.Round(h.UVI))
+
+	c := Conditions{
+		WeatherCondition:     owmWeatherCondition(h.Weather, lang),
+		Temperature:          &Temperature{Degrees: h.Temp, Unit: "CELSIUS"},
+		FeelsLikeTemperature: &Temperature{Degrees: h.FeelsLike, Unit: "CELSIUS"},
+		DewPoint:             &Temperature{Degrees: h.DewPoint, Unit: "CELSIUS"},
+		RelativeHumidity:     &humidity,
+		UVIndex:              &uvIndex,
+		CloudCover:           &clouds,
+		AirPressure:          &AirPressure{MeanSeaLevelMillibars: h.Pressure},
+		Wind:                 owmWind(h.WindSpeed, h.WindDeg, h.WindGust),
+	}
+	if len(h.Weather) > 0 {
+		isDaytime := strings.HasSuffix(h.Weather[0].Icon, "d")
+		c.IsDaytime = &isDaytime
+	}
+	if h.Visibility != nil {
+		c.Visibility = &Visibility{Distance: *h.Visibility / 1000, Unit: "KILOMETERS"}
+	}
+
+	precipType, amount := "RAIN", 0.0
+	if h.Rain != nil {
+		amount = h.Rain.OneHour
+	}
+	if h.Snow != nil && h.Snow.OneHour > amount {
+		precipType, amount = "SNOW", h.Snow.OneHour
+	}
+	if h.Pop != nil || amount > 0 {
+		c.Precipitation = &Precipitation{Qpf: &Quantity{Quantity: amount, Unit: "MILLIMETERS"}}
+		if h.Pop != nil {
+			c.Precipitation.Probability = &Probability{Percent: int(math.Round(*h.Pop * 100)), Type: precipType}
+		}
+	}
+	return c
+}
+
+func (d owmDay) toDailyForecast(loc *time.Location, lang string) DailyForecast {
+	humidity := d.Humidity
+	uvIndex := int(math.Round(d.UVI))
+	clouds := d.Clouds
+
+	precipType, amount := "RAIN", d.Rain
+	if d.Snow > amount {
+		precipType, amount = "SNOW", d.Snow
+	}
+	precipitation := &Precipitation{
+		Probability: &Probability{Percent: int(math.Round(d.Pop * 100)), Type: precipType},
+		Qpf:         &Quantity{Quantity: amount, Unit: "MILLIMETERS"},
+	}
+	condition := owmWeatherCondition(d.Weather, lang)
+	wind := owmWind(d.WindSpeed, d.WindDeg, d.WindGust)
+
+	return DailyForecast{
+		Date:                     time.Unix(d.Dt, 0).In(loc).Format("2006-01-02"),
+		MaxTemperature:           &Temperature{Degrees: d.Temp.Max, Unit: "CELSIUS"},
+		MinTemperature:           &Temperature{Degrees: d.Temp.Min, Unit: "CELSIUS"},
+		FeelsLikeMaxTemperature:  &Temperature{Degrees: d.FeelsLike.Day, Unit: "CELSIUS"},
+		FeelsLikeMinTemperature:  &Temperature{Degrees: d.FeelsLike.Night, Unit: "CELSIUS"},
+		WeatherCondition:         condition,
+		PrecipitationProbability: precipitation.Probability,
+		Precipitation:            precipitation,
+		Wind:                     wind,
+		RelativeHumidity:         &humidity,
+		UVIndex:                  &uvIndex,
+		SunEvents: &SunEvents{
+			SunriseTime: time.Unix(d.Sunrise, 0).UTC().Format(time.RFC3339),
+			SunsetTime:  time.Unix(d.Sunset, 0).UTC().Format(time.RFC3339),
+		},
+		MoonEvents: &MoonEvents{MoonPhase: owmMoonPhase(d.MoonPhase)},
+		DaytimeForecast: &DayPartForecast{
+			WeatherCondition: condition,
+			RelativeHumidity: &humidity,
+			UVIndex:          &uvIndex,
+			Precipitation:    precipitation,
+			Wind:             wind,
+			CloudCover:       &clouds,
+		},
+	}
+}
+
+// Convert a metres-per-second wind reading to the km/h shape Google reports
+func owmWind(speed float64, deg int, gust *float64) *Wind {
+	wind := &Wind{
+		Direction: &WindDirection{Degrees: deg, Cardinal: cardinalDirection(deg)},
+		Speed:     &Speed{Value: speed * 3.6, Unit: "KILOMETERS_PER_HOUR"},
+	}
+	if gust != nil {
+		wind.Gust = &Speed{Value: *gust * 3.6, Unit: "KILOMETERS_PER_HOUR"}
+	}
+	return wind
+}
+
+var cardinalDirections = []string{
+	"NORTH", "NORTH_NORTHEAST", "NORTHEAST", "EAST_NORTHEAST",
+	"EAST", "EAST_SOUTHEAST", "SOUTHEAST", "SOUTH_SOUTHEAST",
+	"SOUTH", "SOUTH_SOUTHWEST", "SOUTHWEST", "WEST_SOUTHWEST",
+	"WEST", "WEST_NORTHWEST", "NORTHWEST", "NORTH_NORTHWEST",
+}
+
+// Map a bearing in degrees to one of the 16 Google cardinal names
+func cardinalDirection(deg int) string {
+	idx := int(math.Round(float64(((deg%360)+360)%360)/22.5)) % 16
+	return cardinalDirections[idx]
+}
+
+// Map an OpenWeatherMap condition ID to the Google condition type
+func owmConditionType(id int) string {
+	switch {
+	case id >= 200 && id < 210:
+		return "THUNDERSHOWER"
+	case id >= 210 && id < 220:
+		return "THUNDERSTORM"
+	case id >= 220 && id < 300:
+		return "HEAVY_THUNDERSTORM"
+	case id >= 300 && id < 400:
+		return "LIGHT_RAIN"
+	case id == 500:
+		return "LIGHT_RAIN"
+	case id == 501:
+		return "RAIN"
+	case id >= 502 && id <= 504:
+		return "HEAVY_RAIN"
+	case id == 511:
+		return "RAIN_AND_SNOW"
+	case id == 520:
+		return "LIGHT_RAIN_SHOWERS"
+	case id >= 521 && id < 600:
+		return "RAIN_SHOWERS"
+	case id == 600:
+		return "LIGHT_SNOW"
+	case id == 601:
+		return "SNOW"
+	case id == 602:
+		return "HEAVY_SNOW"
+	case id >= 611 && id < 620:
+		return "RAIN_AND_SNOW"
+	case id == 620:
+		return "LIGHT_SNOW_SHOWERS"
+	case id >= 621 && id < 700:
+		return "SNOW_SHOWERS"
+	case id == 701:
+		return "MIST"
+	case id == 711:
+		return "SMOKE"
+	case id == 721:
+		return "HAZE"
+	case id == 731 || id == 751 || id == 761:
+		return "DUST"
+	case id == 741:
+		return "FOG"
+	case id == 762:
+		return "VOLCANIC_ASH"
+	case id == 771:
+		return "SQUALLS"
+	case id == 781:
+		return "TORNADO"
+	case id >= 700 && id < 800:
+		return "CLOUDY"
+	case id == 800:
+		return "CLEAR"
+	case id == 801:
+		return "MOSTLY_CLEAR"
+	case id == 802:
+		return "PARTLY_CLOUDY"
+	case id == 803:
+		return "MOSTLY_CLOUDY"
+	case id == 804:
+		return "CLOUDY"
+	}
+	return "TYPE_UNSPECIFIED"
+}
+
+func owmWeatherCondition(conditions []owmCondition, lang string) *WeatherCondition {
+	if len(conditions) == 0 {
+		return nil
+	}
+	c := conditions[0]
+	// Descriptions come lowercase and in lang, which may not be ASCII
+	description := c.Description
+	if first, size := utf8.DecodeRuneInString(description); size > 0 {
+		description = string(unicode.ToUpper(first)) + description[size:]
+	}
+	return &WeatherCondition{
+		Type:        owmConditionType(c.ID),
+		Description: LocalizedText{Text: description, LanguageCode: lang},
+	}
+}
+
+// Map the 0..1 lunation fraction to the Google moon phase names
+func owmMoonPhase(phase float64) string {
+	switch {
+	case phase < 0.03 || phase > 0.97:
+		return "NEW_MOON"
+	case phase < 0.22:
+		return "WAXING_CRESCENT"
+	case phase < 0.28:
+		return "FIRST_QUARTER"
+	case phase < 0.47:
+		return "WAXING_GIBBOUS"
+	case phase < 0.53:
+		return "FULL_MOON"
+	case phase < 0.72:
+		return "WANING_GIBBOUS"
+	case phase < 0.78:
+		return "LAST_QUARTER"
+	}
+	return "WANING_CRESCENT"
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Test OpenWeatherMap condition codes map to Google condition types
+func TestOWMConditionType(t *testing.T) {
+	tests := []struct {
+		id       int
+		expected string
+	}{
+		{200, "THUNDERSHOWER"},
+		{211, "THUNDERSTORM"},
+		{232, "HEAVY_THUNDERSTORM"},
+		{301, "LIGHT_RAIN"},
+		{500, "LIGHT_RAIN"},
+		{501, "RAIN"},
+		{504, "HEAVY_RAIN"},
+		{511, "RAIN_AND_SNOW"},
+		{520, "LIGHT_RAIN_SHOWERS"},
+		{531, "RAIN_SHOWERS"},
+		{600, "LIGHT_SNOW"},
+		{601, "SNOW"},
+		{602, "HEAVY_SNOW"},
+		{613, "RAIN_AND_SNOW"},
+		{620, "LIGHT_SNOW_SHOWERS"},
+		{622, "SNOW_SHOWERS"},
+		{701, "MIST"},
+		{741, "FOG"},
+		{751, "DUST"},
+		{762, "VOLCANIC_ASH"},
+		{781, "TORNADO"},
+		{799, "CLOUDY"},
+		{800, "CLEAR"},
+		{801, "MOSTLY_CLEAR"},
+		{802, "PARTLY_CLOUDY"},
+		{803, "MOSTLY_CLOUDY"},
+		{804, "CLOUDY"},
+		{900, "TYPE_UNSPECIFIED"},
+	}
+
+	for _, test := range tests {
+		if got := owmConditionType(test.id); got != test.expected {
+			t.Errorf("owmConditionType(%d) = %s, expected %s", test.id, got, test.expected)
+		}
+	}
+}
+
+// Test lunation fractions map to Google moon phase names
+func TestOWMMoonPhase(t *testing.T) {
+	tests := []struct {
+		phase    float64
+		expected string
+	}{
+		{0, "NEW_MOON"},
+		{0.1, "WAXING_CRESCENT"},
+		{0.25, "FIRST_QUARTER"},
+		{0.4, "WAXING_GIBBOUS"},
+		{0.5, "FULL_MOON"},
+		{0.6, "WANING_GIBBOUS"},
+		{0.75, "LAST_QUARTER"},
+		{0.9, "WANING_CRESCENT"},
+		{0.98, "NEW_MOON"},
+		{1, "NEW_MOON"},
+	}
+
+	for _, test := range tests {
+		if got := owmMoonPhase(test.phase); got != test.expected {
+			t.Errorf("owmMoonPhase(%g) = %s, expected %s", test.phase, got, test.expected)
+		}
+	}
+}
+
+// Test that the larger of rain and snow sets the precipitation type and
+// amount
+func TestOWMPrecipitation(t *testing.T) {
+	pop := 0.35
+	hourTests := []struct {
+		name     string
+		hour     owmHour
+		want     bool
+		wantType string
+		amount   float64
+	}{
+		{"dry", owmHour{}, false, "", 0},
+		{"probability only", owmHour{Pop: &pop}, true, "RAIN", 0},
+		{"rain", owmHour{Pop: &pop, Rain: &owmVolume{OneHour: 1.5}}, true, "RAIN", 1.5},
+		{"snow", owmHour{Pop: &pop, Snow: &owmVolume{OneHour: 2}}, true, "SNOW", 2},
+		{"more rain than snow", owmHour{Pop: &pop, Rain: &owmVolume{OneHour: 3}, Snow: &owmVolume{OneHour: 1}}, true, "RAIN", 3},
+		{"amount without probability", owmHour{Rain: &owmVolume{OneHour: 0.4}}, true, "", 0.4},
+	}
+
+	for _, test := range hourTests {
+		precipitation := test.hour.toConditions("en").Precipitation
+		if (precipitation != nil) != test.want {
+			t.Errorf("%s: expected precipitation %v, got %+v", test.name, test.want, precipitation)
+			continue
+		}
+		if precipitation == nil {
+			continue
+		}
+		if precipitation.Qpf.Quantity != test.amount || precipitation.Qpf.Unit != "MILLIMETERS" {
+			t.Errorf("%s: expected %g mm, got %+v", test.name, test.amount, precipitation.Qpf)
+		}
+		switch {
+		case test.wantType == "" && precipitation.Probability != nil:
+			t.Errorf("%s: expected no probability, got %+v", test.name, precipitation.Probability)
+		case test.wantType != "" && (precipitation.Probability == nil || precipitation.Probability.Type != test.wantType || precipitation.Probability.Percent != 35):
+			t.Errorf("%s: expected 35%% %s, got %+v", test.name, test.wantType, precipitation.Probability)
+		}
+	}
+
+	dayTests := []struct {
+		rain, snow float64
+		wantType   string
+		amount     float64
+	}{
+		{0, 0, "RAIN", 0},
+		{4, 0, "RAIN", 4},
+		{1, 6, "SNOW", 6},
+	}
+
+	for _, test := range dayTests {
+		day := owmDay{Pop: 0.8, Rain: test.rain, Snow: test.snow}
+		forecast := day.toDailyForecast(time.UTC, "en")
+		if forecast.Precipitation.Probability.Type != test.wantType || forecast.Precipitation.Qpf.Quantity != test.amount {
+			t.Errorf("rain %g, snow %g: expected %g mm of %s, got %+v", test.rain, test.snow, test.amount, test.wantType, forecast.Precipitation)
+		}
+		if forecast.Precipitation.Probability.Percent != 80 {
+			t.Errorf("Expected 80%% probability, got %d", forecast.Precipitation.Probability.Percent)
+		}
+	}
+}
+
+// Test that metric One Call values are converted to the units Google reports
+func TestOpenWeatherUnits(t *testing.T) {
+	owmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if query := r.URL.Query(); query.Get("units") != "metric" || query.Get("lang") != "de" {
+			t.Errorf("Expected metric units in German, got %v", query)
+		}
+		response := mockOneCallResponse()
+		current := response["current"].(map[string]interface{})
+		current["wind_gust"] = 10.0
+		current["visibility"] = 2500
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer owmServer.Close()
+
+	originalOneCall := OPENWEATHER_ONECALL_URL
+	OPENWEATHER_ONECALL_URL = owmServer.URL
+	defer func() { OPENWEATHER_ONECALL_URL = originalOneCall }()
+
+	provider := &openWeatherProvider{apiKey: "test-owm-key"}
+	ctx := withLanguage(context.Background(), "de")
+
+	current, err := provider.CurrentConditions(ctx, "51.5", "-0.12")
+	if err != nil {
+		t.Fatalf("Failed to fetch current conditions: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		value    float64
+		unit     string
+		expected float64
+		wantUnit string
+	}{
+		{"temperature", current.Temperature.Degrees, current.Temperature.Unit, 8.5, "CELSIUS"},
+		{"feels like", current.FeelsLikeTemperature.Degrees, current.FeelsLikeTemperature.Unit, 6.1, "CELSIUS"},
+		{"dew point", current.DewPoint.Degrees, current.DewPoint.Unit, 5.4, "CELSIUS"},
+		{"wind speed", current.Wind.Speed.Value, current.Wind.Speed.Unit, 18, "KILOMETERS_PER_HOUR"},
+		{"wind gust", current.Wind.Gust.Value, current.Wind.Gust.Unit, 36, "KILOMETERS_PER_HOUR"},
+		{"visibility", current.Visibility.Distance, current.Visibility.Unit, 2.5, "KILOMETERS"},
+		{"pressure", current.AirPressure.MeanSeaLevelMillibars, "", 1012, ""},
+		{"rain", current.Precipitation.Qpf.Quantity, current.Precipitation.Qpf.Unit, 0.3, "MILLIMETERS"},
+	}
+
+	for _, test := range tests {
+		if math.Abs(test.value-test.expected) > 1e-9 || test.unit != test.wantUnit {
+			t.Errorf("%s: expected %g %s, got %g %s", test.name, test.expected, test.wantUnit, test.value, test.unit)
+		}
+	}
+	if current.WeatherCondition.Description.LanguageCode != "de" {
+		t.Errorf("Expected the description in German, got %+v", current.WeatherCondition.Description)
+	}
+	if current.IsDaytime == nil || !*current.IsDaytime {
+		t.Errorf("Expected daytime from the 10d icon, got %v", current.IsDaytime)
+	}
+}
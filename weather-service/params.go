@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Query parameter limits. The hour and day limits are the most the Google
+// Weather, Air Quality and Pollen APIs return for each lookup.
+const (
+	MAX_FORECAST_HOURS     = 240
+	MAX_AIR_QUALITY_HOURS  = 96
+	MAX_HISTORY_HOURS      = 24
+	MAX_FORECAST_DAYS      = 10
+	DEFAULT_FORECAST_HOURS = 24
+	DEFAULT_HISTORY_HOURS  = 24
+	DEFAULT_FORECAST_DAYS  = 10
+	DEFAULT_COMBINED_DAYS  = 5 // daily forecast days on /api/weather
+	MAX_POLLEN_DAYS        = 5
+	MAX_ADDRESS_LENGTH     = 256
+	MIN_PLACE_QUERY_LENGTH = 2
+	MAX_PLACE_QUERY_LENGTH = 100
+)
+
+// A query parameter that is missing or out of range
+type ParamError struct {
+	Code    string // ERR_MISSING_PARAMETER or ERR_INVALID_PARAMETER
+	Param   string
+	Message string
+	Details map[string]interface{}
+}
+
+func (e *ParamError) Error() string {
+	return e.Message
+}
+
+func missingParam(name string) *ParamError {
+	return &ParamError{
+		Code:    ERR_MISSING_PARAMETER,
+		Param:   name,
+		Message: fmt.Sprintf("Missing %s parameter", name),
+		Details: map[string]interface{}{"parameter": name},
+	}
+}
+
+func invalidParam(name, message string, details map[string]interface{}) *ParamError {
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+	details["parameter"] = name
+	return &ParamError{Code: ERR_INVALID_PARAMETER, Param: name, Message: message, Details: details}
+}
+
+// Write a parameter error as a 400 response
+func writeParamError(w http.ResponseWriter, err *ParamError) {
+	writeError(w, http.StatusBadRequest, err.Code, err.Message, err.Details)
+}
+
+// Parse lat and lon, returning them in canonical decimal form so they can be
+// passed upstream and used in cache keys as-is
+func parseCoordinates(query url.Values) (lat, lon string, err *ParamError) {
+	lat, err = parseFloatParam(query, "lat", -90, 90)
+	if err != nil {
+		return "", "", err
+	}
+	lon, err = parseFloatParam(query, "lon", -180, 180)
+	if err != nil {
+		return "", "", err
+	}
+	return lat, lon, nil
+}
+
+func parseFloatParam(query url.Values, name string, min, max float64) (string, *ParamError) {
+	raw := query.Get(name)
+	if raw == "" {
+		return "", missingParam(name)
+	}
+	value, parseErr := strconv.ParseFloat(raw, 64)
+	if parseErr != nil || math.IsNaN(value) || value < min || value > max {
+		return "", invalidParam(name, fmt.Sprintf("%s must be a number from %g to %g", name, min, max),
+			map[string]interface{}{"min": min, "max": max})
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64), nil
+}
+
+// Parse an optional whole-number parameter in [1, max], using def when it
+// is absent
+func parseCountParam(query url.Values, name string, def, max int) (string, *ParamError) {
+	raw := query.Get(name)
+	if raw == "" {
+		return strconv.Itoa(def), nil
+	}
+	value, parseErr := strconv.Atoi(raw)
+	if parseErr != nil || value < 1 || value > max {
+		return "", invalidParam(name, fmt.Sprintf("%s must be a whole number from 1 to %d", name, max),
+			map[string]interface{}{"min": 1, "max": max})
+	}
+	return strconv.Itoa(value), nil
+}
+
+// Parse q, the partial place name typed into a location search box.
+// Whitespace is collapsed so "new  york " and "new york" share a cache entry.
+func parsePlaceQuery(query url.Values) (string, *ParamError) {
+	text := strings.Join(strings.Fields(query.Get("q")), " ")
+	if text == "" {
+		return "", missingParam("q")
+	}
+	if length := utf8.RuneCountInString(text); length < MIN_PLACE_QUERY_LENGTH || length > MAX_PLACE_QUERY_LENGTH {
+		return "", invalidParam("q", fmt.Sprintf("q must be %d to %d characters", MIN_PLACE_QUERY_LENGTH, MAX_PLACE_QUERY_LENGTH),
+			map[string]interface{}{"minLength": MIN_PLACE_QUERY_LENGTH, "maxLength": MAX_PLACE_QUERY_LENGTH})
+	}
+	return text, nil
+}
+
+// Parse include, a comma-separated list of optional sections. Every value
+// must be one of allowed.
+func parseInclude(query url.Values, allowed ...string) (map[string]bool, *ParamError) {
+	include := map[string]bool{}
+	raw := query.Get("include")
+	if raw == "" {
+		return include, nil
+	}
+	for _, section := range strings.Split(raw, ",") {
+		section = strings.ToLower(strings.TrimSpace(section))
+		if !slices.Contains(allowed, section) {
+			return nil, invalidParam("include", "include must be a comma-separated list of "+strings.Join(allowed, ", "),
+				map[string]interface{}{"allowed": allowed})
+		}
+		include[section] = true
+	}
+	return include, nil
+}
+
+// Parse fallback, which opts in to synthetic sections in place of ones that
+// failed with no stale data to fall back on. Only "synthetic" is accepted.
+func parseFallback(query url.Values) (synthetic bool, err *ParamError) {
+	switch strings.ToLower(query.Get("fallback")) {
+	case "":
+		return false, nil
+	case "synthetic":
+		return true, nil
+	}
+	return false, invalidParam("fallback", "fallback must be synthetic", map[string]interface{}{"allowed": []string{"synthetic"}})
+}
+
+// Parse the address to geocode
+func parseAddress(query url.Values) (string, *ParamError) {
+	address := strings.TrimSpace(query.Get("address"))
+	if address == "" {
+		return "", missingParam("address")
+	}
+	if len(address) > MAX_ADDRESS_LENGTH {
+		return "", invalidParam("address", fmt.Sprintf("address must be at most %d bytes", MAX_ADDRESS_LENGTH),
+			map[string]interface{}{"maxLength": MAX_ADDRESS_LENGTH})
+	}
+	return address, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseCoordinates(t *testing.T) {
+	tests := []struct {
+		query    string
+		lat, lon string
+		code     string
+		param    string
+	}{
+		{"lat=37.7749&lon=-122.4194", "37.7749", "-122.4194", "", ""},
+		{"lat=%2B90&lon=180.000", "90", "180", "", ""},
+		{"lat=1e1&lon=-0", "10", "-0", "", ""},
+		{"lon=1", "", "", ERR_MISSING_PARAMETER, "lat"},
+		{"lat=1", "", "", ERR_MISSING_PARAMETER, "lon"},
+		{"lat=90.01&lon=0", "", "", ERR_INVALID_PARAMETER, "lat"},
+		{"lat=0&lon=-180.5", "", "", ERR_INVALID_PARAMETER, "lon"},
+		{"lat=NaN&lon=0", "", "", ERR_INVALID_PARAMETER, "lat"},
+		{"lat=0&lon=Inf", "", "", ERR_INVALID_PARAMETER, "lon"},
+		{"lat=1%26key%3Devil&lon=0", "", "", ERR_INVALID_PARAMETER, "lat"},
+	}
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		lat, lon, err := parseCoordinates(query)
+		if tt.code == "" {
+			if err != nil || lat != tt.lat || lon != tt.lon {
+				t.Errorf("%s: expected %s,%s, got %s,%s (%v)", tt.query, tt.lat, tt.lon, lat, lon, err)
+			}
+			continue
+		}
+		if err == nil || err.Code != tt.code || err.Param != tt.param {
+			t.Errorf("%s: expected %s for %s, got %+v", tt.query, tt.code, tt.param, err)
+		}
+	}
+}
+
+func TestParseCountParam(t *testing.T) {
+	tests := []struct {
+		raw   string
+		want  string
+		valid bool
+	}{
+		{"", "24", true},
+		{"1", "1", true},
+		{"048", "48", true},
+		{"240", "240", true},
+		{"0", "", false},
+		{"241", "", false},
+		{"-5", "", false},
+		{"12.5", "", false},
+		{"24&days=99", "", false},
+	}
+	for _, tt := range tests {
+		query := url.Values{}
+		if tt.raw != "" {
+			query.Set("hours", tt.raw)
+		}
+		got, err := parseCountParam(query, "hours", DEFAULT_FORECAST_HOURS, MAX_FORECAST_HOURS)
+		if tt.valid && (err != nil || got != tt.want) {
+			t.Errorf("hours=%q: expected %s, got %q (%v)", tt.raw, tt.want, got, err)
+		}
+		if !tt.valid && (err == nil || err.Code != ERR_INVALID_PARAMETER || err.Details["max"] != MAX_FORECAST_HOURS) {
+			t.Errorf("hours=%q: expected INVALID_PARAMETER with bounds, got %+v", tt.raw, err)
+		}
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	if address, err := parseAddress(url.Values{"address": {"  Paris  "}}); err != nil || address != "Paris" {
+		t.Errorf("Expected trimmed address, got %q (%v)", address, err)
+	}
+	if _, err := parseAddress(url.Values{"address": {"   "}}); err == nil || err.Code != ERR_MISSING_PARAMETER {
+		t.Errorf("Expected blank address to be missing, got %+v", err)
+	}
+	long := make([]byte, MAX_ADDRESS_LENGTH+1)
+	for i := range long {
+		long[i] = 'a'
+	}
+	if _, err := parseAddress(url.Values{"address": {string(long)}}); err == nil || err.Code != ERR_INVALID_PARAMETER {
+		t.Errorf("Expected long address to be rejected, got %+v", err)
+	}
+}
+
+func TestParsePlaceQuery(t *testing.T) {
+	if text, err := parsePlaceQuery(url.Values{"q": {"  New   York "}}); err != nil || text != "New York" {
+		t.Errorf("Expected collapsed whitespace, got %q (%v)", text, err)
+	}
+	if _, err := parsePlaceQuery(url.Values{}); err == nil || err.Code != ERR_MISSING_PARAMETER {
+		t.Errorf("Expected missing q, got %+v", err)
+	}
+	// Length is counted in characters, not bytes
+	if text, err := parsePlaceQuery(url.Values{"q": {"東京"}}); err != nil || text != "東京" {
+		t.Errorf("Expected two-character query to be accepted, got %q (%v)", text, err)
+	}
+	if _, err := parsePlaceQuery(url.Values{"q": {"é"}}); err == nil || err.Code != ERR_INVALID_PARAMETER {
+		t.Errorf("Expected one-character query to be rejected, got %+v", err)
+	}
+}
+
+func TestParseInclude(t *testing.T) {
+	include, err := parseInclude(url.Values{"include": {" Pollen ,alerts"}}, "pollen", "alerts")
+	if err != nil || !include["pollen"] || !include["alerts"] || len(include) != 2 {
+		t.Errorf("Expected pollen and alerts, got %v (%v)", include, err)
+	}
+	if include, err := parseInclude(url.Values{}, "pollen"); err != nil || len(include) != 0 {
+		t.Errorf("Expected nothing included by default, got %v (%v)", include, err)
+	}
+	if _, err := parseInclude(url.Values{"include": {"pollen,"}}, "pollen"); err == nil || err.Param != "include" {
+		t.Errorf("Expected empty section to be rejected, got %+v", err)
+	}
+}
+
+func TestParseFallback(t *testing.T) {
+	if synthetic, err := parseFallback(url.Values{}); err != nil || synthetic {
+		t.Errorf("Expected no synthetic data by default, got %v (%v)", synthetic, err)
+	}
+	if synthetic, err := parseFallback(url.Values{"fallback": {"Synthetic"}}); err != nil || !synthetic {
+		t.Errorf("Expected synthetic data, got %v (%v)", synthetic, err)
+	}
+	if _, err := parseFallback(url.Values{"fallback": {"cached"}}); err == nil || err.Param != "fallback" {
+		t.Errorf("Expected an unknown fallback to be rejected, got %+v", err)
+	}
+}
+
+// Test that caller input can't add parameters to upstream requests
+func TestUpstreamQueryEncoding(t *testing.T) {
+	weatherCache = newResponseCache()
+
+	var calls atomic.Int32
+	var gotQuery url.Values
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		gotQuery = r.URL.Query()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": []interface{}{}, "status": "OK"})
+	}))
+	defer mockServer.Close()
+
+	originalBase, originalGeocoding := GOOGLE_WEATHER_BASE, GOOGLE_GEOCODING_URL
+	GOOGLE_WEATHER_BASE, GOOGLE_GEOCODING_URL = mockServer.URL, mockServer.URL
+	defer func() { GOOGLE_WEATHER_BASE, GOOGLE_GEOCODING_URL = originalBase, originalGeocoding }()
+	setTestConfig(t, func(c *Config) { c.GoogleAPIKey = "test-key" })
+
+	// Injected coordinates and hours are rejected before reaching upstream
+	for _, target := range []string{
+		"/api/hourly?lat=1%26key%3Devil&lon=2",
+		"/api/hourly?lat=1&lon=2&hours=24%26key%3Devil",
+	} {
+		w := httptest.NewRecorder()
+		hourlyForecastHandler(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", target, w.Code)
+		}
+	}
+	if calls.Load() != 0 {
+		t.Errorf("Expected no upstream calls for invalid parameters, got %d", calls.Load())
+	}
+
+	// Free text is passed through as a single encoded value
+	w := httptest.NewRecorder()
+	geocodeHandler(w, httptest.NewRequest("GET", "/api/geocode?address=Rue+1%26key%3Devil", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if gotQuery.Get("address") != "Rue 1&key=evil" || len(gotQuery["key"]) != 1 || gotQuery.Get("key") != "test-key" {
+		t.Errorf("Expected address encoded as one value, got %v", gotQuery)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Most results returned by a place lookup
+const MAX_PLACE_RESULTS = 5
+
+// Address component types that name a locality, most specific first
+var localityTypes = []string{"locality", "postal_town", "administrative_area_level_3", "administrative_area_level_2"}
+
+// Place is a compact location result, the same whichever provider answered
+type Place struct {
+	Name        string  `json:"name"`
+	AdminArea   string  `json:"adminArea,omitempty"`
+	Country     string  `json:"country,omitempty"`
+	CountryCode string  `json:"countryCode,omitempty"`
+	Lat         float64 `json:"lat"`
+	Lon         float64 `json:"lon"`
+	TimeZone    string  `json:"timeZone,omitempty"` // IANA ID, e.g. Europe/Paris
+}
+
+// PlacesResponse is the response of /api/reverse-geocode and
+// /api/places/autocomplete
+type PlacesResponse struct {
+	Results   []Place `json:"results"`
+	Timestamp string  `json:"timestamp"`
+}
+
+// Check that a place has a name and coordinates in range
+func (p *Place) Validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("place: missing name")
+	}
+	if p.Lat < -90 || p.Lat > 90 || p.Lon < -180 || p.Lon > 180 {
+		return fmt.Errorf("place %q: coordinates %g,%g out of range", p.Name, p.Lat, p.Lon)
+	}
+	return nil
+}
+
+// Build a place from address components. name is used when it is set,
+// otherwise the most specific locality component.
+func placeFromComponents(name string, components []AddressComponent, lat, lon float64) Place {
+	place := Place{Name: name, Lat: lat, Lon: lon}
+	for _, localityType := range localityTypes {
+		if place.Name != "" {
+			break
+		}
+		for _, c := range components {
+			if slices.Contains(c.Types, localityType) {
+				place.Name = c.LongName
+				break
+			}
+		}
+	}
+	for _, c := range components {
+		switch {
+		case slices.Contains(c.Types, "administrative_area_level_1"):
+			place.AdminArea = c.LongName
+		case slices.Contains(c.Types, "country"):
+			place.Country = c.LongName
+			place.CountryCode = c.ShortName
+		}
+	}
+	return place
+}
+
+// Convert Geocoding API results to places
+func placesFromGeocodeResults(results []GeocodeResult) []Place {
+	places := make([]Place, 0, len(results))
+	for _, r := range results {
+		location := r.Geometry.Location
+		places = append(places, placeFromComponents("", r.AddressComponents, location.Lat, location.Lng))
+	}
+	return dedupePlaces(places)
+}
+
+// Drop invalid places and repeats of the same name, admin area and
+// country, keeping at most MAX_PLACE_RESULTS
+func dedupePlaces(places []Place) []Place {
+	type placeKey struct{ name, adminArea, country string }
+	seen := make(map[placeKey]bool)
+	deduped := make([]Place, 0, len(places))
+	for i, p := range places {
+		if err := p.Validate(); err != nil {
+			slog.Warn("skipping invalid place", "index", i, "error", err)
+			continue
+		}
+		key := placeKey{p.Name, p.AdminArea, p.CountryCode}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		deduped = append(deduped, p)
+		if len(deduped) == MAX_PLACE_RESULTS {
+			break
+		}
+	}
+	return deduped
+}
+
+// Google Places API (New) text search wire format
+
+type googlePlacesSearchRequest struct {
+	TextQuery    string `json:"textQuery"`
+	IncludedType string `json:"includedType,omitempty"`
+	LanguageCode string `json:"languageCode"`
+	PageSize     int    `json:"pageSize"`
+}
+
+type googlePlacesSearchResponse struct {
+	Places []struct {
+		DisplayName       LocalizedText  `json:"displayName"`
+		Location          googleLocation `json:"location"`
+		AddressComponents []struct {
+			LongText  string   `json:"longText"`
+			ShortText string   `json:"shortText"`
+			Types     []string `json:"types"`
+		} `json:"addressComponents"`
+	} `json:"places"`
+}
+
+// Parse a Places API text search response
+func parsePlacesSearch(body []byte) ([]Place, error) {
+	var resp googlePlacesSearchResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, &PayloadError{fmt.Errorf("decode places search: %w", err)}
+	}
+
+	places := make([]Place, 0, len(resp.Places))
+	for _, p := range resp.Places {
+		components := make([]AddressComponent, 0, len(p.AddressComponents))
+		for _, c := range p.AddressComponents {
+			components = append(components, AddressComponent{LongName: c.LongText, ShortName: c.ShortText, Types: c.Types})
+		}
+		places = append(places, placeFromComponents(p.DisplayName.Text, components, p.Location.Latitude, p.Location.Longitude))
+	}
+	return dedupePlaces(places), nil
+}
+
+// Fill in the time zone of each place from the Google Time Zone API. Time
+// zones are cached for a long time, and a failed lookup leaves the time
+// zone empty rather than failing the places. Without a Google API key
+// places are returned as they are.
+func withTimeZones(ctx context.Context, places []Place) []Place {
+	apiKey := config.GoogleAPIKey
+	if apiKey == "" {
+		return places
+	}
+
+	var wg sync.WaitGroup
+	for i := range places {
+		wg.Add(1)
+		go func(p *Place) {
+			defer wg.Done()
+			timeZone, err := cachedTimeZone(ctx, apiKey, p.Lat, p.Lon)
+			if err != nil {
+				slog.WarnContext(ctx, "time zone lookup failed", "place", p.Name, "error", err)
+				return
+			}
+			p.TimeZone = timeZone
+		}(&places[i])
+	}
+	wg.Wait()
+	return places
+}
+
+func cachedTimeZone(ctx context.Context, apiKey string, lat, lon float64) (string, error) {
+	latitude, longitude := strconv.FormatFloat(lat, 'f', -1, 64), strconv.FormatFloat(lon, 'f', -1, 64)
+	value, _, err := placesCache.Fetch(ctx, locationCacheKey("timezone", latitude, longitude), CACHE_TTL_TIME_ZONE, func(ctx context.Context) (interface{}, error) {
+		start := time.Now()
+		timeZone, err := fetchTimeZone(ctx, apiKey, latitude, longitude)
+		observeUpstream(ctx, "google", "timezone", start, err)
+		return timeZone, err
+	})
+	if err != nil {
+		return "", err
+	}
+	return value.(string), nil
+}
+
+func fetchTimeZone(ctx context.Context, apiKey, lat, lon string) (string, error) {
+	apiURL := upstreamURL(GOOGLE_TIMEZONE_URL, url.Values{
+		"location":  {lat + "," + lon},
+		"timestamp": {strconv.FormatInt(time.Now().Unix(), 10)},
+		"key":       {apiKey},
+	})
+	body, err := fetchUpstream(ctx, apiURL)
+	if err != nil {
+		return "", err
+	}
+
+	var resp struct {
+		Status     string `json:"status"`
+		TimeZoneID string `json:"timeZoneId"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "", &PayloadError{fmt.Errorf("decode time zone response: %w", err)}
+	}
+	// Like the Geocoding API, problems are reported with a 200 status
+	if resp.Status != "OK" {
+		return "", &UpstreamError{StatusCode: http.StatusBadGateway, Body: resp.Status}
+	}
+	return resp.TimeZoneID, nil
+}
+
+// Reverse geocoding endpoint: name the locality at a GPS location
+func reverseGeocodeHandler(w http.ResponseWriter, r *http.Request) {
+	provider := newWeatherProvider(config)
+	if provider == nil {
+		writeError(w, http.StatusInternalServerError, ERR_NOT_CONFIGURED, "API key not configured", nil)
+		return
+	}
+
+	query := r.URL.Query()
+	lat, lon, paramErr := parseCoordinates(query)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+	lang, paramErr := parseLanguage(query)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+	ctx := withLanguage(r.Context(), lang)
+
+	places, status, err := cachedReverseGeocode(ctx, provider, lat, lon)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "reverse geocoding failed", "error", err)
+		writeUpstreamError(w, err, "Failed to reverse geocode location")
+		return
+	}
+
+	w.Header().Set("X-Cache", string(status))
+	writeJSON(w, PlacesResponse{Results: places, Timestamp: time.Now().Format(time.RFC3339)})
+}
+
+// Place autocomplete endpoint for the location search box
+func autocompleteHandler(w http.ResponseWriter, r *http.Request) {
+	provider := newWeatherProvider(config)
+	if provider == nil {
+		writeError(w, http.StatusInternalServerError, ERR_NOT_CONFIGURED, "API key not configured", nil)
+		return
+	}
+
+	query := r.URL.Query()
+	text, paramErr := parsePlaceQuery(query)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+	lang, paramErr := parseLanguage(query)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+	ctx := withLanguage(r.Context(), lang)
+
+	places, status, err := cachedAutocomplete(ctx, provider, text)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "place autocomplete failed", "error", err)
+		writeUpstreamError(w, err, "Failed to search places")
+		return
+	}
+
+	w.Header().Set("X-Cache", string(status))
+	writeJSON(w, PlacesResponse{Results: places, Timestamp: time.Now().Format(time.RFC3339)})
+}
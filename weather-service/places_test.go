@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPlacesFromGeocodeResults(t *testing.T) {
+	body := []byte(`{
+	  "status": "OK",
+	  "results": [
+	    {"formatted_address": "Paris, France", "geometry": {"location": {"lat": 48.8566, "lng": 2.3522}},
+	     "address_components": [
+	       {"long_name": "Paris", "short_name": "Paris", "types": ["locality", "political"]},
+	       {"long_name": "Paris", "short_name": "Paris", "types": ["administrative_area_level_2", "political"]},
+	       {"long_name": "Île-de-France", "short_name": "IDF", "types": ["administrative_area_level_1", "political"]},
+	       {"long_name": "France", "short_name": "FR", "types": ["country", "political"]}]},
+	    {"formatted_address": "Paris, France", "geometry": {"location": {"lat": 48.85, "lng": 2.35}},
+	     "address_components": [
+	       {"long_name": "Paris", "short_name": "Paris", "types": ["administrative_area_level_2", "political"]},
+	       {"long_name": "Île-de-France", "short_name": "IDF", "types": ["administrative_area_level_1", "political"]},
+	       {"long_name": "France", "short_name": "FR", "types": ["country", "political"]}]},
+	    {"formatted_address": "Nowhere", "geometry": {"location": {"lat": 1, "lng": 2}}, "address_components": []}
+	  ]
+	}`)
+	result, err := parseGeocodeResponse(body)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The repeated locality and the result without one are dropped
+	places := placesFromGeocodeResults(result.Results)
+	want := Place{Name: "Paris", AdminArea: "Île-de-France", Country: "France", CountryCode: "FR", Lat: 48.8566, Lon: 2.3522}
+	if len(places) != 1 || places[0] != want {
+		t.Errorf("Expected %+v, got %+v", want, places)
+	}
+}
+
+// Test autocomplete against a fake Places API, with time zones filled in
+// and both lookups cached. A failed time zone lookup is retried on the next
+// request rather than cached with the places.
+func TestAutocompleteHandler(t *testing.T) {
+	placesCache = newBoundedResponseCache(CACHE_MAX_PLACES)
+
+	var searches, timeZoneCalls atomic.Int32
+	placesServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		searches.Add(1)
+		var req googlePlacesSearchRequest
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &req)
+		if r.Method != http.MethodPost || r.URL.Path != "/places:searchText" || r.URL.Query().Get("fields") == "" {
+			t.Errorf("Unexpected upstream request %s %s", r.Method, r.URL)
+		}
+		if req.TextQuery != "San Fr" || req.LanguageCode != "es" || req.PageSize != MAX_PLACE_RESULTS {
+			t.Errorf("Unexpected search %+v", req)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"places": [
+		  {"displayName": {"text": "San Francisco"}, "location": {"latitude": 37.7749, "longitude": -122.4194},
+		   "addressComponents": [
+		     {"longText": "California", "shortText": "CA", "types": ["administrative_area_level_1", "political"]},
+		     {"longText": "Estados Unidos", "shortText": "US", "types": ["country", "political"]}]},
+		  {"displayName": {"text": ""}, "location": {"latitude": 0, "longitude": 0}}
+		]}`))
+	}))
+	defer placesServer.Close()
+
+	timeZoneServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("location") != "37.7749,-122.4194" {
+			t.Errorf("Unexpected time zone location %q", r.URL.Query().Get("location"))
+		}
+		if timeZoneCalls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "OK", "timeZoneId": "America/Los_Angeles"}`))
+	}))
+	defer timeZoneServer.Close()
+
+	originalPlaces, originalTimeZone := GOOGLE_PLACES_BASE, GOOGLE_TIMEZONE_URL
+	GOOGLE_PLACES_BASE, GOOGLE_TIMEZONE_URL = placesServer.URL, timeZoneServer.URL
+	defer func() { GOOGLE_PLACES_BASE, GOOGLE_TIMEZONE_URL = originalPlaces, originalTimeZone }()
+	setTestConfig(t, func(c *Config) { c.GoogleAPIKey = "test-key" })
+
+	for i, target := range []string{"/api/places/autocomplete?q=San+Fr&lang=es", "/api/places/autocomplete?q=%20san%20%20fr&lang=es", "/api/places/autocomplete?q=san+fr&lang=es"} {
+		w := httptest.NewRecorder()
+		autocompleteHandler(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", target, w.Code, w.Body.String())
+		}
+		var resp PlacesResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		want := Place{Name: "San Francisco", AdminArea: "California", Country: "Estados Unidos", CountryCode: "US", Lat: 37.7749, Lon: -122.4194, TimeZone: "America/Los_Angeles"}
+		if i == 0 {
+			want.TimeZone = ""
+		}
+		if len(resp.Results) != 1 || resp.Results[0] != want {
+			t.Errorf("%s: expected %+v, got %+v", target, want, resp.Results)
+		}
+	}
+	if searches.Load() != 1 || timeZoneCalls.Load() != 2 {
+		t.Errorf("Expected one search and two time zone lookups, got %d and %d", searches.Load(), timeZoneCalls.Load())
+	}
+
+	w := httptest.NewRecorder()
+	autocompleteHandler(w, httptest.NewRequest("GET", "/api/places/autocomplete?q=s", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a one-character query, got %d", w.Code)
+	}
+}
+
+// Test reverse geocoding through OpenWeatherMap, which has no time zones
+func TestReverseGeocodeOpenWeather(t *testing.T) {
+	placesCache = newBoundedResponseCache(CACHE_MAX_PLACES)
+
+	owmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("lat") != "51.5074" || query.Get("lon") != "-0.1278" || query.Get("appid") != "test-owm-key" {
+			t.Errorf("Unexpected upstream query %v", query)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[
+		  {"name": "London", "local_names": {"fr": "Londres"}, "lat": 51.5073, "lon": -0.1276, "country": "GB", "state": "England"},
+		  {"name": "London", "local_names": {"fr": "Londres"}, "lat": 51.5, "lon": -0.12, "country": "GB", "state": "England"}
+		]`))
+	}))
+	defer owmServer.Close()
+
+	originalURL := OPENWEATHER_REVERSE_GEOCODING_URL
+	OPENWEATHER_REVERSE_GEOCODING_URL = owmServer.URL
+	defer func() { OPENWEATHER_REVERSE_GEOCODING_URL = originalURL }()
+	setTestConfig(t, func(c *Config) {
+		c.GoogleAPIKey = ""
+		c.OpenWeatherAPIKey = "test-owm-key"
+	})
+
+	w := httptest.NewRecorder()
+	reverseGeocodeHandler(w, httptest.NewRequest("GET", "/api/reverse-geocode?lat=51.5074&lon=-0.1278&lang=fr", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp PlacesResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	want := Place{Name: "Londres", AdminArea: "England", Country: "GB", CountryCode: "GB", Lat: 51.5073, Lon: -0.1276}
+	if len(resp.Results) != 1 || resp.Results[0] != want {
+		t.Errorf("Expected %+v, got %+v", want, resp.Results)
+	}
+}
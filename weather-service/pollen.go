@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Google pollen type codes
+const (
+	POLLEN_GRASS = "GRASS"
+	POLLEN_TREE  = "TREE"
+	POLLEN_WEED  = "WEED"
+)
+
+// PollenDay is the pollen forecast for one day
+type PollenDay struct {
+	Date   string        `json:"date"`
+	Grass  *PollenLevel  `json:"grass,omitempty"`
+	Tree   *PollenLevel  `json:"tree,omitempty"`
+	Weed   *PollenLevel  `json:"weed,omitempty"`
+	Plants []PollenPlant `json:"plants,omitempty"`
+}
+
+// PollenLevel is the forecast for one pollen type. Index is missing when
+// the type is out of season.
+type PollenLevel struct {
+	DisplayName           string       `json:"displayName"`
+	InSeason              bool         `json:"inSeason"`
+	Index                 *PollenIndex `json:"index,omitempty"`
+	HealthRecommendations []string     `json:"healthRecommendations,omitempty"`
+}
+
+// PollenIndex is a Universal Pollen Index value from 0 (none) to 5 (very
+// high)
+type PollenIndex struct {
+	Value       int    `json:"value"`
+	Category    string `json:"category"`
+	Description string `json:"description,omitempty"`
+	Color       string `json:"color,omitempty"` // #rrggbb
+}
+
+// PollenPlant is the forecast for one plant species
+type PollenPlant struct {
+	Code          string       `json:"code"`
+	DisplayName   string       `json:"displayName"`
+	Type          string       `json:"type,omitempty"` // GRASS, TREE or WEED
+	InSeason      bool         `json:"inSeason"`
+	Index         *PollenIndex `json:"index,omitempty"`
+	Family        string       `json:"family,omitempty"`
+	Season        string       `json:"season,omitempty"`
+	CrossReaction string       `json:"crossReaction,omitempty"`
+}
+
+// PollenResponse is the response of /api/pollen
+type PollenResponse struct {
+	Daily      []PollenDay      `json:"daily"`
+	RegionCode string           `json:"regionCode,omitempty"`
+	Location   *RequestLocation `json:"location,omitempty"`
+	Timestamp  string           `json:"timestamp"`
+}
+
+// Check that a day has a date and that index values are in range
+func (d *PollenDay) Validate() error {
+	if d.Date == "" {
+		return fmt.Errorf("pollen day: missing date")
+	}
+	for _, level := range []*PollenLevel{d.Grass, d.Tree, d.Weed} {
+		if level != nil && level.Index != nil && (level.Index.Value < 0 || level.Index.Value > 5) {
+			return fmt.Errorf("pollen day %s: index %d out of range", d.Date, level.Index.Value)
+		}
+	}
+	return nil
+}
+
+// Google Pollen API wire format
+
+type googlePollenResponse struct {
+	RegionCode string `json:"regionCode"`
+	DailyInfo  []struct {
+		Date           googleDate `json:"date"`
+		PollenTypeInfo []struct {
+			Code                  string             `json:"code"`
+			DisplayName           string             `json:"displayName"`
+			InSeason              bool               `json:"inSeason"`
+			IndexInfo             *googlePollenIndex `json:"indexInfo"`
+			HealthRecommendations []string           `json:"healthRecommendations"`
+		} `json:"pollenTypeInfo"`
+		PlantInfo []struct {
+			Code             string             `json:"code"`
+			DisplayName      string             `json:"displayName"`
+			InSeason         bool               `json:"inSeason"`
+			IndexInfo        *googlePollenIndex `json:"indexInfo"`
+			PlantDescription *struct {
+				Type          string `json:"type"`
+				Family        string `json:"family"`
+				Season        string `json:"season"`
+				CrossReaction string `json:"crossReaction"`
+			} `json:"plantDescription"`
+		} `json:"plantInfo"`
+	} `json:"dailyInfo"`
+}
+
+type googlePollenIndex struct {
+	Value            int          `json:"value"`
+	Category         string       `json:"category"`
+	IndexDescription string       `json:"indexDescription"`
+	Color            *googleColor `json:"color"`
+}
+
+func (i *googlePollenIndex) toPollenIndex() *PollenIndex {
+	if i == nil {
+		return nil
+	}
+	return &PollenIndex{Value: i.Value, Category: i.Category, Description: i.IndexDescription, Color: i.Color.hex()}
+}
+
+// Parse a Google pollen forecast. Days that fail validation are dropped
+// rather than failing the whole response.
+func parsePollenForecast(body []byte) ([]PollenDay, string, error) {
+	var resp googlePollenResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, "", &PayloadError{fmt.Errorf("decode pollen forecast: %w", err)}
+	}
+
+	daily := make([]PollenDay, 0, len(resp.DailyInfo))
+	for i, info := range resp.DailyInfo {
+		day := PollenDay{Date: info.Date.String()}
+		for _, t := range info.PollenTypeInfo {
+			level := &PollenLevel{
+				DisplayName:           t.DisplayName,
+				InSeason:              t.InSeason,
+				Index:                 t.IndexInfo.toPollenIndex(),
+				HealthRecommendations: t.HealthRecommendations,
+			}
+			switch t.Code {
+			case POLLEN_GRASS:
+				day.Grass = level
+			case POLLEN_TREE:
+				day.Tree = level
+			case POLLEN_WEED:
+				day.Weed = level
+			}
+		}
+		for _, p := range info.PlantInfo {
+			plant := PollenPlant{Code: p.Code, DisplayName: p.DisplayName, InSeason: p.InSeason, Index: p.IndexInfo.toPollenIndex()}
+			if d := p.PlantDescription; d != nil {
+				plant.Type, plant.Family, plant.Season, plant.CrossReaction = d.Type, d.Family, d.Season, d.CrossReaction
+			}
+			day.Plants = append(day.Plants, plant)
+		}
+		if err := day.Validate(); err != nil {
+			slog.Warn("skipping invalid pollen day", "index", i, "error", err)
+			continue
+		}
+		daily = append(daily, day)
+	}
+	return daily, resp.RegionCode, nil
+}
+
+// googlePollen talks to the Google Pollen API. Like air quality, pollen has
+// no secondary provider.
+type googlePollen struct {
+	apiKey string
+}
+
+// Returns nil when the Google API key isn't set
+func newPollenClient(cfg *Config) *googlePollen {
+	if cfg.GoogleAPIKey == "" {
+		return nil
+	}
+	return &googlePollen{apiKey: cfg.GoogleAPIKey}
+}
+
+// Pollen forecast for the next days and the region code of the location
+func (g *googlePollen) Forecast(ctx context.Context, lat, lon, days string) ([]PollenDay, string, error) {
+	start := time.Now()
+	daily, regionCode, err := g.forecast(ctx, lat, lon, days)
+	observeUpstream(ctx, "google", "pollen", start, err)
+	return daily, regionCode, err
+}
+
+func (g *googlePollen) forecast(ctx context.Context, lat, lon, days string) ([]PollenDay, string, error) {
+	apiURL := upstreamURL(GOOGLE_POLLEN_BASE+"/forecast:lookup", url.Values{
+		"key":                {g.apiKey},
+		"location.latitude":  {lat},
+		"location.longitude": {lon},
+		"days":               {days},
+		"languageCode":       {languageFromContext(ctx)},
+		"plantsDescription":  {"true"},
+	})
+	body, err := fetchUpstream(ctx, apiURL)
+	if err != nil {
+		return nil, "", err
+	}
+	return parsePollenForecast(body)
+}
+
+// Cached wrapper around the pollen lookup. Keys include the language in
+// ctx, since categories and descriptions are localized upstream.
+
+type pollenResult struct {
+	daily      []PollenDay
+	regionCode string
+}
+
+func cachedPollenForecast(ctx context.Context, client *googlePollen, lat, lon, days string) ([]PollenDay, string, cacheStatus, error) {
+	value, status, err := weatherCache.Fetch(ctx, locationCacheKey("pollen", lat, lon, days, languageFromContext(ctx)), CACHE_TTL_POLLEN, func(ctx context.Context) (interface{}, error) {
+		daily, regionCode, err := client.Forecast(ctx, lat, lon, days)
+		return pollenResult{daily, regionCode}, err
+	})
+	if err != nil {
+		return nil, "", status, err
+	}
+	result := value.(pollenResult)
+	return result.daily, result.regionCode, status, nil
+}
+
+// Pollen forecast endpoint
+func pollenHandler(w http.ResponseWriter, r *http.Request) {
+	client := newPollenClient(config)
+	if client == nil {
+		writeError(w, http.StatusInternalServerError, ERR_NOT_CONFIGURED, "API key not configured", nil)
+		return
+	}
+
+	query := r.URL.Query()
+	lang, paramErr := parseLanguage(query)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+	lat, lon, location, paramErr := locateRequest(r, query, lang)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+	days, paramErr := parseCountParam(query, "days", MAX_POLLEN_DAYS, MAX_POLLEN_DAYS)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+	ctx := withLanguage(r.Context(), lang)
+
+	daily, regionCode, status, err := cachedPollenForecast(ctx, client, lat, lon, days)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "fetching pollen forecast failed", "error", err)
+		writeUpstreamError(w, err, "Failed to fetch pollen data")
+		return
+	}
+
+	w.Header().Set("X-Cache", string(status))
+	writeJSON(w, PollenResponse{
+		Daily:      daily,
+		RegionCode: regionCode,
+		Location:   location,
+		Timestamp:  time.Now().Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const mockGooglePollenResponse = `{
+  "regionCode": "us",
+  "dailyInfo": [
+    {
+      "date": {"year": 2024, "month": 4, "day": 15},
+      "pollenTypeInfo": [
+        {"code": "GRASS", "displayName": "Grass", "inSeason": true,
+         "indexInfo": {"code": "UPI", "value": 2, "category": "Low", "indexDescription": "People with very high allergy to pollen are likely to experience symptoms", "color": {"red": 0.6, "green": 0.8}},
+         "healthRecommendations": ["It's a good day for outdoor activities."]},
+        {"code": "TREE", "displayName": "Tree", "inSeason": true,
+         "indexInfo": {"code": "UPI", "value": 4, "category": "High"}},
+        {"code": "WEED", "displayName": "Weed", "inSeason": false}
+      ],
+      "plantInfo": [
+        {"code": "BIRCH", "displayName": "Birch", "inSeason": true,
+         "indexInfo": {"code": "UPI", "value": 4, "category": "High"},
+         "plantDescription": {"type": "TREE", "family": "Betulaceae (the birch family)", "season": "Late winter, spring", "crossReaction": "Alder, Hazel"}},
+        {"code": "RAGWEED", "displayName": "Ragweed", "inSeason": false}
+      ]
+    },
+    {"date": {"year": 2024, "month": 4, "day": 16},
+     "pollenTypeInfo": [{"code": "TREE", "displayName": "Tree", "inSeason": true, "indexInfo": {"value": 9, "category": "Broken"}}]},
+    {"date": {"year": 2024, "month": 4, "day": 17},
+     "pollenTypeInfo": [{"code": "TREE", "displayName": "Tree", "inSeason": true, "indexInfo": {"value": 3, "category": "Moderate"}}]}
+  ]
+}`
+
+func TestParsePollenForecast(t *testing.T) {
+	daily, regionCode, err := parsePollenForecast([]byte(mockGooglePollenResponse))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if regionCode != "us" {
+		t.Errorf("Expected region us, got %q", regionCode)
+	}
+
+	// The day with an out-of-range index is dropped
+	if len(daily) != 2 || daily[0].Date != "2024-04-15" || daily[1].Date != "2024-04-17" {
+		t.Fatalf("Unexpected days %+v", daily)
+	}
+
+	day := daily[0]
+	if day.Grass == nil || *day.Grass.Index != (PollenIndex{2, "Low", "People with very high allergy to pollen are likely to experience symptoms", "#99cc00"}) {
+		t.Errorf("Unexpected grass %+v", day.Grass)
+	}
+	if len(day.Grass.HealthRecommendations) != 1 {
+		t.Errorf("Expected grass health recommendations, got %v", day.Grass.HealthRecommendations)
+	}
+	if day.Tree == nil || day.Tree.Index.Value != 4 {
+		t.Errorf("Unexpected tree %+v", day.Tree)
+	}
+	if day.Weed == nil || day.Weed.InSeason || day.Weed.Index != nil {
+		t.Errorf("Expected out-of-season weed without an index, got %+v", day.Weed)
+	}
+	if len(day.Plants) != 2 || day.Plants[0].Type != "TREE" || day.Plants[0].CrossReaction != "Alder, Hazel" || day.Plants[1].Index != nil {
+		t.Errorf("Unexpected plants %+v", day.Plants)
+	}
+}
+
+// Test /api/pollen and include=pollen on /api/weather against fake upstreams
+func TestPollenHandler(t *testing.T) {
+	weatherCache = newResponseCache()
+
+	var pollenQueries []url.Values
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/pollen/"):
+			pollenQueries = append(pollenQueries, r.URL.Query())
+			w.Write([]byte(mockGooglePollenResponse))
+		case r.URL.Path == "/currentConditions:lookup":
+			json.NewEncoder(w).Encode(mockGoogleWeatherResponse())
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer mockServer.Close()
+
+	originalWeather, originalPollen := GOOGLE_WEATHER_BASE, GOOGLE_POLLEN_BASE
+	GOOGLE_WEATHER_BASE, GOOGLE_POLLEN_BASE = mockServer.URL, mockServer.URL+"/pollen"
+	defer func() { GOOGLE_WEATHER_BASE, GOOGLE_POLLEN_BASE = originalWeather, originalPollen }()
+	setTestConfig(t, func(c *Config) { c.GoogleAPIKey = "test-key" })
+
+	w := httptest.NewRecorder()
+	pollenHandler(w, httptest.NewRequest("GET", "/api/pollen?lat=51.5&lon=-0.12&days=3&lang=de", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp PollenResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(resp.Daily) != 2 || resp.RegionCode != "us" {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+	query := pollenQueries[0]
+	if query.Get("days") != "3" || query.Get("languageCode") != "de" || query.Get("location.latitude") != "51.5" || query.Get("key") != "test-key" {
+		t.Errorf("Unexpected upstream query %v", query)
+	}
+
+	w = httptest.NewRecorder()
+	pollenHandler(w, httptest.NewRequest("GET", "/api/pollen?lat=51.5&lon=-0.12&days=6", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for more than %d days, got %d", MAX_POLLEN_DAYS, w.Code)
+	}
+
+	// Pollen is merged into the combined response only when included
+	for _, tt := range []struct {
+		query  string
+		pollen bool
+	}{
+		{"", false},
+		{"&include=pollen", true},
+	} {
+		w = httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest("GET", "/api/weather?lat=51.5&lon=-0.12"+tt.query, nil))
+		var weather WeatherResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &weather); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		if got := len(weather.Pollen) > 0; got != tt.pollen {
+			t.Errorf("%q: expected pollen %v, got %+v", tt.query, tt.pollen, weather.Pollen)
+		}
+		if tt.pollen && !strings.Contains(w.Header().Get("X-Cache-Detail"), "pollen=MISS") {
+			t.Errorf("Expected pollen in X-Cache-Detail, got %q", w.Header().Get("X-Cache-Detail"))
+		}
+	}
+
+	w = httptest.NewRecorder()
+	weatherHandler(w, httptest.NewRequest("GET", "/api/weather?lat=51.5&lon=-0.12&include=pollen,tides", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown include, got %d", w.Code)
+	}
+}
+
+// Test that a failed pollen lookup is listed in missing without failing
+// the combined response
+func TestWeatherHandlerPollenMissing(t *testing.T) {
+	weatherCache = newResponseCache()
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/currentConditions:lookup" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(mockGoogleWeatherResponse())
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer mockServer.Close()
+
+	originalWeather, originalPollen := GOOGLE_WEATHER_BASE, GOOGLE_POLLEN_BASE
+	GOOGLE_WEATHER_BASE, GOOGLE_POLLEN_BASE = mockServer.URL, mockServer.URL+"/pollen"
+	defer func() { GOOGLE_WEATHER_BASE, GOOGLE_POLLEN_BASE = originalWeather, originalPollen }()
+	setTestConfig(t, func(c *Config) { c.GoogleAPIKey = "test-key" })
+
+	w := httptest.NewRecorder()
+	weatherHandler(w, httptest.NewRequest("GET", "/api/weather?lat=1&lon=2&include=pollen", nil))
+	var weather WeatherResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &weather); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if w.Code != http.StatusOK || weather.Current == nil || !strings.Contains(strings.Join(weather.Missing, ","), "pollen") {
+		t.Errorf("Expected current conditions with pollen missing, got %d %+v", w.Code, weather.Missing)
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+)
+
+// WeatherProvider is an upstream weather data source. Implementations
+// normalise their responses into the domain model in weather.go so handlers
+// don't care which provider answered.
+type WeatherProvider interface {
+	Name() string
+	CurrentConditions(ctx context.Context, lat, lon string) (*CurrentConditions, error)
+	HourlyForecast(ctx context.Context, lat, lon, hours string) ([]HourlyForecast, *TimeZone, error)
+	HourlyHistory(ctx context.Context, lat, lon, hours string) ([]HourlyForecast, *TimeZone, error)
+	DailyForecast(ctx context.Context, lat, lon, days string) ([]DailyForecast, *TimeZone, error)
+	Geocode(ctx context.Context, address string) (*GeocodeResponse, error)
+	Alerts(ctx context.Context, lat, lon string) ([]WeatherAlert, error)
+	ReverseGeocode(ctx context.Context, lat, lon string) ([]Place, error)
+	Autocomplete(ctx context.Context, text string) ([]Place, error)
+}
+
+// Geocoding results use the Google Geocoding field names, which the widget
+// already reads, whichever provider produced them
+
+// GeocodeResponse is the response of /api/geocode
+type GeocodeResponse struct {
+	Results []GeocodeResult `json:"results"`
+	Status  string          `json:"status"`
+}
+
+// GeocodeResult is a single geocoding match
+type GeocodeResult struct {
+	FormattedAddress  string             `json:"formatted_address"`
+	AddressComponents []AddressComponent `json:"address_components"`
+	Geometry          GeocodeGeometry    `json:"geometry"`
+	PlaceID           string             `json:"place_id,omitempty"`
+	Types             []string           `json:"types,omitempty"`
+}
+
+// AddressComponent is one part of a structured address, e.g. the locality
+type AddressComponent struct {
+	LongName  string   `json:"long_name"`
+	ShortName string   `json:"short_name"`
+	Types     []string `json:"types"`
+}
+
+// GeocodeGeometry holds the coordinates of a geocoding match
+type GeocodeGeometry struct {
+	Location LatLng `json:"location"`
+}
+
+// LatLng is a coordinate pair
+type LatLng struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// Build the provider chain for cfg. Google is the primary provider;
+// OpenWeatherMap is added as a secondary when its API key is set. Each
+// provider records upstream metrics. Returns nil when no provider is
+// configured.
+func newWeatherProvider(cfg *Config) WeatherProvider {
+	var providers []WeatherProvider
+	if apiKey := cfg.GoogleAPIKey; apiKey != "" {
+		providers = append(providers, &instrumentedProvider{provider: &googleProvider{apiKey: apiKey}})
+	}
+	if apiKey := cfg.OpenWeatherAPIKey; apiKey != "" {
+		providers = append(providers, &instrumentedProvider{provider: &openWeatherProvider{apiKey: apiKey}})
+	}
+
+	switch len(providers) {
+	case 0:
+		return nil
+	case 1:
+		return providers[0]
+	default:
+		return &failoverProvider{providers: providers}
+	}
+}
+
+// failoverProvider tries each provider in order and returns the first
+// successful answer. Any error, including a non-200 upstream status or an
+// invalid payload, moves on to the next provider.
+type failoverProvider struct {
+	providers []WeatherProvider
+}
+
+func (f *failoverProvider) Name() string {
+	return f.providers[0].Name()
+}
+
+// Call each provider in turn until one succeeds. When all fail, the error
+// is the last real failure: a provider that doesn't support the lookup
+// mustn't hide why the others failed.
+func tryProviders[T any](ctx context.Context, f *failoverProvider, op string, call func(WeatherProvider) (T, error)) (T, error) {
+	var zero T
+	var lastErr error
+	for _, p := range f.providers {
+		result, err := call(p)
+		if err == nil {
+			return result, nil
+		}
+		slog.WarnContext(ctx, "provider failed "+op, "provider", p.Name(), "error", err)
+		if lastErr == nil || !errors.Is(err, errNotSupported) {
+			lastErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return zero, lastErr
+}
+
+func (f *failoverProvider) CurrentConditions(ctx context.Context, lat, lon string) (*CurrentConditions, error) {
+	return tryProviders(ctx, f, "current conditions", func(p WeatherProvider) (*CurrentConditions, error) {
+		return p.CurrentConditions(ctx, lat, lon)
+	})
+}
+
+func (f *failoverProvider) HourlyForecast(ctx context.Context, lat, lon, hours string) ([]HourlyForecast, *TimeZone, error) {
+	result, err := tryProviders(ctx, f, "hourly forecast", func(p WeatherProvider) (hourlyResult, error) {
+		hourly, timeZone, err := p.HourlyForecast(ctx, lat, lon, hours)
+		return hourlyResult{hourly, timeZone}, err
+	})
+	return result.hourly, result.timeZone, err
+}
+
+func (f *failoverProvider) HourlyHistory(ctx context.Context, lat, lon, hours string) ([]HourlyForecast, *TimeZone, error) {
+	result, err := tryProviders(ctx, f, "hourly history", func(p WeatherProvider) (hourlyResult, error) {
+		hourly, timeZone, err := p.HourlyHistory(ctx, lat, lon, hours)
+		return hourlyResult{hourly, timeZone}, err
+	})
+	return result.hourly, result.timeZone, err
+}
+
+func (f *failoverProvider) DailyForecast(ctx context.Context, lat, lon, days string) ([]DailyForecast, *TimeZone, error) {
+	result, err := tryProviders(ctx, f, "daily forecast", func(p WeatherProvider) (dailyResult, error) {
+		daily, timeZone, err := p.DailyForecast(ctx, lat, lon, days)
+		return dailyResult{daily, timeZone}, err
+	})
+	return result.daily, result.timeZone, err
+}
+
+func (f *failoverProvider) Geocode(ctx context.Context, address string) (*GeocodeResponse, error) {
+	return tryProviders(ctx, f, "geocoding", func(p WeatherProvider) (*GeocodeResponse, error) {
+		return p.Geocode(ctx, address)
+	})
+}
+
+func (f *failoverProvider) Alerts(ctx context.Context, lat, lon string) ([]WeatherAlert, error) {
+	return tryProviders(ctx, f, "alerts", func(p WeatherProvider) ([]WeatherAlert, error) {
+		return p.Alerts(ctx, lat, lon)
+	})
+}
+
+func (f *failoverProvider) ReverseGeocode(ctx context.Context, lat, lon string) ([]Place, error) {
+	return tryProviders(ctx, f, "reverse geocoding", func(p WeatherProvider) ([]Place, error) {
+		return p.ReverseGeocode(ctx, lat, lon)
+	})
+}
+
+func (f *failoverProvider) Autocomplete(ctx context.Context, text string) ([]Place, error) {
+	return tryProviders(ctx, f, "autocomplete", func(p WeatherProvider) ([]Place, error) {
+		return p.Autocomplete(ctx, text)
+	})
+}
+
+// googleProvider talks to the Google Weather, Geocoding and Places APIs
+type googleProvider struct {
+	apiKey string
+}
+
+func (g *googleProvider) Name() string {
+	return "google"
+}
+
+// Build an upstream URL. Every query value is encoded, so caller input can't
+// add or override parameters.
+func upstreamURL(base string, query url.Values) string {
+	return base + "?" + query.Encode()
+}
+
+// URL of a Google Weather lookup for a location, with extra query parameters
+func (g *googleProvider) weatherURL(ctx context.Context, path, lat, lon string, extra url.Values) string {
+	query := url.Values{
+		"key":                {g.apiKey},
+		"location.latitude":  {lat},
+		"location.longitude": {lon},
+		"unitsSystem":        {"METRIC"},
+		"languageCode":       {languageFromContext(ctx)},
+	}
+	for name, values := range extra {
+		query[name] = values
+	}
+	return upstreamURL(GOOGLE_WEATHER_BASE+path, query)
+}
+
+func (g *googleProvider) CurrentConditions(ctx context.Context, lat, lon string) (*CurrentConditions, error) {
+	body, err := fetchUpstream(ctx, g.weatherURL(ctx, "/currentConditions:lookup", lat, lon, nil))
+	if err != nil {
+		return nil, err
+	}
+	return parseCurrentConditions(body)
+}
+
+func (g *googleProvider) HourlyForecast(ctx context.Context, lat, lon, hours string) ([]HourlyForecast, *TimeZone, error) {
+	body, err := fetchUpstream(ctx, g.weatherURL(ctx, "/forecast/hours:lookup", lat, lon, url.Values{"hours": {hours}}))
+	if err != nil {
+		return nil, nil, err
+	}
+	return parseForecastHours(body)
+}
+
+func (g *googleProvider) HourlyHistory(ctx context.Context, lat, lon, hours string) ([]HourlyForecast, *TimeZone, error) {
+	body, err := fetchUpstream(ctx, g.weatherURL(ctx, "/history/hours:lookup", lat, lon, url.Values{"hours": {hours}}))
+	if err != nil {
+		return nil, nil, err
+	}
+	return parseForecastHours(body)
+}
+
+func (g *googleProvider) DailyForecast(ctx context.Context, lat, lon, days string) ([]DailyForecast, *TimeZone, error) {
+	body, err := fetchUpstream(ctx, g.weatherURL(ctx, "/forecast/days:lookup", lat, lon, url.Values{"days": {days}}))
+	if err != nil {
+		return nil, nil, err
+	}
+	return parseForecastDays(body)
+}
+
+func (g *googleProvider) Geocode(ctx context.Context, address string) (*GeocodeResponse, error) {
+	// address is already URL-decoded by r.URL.Query(), re-encode it for Google
+	apiURL := upstreamURL(GOOGLE_GEOCODING_URL, url.Values{
+		"address":  {address},
+		"language": {languageFromContext(ctx)},
+		"key":      {g.apiKey},
+	})
+
+	body, err := fetchUpstream(ctx, apiURL)
+	if err != nil {
+		return nil, err
+	}
+	return parseGeocodeResponse(body)
+}
+
+// Parse a Google Geocoding API response
+func parseGeocodeResponse(body []byte) (*GeocodeResponse, error) {
+	var result GeocodeResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, &PayloadError{fmt.Errorf("decode geocoding response: %w", err)}
+	}
+
+	// The Geocoding API reports quota and key problems with a 200 status
+	if result.Status != "OK" && result.Status != "ZERO_RESULTS" {
+		return nil, &UpstreamError{StatusCode: http.StatusBadGateway, Body: result.Status}
+	}
+	if result.Results == nil {
+		result.Results = []GeocodeResult{}
+	}
+	return &result, nil
+}
+
+func (g *googleProvider) Alerts(ctx context.Context, lat, lon string) ([]WeatherAlert, error) {
+	body, err := fetchUpstream(ctx, g.weatherURL(ctx, "/publicAlerts:lookup", lat, lon, nil))
+	if err != nil {
+		return nil, err
+	}
+	return parseAlerts(body)
+}
+
+// Localities at a location, from the Geocoding API's reverse lookup
+func (g *googleProvider) ReverseGeocode(ctx context.Context, lat, lon string) ([]Place, error) {
+	apiURL := upstreamURL(GOOGLE_GEOCODING_URL, url.Values{
+		"latlng":      {lat + "," + lon},
+		"result_type": {"locality|postal_town|administrative_area_level_3|administrative_area_level_2"},
+		"language":    {languageFromContext(ctx)},
+		"key":         {g.apiKey},
+	})
+
+	body, err := fetchUpstream(ctx, apiURL)
+	if err != nil {
+		return nil, err
+	}
+	result, err := parseGeocodeResponse(body)
+	if err != nil {
+		return nil, err
+	}
+	return placesFromGeocodeResults(result.Results), nil
+}
+
+// Localities matching partial text, from a Places API text search. Unlike
+// Places Autocomplete it returns coordinates, so no per-result lookup is
+// needed.
+func (g *googleProvider) Autocomplete(ctx context.Context, text string) ([]Place, error) {
+	payload := googlePlacesSearchRequest{
+		TextQuery:    text,
+		IncludedType: "locality",
+		LanguageCode: languageFromContext(ctx),
+		PageSize:     MAX_PLACE_RESULTS,
+	}
+	apiURL := upstreamURL(GOOGLE_PLACES_BASE+"/places:searchText", url.Values{
+		"fields": {"places.displayName,places.location,places.addressComponents"},
+		"key":    {g.apiKey},
+	})
+	body, err := postUpstream(ctx, apiURL, payload)
+	if err != nil {
+		return nil, err
+	}
+	return parsePlacesSearch(body)
+}
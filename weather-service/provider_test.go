@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Mock OpenWeatherMap One Call response for testing
+func mockOneCallResponse() map[string]interface{} {
+	return map[string]interface{}{
+		"timezone": "Europe/London",
+		"current": map[string]interface{}{
+			"dt":         1735725600,
+			"temp":       8.5,
+			"feels_like": 6.1,
+			"pressure":   1012,
+			"humidity":   81,
+			"dew_point":  5.4,
+			"uvi":        0.4,
+			"clouds":     75,
+			"visibility": 10000,
+			"wind_speed": 5.0,
+			"wind_deg":   225,
+			"weather": []map[string]interface{}{
+				{"id": 500, "main": "Rain", "description": "light rain", "icon": "10d"},
+			},
+			"rain": map[string]interface{}{"1h": 0.3},
+		},
+		"hourly": []map[string]interface{}{
+			{"dt": 1735725600, "temp": 8.5, "feels_like": 6.1, "humidity": 81, "wind_speed": 5.0, "wind_deg": 225, "pop": 0.4,
+				"weather": []map[string]interface{}{{"id": 500, "description": "light rain", "icon": "10d"}}},
+			{"dt": 1735729200, "temp": 9.0, "feels_like": 7.0, "humidity": 78, "wind_speed": 4.0, "wind_deg": 230, "pop": 0.2,
+				"weather": []map[string]interface{}{{"id": 803, "description": "broken clouds", "icon": "04d"}}},
+		},
+		"daily": []map[string]interface{}{
+			{"dt": 1735732800, "sunrise": 1735718400, "sunset": 1735747200, "moon_phase": 0.5,
+				"temp":       map[string]interface{}{"day": 9, "min": 4, "max": 10, "night": 5},
+				"feels_like": map[string]interface{}{"day": 7, "night": 3},
+				"humidity":   80, "wind_speed": 6.0, "wind_deg": 180, "clouds": 90, "pop": 0.7, "rain": 3.2, "uvi": 1.2,
+				"weather": []map[string]interface{}{{"id": 501, "description": "moderate rain", "icon": "10d"}}},
+		},
+	}
+}
+
+// Test that the failover provider moves on to the secondary when Google errors
+func TestProviderFailover(t *testing.T) {
+	weatherCache = newResponseCache()
+
+	googleServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer googleServer.Close()
+
+	owmCalls := 0
+	owmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		owmCalls++
+		if r.URL.Query().Get("units") != "metric" {
+			t.Error("OpenWeatherMap should be queried in metric units")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(mockOneCallResponse())
+	}))
+	defer owmServer.Close()
+
+	originalBase, originalOneCall := GOOGLE_WEATHER_BASE, OPENWEATHER_ONECALL_URL
+	GOOGLE_WEATHER_BASE, OPENWEATHER_ONECALL_URL = googleServer.URL, owmServer.URL
+	defer func() { GOOGLE_WEATHER_BASE, OPENWEATHER_ONECALL_URL = originalBase, originalOneCall }()
+
+	setTestConfig(t, func(c *Config) {
+		c.GoogleAPIKey = "test-key"
+		c.OpenWeatherAPIKey = "test-owm-key"
+	})
+
+	req := httptest.NewRequest("GET", "/api/weather?lat=51.5&lon=-0.12", nil)
+	w := httptest.NewRecorder()
+	weatherHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 after failover, got %d: %s", w.Code, w.Body.String())
+	}
+	if owmCalls != 3 {
+		t.Errorf("Expected 3 OpenWeatherMap calls, got %d", owmCalls)
+	}
+
+	var response WeatherResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if response.Current == nil || response.Current.Temperature.Degrees != 8.5 {
+		t.Errorf("Expected current temperature from secondary provider, got %+v", response.Current)
+	}
+	if len(response.Forecast.Hourly) != 2 {
+		t.Errorf("Expected 2 real hourly entries from secondary provider, got %d", len(response.Forecast.Hourly))
+	}
+	if len(response.Forecast.Daily) != 1 {
+		t.Errorf("Expected 1 real daily entry from secondary provider, got %d", len(response.Forecast.Daily))
+	}
+}
+
+// Test that when Google fails on history, which OpenWeatherMap doesn't
+// support, the client gets Google's upstream error
+func TestProviderFailoverUnsupported(t *testing.T) {
+	weatherCache = newResponseCache()
+
+	googleServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer googleServer.Close()
+
+	originalBase := GOOGLE_WEATHER_BASE
+	GOOGLE_WEATHER_BASE = googleServer.URL
+	defer func() { GOOGLE_WEATHER_BASE = originalBase }()
+
+	setTestConfig(t, func(c *Config) {
+		c.GoogleAPIKey = "test-key"
+		c.OpenWeatherAPIKey = "test-owm-key"
+	})
+
+	w := httptest.NewRecorder()
+	hourlyHistoryHandler(w, httptest.NewRequest("GET", "/api/history?lat=51.5&lon=-0.12", nil))
+	if apiErr := decodeAPIError(t, w); w.Code != http.StatusServiceUnavailable || apiErr.Code != ERR_UPSTREAM_ERROR {
+		t.Errorf("Expected Google's 503 as UPSTREAM_ERROR, got %d %+v", w.Code, apiErr)
+	}
+}
+
+// Test that OpenWeatherMap data is normalised to the Google shape
+func TestOpenWeatherNormalisation(t *testing.T) {
+	owmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(mockOneCallResponse())
+	}))
+	defer owmServer.Close()
+
+	originalOneCall := OPENWEATHER_ONECALL_URL
+	OPENWEATHER_ONECALL_URL = owmServer.URL
+	defer func() { OPENWEATHER_ONECALL_URL = originalOneCall }()
+
+	provider := &openWeatherProvider{apiKey: "test-owm-key"}
+
+	current, err := provider.CurrentConditions(context.Background(), "51.5", "-0.12")
+	if err != nil {
+		t.Fatalf("Failed to fetch current conditions: %v", err)
+	}
+	if current.WeatherCondition.Type != "LIGHT_RAIN" {
+		t.Errorf("Expected LIGHT_RAIN, got %s", current.WeatherCondition.Type)
+	}
+	if current.WeatherCondition.Description.Text != "Light rain" {
+		t.Errorf("Expected capitalised description, got %q", current.WeatherCondition.Description.Text)
+	}
+	if got := owmWeatherCondition([]owmCondition{{ID: 500, Description: "éclaircies"}}, "fr").Description.Text; got != "Éclaircies" {
+		t.Errorf("Expected the first letter capitalised, got %q", got)
+	}
+	if current.Wind.Speed.Value != 18 || current.Wind.Speed.Unit != "KILOMETERS_PER_HOUR" {
+		t.Errorf("Expected 18 km/h wind, got %+v", current.Wind.Speed)
+	}
+	if current.Wind.Direction.Cardinal != "SOUTHWEST" {
+		t.Errorf("Expected SOUTHWEST wind, got %s", current.Wind.Direction.Cardinal)
+	}
+	if current.Visibility.Distance != 10 || current.Visibility.Unit != "KILOMETERS" {
+		t.Errorf("Expected 10 km visibility, got %+v", current.Visibility)
+	}
+	if current.TimeZone == nil || current.TimeZone.ID != "Europe/London" {
+		t.Errorf("Expected Europe/London time zone, got %+v", current.TimeZone)
+	}
+
+	hourly, _, err := provider.HourlyForecast(context.Background(), "51.5", "-0.12", "1")
+	if err != nil {
+		t.Fatalf("Failed to fetch hourly forecast: %v", err)
+	}
+	if len(hourly) != 1 {
+		t.Fatalf("Expected hours to be limited to 1, got %d", len(hourly))
+	}
+	if hourly[0].PrecipitationProbability == nil || hourly[0].PrecipitationProbability.Percent != 40 {
+		t.Errorf("Expected 40%% precipitation probability, got %+v", hourly[0].PrecipitationProbability)
+	}
+
+	daily, _, err := provider.DailyForecast(context.Background(), "51.5", "-0.12", "5")
+	if err != nil {
+		t.Fatalf("Failed to fetch daily forecast: %v", err)
+	}
+	if daily[0].Date != "2025-01-01" {
+		t.Errorf("Expected local date 2025-01-01, got %s", daily[0].Date)
+	}
+	if daily[0].MaxTemperature.Degrees != 10 || daily[0].MinTemperature.Degrees != 4 {
+		t.Errorf("Unexpected daily range: %+v / %+v", daily[0].MaxTemperature, daily[0].MinTemperature)
+	}
+	if daily[0].MoonEvents.MoonPhase != "FULL_MOON" {
+		t.Errorf("Expected FULL_MOON, got %s", daily[0].MoonEvents.MoonPhase)
+	}
+
+	if _, _, err := provider.HourlyHistory(context.Background(), "51.5", "-0.12", "24"); err != errNotSupported {
+		t.Errorf("Expected errNotSupported for history, got %v", err)
+	}
+}
+
+// Test cardinal direction mapping
+func TestCardinalDirection(t *testing.T) {
+	cases := map[int]string{0: "NORTH", 360: "NORTH", 45: "NORTHEAST", 180: "SOUTH", 350: "NORTH", 200: "SOUTH_SOUTHWEST", -90: "WEST"}
+	for deg, expected := range cases {
+		if got := cardinalDirection(deg); got != expected {
+			t.Errorf("cardinalDirection(%d) = %s, expected %s", deg, got, expected)
+		}
+	}
+}
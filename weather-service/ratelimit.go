@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Buckets untouched for this long are full again and can be dropped
+const RATE_LIMIT_IDLE_TTL = 10 * time.Minute
+
+// Route key of the shared bucket that routes without their own limit draw from
+const RATE_LIMIT_DEFAULT_ROUTE = "*"
+
+// RateLimitRule is how a route is rate limited. Cost tokens are charged per
+// request. A route with a Limit gets its own bucket holding Limit tokens
+// and refilling Limit tokens per minute; with Limit 0 it draws from the
+// shared default bucket.
+type RateLimitRule struct {
+	Limit int
+	Cost  int
+}
+
+// Default rules. /api/weather makes three upstream calls and /api/airquality
+// two, so they cost that many requests; /api/weather/batch costs one per
+// upstream call its locations make. Token refreshes get a small bucket of
+// their own.
+func defaultRateLimitRules() map[string]RateLimitRule {
+	return map[string]RateLimitRule{
+		RATE_LIMIT_DEFAULT_ROUTE: {Limit: DefaultConfig().RequestsPerMinute, Cost: 1},
+		"/api/weather":           {Cost: 1},
+		"/api/weather/batch":     {Cost: 1},
+		"/api/airquality":        {Cost: 2},
+		"/api/auth/refresh":      {Limit: 5, Cost: 1},
+	}
+}
+
+// Routes that authMiddleware doesn't charge, because their handlers charge
+// the whole request with AllowN once they know what it will cost, mapped to
+// the largest n one request can be charged
+var handlerChargedRoutes = map[string]int{
+	"/api/weather":       MAX_COMBINED_UPSTREAM_CALLS,
+	"/api/weather/batch": MAX_BATCH_LOCATIONS * MAX_COMBINED_UPSTREAM_CALLS,
+}
+
+// RateLimitResult is the outcome of charging a request against a bucket
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// RateLimiter is a per-extension token-bucket limiter
+type RateLimiter struct {
+	mu      sync.Mutex
+	rules   map[string]RateLimitRule
+	buckets map[string]*tokenBucket
+}
+
+// Create a limiter. rules must contain RATE_LIMIT_DEFAULT_ROUTE.
+func NewRateLimiter(rules map[string]RateLimitRule) *RateLimiter {
+	return &RateLimiter{
+		rules:   rules,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+var rateLimiter = NewRateLimiter(defaultRateLimitRules())
+
+// Create the limiter for cfg. The shared bucket holds RequestsPerMinute;
+// RateLimits (RATE_LIMITS) is a comma-separated list of route:limit:cost
+// entries applied over the defaults. Route * is the shared default bucket;
+// an empty or zero limit makes a route use it.
+// For example "*:200:1,/api/weather::3,/api/geocode:30:1".
+func newRateLimiter(cfg *Config) (*RateLimiter, error) {
+	rules, err := cfg.rateLimitRules()
+	if err != nil {
+		return nil, err
+	}
+	return NewRateLimiter(rules), nil
+}
+
+func parseRateLimitRules(spec string, rules map[string]RateLimitRule) error {
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 || parts[0] == "" {
+			return fmt.Errorf("rate limit entry %q must be route:limit:cost", entry)
+		}
+		var rule RateLimitRule
+		var err error
+		if parts[1] != "" {
+			if rule.Limit, err = strconv.Atoi(parts[1]); err != nil || rule.Limit < 0 {
+				return fmt.Errorf("rate limit entry %q: invalid limit", entry)
+			}
+		}
+		if rule.Cost, err = strconv.Atoi(parts[2]); err != nil || rule.Cost < 1 {
+			return fmt.Errorf("rate limit entry %q: invalid cost", entry)
+		}
+		rules[parts[0]] = rule
+	}
+
+	defaultRule := rules[RATE_LIMIT_DEFAULT_ROUTE]
+	if defaultRule.Limit < 1 {
+		return fmt.Errorf("rate limit for %s must be at least 1", RATE_LIMIT_DEFAULT_ROUTE)
+	}
+	// A request costing more than its bucket holds could never succeed, so
+	// handler-charged routes must fit their largest request
+	for route, rule := range rules {
+		limit := rule.Limit
+		if limit == 0 {
+			limit = defaultRule.Limit
+		}
+		cost := rule.Cost
+		if n := handlerChargedRoutes[route]; n > 0 {
+			cost *= n
+		}
+		if cost > limit {
+			return fmt.Errorf("rate limit for %s: cost %d exceeds limit %d", route, cost, limit)
+		}
+	}
+	return nil
+}
+
+// Charge a request to route against extensionID's bucket
+func (l *RateLimiter) Allow(extensionID, route string) RateLimitResult {
+	return l.AllowN(extensionID, route, 1)
+}
+
+// Charge n times route's cost, for requests whose work grows with their
+// size. Nothing is charged when the bucket can't cover all of it.
+func (l *RateLimiter) AllowN(extensionID, route string, n int) RateLimitResult {
+	rule, ok := l.rules[route]
+	if !ok {
+		rule = l.rules[RATE_LIMIT_DEFAULT_ROUTE]
+	}
+	bucketRoute := route
+	if rule.Limit == 0 || !ok {
+		bucketRoute = RATE_LIMIT_DEFAULT_ROUTE
+	}
+	limit := l.rules[bucketRoute].Limit
+	key := extensionID + " " + bucketRoute
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	bucket, exists := l.buckets[key]
+	if !exists {
+		bucket = &tokenBucket{tokens: float64(limit), updated: now}
+		l.buckets[key] = bucket
+	}
+
+	// Refill at limit tokens per minute, up to the bucket size
+	ratePerSecond := float64(limit) / 60
+	bucket.tokens = math.Min(float64(limit), bucket.tokens+now.Sub(bucket.updated).Seconds()*ratePerSecond)
+	bucket.updated = now
+
+	result := RateLimitResult{Limit: limit}
+	cost := float64(rule.Cost * n)
+	if bucket.tokens >= cost {
+		bucket.tokens -= cost
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration((cost - bucket.tokens) / ratePerSecond * float64(time.Second))
+	}
+	result.Remaining = int(bucket.tokens)
+	return result
+}
+
+// Drop buckets that haven't been used for idle, returning how many
+func (l *RateLimiter) EvictIdle(idle time.Duration) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cutoff := time.Now().Add(-idle)
+	evicted := 0
+	for key, bucket := range l.buckets {
+		if bucket.updated.Before(cutoff) {
+			delete(l.buckets, key)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// Number of tracked buckets
+func (l *RateLimiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+// Periodically drop idle rate limit buckets
+func cleanupIdleRateLimits(workers *Workers) {
+	workers.Every(5*time.Minute, func() {
+		if evicted := rateLimiter.EvictIdle(RATE_LIMIT_IDLE_TTL); evicted > 0 {
+			slog.Info("evicted idle rate limit buckets", "count", evicted)
+		}
+	})
+}
+
+// Charge n times the route's cost to the extension authMiddleware
+// validated, for routes in handlerChargedRoutes. Writes the rate limit
+// headers, and the 429 when the bucket can't cover the charge, returning
+// whether the request may go ahead.
+func chargeRequest(w http.ResponseWriter, r *http.Request, n int) bool {
+	extensionID := r.Header.Get("X-Validated-Extension-ID")
+	if extensionID == "" {
+		return true
+	}
+	limit := rateLimiter.AllowN(extensionID, r.URL.Path, n)
+	writeRateLimitHeaders(w, limit)
+	if !limit.Allowed {
+		writeRateLimited(w, r, extensionID, limit)
+		return false
+	}
+	return true
+}
+
+// Reject a request that exceeded extensionID's rate limit
+func writeRateLimited(w http.ResponseWriter, r *http.Request, extensionID string, result RateLimitResult) {
+	rateLimitRejectionsTotal.Inc(r.URL.Path)
+	logSecurityEvent(r.Context(), "RATE_LIMIT_EXCEEDED", map[string]interface{}{
+		"extensionId": extensionID,
+		"endpoint":    r.URL.Path,
+		"retryAfter":  result.RetryAfter.Seconds(),
+	})
+	writeError(w, http.StatusTooManyRequests, ERR_RATE_LIMITED, "Rate limit exceeded", map[string]interface{}{
+		"retryAfter": int(math.Ceil(result.RetryAfter.Seconds())),
+	})
+}
+
+// Set the X-RateLimit-* headers, and Retry-After on rejected requests
+func writeRateLimitHeaders(w http.ResponseWriter, result RateLimitResult) {
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	if !result.Allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(result.RetryAfter.Seconds()))))
+	}
+}
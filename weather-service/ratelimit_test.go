@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Test that routes are charged their configured cost
+func TestRateLimitCosts(t *testing.T) {
+	limiter := NewRateLimiter(map[string]RateLimitRule{
+		RATE_LIMIT_DEFAULT_ROUTE: {Limit: 10, Cost: 1},
+		"/api/weather":           {Cost: 3},
+		"/api/auth/refresh":      {Limit: 2, Cost: 1},
+	})
+
+	if result := limiter.Allow("ext", "/api/weather"); !result.Allowed || result.Remaining != 7 {
+		t.Fatalf("Expected weather to cost 3, got %+v", result)
+	}
+	if result := limiter.Allow("ext", "/api/auth/validate"); !result.Allowed || result.Remaining != 6 {
+		t.Fatalf("Expected validate to cost 1 from the shared bucket, got %+v", result)
+	}
+
+	// Routes with their own limit don't touch the shared bucket
+	limiter.Allow("ext", "/api/auth/refresh")
+	limiter.Allow("ext", "/api/auth/refresh")
+	refresh := limiter.Allow("ext", "/api/auth/refresh")
+	if refresh.Allowed || refresh.Limit != 2 {
+		t.Fatalf("Expected the refresh bucket to be exhausted, got %+v", refresh)
+	}
+	if refresh.RetryAfter <= 0 || refresh.RetryAfter > 30*time.Second {
+		t.Errorf("Expected Retry-After of up to 30s for one token at 2/min, got %v", refresh.RetryAfter)
+	}
+	if result := limiter.Allow("ext", "/api/current"); !result.Allowed || result.Remaining != 5 {
+		t.Errorf("Shared bucket should be unaffected by refreshes, got %+v", result)
+	}
+
+	// A weather request needs three tokens even when one is left
+	for limiter.Allow("ext", "/api/current").Remaining > 1 {
+	}
+	if limiter.Allow("ext", "/api/weather").Allowed {
+		t.Error("Weather should be rejected without enough tokens")
+	}
+
+	// Buckets are per extension
+	if !limiter.Allow("other", "/api/weather").Allowed {
+		t.Error("Another extension should have its own bucket")
+	}
+}
+
+// Test that buckets refill over time
+func TestRateLimitRefill(t *testing.T) {
+	limiter := NewRateLimiter(map[string]RateLimitRule{RATE_LIMIT_DEFAULT_ROUTE: {Limit: 600, Cost: 600}})
+
+	if !limiter.Allow("ext", "/").Allowed {
+		t.Fatal("First request should drain the bucket")
+	}
+	if limiter.Allow("ext", "/").Allowed {
+		t.Fatal("Empty bucket should reject")
+	}
+
+	// Pretend the bucket was last touched a minute ago
+	limiter.mu.Lock()
+	limiter.buckets["ext "+RATE_LIMIT_DEFAULT_ROUTE].updated = time.Now().Add(-time.Minute)
+	limiter.mu.Unlock()
+	if !limiter.Allow("ext", "/").Allowed {
+		t.Error("Bucket should be full again after a minute")
+	}
+}
+
+// Test idle bucket eviction
+func TestRateLimitEvictIdle(t *testing.T) {
+	limiter := NewRateLimiter(defaultRateLimitRules())
+	limiter.Allow("idle", "/api/current")
+	limiter.Allow("active", "/api/current")
+
+	limiter.mu.Lock()
+	limiter.buckets["idle "+RATE_LIMIT_DEFAULT_ROUTE].updated = time.Now().Add(-time.Hour)
+	limiter.mu.Unlock()
+
+	if evicted := limiter.EvictIdle(RATE_LIMIT_IDLE_TTL); evicted != 1 {
+		t.Errorf("Expected 1 evicted bucket, got %d", evicted)
+	}
+	if limiter.Len() != 1 {
+		t.Errorf("Expected 1 remaining bucket, got %d", limiter.Len())
+	}
+}
+
+// Test RATE_LIMITS parsing
+func TestParseRateLimitRules(t *testing.T) {
+	rules := defaultRateLimitRules()
+	if err := parseRateLimitRules("*:200:1, /api/weather::4, /api/geocode:30:2", rules); err != nil {
+		t.Fatalf("Failed to parse rules: %v", err)
+	}
+	if rules[RATE_LIMIT_DEFAULT_ROUTE].Limit != 200 || rules["/api/weather"].Cost != 4 || rules["/api/geocode"].Limit != 30 {
+		t.Errorf("Unexpected rules: %+v", rules)
+	}
+
+	// A full batch costs 50 tokens at the default cost of 1
+	if err := parseRateLimitRules("*:40:1, /api/weather/batch:50:1", defaultRateLimitRules()); err != nil {
+		t.Errorf("Expected a batch bucket that fits a full batch, got %v", err)
+	}
+
+	for _, spec := range []string{"/api/weather:3", "/api/weather:x:1", "/api/weather::0", "*:0:1", "/api/geocode:2:3", "*:40:1", "/api/weather/batch::3"} {
+		if err := parseRateLimitRules(spec, defaultRateLimitRules()); err == nil {
+			t.Errorf("Expected error for %q", spec)
+		}
+	}
+}
+
+// Test the rate limit headers set by the auth middleware
+func TestRateLimitHeaders(t *testing.T) {
+	extensionRegistry = NewMemorySessionStore()
+	rateLimiter = NewRateLimiter(map[string]RateLimitRule{
+		RATE_LIMIT_DEFAULT_ROUTE: {Limit: 4, Cost: 1},
+		"/api/airquality":        {Cost: 3},
+	})
+	defer func() { rateLimiter = NewRateLimiter(defaultRateLimitRules()) }()
+
+	identity := generateTestIdentity()
+	extensionRegistry.Put(&ExtensionSession{Identity: identity, RegisterTime: time.Now(), LastActivity: time.Now(), IsActive: true})
+	headers := map[string]string{"X-Extension-Token": generateTestToken(identity), "X-Extension-ID": identity.ExtensionID}
+	okHandler := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+
+	recorder := httptest.NewRecorder()
+	authMiddleware(okHandler)(recorder, createTestRequest("GET", "/api/airquality", nil, headers))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", recorder.Code)
+	}
+	if recorder.Header().Get("X-RateLimit-Limit") != "4" || recorder.Header().Get("X-RateLimit-Remaining") != "1" {
+		t.Errorf("Unexpected headers: limit %q remaining %q",
+			recorder.Header().Get("X-RateLimit-Limit"), recorder.Header().Get("X-RateLimit-Remaining"))
+	}
+
+	recorder = httptest.NewRecorder()
+	authMiddleware(okHandler)(recorder, createTestRequest("GET", "/api/airquality", nil, headers))
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429, got %d", recorder.Code)
+	}
+	if retryAfter := recorder.Header().Get("Retry-After"); retryAfter != "30" {
+		t.Errorf("Expected Retry-After 30 for two tokens at 4/min, got %q", retryAfter)
+	}
+}
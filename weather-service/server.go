@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Workers runs periodic background tasks until it is stopped
+type Workers struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewWorkers() *Workers {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Workers{ctx: ctx, cancel: cancel}
+}
+
+// Run task every interval until Stop is called
+func (w *Workers) Every(interval time.Duration, task func()) {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				task()
+			case <-w.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop all tasks, waiting for any that are running to finish
+func (w *Workers) Stop() {
+	w.cancel()
+	w.wg.Wait()
+}
+
+// Build the HTTP server for cfg. Request bodies over MaxBodyBytes fail to
+// read, and the server's own errors go to the structured log.
+func newHTTPServer(cfg *Config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              ":" + cfg.Port,
+		Handler:           http.MaxBytesHandler(handler, int64(cfg.MaxBodyBytes)),
+		ReadHeaderTimeout: time.Duration(cfg.ReadHeaderTimeout),
+		ReadTimeout:       time.Duration(cfg.ReadTimeout),
+		WriteTimeout:      time.Duration(cfg.WriteTimeout),
+		IdleTimeout:       time.Duration(cfg.IdleTimeout),
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+}
+
+// Serve on listener until ctx is done, then stop accepting connections and
+// give in-flight requests up to drainTimeout to finish. Connections still
+// open after that are closed.
+func serve(ctx context.Context, server *http.Server, listener net.Listener, drainTimeout time.Duration) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down, draining connections", "timeout", drainTimeout.String())
+	drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := server.Shutdown(drainCtx); err != nil {
+		server.Close()
+		return fmt.Errorf("drain connections: %w", err)
+	}
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
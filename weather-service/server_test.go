@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkersStop(t *testing.T) {
+	workers := NewWorkers()
+	var runs atomic.Int32
+	workers.Every(time.Millisecond, func() { runs.Add(1) })
+
+	time.Sleep(20 * time.Millisecond)
+	workers.Stop()
+	stopped := runs.Load()
+	if stopped == 0 {
+		t.Fatal("Expected the task to run before Stop")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if runs.Load() != stopped {
+		t.Error("Expected no runs after Stop returned")
+	}
+}
+
+// Test that shutdown waits for in-flight requests and refuses new ones
+func TestServeDrainsInFlightRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := newHTTPServer(DefaultConfig(), handler)
+	ctx, cancel := context.WithCancel(context.Background())
+	serveDone := make(chan error, 1)
+	go func() { serveDone <- serve(ctx, server, listener, 5*time.Second) }()
+
+	url := "http://" + listener.Addr().String()
+	response := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			response <- "error: " + err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		response <- string(body)
+	}()
+
+	<-started
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	if _, err := http.Get(url); err == nil {
+		t.Error("Expected new connections to be refused while draining")
+	}
+
+	close(release)
+	if got := <-response; got != "done" {
+		t.Errorf("Expected in-flight request to complete, got %q", got)
+	}
+	if err := <-serveDone; err != nil {
+		t.Errorf("Expected clean shutdown, got %v", err)
+	}
+}
+
+// Test that a request still running after the drain timeout is cut off
+func TestServeDrainTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	server := newHTTPServer(DefaultConfig(), handler)
+	ctx, cancel := context.WithCancel(context.Background())
+	serveDone := make(chan error, 1)
+	go func() { serveDone <- serve(ctx, server, listener, 50*time.Millisecond) }()
+
+	go http.Get("http://" + listener.Addr().String())
+	<-started
+	cancel()
+
+	select {
+	case err := <-serveDone:
+		if err == nil {
+			t.Error("Expected an error when connections don't drain in time")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after the drain timeout")
+	}
+}
+
+func TestHTTPServerLimits(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxBodyBytes = 1024
+
+	var readErr error
+	server := newHTTPServer(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, readErr = io.ReadAll(r.Body)
+	}))
+	if server.ReadHeaderTimeout != 5*time.Second || server.WriteTimeout != 30*time.Second || server.MaxHeaderBytes != 64<<10 {
+		t.Errorf("Expected configured timeouts and header limit, got %+v", server)
+	}
+
+	req := httptest.NewRequest("POST", "/api/auth/register", strings.NewReader(strings.Repeat("x", 2048)))
+	server.Handler.ServeHTTP(httptest.NewRecorder(), req)
+	if readErr == nil {
+		t.Error("Expected reading an oversized body to fail")
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often a FileSessionStore writes pending updates to disk.
+// Registrations, bans and admin updates such as revocations are written
+// immediately.
+const SESSION_FLUSH_INTERVAL = 30 * time.Second
+
+// SessionStore holds registered extension sessions. Implementations return
+// copies, so callers can't mutate stored sessions without going through the
+// store.
+type SessionStore interface {
+	// Get returns the session for extensionID, or nil if there is none
+	Get(extensionID string) (*ExtensionSession, error)
+	// Put creates or replaces the session keyed by its extension ID
+	Put(session *ExtensionSession) error
+	// RecordActivity bumps the request count and last activity time
+	RecordActivity(extensionID string, at time.Time) error
+	// Delete removes a session
+	Delete(extensionID string) error
+	// Count returns the number of stored sessions
+	Count() (int, error)
+	// List returns every stored session
+	List() ([]*ExtensionSession, error)
+	// DeleteInactive removes and returns sessions idle since before cutoff
+	DeleteInactive(cutoff time.Time) ([]*ExtensionSession, error)
+	// Update applies fn to a stored session atomically and returns the
+	// result, or nil if there is no such session
+	Update(extensionID string, fn func(*ExtensionSession)) (*ExtensionSession, error)
+	// PutBan adds or replaces a ban
+	PutBan(ban *Ban) error
+	// DeleteBan lifts a ban, reporting whether it existed
+	DeleteBan(kind, value string) (bool, error)
+	// ListBans returns every ban
+	ListBans() ([]*Ban, error)
+	// FindBan returns the ban matching an extension ID or fingerprint, if any
+	FindBan(extensionID, fingerprint string) (*Ban, error)
+	// Close flushes pending writes and releases resources
+	Close() error
+}
+
+// Open the configured session store. A SessionStorePath selects a
+// FileSessionStore at that path; otherwise sessions are kept in memory and
+// lost on restart.
+func newSessionStore(cfg *Config) (SessionStore, error) {
+	if path := cfg.SessionStorePath; path != "" {
+		return OpenFileSessionStore(path, SESSION_FLUSH_INTERVAL)
+	}
+	return NewMemorySessionStore(), nil
+}
+
+// Kinds of ban
+const (
+	BAN_EXTENSION_ID = "extensionId"
+	BAN_FINGERPRINT  = "fingerprint"
+)
+
+// Ban blocks an extension ID or fingerprint from registering or making
+// requests
+type Ban struct {
+	Kind      string    `json:"kind"`
+	Value     string    `json:"value"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func banKey(kind, value string) string {
+	return kind + ":" + value
+}
+
+// MemorySessionStore is a process-local SessionStore
+type MemorySessionStore struct {
+	mu       sync.RWMutex
+	sessions map[string]*ExtensionSession
+	bans     map[string]*Ban
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions: make(map[string]*ExtensionSession),
+		bans:     make(map[string]*Ban),
+	}
+}
+
+func (m *MemorySessionStore) Get(extensionID string) (*ExtensionSession, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	session, ok := m.sessions[extensionID]
+	if !ok {
+		return nil, nil
+	}
+	copied := *session
+	return &copied, nil
+}
+
+func (m *MemorySessionStore) Put(session *ExtensionSession) error {
+	copied := *session
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[session.Identity.ExtensionID] = &copied
+	return nil
+}
+
+func (m *MemorySessionStore) RecordActivity(extensionID string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if session, exists := m.sessions[extensionID]; exists {
+		session.LastActivity = at
+		session.RequestCount++
+	}
+	return nil
+}
+
+func (m *MemorySessionStore) Delete(extensionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, extensionID)
+	return nil
+}
+
+func (m *MemorySessionStore) Count() (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.sessions), nil
+}
+
+func (m *MemorySessionStore) List() ([]*ExtensionSession, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sessions := make([]*ExtensionSession, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		copied := *session
+		sessions = append(sessions, &copied)
+	}
+	return sessions, nil
+}
+
+func (m *MemorySessionStore) DeleteInactive(cutoff time.Time) ([]*ExtensionSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var removed []*ExtensionSession
+	for extensionID, session := range m.sessions {
+		if session.LastActivity.Before(cutoff) {
+			delete(m.sessions, extensionID)
+			removed = append(removed, session)
+		}
+	}
+	return removed, nil
+}
+
+func (m *MemorySessionStore) Update(extensionID string, fn func(*ExtensionSession)) (*ExtensionSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[extensionID]
+	if !ok {
+		return nil, nil
+	}
+	fn(session)
+	copied := *session
+	return &copied, nil
+}
+
+func (m *MemorySessionStore) PutBan(ban *Ban) error {
+	copied := *ban
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bans[banKey(ban.Kind, ban.Value)] = &copied
+	return nil
+}
+
+func (m *MemorySessionStore) DeleteBan(kind, value string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := banKey(kind, value)
+	_, existed := m.bans[key]
+	delete(m.bans, key)
+	return existed, nil
+}
+
+func (m *MemorySessionStore) ListBans() ([]*Ban, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	bans := make([]*Ban, 0, len(m.bans))
+	for _, ban := range m.bans {
+		copied := *ban
+		bans = append(bans, &copied)
+	}
+	return bans, nil
+}
+
+func (m *MemorySessionStore) FindBan(extensionID, fingerprint string) (*Ban, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if ban, ok := m.bans[banKey(BAN_EXTENSION_ID, extensionID)]; ok {
+		copied := *ban
+		return &copied, nil
+	}
+	if fingerprint != "" {
+		if ban, ok := m.bans[banKey(BAN_FINGERPRINT, fingerprint)]; ok {
+			copied := *ban
+			return &copied, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MemorySessionStore) Close() error {
+	return nil
+}
+
+// On-disk format of a FileSessionStore
+type sessionFile struct {
+	Version  int                 `json:"version"`
+	SavedAt  time.Time           `json:"savedAt"`
+	Sessions []*ExtensionSession `json:"sessions"`
+	Bans     []*Ban              `json:"bans,omitempty"`
+}
+
+// FileSessionStore is an embedded SessionStore that keeps sessions in memory
+// and persists them to a JSON file, so registrations survive restarts when
+// the path is on a persistent volume. Each write replaces the whole file,
+// so removals and activity counters are batched and written every flush
+// interval and on Close; registrations, bans and admin updates, which must
+// not be lost, are written through immediately. Files are replaced atomically, so a crash mid-write
+// leaves the previous snapshot intact.
+type FileSessionStore struct {
+	*MemorySessionStore
+	path    string
+	writeMu sync.Mutex
+	dirty   atomic.Bool
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+// Open (or create) a file-backed session store at path
+func OpenFileSessionStore(path string, flushInterval time.Duration) (*FileSessionStore, error) {
+	store := &FileSessionStore{
+		MemorySessionStore: NewMemorySessionStore(),
+		path:               path,
+		stop:               make(chan struct{}),
+		done:               make(chan struct{}),
+	}
+
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("create session store directory: %w", err)
+	}
+
+	go store.flushLoop(flushInterval)
+	return store, nil
+}
+
+func (f *FileSessionStore) load() error {
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read session store: %w", err)
+	}
+
+	var file sessionFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("decode session store %s: %w", f.path, err)
+	}
+	for _, session := range file.Sessions {
+		f.sessions[session.Identity.ExtensionID] = session
+	}
+	for _, ban := range file.Bans {
+		f.bans[banKey(ban.Kind, ban.Value)] = ban
+	}
+	slog.Info("loaded extension sessions", "count", len(file.Sessions), "path", f.path)
+	return nil
+}
+
+func (f *FileSessionStore) flushLoop(interval time.Duration) {
+	defer close(f.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if f.dirty.Load() {
+				if err := f.Flush(); err != nil {
+					slog.Error("flushing session store failed", "error", err)
+				}
+			}
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+// Flush writes a snapshot of every session to disk
+func (f *FileSessionStore) Flush() error {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	// Clear before snapshotting so updates made during the write stay dirty
+	f.dirty.Store(false)
+	sessions, _ := f.MemorySessionStore.List()
+	bans, _ := f.MemorySessionStore.ListBans()
+
+	data, err := json.Marshal(sessionFile{Version: 1, SavedAt: time.Now().UTC(), Sessions: sessions, Bans: bans})
+	if err != nil {
+		f.dirty.Store(true)
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp-*")
+	if err != nil {
+		f.dirty.Store(true)
+		return fmt.Errorf("create temp session file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		f.dirty.Store(true)
+		return fmt.Errorf("write session file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		f.dirty.Store(true)
+		return fmt.Errorf("sync session file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		f.dirty.Store(true)
+		return err
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		f.dirty.Store(true)
+		return fmt.Errorf("replace session file: %w", err)
+	}
+	return nil
+}
+
+// Registrations are written immediately, so an extension isn't asked to
+// register again after a restart
+func (f *FileSessionStore) Put(session *ExtensionSession) error {
+	f.MemorySessionStore.Put(session)
+	return f.Flush()
+}
+
+func (f *FileSessionStore) RecordActivity(extensionID string, at time.Time) error {
+	f.MemorySessionStore.RecordActivity(extensionID, at)
+	f.dirty.Store(true)
+	return nil
+}
+
+func (f *FileSessionStore) Delete(extensionID string) error {
+	f.MemorySessionStore.Delete(extensionID)
+	f.dirty.Store(true)
+	return nil
+}
+
+func (f *FileSessionStore) DeleteInactive(cutoff time.Time) ([]*ExtensionSession, error) {
+	removed, _ := f.MemorySessionStore.DeleteInactive(cutoff)
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	f.dirty.Store(true)
+	return removed, nil
+}
+
+// Updates come from the admin API (suspensions and revocations), so they
+// are written immediately
+func (f *FileSessionStore) Update(extensionID string, fn func(*ExtensionSession)) (*ExtensionSession, error) {
+	session, _ := f.MemorySessionStore.Update(extensionID, fn)
+	if session == nil {
+		return nil, nil
+	}
+	return session, f.Flush()
+}
+
+func (f *FileSessionStore) PutBan(ban *Ban) error {
+	f.MemorySessionStore.PutBan(ban)
+	return f.Flush()
+}
+
+func (f *FileSessionStore) DeleteBan(kind, value string) (bool, error) {
+	existed, _ := f.MemorySessionStore.DeleteBan(kind, value)
+	if !existed {
+		return false, nil
+	}
+	return true, f.Flush()
+}
+
+// Close stops the background flusher and writes any pending updates
+func (f *FileSessionStore) Close() error {
+	var err error
+	f.once.Do(func() {
+		close(f.stop)
+		<-f.done
+		if f.dirty.Load() {
+			err = f.Flush()
+		}
+	})
+	return err
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSession(extensionID string, lastActivity time.Time) *ExtensionSession {
+	return &ExtensionSession{
+		Identity:     ExtensionIdentity{ExtensionID: extensionID, ExtensionVersion: "1.0.0"},
+		Token:        "token-" + extensionID,
+		RegisterTime: lastActivity,
+		LastActivity: lastActivity,
+		IsActive:     true,
+	}
+}
+
+// Test the in-memory store
+func TestMemorySessionStore(t *testing.T) {
+	store := NewMemorySessionStore()
+	now := time.Now()
+
+	store.Put(testSession("abcdefghijklmnopqrstuvwxyzabcdef", now))
+	store.Put(testSession("bbcdefghijklmnopqrstuvwxyzabcdef", now.Add(-8*24*time.Hour)))
+
+	session, _ := store.Get("abcdefghijklmnopqrstuvwxyzabcdef")
+	if session == nil || session.Token != "token-abcdefghijklmnopqrstuvwxyzabcdef" {
+		t.Fatalf("Expected stored session, got %+v", session)
+	}
+
+	// Returned sessions are copies
+	session.IsActive = false
+	if stored, _ := store.Get("abcdefghijklmnopqrstuvwxyzabcdef"); !stored.IsActive {
+		t.Error("Mutating a returned session should not change the store")
+	}
+
+	store.RecordActivity("abcdefghijklmnopqrstuvwxyzabcdef", now.Add(time.Minute))
+	if stored, _ := store.Get("abcdefghijklmnopqrstuvwxyzabcdef"); stored.RequestCount != 1 {
+		t.Errorf("Expected request count 1, got %d", stored.RequestCount)
+	}
+
+	removed, _ := store.DeleteInactive(now.Add(-7 * 24 * time.Hour))
+	if len(removed) != 1 || removed[0].Identity.ExtensionID != "bbcdefghijklmnopqrstuvwxyzabcdef" {
+		t.Errorf("Expected the stale session to be removed, got %+v", removed)
+	}
+	if count, _ := store.Count(); count != 1 {
+		t.Errorf("Expected 1 remaining session, got %d", count)
+	}
+
+	if missing, _ := store.Get("missing"); missing != nil {
+		t.Errorf("Expected nil for unknown extension, got %+v", missing)
+	}
+}
+
+// Test that file-backed sessions survive reopening the store
+func TestFileSessionStorePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions", "sessions.json")
+	now := time.Now().UTC().Truncate(time.Second)
+
+	store, err := OpenFileSessionStore(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	// Registrations and bans are written immediately
+	store.Put(testSession("abcdefghijklmnopqrstuvwxyzabcdef", now))
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Expected a registration to be written immediately: %v", err)
+	}
+	store.Put(testSession("bbcdefghijklmnopqrstuvwxyzabcdef", now))
+	store.PutBan(&Ban{Kind: BAN_FINGERPRINT, Value: "bad-fingerprint", CreatedAt: now})
+	store.PutBan(&Ban{Kind: BAN_FINGERPRINT, Value: "lifted-fingerprint", CreatedAt: now})
+	store.DeleteBan(BAN_FINGERPRINT, "lifted-fingerprint")
+	if data, _ := os.ReadFile(path); strings.Contains(string(data), "lifted-fingerprint") {
+		t.Error("Expected a lifted ban to be written immediately")
+	}
+
+	// Removals wait for the next flush
+	store.Delete("bbcdefghijklmnopqrstuvwxyzabcdef")
+	if data, _ := os.ReadFile(path); !strings.Contains(string(data), "bbcdefghijklmnopqrstuvwxyzabcdef") {
+		t.Error("Removals should wait for the next flush")
+	}
+
+	// Activity is only written on the next flush or on Close
+	store.RecordActivity("abcdefghijklmnopqrstuvwxyzabcdef", now.Add(time.Minute))
+	store.RecordActivity("abcdefghijklmnopqrstuvwxyzabcdef", now.Add(2*time.Minute))
+	if err := store.Close(); err != nil {
+		t.Fatalf("Failed to close store: %v", err)
+	}
+
+	reopened, err := OpenFileSessionStore(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer reopened.Close()
+
+	if count, _ := reopened.Count(); count != 1 {
+		t.Fatalf("Expected 1 persisted session, got %d", count)
+	}
+	session, _ := reopened.Get("abcdefghijklmnopqrstuvwxyzabcdef")
+	if session == nil {
+		t.Fatal("Expected persisted session after reopening")
+	}
+	if session.RequestCount != 2 || !session.LastActivity.Equal(now.Add(2*time.Minute)) {
+		t.Errorf("Expected flushed activity, got count %d at %v", session.RequestCount, session.LastActivity)
+	}
+	if ban, _ := reopened.FindBan("any", "bad-fingerprint"); ban == nil {
+		t.Error("Expected persisted ban after reopening")
+	}
+	if session.Identity.ExtensionVersion != "1.0.0" || session.Token != "token-abcdefghijklmnopqrstuvwxyzabcdef" {
+		t.Errorf("Session fields were not persisted: %+v", session)
+	}
+}
+
+// Test that the background loop flushes pending activity
+func TestFileSessionStoreFlushLoop(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+
+	store, err := OpenFileSessionStore(path, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+
+	store.Put(testSession("abcdefghijklmnopqrstuvwxyzabcdef", time.Now()))
+	store.RecordActivity("abcdefghijklmnopqrstuvwxyzabcdef", time.Now())
+
+	// Read the file with a second store rather than waiting on Close. The
+	// dirty flag clears before the write lands, so poll the file itself.
+	var session *ExtensionSession
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		snapshot, err := OpenFileSessionStore(path, time.Hour)
+		if err != nil {
+			t.Fatalf("Failed to open snapshot: %v", err)
+		}
+		session, _ = snapshot.Get("abcdefghijklmnopqrstuvwxyzabcdef")
+		snapshot.Close()
+		if session != nil && session.RequestCount == 1 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Errorf("Expected flushed request count 1, got %+v", session)
+}
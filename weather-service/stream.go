@@ -0,0 +1,403 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Live weather stream settings. Refreshes mostly hit the cache, so the
+// upstream is called about once per CACHE_TTL_CURRENT for each location
+// however many clients are subscribed.
+const (
+	STREAM_REFRESH_INTERVAL   = time.Minute
+	STREAM_HEARTBEAT_INTERVAL = 15 * time.Second
+	STREAM_RETRY_MS           = 5000 // reconnect delay suggested to clients
+	STREAM_HISTORY_SIZE       = 32   // events kept per location for Last-Event-ID
+	STREAM_BUFFER_SIZE        = 16   // events queued per subscriber before it is dropped
+)
+
+// Stream event types
+const (
+	STREAM_EVENT_CONDITIONS = "conditions"
+	STREAM_EVENT_ALERT      = "alert"
+)
+
+// streamEvent is a change pushed to the subscribers of a location. Data is
+// kept in metric units and converted for each subscriber.
+type streamEvent struct {
+	ID         uint64
+	Type       string
+	Conditions *CurrentConditions
+	Alert      *WeatherAlert
+}
+
+// streamSubscriber is one open /api/weather/stream connection
+type streamSubscriber struct {
+	loop   *streamLoop
+	events chan streamEvent
+}
+
+// streamLoop refreshes one location and language for all its subscribers.
+// Its fields are guarded by the hub's mutex.
+type streamLoop struct {
+	key            string
+	lat, lon, lang string
+	cancel         context.CancelFunc
+	subscribers    map[*streamSubscriber]bool
+	history        []streamEvent
+	current        *streamEvent
+	alerts         map[string]streamEvent // active alert events by alertKey
+}
+
+// streamHub shares one refresh loop between the subscribers of each
+// location. Loops start with the first subscriber and stop with the last.
+type streamHub struct {
+	refreshInterval   time.Duration
+	heartbeatInterval time.Duration
+	ctx               context.Context
+	cancel            context.CancelFunc
+	lastID            atomic.Uint64 // event IDs are unique across loops
+	running           sync.WaitGroup
+
+	mu     sync.Mutex
+	loops  map[string]*streamLoop
+	closed bool
+}
+
+func newStreamHub(refreshInterval, heartbeatInterval time.Duration) *streamHub {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &streamHub{
+		refreshInterval:   refreshInterval,
+		heartbeatInterval: heartbeatInterval,
+		ctx:               ctx,
+		cancel:            cancel,
+		loops:             make(map[string]*streamLoop),
+	}
+}
+
+// Global stream hub, closed on shutdown
+var weatherStreams = newStreamHub(STREAM_REFRESH_INTERVAL, STREAM_HEARTBEAT_INTERVAL)
+
+// Subscribe to a location, starting its refresh loop if needed. The events
+// returned bring the subscriber up to date: those after lastEventID when
+// they are still in the history, otherwise the latest conditions and every
+// active alert.
+func (h *streamHub) Subscribe(lat, lon, lang string, lastEventID uint64) (*streamSubscriber, []streamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sub := &streamSubscriber{events: make(chan streamEvent, STREAM_BUFFER_SIZE)}
+	if h.closed {
+		close(sub.events)
+		return sub, nil
+	}
+
+	key := lat + "," + lon + ":" + lang
+	loop := h.loops[key]
+	if loop == nil {
+		ctx, cancel := context.WithCancel(h.ctx)
+		loop = &streamLoop{
+			key:         key,
+			lat:         lat,
+			lon:         lon,
+			lang:        lang,
+			cancel:      cancel,
+			subscribers: make(map[*streamSubscriber]bool),
+			alerts:      make(map[string]streamEvent),
+		}
+		h.loops[key] = loop
+		h.running.Add(1)
+		go func() {
+			defer h.running.Done()
+			h.run(ctx, loop)
+		}()
+	}
+	sub.loop = loop
+	loop.subscribers[sub] = true
+	return sub, loop.replay(lastEventID)
+}
+
+// Unsubscribe, stopping the loop when it was the last subscriber
+func (h *streamHub) Unsubscribe(sub *streamSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	loop := sub.loop
+	if loop == nil {
+		return
+	}
+	if loop.subscribers[sub] {
+		delete(loop.subscribers, sub)
+		close(sub.events)
+	}
+	if len(loop.subscribers) == 0 && h.loops[loop.key] == loop {
+		loop.cancel()
+		delete(h.loops, loop.key)
+	}
+}
+
+// End every stream and wait for the loops to stop
+func (h *streamHub) Close() {
+	h.mu.Lock()
+	h.closed = true
+	h.cancel()
+	for key, loop := range h.loops {
+		for sub := range loop.subscribers {
+			delete(loop.subscribers, sub)
+			close(sub.events)
+		}
+		delete(h.loops, key)
+	}
+	h.mu.Unlock()
+
+	h.running.Wait()
+}
+
+// Number of open streams
+func (h *streamHub) Subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	count := 0
+	for _, loop := range h.loops {
+		count += len(loop.subscribers)
+	}
+	return count
+}
+
+// Refresh a loop immediately and then every refreshInterval until it stops
+func (h *streamHub) run(ctx context.Context, loop *streamLoop) {
+	ticker := time.NewTicker(h.refreshInterval)
+	defer ticker.Stop()
+	for {
+		h.refresh(ctx, loop)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Fetch the current conditions and alerts through the cache and publish
+// what changed: new conditions values and alerts not seen before
+func (h *streamHub) refresh(ctx context.Context, loop *streamLoop) {
+	provider := newWeatherProvider(config)
+	if provider == nil {
+		return
+	}
+	fetchCtx, cancel := context.WithTimeout(withLanguage(ctx, loop.lang), time.Duration(config.WeatherDeadline))
+	defer cancel()
+
+	var (
+		wg                   sync.WaitGroup
+		current              *CurrentConditions
+		alerts               []WeatherAlert
+		currentErr, alertErr error
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		current, _, currentErr = cachedCurrentConditions(fetchCtx, provider, loop.lat, loop.lon)
+	}()
+	go func() {
+		defer wg.Done()
+		alerts, _, alertErr = cachedAlerts(fetchCtx, provider, loop.lat, loop.lon)
+	}()
+	wg.Wait()
+	// The last subscriber left while fetching
+	if ctx.Err() != nil {
+		return
+	}
+	if currentErr != nil {
+		slog.WarnContext(ctx, "stream refresh of current conditions failed", "location", loop.key, "error", currentErr)
+	}
+	if alertErr != nil {
+		slog.WarnContext(ctx, "stream refresh of alerts failed", "location", loop.key, "error", alertErr)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// The observation time moves on every upstream refresh; only a change
+	// in the values themselves is worth an event
+	if currentErr == nil && (loop.current == nil || !reflect.DeepEqual(loop.current.Conditions.Conditions, current.Conditions)) {
+		event := h.publish(loop, streamEvent{Type: STREAM_EVENT_CONDITIONS, Conditions: current})
+		loop.current = &event
+	}
+	if alertErr == nil {
+		active := make(map[string]streamEvent)
+		for _, alert := range activeAlerts(alerts, time.Now()) {
+			key := alertKey(alert)
+			event, seen := loop.alerts[key]
+			if !seen {
+				event = h.publish(loop, streamEvent{Type: STREAM_EVENT_ALERT, Alert: &alert})
+			}
+			active[key] = event
+		}
+		loop.alerts = active
+	}
+}
+
+// Number an event, add it to the loop's history and send it to every
+// subscriber. Subscribers that fall STREAM_BUFFER_SIZE events behind are
+// disconnected; they reconnect with Last-Event-ID and catch up from the
+// history. Must be called with h.mu held.
+func (h *streamHub) publish(loop *streamLoop, event streamEvent) streamEvent {
+	event.ID = h.lastID.Add(1)
+	loop.history = append(loop.history, event)
+	if len(loop.history) > STREAM_HISTORY_SIZE {
+		loop.history = slices.Delete(loop.history, 0, len(loop.history)-STREAM_HISTORY_SIZE)
+	}
+	for sub := range loop.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+			slog.Warn("dropping slow stream subscriber", "location", loop.key)
+			delete(loop.subscribers, sub)
+			close(sub.events)
+		}
+	}
+	return event
+}
+
+// Events to send a new subscriber. Must be called with h.mu held.
+func (l *streamLoop) replay(lastEventID uint64) []streamEvent {
+	if n := len(l.history); lastEventID > 0 && n > 0 && lastEventID+1 >= l.history[0].ID && lastEventID <= l.history[n-1].ID {
+		var missed []streamEvent
+		for _, event := range l.history {
+			if event.ID > lastEventID {
+				missed = append(missed, event)
+			}
+		}
+		return missed
+	}
+
+	var snapshot []streamEvent
+	if l.current != nil {
+		snapshot = append(snapshot, *l.current)
+	}
+	for _, event := range l.alerts {
+		snapshot = append(snapshot, event)
+	}
+	slices.SortFunc(snapshot, func(a, b streamEvent) int { return cmp.Compare(a.ID, b.ID) })
+	return snapshot
+}
+
+// Identify an alert across refreshes. Alerts without an ID are told apart
+// by headline and start time.
+func alertKey(alert WeatherAlert) string {
+	if alert.ID != "" {
+		return alert.ID
+	}
+	return alert.Headline + "@" + alert.Effective
+}
+
+// Write an event in the text/event-stream format, converting conditions to
+// the subscriber's units and language
+func writeStreamEvent(w http.ResponseWriter, event streamEvent, units Units, lang string, location *RequestLocation) error {
+	var data interface{}
+	switch event.Type {
+	case STREAM_EVENT_CONDITIONS:
+		conditions := event.Conditions.InUnits(units).Localized(lang)
+		conditions.Location = location
+		data = conditions
+	case STREAM_EVENT_ALERT:
+		data = event.Alert
+	}
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, body)
+	return err
+}
+
+// Live weather endpoint. Pushes a conditions event whenever the current
+// conditions for the location change and an alert event for each new
+// alert, with heartbeat comments in between to keep proxies from closing
+// an idle connection.
+func weatherStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if newWeatherProvider(config) == nil {
+		writeError(w, http.StatusInternalServerError, ERR_NOT_CONFIGURED, "API key not configured", nil)
+		return
+	}
+
+	query := r.URL.Query()
+	lang, paramErr := parseLanguage(query)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+	lat, lon, location, paramErr := locateRequest(r, query, lang)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+	units, paramErr := parseUnits(query)
+	if paramErr != nil {
+		writeParamError(w, paramErr)
+		return
+	}
+	// An unparseable Last-Event-ID is treated as a fresh connection
+	lastEventID, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+
+	sub, replay := weatherStreams.Subscribe(lat, lon, lang, lastEventID)
+	defer weatherStreams.Unsubscribe(sub)
+
+	// Streams outlive the server's write timeout, so each write gets its
+	// own deadline instead. Writers that don't support deadlines are fine.
+	controller := http.NewResponseController(w)
+	write := func(send func() error) bool {
+		controller.SetWriteDeadline(time.Now().Add(time.Duration(config.WriteTimeout)))
+		if err := send(); err != nil {
+			return false
+		}
+		return controller.Flush() == nil
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	ok := write(func() error {
+		if _, err := fmt.Fprintf(w, "retry: %d\n\n", STREAM_RETRY_MS); err != nil {
+			return err
+		}
+		for _, event := range replay {
+			if err := writeStreamEvent(w, event, units, lang, location); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	heartbeat := time.NewTicker(weatherStreams.heartbeatInterval)
+	defer heartbeat.Stop()
+	for ok {
+		select {
+		case event, open := <-sub.events:
+			if !open {
+				return
+			}
+			ok = write(func() error { return writeStreamEvent(w, event, units, lang, location) })
+		case <-heartbeat.C:
+			ok = write(func() error {
+				_, err := fmt.Fprint(w, ": heartbeat\n\n")
+				return err
+			})
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Fake Google upstream whose temperature and alerts can be changed
+type streamUpstream struct {
+	*httptest.Server
+	temperature  atomic.Value
+	alerts       atomic.Value
+	currentCalls atomic.Int32
+}
+
+func newStreamUpstream(t *testing.T) *streamUpstream {
+	t.Helper()
+	upstream := &streamUpstream{}
+	upstream.temperature.Store(20.5)
+	upstream.alerts.Store(`{"weatherAlerts": []}`)
+	upstream.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/currentConditions:lookup":
+			upstream.currentCalls.Add(1)
+			body := mockGoogleWeatherResponse()
+			body["temperature"] = map[string]interface{}{"degrees": upstream.temperature.Load(), "unit": "CELSIUS"}
+			json.NewEncoder(w).Encode(body)
+		case "/publicAlerts:lookup":
+			w.Write([]byte(upstream.alerts.Load().(string)))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(upstream.Close)
+
+	originalBase := GOOGLE_WEATHER_BASE
+	GOOGLE_WEATHER_BASE = upstream.URL
+	t.Cleanup(func() { GOOGLE_WEATHER_BASE = originalBase })
+	setTestConfig(t, func(c *Config) { c.GoogleAPIKey = "test-key" })
+	return upstream
+}
+
+func eventTypes(events []streamEvent) string {
+	var types []string
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	return strings.Join(types, ",")
+}
+
+// Test that refreshes publish only changed conditions and new alerts, and
+// what reconnecting subscribers are replayed
+func TestStreamRefresh(t *testing.T) {
+	weatherCache = newResponseCache()
+	upstream := newStreamUpstream(t)
+
+	hub := newStreamHub(time.Hour, time.Hour)
+	loop := &streamLoop{key: "1,2:en", lat: "1", lon: "2", lang: "en",
+		subscribers: map[*streamSubscriber]bool{}, alerts: map[string]streamEvent{}}
+	sub := &streamSubscriber{loop: loop, events: make(chan streamEvent, STREAM_BUFFER_SIZE)}
+	loop.subscribers[sub] = true
+	received := func() []streamEvent {
+		var events []streamEvent
+		for len(sub.events) > 0 {
+			events = append(events, <-sub.events)
+		}
+		return events
+	}
+
+	hub.refresh(context.Background(), loop)
+	first := received()
+	if eventTypes(first) != STREAM_EVENT_CONDITIONS || first[0].Conditions.Temperature.Degrees != 20.5 {
+		t.Fatalf("Expected the initial conditions, got %+v", first)
+	}
+
+	// A new upstream fetch with the same values publishes nothing
+	weatherCache = newResponseCache()
+	hub.refresh(context.Background(), loop)
+	if events := received(); len(events) != 0 {
+		t.Errorf("Expected no events for unchanged conditions, got %s", eventTypes(events))
+	}
+
+	upstream.temperature.Store(22.0)
+	upstream.alerts.Store(mockGoogleAlertsResponse)
+	weatherCache = newResponseCache()
+	hub.refresh(context.Background(), loop)
+	if events := received(); eventTypes(events) != "conditions,alert,alert" || events[1].Alert.ID != "extreme-1" {
+		t.Errorf("Expected new conditions and both active alerts, got %s", eventTypes(events))
+	}
+
+	// Alerts already sent aren't repeated
+	weatherCache = newResponseCache()
+	hub.refresh(context.Background(), loop)
+	if events := received(); len(events) != 0 {
+		t.Errorf("Expected no events for the same alerts, got %s", eventTypes(events))
+	}
+
+	for _, tt := range []struct {
+		name        string
+		lastEventID uint64
+		want        string
+	}{
+		{"new subscriber", 0, "conditions,alert,alert"},
+		{"missed events", first[0].ID, "conditions,alert,alert"},
+		{"up to date", first[0].ID + 3, ""},
+		{"unknown id", first[0].ID + 100, "conditions,alert,alert"},
+	} {
+		replay := loop.replay(tt.lastEventID)
+		if got := eventTypes(replay); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, got)
+		}
+		if tt.lastEventID == 0 && replay[0].Conditions.Temperature.Degrees != 22 {
+			t.Errorf("Expected the latest conditions in the snapshot, got %+v", replay[0].Conditions.Temperature)
+		}
+	}
+	if upstream.currentCalls.Load() != 4 {
+		t.Errorf("Expected one upstream call per refresh, got %d", upstream.currentCalls.Load())
+	}
+}
+
+// Read a stream until an event of eventType arrives, returning its id and
+// data
+func readStreamEvent(t *testing.T, reader *bufio.Reader, eventType string) (id, data string) {
+	t.Helper()
+	var event string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Stream ended waiting for %s: %v", eventType, err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		case line == ": heartbeat" && eventType == "heartbeat":
+			return "", ""
+		case line == "" && event == eventType:
+			return id, data
+		case line == "":
+			id, event, data = "", "", ""
+		}
+	}
+}
+
+// Test streams end to end: shared loops, unit conversion, heartbeats and
+// Last-Event-ID
+func TestWeatherStreamHandler(t *testing.T) {
+	weatherCache = newResponseCache()
+	upstream := newStreamUpstream(t)
+
+	originalStreams := weatherStreams
+	weatherStreams = newStreamHub(time.Hour, 20*time.Millisecond)
+	defer func() { weatherStreams = originalStreams }()
+	server := httptest.NewServer(http.HandlerFunc(weatherStreamHandler))
+	defer server.Close()
+	defer weatherStreams.Close()
+
+	open := func(query, lastEventID string) (*http.Response, *bufio.Reader) {
+		req, _ := http.NewRequest("GET", server.URL+"/api/weather/stream?"+query, nil)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to open stream: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("Expected an event stream, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		return resp, bufio.NewReader(resp.Body)
+	}
+
+	metric, metricReader := open("lat=51.5&lon=-0.12", "")
+	defer metric.Body.Close()
+	id, data := readStreamEvent(t, metricReader, STREAM_EVENT_CONDITIONS)
+	var conditions CurrentConditions
+	json.Unmarshal([]byte(data), &conditions)
+	if conditions.Temperature.Degrees != 20.5 {
+		t.Errorf("Expected 20.5 degrees, got %+v", conditions.Temperature)
+	}
+
+	// The second subscriber shares the loop and gets its own units
+	imperial, imperialReader := open("lat=51.5&lon=-0.12&units=imperial", "")
+	defer imperial.Body.Close()
+	_, data = readStreamEvent(t, imperialReader, STREAM_EVENT_CONDITIONS)
+	json.Unmarshal([]byte(data), &conditions)
+	if conditions.Temperature.Unit != "FAHRENHEIT" {
+		t.Errorf("Expected fahrenheit, got %+v", conditions.Temperature)
+	}
+	weatherStreams.mu.Lock()
+	loops := len(weatherStreams.loops)
+	weatherStreams.mu.Unlock()
+	if weatherStreams.Subscribers() != 2 || loops != 1 || upstream.currentCalls.Load() != 1 {
+		t.Errorf("Expected two subscribers on one loop and one upstream call, got %d, %d loops, %d calls",
+			weatherStreams.Subscribers(), loops, upstream.currentCalls.Load())
+	}
+
+	// A client that has seen the latest event gets only heartbeats
+	resumed, resumedReader := open("lat=51.5&lon=-0.12", id)
+	defer resumed.Body.Close()
+	readStreamEvent(t, resumedReader, "heartbeat")
+	if buffered, _ := resumedReader.Peek(resumedReader.Buffered()); strings.Contains(string(buffered), "event:") {
+		t.Errorf("Expected no replayed events, got %q", buffered)
+	}
+
+	// The loop stops once every client has gone
+	metric.Body.Close()
+	imperial.Body.Close()
+	resumed.Body.Close()
+	for deadline := time.Now().Add(time.Second); weatherStreams.Subscribers() > 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if weatherStreams.Subscribers() != 0 {
+		t.Errorf("Expected the subscribers to be removed, got %d", weatherStreams.Subscribers())
+	}
+
+	resp, err := http.Get(server.URL + "/api/weather/stream?lat=91&lon=0")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid latitude, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Supported token signing algorithms, named as in JWS
+const (
+	TOKEN_ALG_HS256 = "HS256"
+	TOKEN_ALG_EDDSA = "EdDSA"
+)
+
+// Minimum HMAC secret length in bytes
+const MIN_HMAC_SECRET_BYTES = 32
+
+// Token verification failures, reported in INVALID_TOKEN security events
+var (
+	errTokenMalformed   = errors.New("malformed token")
+	errTokenUnknownKey  = errors.New("unknown signing key")
+	errTokenSignature   = errors.New("invalid signature")
+	errTokenExpired     = errors.New("token expired")
+	errTokenExtension   = errors.New("extension id mismatch")
+	errTokenFingerprint = errors.New("fingerprint mismatch")
+)
+
+// TokenHeader is the JOSE header of an issued token. Kid names the key that
+// signed it, so tokens issued before a key rotation stay verifiable.
+type TokenHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+// TokenClaims is the payload of an issued token
+type TokenClaims struct {
+	ExtensionID string  `json:"ext"`
+	Fingerprint string  `json:"fp,omitempty"`
+	IssuedAt    float64 `json:"iat"` // to the microsecond, so revocations are exact
+	ExpiresAt   int64   `json:"exp"`
+	ID          string  `json:"jti"`
+}
+
+// Time the token was issued
+func (c *TokenClaims) Issued() time.Time {
+	return time.UnixMicro(int64(math.Round(c.IssuedAt * 1e6)))
+}
+
+// signingKey is a server key that can sign and verify tokens
+type signingKey struct {
+	id      string
+	alg     string
+	secret  []byte
+	private ed25519.PrivateKey
+}
+
+func (k *signingKey) sign(data []byte) []byte {
+	if k.alg == TOKEN_ALG_EDDSA {
+		return ed25519.Sign(k.private, data)
+	}
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func (k *signingKey) verify(data, signature []byte) bool {
+	if k.alg == TOKEN_ALG_EDDSA {
+		return ed25519.Verify(k.private.Public().(ed25519.PublicKey), data, signature)
+	}
+	return hmac.Equal(k.sign(data), signature)
+}
+
+// TokenKeyring signs new tokens with its active key and verifies tokens
+// signed by any key it holds. To rotate, configure a new key first and keep
+// the old one listed until the tokens it signed have expired.
+type TokenKeyring struct {
+	active  *signingKey
+	keys    map[string]*signingKey
+	ordered []*signingKey
+}
+
+// Create a keyring; the first key is the active signing key
+func NewTokenKeyring(keys ...*signingKey) (*TokenKeyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+	keyring := &TokenKeyring{active: keys[0], keys: make(map[string]*signingKey)}
+	for _, key := range keys {
+		if _, exists := keyring.keys[key.id]; exists {
+			return nil, fmt.Errorf("duplicate signing key id %q", key.id)
+		}
+		keyring.keys[key.id] = key
+		keyring.ordered = append(keyring.ordered, key)
+	}
+	return keyring, nil
+}
+
+// Global token keyring. The default ephemeral key lets tests and local runs
+// work without configuration; main replaces it from the configured keys.
+var tokenKeys = mustEphemeralKeyring()
+
+// Load the keyring from cfg.TokenSigningKeys (TOKEN_SIGNING_KEYS), a
+// comma-separated list of kid:alg:base64key entries. HS256 keys are raw
+// secrets, EdDSA keys are 32-byte Ed25519 seeds. Instances that don't share
+// keys reject each other's tokens, so keys are required unless
+// cfg.EphemeralTokenKeys allows a random per-process key for local
+// development.
+func newTokenKeyring(cfg *Config) (*TokenKeyring, error) {
+	spec := cfg.TokenSigningKeys
+	if spec == "" {
+		if !cfg.EphemeralTokenKeys {
+			return nil, errors.New("TOKEN_SIGNING_KEYS is not set; set EPHEMERAL_TOKEN_KEYS=true to use a random key for local development")
+		}
+		slog.Warn("TOKEN_SIGNING_KEYS not set, using an ephemeral signing key")
+		return newEphemeralKeyring()
+	}
+
+	keys, err := parseSigningKeys(spec)
+	if err != nil {
+		return nil, err
+	}
+	return NewTokenKeyring(keys...)
+}
+
+func parseSigningKeys(spec string) ([]*signingKey, error) {
+	var keys []*signingKey
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("signing key entry must be kid:alg:key")
+		}
+		material, err := base64.StdEncoding.DecodeString(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("signing key %s: decode key: %w", parts[0], err)
+		}
+
+		key := &signingKey{id: parts[0], alg: parts[1]}
+		switch parts[1] {
+		case TOKEN_ALG_HS256:
+			if len(material) < MIN_HMAC_SECRET_BYTES {
+				return nil, fmt.Errorf("signing key %s: HS256 secret must be at least %d bytes", key.id, MIN_HMAC_SECRET_BYTES)
+			}
+			key.secret = material
+		case TOKEN_ALG_EDDSA:
+			if len(material) != ed25519.SeedSize {
+				return nil, fmt.Errorf("signing key %s: EdDSA seed must be %d bytes", key.id, ed25519.SeedSize)
+			}
+			key.private = ed25519.NewKeyFromSeed(material)
+		default:
+			return nil, fmt.Errorf("signing key %s: unsupported algorithm %q", key.id, parts[1])
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func newEphemeralKeyring() (*TokenKeyring, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 4)
+	rand.Read(id)
+	return NewTokenKeyring(&signingKey{id: "ephemeral-" + hex.EncodeToString(id), alg: TOKEN_ALG_EDDSA, private: private})
+}
+
+func mustEphemeralKeyring() *TokenKeyring {
+	keyring, err := newEphemeralKeyring()
+	if err != nil {
+		panic(err)
+	}
+	return keyring
+}
+
+// Sign claims with the active key
+func (k *TokenKeyring) Issue(claims TokenClaims) (string, error) {
+	header, err := json.Marshal(TokenHeader{Alg: k.active.alg, Kid: k.active.id, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature := k.active.sign([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Check a token's signature and expiry and return its claims
+func (k *TokenKeyring) Verify(token string, now time.Time) (*TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errTokenMalformed
+	}
+
+	var header TokenHeader
+	if err := decodeTokenSegment(parts[0], &header); err != nil {
+		return nil, errTokenMalformed
+	}
+	key, ok := k.keys[header.Kid]
+	if !ok {
+		return nil, errTokenUnknownKey
+	}
+	// Never let the token pick a different algorithm than the key's own
+	if header.Alg != key.alg {
+		return nil, errTokenSignature
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errTokenMalformed
+	}
+	if !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return nil, errTokenSignature
+	}
+
+	var claims TokenClaims
+	if err := decodeTokenSegment(parts[1], &claims); err != nil {
+		return nil, errTokenMalformed
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, errTokenExpired
+	}
+	return &claims, nil
+}
+
+func decodeTokenSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// JSONWebKey is a public key in JWK format
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	X   string `json:"x"`
+}
+
+// JSONWebKeySet is the response of /.well-known/jwks.json
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// Public keys of every asymmetric key in the keyring. HMAC secrets are
+// never published.
+func (k *TokenKeyring) JWKS() JSONWebKeySet {
+	set := JSONWebKeySet{Keys: []JSONWebKey{}}
+	for _, key := range k.ordered {
+		if key.alg != TOKEN_ALG_EDDSA {
+			continue
+		}
+		set.Keys = append(set.Keys, JSONWebKey{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			Kid: key.id,
+			Alg: TOKEN_ALG_EDDSA,
+			Use: "sig",
+			X:   base64.RawURLEncoding.EncodeToString(key.private.Public().(ed25519.PublicKey)),
+		})
+	}
+	return set
+}
+
+// Issue a token for a registered extension
+func issueExtensionToken(identity ExtensionIdentity, now time.Time) (string, *TokenClaims, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+
+	claims := &TokenClaims{
+		ExtensionID: identity.ExtensionID,
+		Fingerprint: identity.Fingerprint,
+		IssuedAt:    float64(now.UnixMicro()) / 1e6,
+		ExpiresAt:   now.Add(time.Duration(config.TokenExpiry)).Unix(),
+		ID:          hex.EncodeToString(nonce),
+	}
+	token, err := tokenKeys.Issue(*claims)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, claims, nil
+}
+
+// Verify a token presented by an extension. The token must be signed by a
+// known server key, unexpired, and issued to extensionID; if the request
+// carries a fingerprint it must match the one the token was issued for.
+func verifyExtensionToken(token, extensionID, fingerprint string) (*TokenClaims, error) {
+	claims, err := tokenKeys.Verify(token, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if claims.ExtensionID != extensionID {
+		return nil, errTokenExtension
+	}
+	if fingerprint != "" && claims.Fingerprint != fingerprint {
+		return nil, errTokenFingerprint
+	}
+	return claims, nil
+}
+
+// Publish the token verification keys
+func jwksHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, tokenKeys.JWKS())
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testEd25519Seed = "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="
+	testHMACSecret  = "c2VjcmV0LXNlY3JldC1zZWNyZXQtc2VjcmV0LXNlY3JldA=="
+)
+
+func mustParseKeys(t *testing.T, spec string) []*signingKey {
+	t.Helper()
+	keys, err := parseSigningKeys(spec)
+	if err != nil {
+		t.Fatalf("Failed to parse signing keys: %v", err)
+	}
+	return keys
+}
+
+// Test that tokens signed before a rotation still verify
+func TestTokenKeyRotation(t *testing.T) {
+	keys := mustParseKeys(t, "2025-01:HS256:"+testHMACSecret+",2025-06:EdDSA:"+testEd25519Seed)
+	claims := TokenClaims{ExtensionID: "abc", IssuedAt: float64(time.Now().Unix()), ExpiresAt: time.Now().Add(time.Hour).Unix()}
+
+	before, _ := NewTokenKeyring(keys[0])
+	oldToken, err := before.Issue(claims)
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+
+	// Rotate: the EdDSA key signs, the HMAC key only verifies
+	after, _ := NewTokenKeyring(keys[1], keys[0])
+	newToken, _ := after.Issue(claims)
+
+	for name, token := range map[string]string{"old": oldToken, "new": newToken} {
+		if _, err := after.Verify(token, time.Now()); err != nil {
+			t.Errorf("%s token should verify after rotation: %v", name, err)
+		}
+	}
+
+	var header TokenHeader
+	decodeTokenSegment(strings.Split(newToken, ".")[0], &header)
+	if header.Kid != "2025-06" || header.Alg != TOKEN_ALG_EDDSA {
+		t.Errorf("New tokens should be signed by the active key, got %+v", header)
+	}
+
+	// Once the old key is retired its tokens are rejected
+	retired, _ := NewTokenKeyring(keys[1])
+	if _, err := retired.Verify(oldToken, time.Now()); err != errTokenUnknownKey {
+		t.Errorf("Expected errTokenUnknownKey for a retired key, got %v", err)
+	}
+}
+
+// Test tampering and algorithm substitution
+func TestTokenTampering(t *testing.T) {
+	keyring, _ := NewTokenKeyring(mustParseKeys(t, "k1:EdDSA:"+testEd25519Seed)...)
+	token, _ := keyring.Issue(TokenClaims{ExtensionID: "abc", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	parts := strings.Split(token, ".")
+
+	forgedClaims, _ := json.Marshal(TokenClaims{ExtensionID: "xyz", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	forged := parts[0] + "." + base64.RawURLEncoding.EncodeToString(forgedClaims) + "." + parts[2]
+	if _, err := keyring.Verify(forged, time.Now()); err != errTokenSignature {
+		t.Errorf("Expected errTokenSignature for modified claims, got %v", err)
+	}
+
+	// A header claiming HS256 must not be checked as an HMAC over the public key
+	header, _ := json.Marshal(TokenHeader{Alg: TOKEN_ALG_HS256, Kid: "k1", Typ: "JWT"})
+	substituted := base64.RawURLEncoding.EncodeToString(header) + "." + parts[1] + "." + parts[2]
+	if _, err := keyring.Verify(substituted, time.Now()); err != errTokenSignature {
+		t.Errorf("Expected errTokenSignature for algorithm substitution, got %v", err)
+	}
+}
+
+// Test signing key configuration errors
+func TestParseSigningKeys(t *testing.T) {
+	invalid := []string{
+		"missing-parts",
+		"k1:RS256:" + testHMACSecret,
+		"k1:HS256:c2hvcnQ=",
+		"k1:EdDSA:" + testHMACSecret,
+		"k1:HS256:not-base64!",
+	}
+	for _, spec := range invalid {
+		if _, err := parseSigningKeys(spec); err == nil {
+			t.Errorf("Expected error for %q", spec)
+		}
+	}
+
+	keys := mustParseKeys(t, "k1:HS256:"+testHMACSecret+",k1:EdDSA:"+testEd25519Seed)
+	if _, err := NewTokenKeyring(keys...); err == nil {
+		t.Error("Expected error for duplicate key ids")
+	}
+}
+
+// Test that instances don't fall back to a key of their own unless allowed
+func TestNewTokenKeyringRequiresKeys(t *testing.T) {
+	cfg := DefaultConfig()
+	if _, err := newTokenKeyring(cfg); err == nil {
+		t.Error("Expected missing signing keys to be rejected")
+	}
+	cfg.EphemeralTokenKeys = true
+	if keyring, err := newTokenKeyring(cfg); err != nil || !strings.HasPrefix(keyring.active.id, "ephemeral-") {
+		t.Errorf("Expected an ephemeral key, got %v", err)
+	}
+	cfg.TokenSigningKeys = "k1:EdDSA:" + testEd25519Seed
+	if keyring, err := newTokenKeyring(cfg); err != nil || keyring.active.id != "k1" {
+		t.Errorf("Expected the configured key, got %v", err)
+	}
+}
+
+// Test that the JWKS endpoint publishes public keys only
+func TestJWKSHandler(t *testing.T) {
+	originalKeys := tokenKeys
+	defer func() { tokenKeys = originalKeys }()
+	tokenKeys, _ = NewTokenKeyring(mustParseKeys(t, "ed:EdDSA:"+testEd25519Seed+",mac:HS256:"+testHMACSecret)...)
+
+	w := httptest.NewRecorder()
+	jwksHandler(w, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	var set JSONWebKeySet
+	if err := json.Unmarshal(w.Body.Bytes(), &set); err != nil {
+		t.Fatalf("Failed to parse JWKS: %v", err)
+	}
+	if len(set.Keys) != 1 {
+		t.Fatalf("Expected only the EdDSA key to be published, got %+v", set.Keys)
+	}
+	key := set.Keys[0]
+	if key.Kid != "ed" || key.Kty != "OKP" || key.Crv != "Ed25519" {
+		t.Errorf("Unexpected JWK: %+v", key)
+	}
+	if strings.Contains(w.Body.String(), testHMACSecret) {
+		t.Error("JWKS must not expose HMAC secrets")
+	}
+}
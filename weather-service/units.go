@@ -0,0 +1,299 @@
+package main
+
+import (
+	"math"
+	"net/url"
+	"strings"
+)
+
+// Unit labels. Temperature, speed, distance and precipitation labels are the
+// ones the Google Weather API uses.
+const (
+	UNIT_CELSIUS                = "CELSIUS"
+	UNIT_FAHRENHEIT             = "FAHRENHEIT"
+	UNIT_KILOMETERS_PER_HOUR    = "KILOMETERS_PER_HOUR"
+	UNIT_MILES_PER_HOUR         = "MILES_PER_HOUR"
+	UNIT_METERS_PER_SECOND      = "METERS_PER_SECOND"
+	UNIT_KNOTS                  = "KNOTS"
+	UNIT_KILOMETERS             = "KILOMETERS"
+	UNIT_MILES                  = "MILES"
+	UNIT_MILLIMETERS            = "MILLIMETERS"
+	UNIT_INCHES                 = "INCHES"
+	UNIT_MILLIBARS              = "MILLIBARS"
+	UNIT_HECTOPASCALS           = "HECTOPASCALS"
+	UNIT_INCHES_OF_MERCURY      = "INCHES_OF_MERCURY"
+	UNIT_MILLIMETERS_OF_MERCURY = "MILLIMETERS_OF_MERCURY"
+)
+
+// Units is the unit for each kind of measurement in a response
+type Units struct {
+	Temperature   string
+	Speed         string
+	Distance      string
+	Precipitation string
+	Pressure      string
+}
+
+var (
+	metricUnits   = Units{UNIT_CELSIUS, UNIT_KILOMETERS_PER_HOUR, UNIT_KILOMETERS, UNIT_MILLIMETERS, UNIT_MILLIBARS}
+	imperialUnits = Units{UNIT_FAHRENHEIT, UNIT_MILES_PER_HOUR, UNIT_MILES, UNIT_INCHES, UNIT_INCHES_OF_MERCURY}
+)
+
+// Accepted values of the units, tempUnit, windUnit and pressureUnit
+// parameters
+var (
+	unitSystemParams = map[string]Units{"metric": metricUnits, "imperial": imperialUnits}
+
+	temperatureUnitParams = map[string]string{
+		"celsius":    UNIT_CELSIUS,
+		"fahrenheit": UNIT_FAHRENHEIT,
+	}
+	windUnitParams = map[string]string{
+		"kmh":   UNIT_KILOMETERS_PER_HOUR,
+		"mph":   UNIT_MILES_PER_HOUR,
+		"ms":    UNIT_METERS_PER_SECOND,
+		"knots": UNIT_KNOTS,
+	}
+	pressureUnitParams = map[string]string{
+		"mb":   UNIT_MILLIBARS,
+		"hpa":  UNIT_HECTOPASCALS,
+		"inhg": UNIT_INCHES_OF_MERCURY,
+		"mmhg": UNIT_MILLIMETERS_OF_MERCURY,
+	}
+)
+
+// Size of each linear unit in a common base unit: km/h, km, mm and hPa
+var (
+	speedFactors = map[string]float64{
+		UNIT_KILOMETERS_PER_HOUR: 1,
+		UNIT_MILES_PER_HOUR:      1.609344,
+		UNIT_METERS_PER_SECOND:   3.6,
+		UNIT_KNOTS:               1.852,
+	}
+	distanceFactors = map[string]float64{
+		UNIT_KILOMETERS: 1,
+		UNIT_MILES:      1.609344,
+	}
+	precipitationFactors = map[string]float64{
+		UNIT_MILLIMETERS: 1,
+		UNIT_INCHES:      25.4,
+	}
+	pressureFactors = map[string]float64{
+		UNIT_MILLIBARS:              1,
+		UNIT_HECTOPASCALS:           1,
+		UNIT_INCHES_OF_MERCURY:      33.8639,
+		UNIT_MILLIMETERS_OF_MERCURY: 1.333224,
+	}
+)
+
+// Decimal places kept after converting to a unit, one unless listed
+var unitDecimals = map[string]int{
+	UNIT_INCHES:            2,
+	UNIT_INCHES_OF_MERCURY: 2,
+}
+
+// Parse units=metric|imperial and the tempUnit, windUnit and pressureUnit
+// overrides. The default is metric, which is what upstream data is fetched
+// in.
+func parseUnits(query url.Values) (Units, *ParamError) {
+	units := metricUnits
+	if raw := query.Get("units"); raw != "" {
+		system, ok := unitSystemParams[strings.ToLower(raw)]
+		if !ok {
+			return Units{}, invalidUnitParam("units", unitSystemParams)
+		}
+		units = system
+	}
+
+	overrides := []struct {
+		name    string
+		allowed map[string]string
+		target  *string
+	}{
+		{"tempUnit", temperatureUnitParams, &units.Temperature},
+		{"windUnit", windUnitParams, &units.Speed},
+		{"pressureUnit", pressureUnitParams, &units.Pressure},
+	}
+	for _, o := range overrides {
+		raw := query.Get(o.name)
+		if raw == "" {
+			continue
+		}
+		unit, ok := o.allowed[strings.ToLower(raw)]
+		if !ok {
+			return Units{}, invalidUnitParam(o.name, o.allowed)
+		}
+		*o.target = unit
+	}
+	return units, nil
+}
+
+func invalidUnitParam[V any](name string, allowed map[string]V) *ParamError {
+	values := sortedKeys(allowed)
+	return invalidParam(name, name+" must be one of "+strings.Join(values, ", "),
+		map[string]interface{}{"allowed": values})
+}
+
+// Convert a value between two units of the same kind. Values in units
+// missing from factors are returned unchanged, with ok false.
+func convertLinear(value float64, from, to string, factors map[string]float64) (converted float64, ok bool) {
+	if from == to {
+		return value, true
+	}
+	fromFactor, fromOK := factors[from]
+	toFactor, toOK := factors[to]
+	if !fromOK || !toOK {
+		return value, false
+	}
+	return roundTo(value*fromFactor/toFactor, decimalsFor(to)), true
+}
+
+func decimalsFor(unit string) int {
+	if decimals, ok := unitDecimals[unit]; ok {
+		return decimals
+	}
+	return 1
+}
+
+func roundTo(value float64, decimals int) float64 {
+	scale := math.Pow(10, float64(decimals))
+	return math.Round(value*scale) / scale
+}
+
+// Return t in the given unit. The original is never modified, since it may
+// be shared through the response cache.
+func (t *Temperature) inUnit(unit string) *Temperature {
+	if t == nil || t.Unit == unit {
+		return t
+	}
+	switch {
+	case t.Unit == UNIT_CELSIUS && unit == UNIT_FAHRENHEIT:
+		return &Temperature{Degrees: roundTo(t.Degrees*9/5+32, 1), Unit: unit}
+	case t.Unit == UNIT_FAHRENHEIT && unit == UNIT_CELSIUS:
+		return &Temperature{Degrees: roundTo((t.Degrees-32)*5/9, 1), Unit: unit}
+	}
+	return t
+}
+
+func (s *Speed) inUnit(unit string) *Speed {
+	if s == nil {
+		return nil
+	}
+	if value, ok := convertLinear(s.Value, s.Unit, unit, speedFactors); ok {
+		return &Speed{Value: value, Unit: unit}
+	}
+	return s
+}
+
+func (v *Visibility) inUnit(unit string) *Visibility {
+	if v == nil {
+		return nil
+	}
+	if distance, ok := convertLinear(v.Distance, v.Unit, unit, distanceFactors); ok {
+		return &Visibility{Distance: distance, Unit: unit}
+	}
+	return v
+}
+
+func (q *Quantity) inUnit(unit string) *Quantity {
+	if q == nil {
+		return nil
+	}
+	if amount, ok := convertLinear(q.Quantity, q.Unit, unit, precipitationFactors); ok {
+		return &Quantity{Quantity: amount, Unit: unit}
+	}
+	return q
+}
+
+// Add the pressure in the given unit. MeanSeaLevelMillibars is kept as it
+// is for clients that read it.
+func (p *AirPressure) inUnit(unit string) *AirPressure {
+	if p == nil {
+		return nil
+	}
+	value, _ := convertLinear(p.MeanSeaLevelMillibars, UNIT_MILLIBARS, unit, pressureFactors)
+	return &AirPressure{
+		MeanSeaLevelMillibars: p.MeanSeaLevelMillibars,
+		MeanSeaLevel:          &Pressure{Value: value, Unit: unit},
+	}
+}
+
+func (p *Precipitation) inUnits(u Units) *Precipitation {
+	if p == nil {
+		return nil
+	}
+	return &Precipitation{Probability: p.Probability, Qpf: p.Qpf.inUnit(u.Precipitation)}
+}
+
+func (w *Wind) inUnits(u Units) *Wind {
+	if w == nil {
+		return nil
+	}
+	return &Wind{Direction: w.Direction, Speed: w.Speed.inUnit(u.Speed), Gust: w.Gust.inUnit(u.Speed)}
+}
+
+func (c Conditions) inUnits(u Units) Conditions {
+	c.Temperature = c.Temperature.inUnit(u.Temperature)
+	c.FeelsLikeTemperature = c.FeelsLikeTemperature.inUnit(u.Temperature)
+	c.DewPoint = c.DewPoint.inUnit(u.Temperature)
+	c.HeatIndex = c.HeatIndex.inUnit(u.Temperature)
+	c.WindChill = c.WindChill.inUnit(u.Temperature)
+	c.Precipitation = c.Precipitation.inUnits(u)
+	c.AirPressure = c.AirPressure.inUnit(u.Pressure)
+	c.Wind = c.Wind.inUnits(u)
+	c.Visibility = c.Visibility.inUnit(u.Distance)
+	return c
+}
+
+// Return a copy of current conditions with every measurement in units u
+func (c *CurrentConditions) InUnits(u Units) *CurrentConditions {
+	if c == nil {
+		return nil
+	}
+	converted := *c
+	converted.Conditions = c.Conditions.inUnits(u)
+	return &converted
+}
+
+func (d *DayPartForecast) inUnits(u Units) *DayPartForecast {
+	if d == nil {
+		return nil
+	}
+	converted := *d
+	converted.Precipitation = d.Precipitation.inUnits(u)
+	converted.Wind = d.Wind.inUnits(u)
+	return &converted
+}
+
+// Return copies of forecast hours with every measurement in units u
+func hourlyInUnits(hours []HourlyForecast, u Units) []HourlyForecast {
+	if hours == nil {
+		return nil
+	}
+	converted := make([]HourlyForecast, len(hours))
+	for i, h := range hours {
+		h.Conditions = h.Conditions.inUnits(u)
+		converted[i] = h
+	}
+	return converted
+}
+
+// Return copies of forecast days with every measurement in units u
+func dailyInUnits(days []DailyForecast, u Units) []DailyForecast {
+	if days == nil {
+		return nil
+	}
+	converted := make([]DailyForecast, len(days))
+	for i, d := range days {
+		d.MaxTemperature = d.MaxTemperature.inUnit(u.Temperature)
+		d.MinTemperature = d.MinTemperature.inUnit(u.Temperature)
+		d.FeelsLikeMaxTemperature = d.FeelsLikeMaxTemperature.inUnit(u.Temperature)
+		d.FeelsLikeMinTemperature = d.FeelsLikeMinTemperature.inUnit(u.Temperature)
+		d.Precipitation = d.Precipitation.inUnits(u)
+		d.Wind = d.Wind.inUnits(u)
+		d.DaytimeForecast = d.DaytimeForecast.inUnits(u)
+		d.NighttimeForecast = d.NighttimeForecast.inUnits(u)
+		converted[i] = d
+	}
+	return converted
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestParseUnits(t *testing.T) {
+	tests := []struct {
+		query string
+		want  Units
+	}{
+		{"", metricUnits},
+		{"units=metric", metricUnits},
+		{"units=IMPERIAL", imperialUnits},
+		{"units=imperial&tempUnit=celsius", Units{UNIT_CELSIUS, UNIT_MILES_PER_HOUR, UNIT_MILES, UNIT_INCHES, UNIT_INCHES_OF_MERCURY}},
+		{"windUnit=knots&pressureUnit=hpa", Units{UNIT_CELSIUS, UNIT_KNOTS, UNIT_KILOMETERS, UNIT_MILLIMETERS, UNIT_HECTOPASCALS}},
+	}
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		got, err := parseUnits(query)
+		if err != nil || got != tt.want {
+			t.Errorf("%q: expected %+v, got %+v (%v)", tt.query, tt.want, got, err)
+		}
+	}
+
+	for _, bad := range []string{"units=kelvin", "tempUnit=kelvin", "windUnit=beaufort", "pressureUnit=atm"} {
+		query, _ := url.ParseQuery(bad)
+		if _, err := parseUnits(query); err == nil || err.Code != ERR_INVALID_PARAMETER || err.Details["allowed"] == nil {
+			t.Errorf("%q: expected INVALID_PARAMETER listing allowed values, got %+v", bad, err)
+		}
+	}
+}
+
+func TestConditionsInUnits(t *testing.T) {
+	humidity := 60
+	current := &CurrentConditions{Conditions: Conditions{
+		Temperature:      &Temperature{Degrees: 20, Unit: UNIT_CELSIUS},
+		DewPoint:         &Temperature{Degrees: -40, Unit: UNIT_CELSIUS},
+		RelativeHumidity: &humidity,
+		Wind: &Wind{
+			Direction: &WindDirection{Degrees: 90, Cardinal: "EAST"},
+			Speed:     &Speed{Value: 16.09344, Unit: UNIT_KILOMETERS_PER_HOUR},
+			Gust:      &Speed{Value: 10, Unit: "FURLONGS_PER_FORTNIGHT"},
+		},
+		Visibility:    &Visibility{Distance: 10, Unit: UNIT_KILOMETERS},
+		Precipitation: &Precipitation{Qpf: &Quantity{Quantity: 25.4, Unit: UNIT_MILLIMETERS}},
+		AirPressure:   &AirPressure{MeanSeaLevelMillibars: 1013.25},
+	}}
+
+	got := current.InUnits(imperialUnits)
+	if *got.Temperature != (Temperature{68, UNIT_FAHRENHEIT}) || *got.DewPoint != (Temperature{-40, UNIT_FAHRENHEIT}) {
+		t.Errorf("Unexpected temperatures %+v %+v", got.Temperature, got.DewPoint)
+	}
+	if *got.Wind.Speed != (Speed{10, UNIT_MILES_PER_HOUR}) || got.Wind.Direction.Cardinal != "EAST" {
+		t.Errorf("Unexpected wind %+v", got.Wind)
+	}
+	if *got.Wind.Gust != (Speed{10, "FURLONGS_PER_FORTNIGHT"}) {
+		t.Errorf("Expected unknown units to be left alone, got %+v", got.Wind.Gust)
+	}
+	if *got.Visibility != (Visibility{6.2, UNIT_MILES}) || *got.Precipitation.Qpf != (Quantity{1, UNIT_INCHES}) {
+		t.Errorf("Unexpected visibility %+v or precipitation %+v", got.Visibility, got.Precipitation.Qpf)
+	}
+	if got.AirPressure.MeanSeaLevelMillibars != 1013.25 || *got.AirPressure.MeanSeaLevel != (Pressure{29.92, UNIT_INCHES_OF_MERCURY}) {
+		t.Errorf("Unexpected pressure %+v", got.AirPressure)
+	}
+
+	// Cached values are shared between requests and must not change
+	if current.Temperature.Degrees != 20 || current.Wind.Speed.Unit != UNIT_KILOMETERS_PER_HOUR || current.AirPressure.MeanSeaLevel != nil {
+		t.Errorf("Conversion modified the original %+v", current)
+	}
+}
+
+func TestDailyInUnits(t *testing.T) {
+	days := []DailyForecast{{
+		Date:           "2024-01-15",
+		MaxTemperature: &Temperature{Degrees: 100, Unit: UNIT_CELSIUS},
+		MinTemperature: &Temperature{Degrees: 0, Unit: UNIT_CELSIUS},
+		NighttimeForecast: &DayPartForecast{
+			Wind: &Wind{Speed: &Speed{Value: 36, Unit: UNIT_KILOMETERS_PER_HOUR}},
+		},
+	}}
+
+	got := dailyInUnits(days, Units{UNIT_FAHRENHEIT, UNIT_METERS_PER_SECOND, UNIT_KILOMETERS, UNIT_MILLIMETERS, UNIT_MILLIBARS})
+	if got[0].MaxTemperature.Degrees != 212 || got[0].MinTemperature.Degrees != 32 {
+		t.Errorf("Unexpected temperatures %+v %+v", got[0].MaxTemperature, got[0].MinTemperature)
+	}
+	if *got[0].NighttimeForecast.Wind.Speed != (Speed{10, UNIT_METERS_PER_SECOND}) {
+		t.Errorf("Unexpected night wind %+v", got[0].NighttimeForecast.Wind.Speed)
+	}
+	if days[0].NighttimeForecast.Wind.Speed.Value != 36 {
+		t.Error("Conversion modified the original forecast")
+	}
+}
+
+// Test that handlers convert responses and that cached data stays metric
+func TestHandlerUnits(t *testing.T) {
+	weatherCache = newResponseCache()
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("unitsSystem") != "METRIC" {
+			t.Errorf("Expected metric upstream request, got %s", r.URL.RawQuery)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(mockGoogleWeatherResponse())
+	}))
+	defer mockServer.Close()
+
+	originalBase := GOOGLE_WEATHER_BASE
+	GOOGLE_WEATHER_BASE = mockServer.URL
+	defer func() { GOOGLE_WEATHER_BASE = originalBase }()
+	setTestConfig(t, func(c *Config) { c.GoogleAPIKey = "test-key" })
+
+	for _, tt := range []struct {
+		query string
+		unit  string
+	}{
+		{"units=imperial", UNIT_FAHRENHEIT},
+		{"", UNIT_CELSIUS},
+	} {
+		w := httptest.NewRecorder()
+		currentConditionsHandler(w, httptest.NewRequest("GET", "/api/current?lat=1&lon=2&"+tt.query, nil))
+		var current CurrentConditions
+		if err := json.Unmarshal(w.Body.Bytes(), &current); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		if current.Temperature == nil || current.Temperature.Unit != tt.unit {
+			t.Errorf("%q: expected temperature in %s, got %+v", tt.query, tt.unit, current.Temperature)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	currentConditionsHandler(w, httptest.NewRequest("GET", "/api/current?lat=1&lon=2&units=kelvin", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for unknown units, got %d", w.Code)
+	}
+}
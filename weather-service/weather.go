@@ -0,0 +1,508 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"time"
+)
+
+// Weather domain model
+//
+// These types are the documented contract between the service and the
+// extension. Field names follow the Google Weather API so the widget can
+// keep reading `temperature.degrees`, `wind.speed.value` and friends, but
+// every value is parsed and validated here instead of being copied through
+// as an opaque map.
+
+// Temperature is a temperature reading with its unit (CELSIUS or FAHRENHEIT)
+type Temperature struct {
+	Degrees float64 `json:"degrees"`
+	Unit    string  `json:"unit"`
+}
+
+// LocalizedText is a human readable string and its BCP-47 language code
+type LocalizedText struct {
+	Text         string `json:"text"`
+	LanguageCode string `json:"languageCode,omitempty"`
+}
+
+// WeatherCondition describes the sky/precipitation state, e.g. PARTLY_CLOUDY.
+// Severity and Icon come from the condition catalog in conditions.go.
+type WeatherCondition struct {
+	Type        string        `json:"type"`
+	Description LocalizedText `json:"description"`
+	IconBaseURI string        `json:"iconBaseUri,omitempty"`
+	Severity    int           `json:"severity"`
+	Icon        string        `json:"icon,omitempty"`
+}
+
+// Probability is a percentage chance of precipitation of a given type
+type Probability struct {
+	Percent int    `json:"percent"`
+	Type    string `json:"type,omitempty"`
+}
+
+// Quantity is an amount with its unit, used for quantitative precipitation
+type Quantity struct {
+	Quantity float64 `json:"quantity"`
+	Unit     string  `json:"unit"`
+}
+
+// Precipitation combines the chance and the expected amount of precipitation
+type Precipitation struct {
+	Probability *Probability `json:"probability,omitempty"`
+	Qpf         *Quantity    `json:"qpf,omitempty"`
+}
+
+// Speed is a wind speed with its unit
+type Speed struct {
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit"`
+}
+
+// WindDirection is where the wind blows from, in degrees and as a cardinal
+type WindDirection struct {
+	Degrees  int    `json:"degrees"`
+	Cardinal string `json:"cardinal,omitempty"`
+}
+
+// Wind groups direction, sustained speed and gusts
+type Wind struct {
+	Direction *WindDirection `json:"direction,omitempty"`
+	Speed     *Speed         `json:"speed,omitempty"`
+	Gust      *Speed         `json:"gust,omitempty"`
+}
+
+// Visibility is a visibility distance with its unit
+type Visibility struct {
+	Distance float64 `json:"distance"`
+	Unit     string  `json:"unit"`
+}
+
+// AirPressure is the mean sea level pressure. MeanSeaLevel repeats it in
+// the unit the client asked for.
+type AirPressure struct {
+	MeanSeaLevelMillibars float64   `json:"meanSeaLevelMillibars"`
+	MeanSeaLevel          *Pressure `json:"meanSeaLevel,omitempty"`
+}
+
+// Pressure is an air pressure with its unit
+type Pressure struct {
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit"`
+}
+
+// TimeZone identifies the IANA time zone of the requested location
+type TimeZone struct {
+	ID string `json:"id"`
+}
+
+// SunEvents holds sunrise and sunset for a forecast day
+type SunEvents struct {
+	SunriseTime string `json:"sunriseTime,omitempty"`
+	SunsetTime  string `json:"sunsetTime,omitempty"`
+}
+
+// MoonEvents holds the moon phase and rise/set times for a forecast day
+type MoonEvents struct {
+	MoonPhase     string   `json:"moonPhase,omitempty"`
+	MoonriseTimes []string `json:"moonriseTimes,omitempty"`
+	MoonsetTimes  []string `json:"moonsetTimes,omitempty"`
+}
+
+// Conditions holds the observation fields shared by current conditions and
+// forecast hours
+type Conditions struct {
+	IsDaytime               *bool             `json:"isDaytime,omitempty"`
+	WeatherCondition        *WeatherCondition `json:"weatherCondition,omitempty"`
+	Temperature             *Temperature      `json:"temperature,omitempty"`
+	FeelsLikeTemperature    *Temperature      `json:"feelsLikeTemperature,omitempty"`
+	DewPoint                *Temperature      `json:"dewPoint,omitempty"`
+	HeatIndex               *Temperature      `json:"heatIndex,omitempty"`
+	WindChill               *Temperature      `json:"windChill,omitempty"`
+	RelativeHumidity        *int              `json:"relativeHumidity,omitempty"`
+	UVIndex                 *int              `json:"uvIndex,omitempty"`
+	Precipitation           *Precipitation    `json:"precipitation,omitempty"`
+	ThunderstormProbability *int              `json:"thunderstormProbability,omitempty"`
+	AirPressure             *AirPressure      `json:"airPressure,omitempty"`
+	Wind                    *Wind             `json:"wind,omitempty"`
+	Visibility              *Visibility       `json:"visibility,omitempty"`
+	CloudCover              *int              `json:"cloudCover,omitempty"`
+}
+
+// CurrentConditions is the response of /api/current and the `current`
+// section of /api/weather
+type CurrentConditions struct {
+	CurrentTime string           `json:"currentTime,omitempty"`
+	TimeZone    *TimeZone        `json:"timeZone,omitempty"`
+	Location    *RequestLocation `json:"location,omitempty"` // set on /api/current when located by IP
+	Conditions
+	Freshness
+}
+
+// HourlyForecast is a single hour of forecast or history data
+type HourlyForecast struct {
+	Timestamp string `json:"timestamp"`
+	Conditions
+	PrecipitationProbability *Probability `json:"precipitationProbability,omitempty"`
+	Freshness
+}
+
+// Freshness labels data that isn't a fresh upstream answer: the last good
+// data for a location served after an upstream failure, or data made up
+// from the current conditions on request
+type Freshness struct {
+	Stale      bool  `json:"stale,omitempty"`
+	AgeSeconds int64 `json:"ageSeconds,omitempty"` // time since stale data was fetched
+	Synthetic  bool  `json:"synthetic,omitempty"`
+}
+
+func staleFreshness(fetched time.Time) Freshness {
+	return Freshness{Stale: true, AgeSeconds: int64(time.Since(fetched) / time.Second)}
+}
+
+// Return copies of hours labelled with f. Cached slices are shared, so they
+// are never labelled in place.
+func hourlyWithFreshness(hours []HourlyForecast, f Freshness) []HourlyForecast {
+	labelled := slices.Clone(hours)
+	for i := range labelled {
+		labelled[i].Freshness = f
+	}
+	return labelled
+}
+
+// Return copies of days labelled with f
+func dailyWithFreshness(days []DailyForecast, f Freshness) []DailyForecast {
+	labelled := slices.Clone(days)
+	for i := range labelled {
+		labelled[i].Freshness = f
+	}
+	return labelled
+}
+
+// DayPartForecast is the daytime or nighttime half of a forecast day
+type DayPartForecast struct {
+	WeatherCondition        *WeatherCondition `json:"weatherCondition,omitempty"`
+	RelativeHumidity        *int              `json:"relativeHumidity,omitempty"`
+	UVIndex                 *int              `json:"uvIndex,omitempty"`
+	Precipitation           *Precipitation    `json:"precipitation,omitempty"`
+	ThunderstormProbability *int              `json:"thunderstormProbability,omitempty"`
+	Wind                    *Wind             `json:"wind,omitempty"`
+	CloudCover              *int              `json:"cloudCover,omitempty"`
+}
+
+// DailyForecast is a single forecast day. The top-level condition, wind,
+// humidity and precipitation fields are taken from the daytime forecast.
+type DailyForecast struct {
+	Date                     string            `json:"date"`
+	MaxTemperature           *Temperature      `json:"maxTemperature,omitempty"`
+	MinTemperature           *Temperature      `json:"minTemperature,omitempty"`
+	FeelsLikeMaxTemperature  *Temperature      `json:"feelsLikeMaxTemperature,omitempty"`
+	FeelsLikeMinTemperature  *Temperature      `json:"feelsLikeMinTemperature,omitempty"`
+	WeatherCondition         *WeatherCondition `json:"weatherCondition,omitempty"`
+	PrecipitationProbability *Probability      `json:"precipitationProbability,omitempty"`
+	Precipitation            *Precipitation    `json:"precipitation,omitempty"`
+	Wind                     *Wind             `json:"wind,omitempty"`
+	RelativeHumidity         *int              `json:"relativeHumidity,omitempty"`
+	UVIndex                  *int              `json:"uvIndex,omitempty"`
+	SunEvents                *SunEvents        `json:"sunEvents,omitempty"`
+	MoonEvents               *MoonEvents       `json:"moonEvents,omitempty"`
+	DaytimeForecast          *DayPartForecast  `json:"daytimeForecast,omitempty"`
+	NighttimeForecast        *DayPartForecast  `json:"nighttimeForecast,omitempty"`
+	Freshness
+}
+
+// HourlyResponse is the response of /api/forecast and /api/history
+type HourlyResponse struct {
+	Hourly    []HourlyForecast `json:"hourly"`
+	TimeZone  *TimeZone        `json:"timeZone,omitempty"`
+	Location  *RequestLocation `json:"location,omitempty"`
+	Timestamp string           `json:"timestamp"`
+}
+
+// DailyResponse is the response of /api/daily
+type DailyResponse struct {
+	Daily     []DailyForecast  `json:"daily"`
+	TimeZone  *TimeZone        `json:"timeZone,omitempty"`
+	Location  *RequestLocation `json:"location,omitempty"`
+	Timestamp string           `json:"timestamp"`
+}
+
+// Forecast is the `forecast` section of /api/weather
+type Forecast struct {
+	Daily  []DailyForecast  `json:"daily"`
+	Hourly []HourlyForecast `json:"hourly"`
+}
+
+// WeatherResponse is the response of the combined /api/weather endpoint.
+// Missing lists the sections ("current", "hourly", "daily" and any included
+// ones) that could not be fetched before the deadline; the others are still
+// returned. Pollen and Alerts are only present with include=pollen and
+// include=alerts; Alerts is omitted when there are none.
+type WeatherResponse struct {
+	Current   *CurrentConditions `json:"current"`
+	Forecast  Forecast           `json:"forecast"`
+	Pollen    []PollenDay        `json:"pollen,omitempty"`
+	Alerts    []WeatherAlert     `json:"alerts,omitempty"`
+	Location  *RequestLocation   `json:"location,omitempty"`
+	Missing   []string           `json:"missing,omitempty"`
+	Timestamp string             `json:"timestamp"`
+}
+
+// Google Weather API wire format. Only the envelope differs from the domain
+// model; the nested value types decode directly into the types above.
+
+type googleInterval struct {
+	StartTime string `json:"startTime"`
+	EndTime   string `json:"endTime"`
+}
+
+type googleDate struct {
+	Year  int `json:"year"`
+	Month int `json:"month"`
+	Day   int `json:"day"`
+}
+
+// Format as YYYY-MM-DD, or "" for an unset date
+func (d googleDate) String() string {
+	if d == (googleDate{}) {
+		return ""
+	}
+	return fmt.Sprintf("%04d-%02d-%02d", d.Year, d.Month, d.Day)
+}
+
+type googleForecastHour struct {
+	Interval *googleInterval `json:"interval"`
+	Conditions
+}
+
+type googleForecastHoursResponse struct {
+	ForecastHours []googleForecastHour `json:"forecastHours"`
+	HistoryHours  []googleForecastHour `json:"historyHours"`
+	Hours         []googleForecastHour `json:"hours"`
+	TimeZone      *TimeZone            `json:"timeZone"`
+}
+
+type googleForecastDay struct {
+	Interval                *googleInterval  `json:"interval"`
+	DisplayDate             *googleDate      `json:"displayDate"`
+	DaytimeForecast         *DayPartForecast `json:"daytimeForecast"`
+	NighttimeForecast       *DayPartForecast `json:"nighttimeForecast"`
+	MaxTemperature          *Temperature     `json:"maxTemperature"`
+	MinTemperature          *Temperature     `json:"minTemperature"`
+	FeelsLikeMaxTemperature *Temperature     `json:"feelsLikeMaxTemperature"`
+	FeelsLikeMinTemperature *Temperature     `json:"feelsLikeMinTemperature"`
+	SunEvents               *SunEvents       `json:"sunEvents"`
+	MoonEvents              *MoonEvents      `json:"moonEvents"`
+}
+
+type googleForecastDaysResponse struct {
+	ForecastDays []googleForecastDay `json:"forecastDays"`
+	Days         []googleForecastDay `json:"days"`
+	TimeZone     *TimeZone           `json:"timeZone"`
+}
+
+// PayloadError reports an upstream response that could not be decoded or
+// failed validation
+type PayloadError struct {
+	Err error
+}
+
+func (e *PayloadError) Error() string {
+	return "invalid upstream payload: " + e.Err.Error()
+}
+
+func (e *PayloadError) Unwrap() error {
+	return e.Err
+}
+
+// Parse Google current conditions into the domain model
+func parseCurrentConditions(body []byte) (*CurrentConditions, error) {
+	var current CurrentConditions
+	if err := json.Unmarshal(body, &current); err != nil {
+		return nil, &PayloadError{fmt.Errorf("decode current conditions: %w", err)}
+	}
+	if err := current.Validate(); err != nil {
+		return nil, &PayloadError{err}
+	}
+	return &current, nil
+}
+
+// Parse a Google hourly forecast or history response. Hours that fail
+// validation are dropped rather than failing the whole response.
+func parseForecastHours(body []byte) ([]HourlyForecast, *TimeZone, error) {
+	var resp googleForecastHoursResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, nil, &PayloadError{fmt.Errorf("decode forecast hours: %w", err)}
+	}
+
+	// Google uses "forecastHours" or "historyHours"; older payloads used "hours"
+	hours := resp.ForecastHours
+	if len(hours) == 0 {
+		hours = resp.HistoryHours
+	}
+	if len(hours) == 0 {
+		hours = resp.Hours
+	}
+
+	hourly := make([]HourlyForecast, 0, len(hours))
+	for i, h := range hours {
+		item := h.toHourlyForecast()
+		if err := item.Validate(); err != nil {
+			slog.Warn("skipping invalid forecast hour", "index", i, "error", err)
+			continue
+		}
+		hourly = append(hourly, item)
+	}
+	return hourly, resp.TimeZone, nil
+}
+
+// Parse a Google daily forecast response. Days that fail validation are
+// dropped rather than failing the whole response.
+func parseForecastDays(body []byte) ([]DailyForecast, *TimeZone, error) {
+	var resp googleForecastDaysResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, nil, &PayloadError{fmt.Errorf("decode forecast days: %w", err)}
+	}
+
+	days := resp.ForecastDays
+	if len(days) == 0 {
+		days = resp.Days
+	}
+
+	daily := make([]DailyForecast, 0, len(days))
+	for i, d := range days {
+		item := d.toDailyForecast()
+		if err := item.Validate(); err != nil {
+			slog.Warn("skipping invalid forecast day", "index", i, "error", err)
+			continue
+		}
+		daily = append(daily, item)
+	}
+	return daily, resp.TimeZone, nil
+}
+
+func (h googleForecastHour) toHourlyForecast() HourlyForecast {
+	item := HourlyForecast{Conditions: h.Conditions}
+	if h.Interval != nil {
+		item.Timestamp = h.Interval.StartTime
+	}
+	if h.Precipitation != nil {
+		item.PrecipitationProbability = h.Precipitation.Probability
+	}
+	return item
+}
+
+func (d googleForecastDay) toDailyForecast() DailyForecast {
+	item := DailyForecast{
+		MaxTemperature:          d.MaxTemperature,
+		MinTemperature:          d.MinTemperature,
+		FeelsLikeMaxTemperature: d.FeelsLikeMaxTemperature,
+		FeelsLikeMinTemperature: d.FeelsLikeMinTemperature,
+		SunEvents:               d.SunEvents,
+		MoonEvents:              d.MoonEvents,
+		DaytimeForecast:         d.DaytimeForecast,
+		NighttimeForecast:       d.NighttimeForecast,
+	}
+
+	// Extract date from displayDate or interval
+	if d.DisplayDate != nil {
+		item.Date = d.DisplayDate.String()
+	} else if d.Interval != nil && len(d.Interval.StartTime) >= 10 {
+		item.Date = d.Interval.StartTime[:10]
+	}
+
+	// Use daytime forecast as primary weather condition
+	if daytime := d.DaytimeForecast; daytime != nil {
+		item.WeatherCondition = daytime.WeatherCondition
+		item.Precipitation = daytime.Precipitation
+		item.Wind = daytime.Wind
+		item.RelativeHumidity = daytime.RelativeHumidity
+		item.UVIndex = daytime.UVIndex
+		if daytime.Precipitation != nil {
+			item.PrecipitationProbability = daytime.Precipitation.Probability
+		}
+	}
+	return item
+}
+
+// Validation
+
+var validTemperatureUnits = map[string]bool{"CELSIUS": true, "FAHRENHEIT": true}
+
+// Validate checks the unit and that the reading is a real number
+func (t *Temperature) Validate() error {
+	if t == nil {
+		return nil
+	}
+	if !validTemperatureUnits[t.Unit] {
+		return fmt.Errorf("unknown temperature unit %q", t.Unit)
+	}
+	if math.IsNaN(t.Degrees) || math.IsInf(t.Degrees, 0) {
+		return fmt.Errorf("temperature is not a number")
+	}
+	return nil
+}
+
+// Validate checks temperatures and percentage ranges
+func (c *Conditions) Validate() error {
+	for _, t := range []*Temperature{c.Temperature, c.FeelsLikeTemperature, c.DewPoint, c.HeatIndex, c.WindChill} {
+		if err := t.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := validatePercent("relativeHumidity", c.RelativeHumidity); err != nil {
+		return err
+	}
+	if err := validatePercent("cloudCover", c.CloudCover); err != nil {
+		return err
+	}
+	if err := validatePercent("thunderstormProbability", c.ThunderstormProbability); err != nil {
+		return err
+	}
+	if c.Precipitation != nil && c.Precipitation.Probability != nil {
+		if err := validatePercent("precipitation.probability", &c.Precipitation.Probability.Percent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate requires a temperature in addition to the shared checks
+func (c *CurrentConditions) Validate() error {
+	if c.Temperature == nil {
+		return fmt.Errorf("current conditions missing temperature")
+	}
+	return c.Conditions.Validate()
+}
+
+// Validate requires an RFC 3339 timestamp in addition to the shared checks
+func (h *HourlyForecast) Validate() error {
+	if _, err := time.Parse(time.RFC3339, h.Timestamp); err != nil {
+		return fmt.Errorf("invalid hour timestamp %q", h.Timestamp)
+	}
+	return h.Conditions.Validate()
+}
+
+// Validate requires a calendar date and valid temperatures
+func (d *DailyForecast) Validate() error {
+	if _, err := time.Parse("2006-01-02", d.Date); err != nil {
+		return fmt.Errorf("invalid forecast date %q", d.Date)
+	}
+	for _, t := range []*Temperature{d.MaxTemperature, d.MinTemperature, d.FeelsLikeMaxTemperature, d.FeelsLikeMinTemperature} {
+		if err := t.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validatePercent(field string, value *int) error {
+	if value != nil && (*value < 0 || *value > 100) {
+		return fmt.Errorf("%s out of range: %d", field, *value)
+	}
+	return nil
+}
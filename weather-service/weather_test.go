@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// Test parsing current conditions into the typed model
+func TestParseCurrentConditions(t *testing.T) {
+	body, _ := json.Marshal(mockGoogleWeatherResponse())
+
+	current, err := parseCurrentConditions(body)
+	if err != nil {
+		t.Fatalf("Failed to parse current conditions: %v", err)
+	}
+
+	if current.Temperature == nil || current.Temperature.Degrees != 20.5 {
+		t.Errorf("Expected temperature 20.5, got %+v", current.Temperature)
+	}
+	if current.WeatherCondition == nil || current.WeatherCondition.Type != "PARTLY_CLOUDY" {
+		t.Errorf("Expected PARTLY_CLOUDY condition, got %+v", current.WeatherCondition)
+	}
+	if current.Wind == nil || current.Wind.Speed == nil || current.Wind.Speed.Value != 15.0 {
+		t.Errorf("Expected wind speed 15, got %+v", current.Wind)
+	}
+	if current.RelativeHumidity == nil || *current.RelativeHumidity != 65 {
+		t.Errorf("Expected humidity 65, got %v", current.RelativeHumidity)
+	}
+
+	// Missing temperature is rejected
+	if _, err := parseCurrentConditions([]byte(`{"relativeHumidity": 50}`)); err == nil {
+		t.Error("Current conditions without temperature should fail validation")
+	}
+
+	// Unknown unit is rejected
+	_, err = parseCurrentConditions([]byte(`{"temperature": {"degrees": 10, "unit": "KELVIN"}}`))
+	var payloadErr *PayloadError
+	if !errors.As(err, &payloadErr) {
+		t.Errorf("Expected PayloadError for unknown unit, got %v", err)
+	}
+}
+
+// Test parsing forecast hours, including invalid entries
+func TestParseForecastHours(t *testing.T) {
+	body := []byte(`{
+		"forecastHours": [
+			{
+				"interval": {"startTime": "2025-01-01T10:00:00Z", "endTime": "2025-01-01T11:00:00Z"},
+				"temperature": {"degrees": 12.5, "unit": "CELSIUS"},
+				"precipitation": {"probability": {"percent": 40, "type": "RAIN"}}
+			},
+			{
+				"interval": {"startTime": "not-a-time"},
+				"temperature": {"degrees": 13, "unit": "CELSIUS"}
+			},
+			{
+				"interval": {"startTime": "2025-01-01T12:00:00Z"},
+				"relativeHumidity": 140
+			}
+		],
+		"timeZone": {"id": "America/New_York"}
+	}`)
+
+	hourly, timeZone, err := parseForecastHours(body)
+	if err != nil {
+		t.Fatalf("Failed to parse forecast hours: %v", err)
+	}
+
+	if len(hourly) != 1 {
+		t.Fatalf("Expected 1 valid hour, got %d", len(hourly))
+	}
+	if hourly[0].Timestamp != "2025-01-01T10:00:00Z" {
+		t.Errorf("Expected timestamp from interval start, got %s", hourly[0].Timestamp)
+	}
+	if hourly[0].PrecipitationProbability == nil || hourly[0].PrecipitationProbability.Percent != 40 {
+		t.Errorf("Expected precipitation probability 40, got %+v", hourly[0].PrecipitationProbability)
+	}
+	if timeZone == nil || timeZone.ID != "America/New_York" {
+		t.Errorf("Expected time zone America/New_York, got %+v", timeZone)
+	}
+
+	// History responses use a different key
+	hourly, _, err = parseForecastHours([]byte(`{"historyHours": [{"interval": {"startTime": "2025-01-01T09:00:00Z"}}]}`))
+	if err != nil || len(hourly) != 1 {
+		t.Errorf("Expected 1 history hour, got %d (err=%v)", len(hourly), err)
+	}
+}
+
+// Test parsing forecast days, including malformed dates that used to panic
+func TestParseForecastDays(t *testing.T) {
+	body := []byte(`{
+		"forecastDays": [
+			{
+				"displayDate": {"year": 2025, "month": 1, "day": 2},
+				"maxTemperature": {"degrees": 20, "unit": "CELSIUS"},
+				"minTemperature": {"degrees": 10, "unit": "CELSIUS"},
+				"daytimeForecast": {
+					"weatherCondition": {"type": "RAIN", "description": {"text": "Rain"}},
+					"precipitation": {"probability": {"percent": 80, "type": "RAIN"}, "qpf": {"quantity": 4.2, "unit": "MILLIMETERS"}}
+				}
+			},
+			{
+				"interval": {"startTime": "2025-01-03T06:00:00Z"},
+				"maxTemperature": {"degrees": 18, "unit": "CELSIUS"}
+			},
+			{
+				"displayDate": {"year": "2025", "month": null}
+			}
+		]
+	}`)
+
+	if _, _, err := parseForecastDays(body); err == nil {
+		t.Fatal("Malformed displayDate should fail to decode instead of panicking")
+	}
+
+	body = []byte(`{
+		"forecastDays": [
+			{
+				"displayDate": {"year": 2025, "month": 1, "day": 2},
+				"maxTemperature": {"degrees": 20, "unit": "CELSIUS"},
+				"daytimeForecast": {
+					"weatherCondition": {"type": "RAIN", "description": {"text": "Rain"}},
+					"precipitation": {"probability": {"percent": 80, "type": "RAIN"}, "qpf": {"quantity": 4.2, "unit": "MILLIMETERS"}}
+				}
+			},
+			{
+				"interval": {"startTime": "2025-01-03T06:00:00Z"},
+				"maxTemperature": {"degrees": 18, "unit": "CELSIUS"}
+			},
+			{
+				"maxTemperature": {"degrees": 18, "unit": "CELSIUS"}
+			}
+		]
+	}`)
+
+	daily, _, err := parseForecastDays(body)
+	if err != nil {
+		t.Fatalf("Failed to parse forecast days: %v", err)
+	}
+
+	if len(daily) != 2 {
+		t.Fatalf("Expected 2 valid days, got %d", len(daily))
+	}
+	if daily[0].Date != "2025-01-02" || daily[1].Date != "2025-01-03" {
+		t.Errorf("Unexpected dates: %s, %s", daily[0].Date, daily[1].Date)
+	}
+	if daily[0].WeatherCondition == nil || daily[0].WeatherCondition.Type != "RAIN" {
+		t.Errorf("Expected daytime condition to be promoted, got %+v", daily[0].WeatherCondition)
+	}
+	if daily[0].PrecipitationProbability == nil || daily[0].PrecipitationProbability.Percent != 80 {
+		t.Errorf("Expected precipitation probability 80, got %+v", daily[0].PrecipitationProbability)
+	}
+	if daily[0].Precipitation == nil || daily[0].Precipitation.Qpf == nil || daily[0].Precipitation.Qpf.Quantity != 4.2 {
+		t.Errorf("Expected qpf 4.2, got %+v", daily[0].Precipitation)
+	}
+}